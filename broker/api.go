@@ -5,30 +5,20 @@ import (
 )
 
 func (b *Broker) GetEventsJSON() []api.EventInfoJSON {
-	events := make(map[string][]string)
-
-	fillMap := func(subMap map[string][]*client) {
-		for event, clients := range subMap {
-			var clientsSlice []string
-			for _, c := range clients {
-				clientsSlice = append(clientsSlice, c.id)
-			}
-			events[event] = clientsSlice
-		}
-	}
-
-	b.subscriberMapMtx.RLock()
-	fillMap(b.subscriberMap)
-	b.subscriberMapMtx.RUnlock()
-
-	b.subscriberMatchMapMtx.RLock()
-	fillMap(b.subscriberMatchMap)
-	b.subscriberMatchMapMtx.RUnlock()
+	events := b.subscriptions.eventsJSON()
+	groups := b.queueGroupsJSON()
 
 	// Compute repsonse
 	ret := make([]api.EventInfoJSON, 0)
-	for event, clients := range events {
-		ret = append(ret, api.EventInfoJSON{Event: event, Subscribers: clients})
+	for event, eventJSON := range events {
+		eventJSON.QueueGroups = groups[event]
+		ret = append(ret, *eventJSON)
+	}
+	// Events with queue groups only
+	for event, eventGroups := range groups {
+		if _, ok := events[event]; !ok {
+			ret = append(ret, api.EventInfoJSON{Event: event, Subscribers: []string{}, QueueGroups: eventGroups})
+		}
 	}
 
 	return ret
@@ -49,10 +39,12 @@ func (b *Broker) GetServicesJSON() []api.ServiceJSON {
 	// Fix static empty slice that is "null" in JSON
 	// A dynamic empty slice is []
 	servicesList := make([]api.ServiceJSON, 0)
+	b.servicesMtx.RLock()
 	for _, names := range b.services {
-		for _, s := range names {
-			servicesList = append(servicesList, *s.JSONStruct())
+		for _, group := range names {
+			servicesList = append(servicesList, group.JSONStruct()...)
 		}
 	}
+	b.servicesMtx.RUnlock()
 	return servicesList
 }
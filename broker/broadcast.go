@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/golang/protobuf/proto"
+)
+
+// Requests sent to this identification are sent to every identification of the
+// service.
+const broadcastIdentification = "*"
+
+// A broadcastRequest gathers the replies to a request sent to every
+// identification of a service.
+type broadcastRequest struct {
+	sender *client
+	req    *cellaserv.Request
+
+	mtx     sync.Mutex
+	pending int // number of replies still expected
+	replies []api.BroadcastReplyJSON
+}
+
+func (b *Broker) handleBroadcastRequest(c *client, req *cellaserv.Request, deadline time.Time, logger common.Logger) {
+	b.servicesMtx.RLock()
+	var groups []*serviceGroup
+	for _, group := range b.services[req.ServiceName] {
+		groups = append(groups, group)
+	}
+	b.servicesMtx.RUnlock()
+
+	if len(groups) == 0 {
+		logger.Warnln("No such service with this name.")
+		c.removePendingRequest(req.Id)
+		c.sendReplyError(req, cellaserv.Reply_Error_NoSuchService)
+		return
+	}
+
+	broadcast := &broadcastRequest{
+		sender:  c,
+		req:     req,
+		pending: len(groups),
+	}
+
+	for _, group := range groups {
+		srvc := group.pick()
+		if srvc == nil {
+			broadcast.addError(b, group.Identification, cellaserv.Reply_Error_InvalidIdentification)
+			continue
+		}
+
+		// Each service receives its own request, with the extensions of
+		// the request: priority, time budget and trace
+		subReq := proto.Clone(req).(*cellaserv.Request)
+		subReq.ServiceIdentification = group.Identification
+		if err := b.forwardRequest(&requestTracking{sender: c, broadcast: broadcast}, group, srvc, subReq, deadline, logger); err != nil {
+			logger.Errorln(err)
+			broadcast.addError(b, group.Identification, cellaserv.Reply_Error_BadArguments)
+		}
+	}
+}
+
+// addReply adds the reply of the service with this identification.
+func (br *broadcastRequest) addReply(b *Broker, ident string, rep *cellaserv.Reply) {
+	reply := api.BroadcastReplyJSON{Identification: ident}
+	if replyErr := rep.GetError(); replyErr != nil && replyErr.GetType() != cellaserv.Reply_Error_NoError {
+		reply.Error = &api.ReplyErrorJSON{
+			Type: common.ReplyErrorTypeName(replyErr.GetType()),
+			What: replyErr.GetWhat(),
+		}
+	} else if len(rep.GetData()) > 0 {
+		if json.Valid(rep.GetData()) {
+			reply.Data = rep.GetData()
+		} else {
+			reply.Data, _ = json.Marshal(string(rep.GetData()))
+		}
+	}
+	br.add(b, reply)
+}
+
+// addError adds the error of the service with this identification.
+func (br *broadcastRequest) addError(b *Broker, ident string, errType cellaserv.Reply_Error_Type) {
+	br.add(b, api.BroadcastReplyJSON{
+		Identification: ident,
+		Error:          &api.ReplyErrorJSON{Type: common.ReplyErrorTypeName(errType)},
+	})
+}
+
+func (br *broadcastRequest) add(b *Broker, reply api.BroadcastReplyJSON) {
+	br.mtx.Lock()
+	br.replies = append(br.replies, reply)
+	br.pending--
+	done := br.pending == 0
+	br.mtx.Unlock()
+
+	if !done {
+		return
+	}
+
+	br.sender.removePendingRequest(br.req.Id)
+
+	// All the services replied, send the gathered replies
+	sort.Slice(br.replies, func(i, j int) bool {
+		return br.replies[i].Identification < br.replies[j].Identification
+	})
+	data, err := json.Marshal(br.replies)
+	if err != nil {
+		b.logger.Errorf("Could not marshal broadcast replies: %s", err)
+		return
+	}
+	br.sender.sendReply(br.req, data)
+}
@@ -0,0 +1,79 @@
+package broker
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/testutil"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestBroadcastRequest(t *testing.T) {
+	options := Options{RequestTimeout: 100 * time.Millisecond}
+	brokerTestWithOptions(t, options, func(b *Broker) {
+		connA := testutil.Dial(t)
+		defer connA.Close()
+		connB := testutil.Dial(t)
+		defer connB.Close()
+		connClient := testutil.Dial(t)
+		defer connClient.Close()
+
+		connA.Write(testutil.MakeMessageRegister(t, "motor", "a"))
+		connB.Write(testutil.MakeMessageRegister(t, "motor", "b"))
+
+		time.Sleep(50 * time.Millisecond)
+
+		connClient.Write(testutil.MakeMessageRequest(t, "motor", "*", "status", nil))
+		requestId := testutil.NextMessageRequestId
+
+		// Both services receive the request
+		msg := testutil.RecvMessage(t, connA)
+		testutil.MsgTypeIs(t, msg, cellaserv.Message_Request)
+		reqA := &cellaserv.Request{}
+		testutil.Ok(t, proto.Unmarshal(msg.GetContent(), reqA))
+		testutil.Equals(t, "a", reqA.GetServiceIdentification())
+
+		msg = testutil.RecvMessage(t, connB)
+		testutil.MsgTypeIs(t, msg, cellaserv.Message_Request)
+		reqB := &cellaserv.Request{}
+		testutil.Ok(t, proto.Unmarshal(msg.GetContent(), reqB))
+		testutil.Equals(t, "b", reqB.GetServiceIdentification())
+		testutil.Assert(t, reqA.GetId() != reqB.GetId(), "The requests have the same id")
+
+		// Only the first service replies, the second one times out
+		connA.Write(testutil.MakeMessageReply(t, reqA.GetId(), []byte(`{"speed":1}`)))
+
+		// The client receives the gathered replies
+		msg = testutil.RecvMessage(t, connClient)
+		testutil.MsgTypeIs(t, msg, cellaserv.Message_Reply)
+		reply := &cellaserv.Reply{}
+		testutil.Ok(t, proto.Unmarshal(msg.GetContent(), reply))
+		testutil.Equals(t, requestId, reply.GetId())
+		var replies []api.BroadcastReplyJSON
+		testutil.Ok(t, json.Unmarshal(reply.GetData(), &replies))
+		testutil.Equals(t, 2, len(replies))
+		testutil.Equals(t, "a", replies[0].Identification)
+		testutil.Equals(t, `{"speed":1}`, string(replies[0].Data))
+		testutil.Assert(t, replies[0].Error == nil, "Unexpected error: %v", replies[0].Error)
+		testutil.Equals(t, "b", replies[1].Identification)
+		testutil.Assert(t, replies[1].Error != nil, "Expected a timeout")
+		testutil.Equals(t, "Timeout", replies[1].Error.Type)
+	})
+}
+
+func TestBroadcastRequestNoService(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		conn := testutil.Dial(t)
+		defer conn.Close()
+
+		conn.Write(testutil.MakeMessageRequest(t, "motor", "*", "status", nil))
+
+		msg := testutil.RecvMessage(t, conn)
+		reply := &cellaserv.Reply{}
+		testutil.Ok(t, proto.Unmarshal(msg.GetContent(), reply))
+		testutil.Equals(t, cellaserv.Reply_Error_NoSuchService, reply.GetError().GetType())
+	})
+}
@@ -16,18 +16,62 @@ import (
 )
 
 type Options struct {
-	ListenAddress         string
+	ListenAddress string
+	// Timeout of requests that do not carry their own time budget
+	RequestTimeout time.Duration
+	// Deprecated: use RequestTimeout. Number of seconds, used when
+	// RequestTimeout is not set.
 	RequestTimeoutSec     time.Duration
 	LogsDir               string
 	PublishLoggingEnabled bool
+	// Maximum number of messages waiting to be sent to a client
+	OutboundQueueSize int
+	// Policy applied when the outbound queue of a client is full
+	OutboundQueueOverflow string
+	// Time after which writing a message to a client fails
+	WriteTimeout time.Duration
+	// Priority of the events and of the requests to the services matching
+	// the patterns, when not set by the sender
+	EventPriorities   map[string]common.Priority
+	ServicePriorities map[string]common.Priority
+	// Events appended to the durable stream, stored in LogsDir
+	StreamPatterns []string
+	// Time after which an event not acknowledged by a durable subscriber
+	// is sent again
+	AckTimeout time.Duration
+	// Maximum number of unacknowledged events kept for a durable
+	// subscriber
+	DurableMaxPending int
+	// Maximum rate of the events matching the patterns published by each
+	// client, per event name, in events per second
+	PublishRateLimits map[string]float64
+	// Capture file in which the routed messages are recorded, empty to not
+	// record them
+	RecordPath string
+	// File or URL of the OTLP/HTTP collector the spans of the requests are
+	// exported to, empty to not export them
+	TraceExport string
 }
 
+const defaultRequestTimeout = 5 * time.Second
+
 type Monitoring struct {
-	Registry *prometheus.Registry
-	requests *prometheus.HistogramVec
+	Registry        *prometheus.Registry
+	requests        *prometheus.HistogramVec
+	droppedMessages *prometheus.CounterVec
+	queueDelay      *prometheus.HistogramVec
+	redeliveries    *prometheus.CounterVec
+	pendingAcks     *prometheus.GaugeVec
+	rateLimited     *prometheus.CounterVec
+	publishLimited  *prometheus.CounterVec
 }
 
 type Broker struct {
+	// Last id of the requests created by the broker
+	// This field address must be aligned to prevent unaligned atomic
+	// writes. See: https://github.com/golang/go/issues/23345
+	lastRequestId uint64
+
 	Monitoring *Monitoring
 
 	Options *Options
@@ -39,22 +83,57 @@ type Broker struct {
 
 	// Map of currently connected services by name, then identification
 	servicesMtx sync.RWMutex
-	services    map[string]map[string]*service
+	services    map[string]map[string]*serviceGroup
+
+	// Spies of the services, by service name, then identification, and
+	// spies of the services matching patterns. The spies are kept when the
+	// service is lost, so that they spy the next service registered with
+	// the same name and identification.
+	spiesMtx    sync.RWMutex
+	spies       map[string]map[string][]*client
+	spyPatterns map[spyKey]*spyPattern
 
 	// Map of requests ids with associated timeout timer
 	reqIdsMtx sync.RWMutex
 	reqIds    map[uint64]*requestTracking
 
 	// Subscriber management
-	subscriberMapMtx      sync.RWMutex
-	subscriberMap         map[string][]*client
-	subscriberMatchMapMtx sync.RWMutex
-	subscriberMatchMap    map[string][]*client
+	subscriptions *subscriptionIndex
+
+	// Publish rate limits and priorities, parsed from the options
+	publishRateLimits []publishRateLimit
+	eventPriorities   []priorityPattern
+	servicePriorities []priorityPattern
+
+	// Durable subscriptions, by subscriber name
+	durablesMtx sync.Mutex
+	durables    map[string]*durableSubscription
+
+	// Queue groups, by pattern and name
+	queueGroupsMtx sync.RWMutex
+	queueGroups    map[queueGroupKey]*queueGroup
 
-	// Publish logging
+	// Durable stream of events, nil if no event is streamed
+	stream *eventStream
+
+	// Spans of the recent requests
+	tracer *tracer
+
+	// Current recording of the routed messages, nil if not recording
+	recordingMtx sync.Mutex
+	recording    *recording
+
+	// Last retained publish of each event
+	retainedMtx sync.RWMutex
+	retained    map[string]retainedEvent
+
+	// Publish logging, the files are written with the read lock held and
+	// closed with the lock held
+	publishLoggingMtx     sync.RWMutex
 	publishLoggingSession string
 	publishLoggingRoot    string
 	publishLoggingLoggers sync.Map // map[string]*os.File
+	publishLoggingClosed  bool
 
 	// The broker is started
 	startedCh chan struct{}
@@ -62,6 +141,13 @@ type Broker struct {
 	startedWithCellaserv chan struct{}
 	// The broker must quit
 	quitCh chan struct{}
+
+	// Listener of the incoming connections, closed on shutdown
+	listenerMtx sync.Mutex
+	listener    net.Listener
+
+	// Accessed atomically
+	shuttingDown int32
 }
 
 // Started returns the started broker channel
@@ -93,6 +179,9 @@ func (b *Broker) handle(conn net.Conn) {
 			b.logger.Infof("Client disconnected: %s", c)
 			break
 		}
+		if msg == nil {
+			continue
+		}
 		err = b.handleMessage(c, msgBytes, msg)
 		if err != nil {
 			b.logger.Errorf("Could not handle message: %s", err)
@@ -100,6 +189,7 @@ func (b *Broker) handle(conn net.Conn) {
 	}
 
 	b.removeClient(c)
+	c.close()
 }
 
 func (b *Broker) logUnmarshalError(msg []byte) {
@@ -133,7 +223,7 @@ func (b *Broker) handleMessage(c *client, msgBytes []byte, msg *cellaserv.Messag
 			b.logUnmarshalError(msgContent)
 			return fmt.Errorf("Could not unmarshal request: %s", err)
 		}
-		b.handleRequest(c, msgBytes, request)
+		b.handleRequest(c, request)
 		return nil
 	case cellaserv.Message_Reply:
 		reply := &cellaserv.Reply{}
@@ -142,7 +232,7 @@ func (b *Broker) handleMessage(c *client, msgBytes []byte, msg *cellaserv.Messag
 			b.logUnmarshalError(msgContent)
 			return fmt.Errorf("Could not unmarshal reply: %s", err)
 		}
-		b.handleReply(c, msgBytes, reply)
+		b.handleReply(c, reply)
 		return nil
 	case cellaserv.Message_Subscribe:
 		sub := &cellaserv.Subscribe{}
@@ -180,6 +270,10 @@ func (b *Broker) serve(l net.Listener, errCh chan error) {
 				time.Sleep(10 * time.Millisecond)
 				continue
 			} else {
+				if b.ShuttingDown() {
+					// The listener is closed on shutdown
+					return
+				}
 				errCh <- err
 				break
 			}
@@ -196,18 +290,49 @@ func (b *Broker) Run(ctx context.Context) error {
 		}
 	}
 
+	if err := b.openStream(); err != nil {
+		b.logger.Errorf("Could not open durable stream: %s", err)
+		return err
+	}
+	defer b.closeStream()
+
+	if b.Options.RecordPath != "" {
+		if err := b.StartRecording(b.Options.RecordPath); err != nil {
+			b.logger.Errorf("Could not start recording: %s", err)
+			return err
+		}
+		defer b.StopRecording()
+	}
+
+	if b.Options.TraceExport != "" {
+		exporter, err := newTraceExporter(b.Options.TraceExport, b.logger)
+		if err != nil {
+			b.logger.Errorf("Could not export traces: %s", err)
+			return err
+		}
+		b.tracer.setExporter(exporter)
+		defer func() {
+			b.tracer.setExporter(nil)
+			exporter.close()
+		}()
+	}
+
 	errCh := make(chan error)
 
 	// Create TCP listenener for incoming connections
 	l, err := net.Listen("tcp", b.Options.ListenAddress)
 	if err != nil {
 		b.logger.Errorf("Could not listen on address %s: %s", b.Options.ListenAddress, err)
-		errCh <- err
-	} else {
-		defer l.Close()
+		return err
 	}
+	defer l.Close()
+
+	b.listenerMtx.Lock()
+	b.listener = l
+	b.listenerMtx.Unlock()
 
 	go b.serve(l, errCh)
+	go b.redeliverLoop(ctx)
 
 	close(b.startedCh)
 
@@ -223,8 +348,29 @@ func (b *Broker) Run(ctx context.Context) error {
 
 func New(options Options, logger common.Logger) *Broker {
 	// Set default options
-	if options.RequestTimeoutSec == 0 {
-		options.RequestTimeoutSec = 3600
+	if options.RequestTimeout == 0 && options.RequestTimeoutSec != 0 {
+		options.RequestTimeout = options.RequestTimeoutSec * time.Second
+	}
+	if options.RequestTimeout == 0 {
+		options.RequestTimeout = defaultRequestTimeout
+	}
+	if options.OutboundQueueSize == 0 {
+		options.OutboundQueueSize = defaultOutboundQueueSize
+	}
+	if !IsValidOverflowPolicy(options.OutboundQueueOverflow) {
+		if options.OutboundQueueOverflow != "" {
+			logger.Warnf("Unknown overflow policy %q, using %q", options.OutboundQueueOverflow, OverflowDropOldest)
+		}
+		options.OutboundQueueOverflow = OverflowDropOldest
+	}
+	if options.WriteTimeout == 0 {
+		options.WriteTimeout = defaultWriteTimeout
+	}
+	if options.AckTimeout == 0 {
+		options.AckTimeout = defaultAckTimeout
+	}
+	if options.DurableMaxPending == 0 {
+		options.DurableMaxPending = defaultDurableMaxPending
 	}
 
 	m := &Monitoring{
@@ -235,6 +381,43 @@ func New(options Options, logger common.Logger) *Broker {
 			Name:      "request_latency_sec",
 			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 15),
 		}, []string{"service", "identification", "method"}),
+		droppedMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cellaserv",
+			Subsystem: "broker",
+			Name:      "client_dropped_messages_total",
+			Help:      "Messages dropped because the outbound queue of the client was full.",
+		}, []string{"client"}),
+		queueDelay: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "cellaserv",
+			Subsystem: "broker",
+			Name:      "outbound_queue_delay_sec",
+			Help:      "Time spent by the messages in the outbound queues, by priority.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 2, 20),
+		}, []string{"priority"}),
+		redeliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cellaserv",
+			Subsystem: "broker",
+			Name:      "durable_redeliveries_total",
+			Help:      "Events sent again to durable subscribers.",
+		}, []string{"subscriber"}),
+		pendingAcks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "cellaserv",
+			Subsystem: "broker",
+			Name:      "durable_pending_acks",
+			Help:      "Events not acknowledged yet by durable subscribers.",
+		}, []string{"subscriber"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cellaserv",
+			Subsystem: "broker",
+			Name:      "subscription_rate_limited_events_total",
+			Help:      "Events not sent to rate limited subscribers, dropped when sampling or replaced by a later event when coalescing.",
+		}, []string{"client", "mode"}),
+		publishLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cellaserv",
+			Subsystem: "broker",
+			Name:      "publish_rate_limited_total",
+			Help:      "Publishes dropped because the client exceeded the rate limit of the event.",
+		}, []string{"client"}),
 	}
 
 	broker := &Broker{
@@ -243,18 +426,40 @@ func New(options Options, logger common.Logger) *Broker {
 
 		Monitoring: m,
 
-		services:           make(map[string]map[string]*service),
-		reqIds:             make(map[uint64]*requestTracking),
-		subscriberMap:      make(map[string][]*client),
-		subscriberMatchMap: make(map[string][]*client),
+		services:      make(map[string]map[string]*serviceGroup),
+		spies:         make(map[string]map[string][]*client),
+		spyPatterns:   make(map[spyKey]*spyPattern),
+		reqIds:        make(map[uint64]*requestTracking),
+		tracer:        newTracer(),
+		subscriptions: newSubscriptionIndex(),
+		retained:      make(map[string]retainedEvent),
+		durables:      make(map[string]*durableSubscription),
+		queueGroups:   make(map[queueGroupKey]*queueGroup),
 
 		startedCh:            make(chan struct{}),
 		startedWithCellaserv: make(chan struct{}),
 		quitCh:               make(chan struct{}),
 	}
 
+	for pattern, rate := range options.PublishRateLimits {
+		p, err := common.ParseTopicPattern(pattern)
+		if err != nil {
+			logger.Warnf("Invalid publish rate limit pattern %q: %s", pattern, err)
+			continue
+		}
+		broker.publishRateLimits = append(broker.publishRateLimits, publishRateLimit{pattern: p, rate: rate})
+	}
+	broker.eventPriorities = parsePriorityPatterns(options.EventPriorities, "event", logger)
+	broker.servicePriorities = parsePriorityPatterns(options.ServicePriorities, "service", logger)
+
 	// Setup monitoring
 	m.Registry.MustRegister(m.requests)
+	m.Registry.MustRegister(m.droppedMessages)
+	m.Registry.MustRegister(m.queueDelay)
+	m.Registry.MustRegister(m.redeliveries)
+	m.Registry.MustRegister(m.pendingAcks)
+	m.Registry.MustRegister(m.rateLimited)
+	m.Registry.MustRegister(m.publishLimited)
 	m.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 		Namespace: "cellaserv",
 		Subsystem: "broker",
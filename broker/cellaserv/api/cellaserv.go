@@ -1,14 +1,37 @@
 package api
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type ClientJSON struct {
 	Id   string `json:"id"`
 	Name string `json:"name"`
 }
 
+// Load balancing policies of service groups
+const (
+	LoadBalancingRoundRobin   = "round-robin"
+	LoadBalancingLeastPending = "least-pending"
+	LoadBalancingRandom       = "random"
+)
+
+// Handling of the events exceeding the rate of a rate limited subscription
+const (
+	// Drop the events
+	RateLimitSample = "sample"
+	// Send the last event of each name at the end of the interval
+	RateLimitCoalesce = "coalesce"
+)
+
 type ServiceJSON struct {
 	Client         string `json:"client"`
 	Name           string `json:"name"`
 	Identification string `json:"identification"`
+	// Load balancing policy of the group of the service, empty if the
+	// service is not part of a group
+	LoadBalancing string `json:"load_balancing,omitempty"`
 }
 
 // Cellaserv service
@@ -20,23 +43,131 @@ type NameClientRequest struct {
 type RegisterServiceRequest struct {
 	Name           string
 	Identification string
+	// Load balancing policy of the group to join, empty to replace the
+	// service
+	LoadBalancing string
+}
+
+type ShutdownRequest struct {
+	// Time given to the pending requests to complete, in seconds
+	Grace float64
+}
+
+type ShutdownEventJSON struct {
+	// Time given to the pending requests to complete, in seconds
+	Grace float64 `json:"grace"`
 }
 
+// SpyRequest is the argument of the spy and unspy requests. The name and
+// identification are topic patterns, for example "*" matches every service.
 type SpyRequest struct {
 	ServiceName           string
 	ServiceIdentification string
 	ClientId              string
 }
 
+// StartRecordingRequest is the argument of the start_recording request.
+// The path is relative to the logs directory, and must be in it.
+type StartRecordingRequest struct {
+	Path string
+}
+
+// RecordingResponse is the reply to the start_recording and stop_recording
+// requests.
+type RecordingResponse struct {
+	// Path of the capture file
+	Path string
+}
+
+type UnsubscribeRequest struct {
+	Event string
+}
+
 type GetLogsRequest struct {
 	Pattern string
 }
 
 type GetLogsResponse map[string]string
 
+// QueueGroupJSON is a queue group of subscribers, each event being sent to a
+// single member.
+type QueueGroupJSON struct {
+	Name    string   `json:"name"`
+	Policy  string   `json:"policy"`
+	Members []string `json:"members"`
+}
+
 type EventInfoJSON struct {
 	Event       string   `json:"event"`
 	Subscribers []string `json:"subscribers"`
+	// Filter expressions of the subscribers with filters, by client id
+	Filters     map[string][]string `json:"filters,omitempty"`
+	QueueGroups []QueueGroupJSON    `json:"queue_groups,omitempty"`
+}
+
+// SubscribeErrorJSON is the data of the publish sent to a client whose
+// subscribe failed.
+type SubscribeErrorJSON struct {
+	// Filter expression of the subscribe, if any
+	Filter string `json:"filter,omitempty"`
+	Error  string `json:"error"`
 }
 
 type ListEventsResponse []EventInfoJSON
+
+type RetainedEventJSON struct {
+	Event string `json:"event"`
+	Data  string `json:"data"`
+}
+
+type ListRetainedResponse []RetainedEventJSON
+
+// Broadcast requests
+
+// ReplyErrorJSON is the error of a single service in reply to a broadcast
+// request.
+type ReplyErrorJSON struct {
+	// Name of the reply error type, eg. "Timeout"
+	Type string `json:"type"`
+	What string `json:"what,omitempty"`
+}
+
+// BroadcastReplyJSON is the reply of a single service to a broadcast request.
+// The data of the reply to a broadcast request is a list of them, sorted by
+// identification.
+type BroadcastReplyJSON struct {
+	Identification string `json:"identification"`
+	// Data of the reply, a JSON string if the data is not valid JSON
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error *ReplyErrorJSON `json:"error,omitempty"`
+}
+
+// Tracing
+
+// SpanJSON is a timed step of a traced request.
+type SpanJSON struct {
+	TraceId string `json:"trace_id"`
+	SpanId  string `json:"span_id"`
+	// Span of the caller, empty for the first request of the trace
+	ParentSpanId string    `json:"parent_span_id,omitempty"`
+	Name         string    `json:"name"`
+	Start        time.Time `json:"start"`
+	// Duration of the span, in seconds
+	Duration   float64           `json:"duration"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Error of the step, empty if it succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// TraceJSON is the summary of a trace.
+type TraceJSON struct {
+	TraceId string `json:"trace_id"`
+	// Name of the first request of the trace
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	// Duration of the trace, in seconds
+	Duration float64 `json:"duration"`
+	Spans    int     `json:"spans"`
+	// Number of failed requests
+	Errors int `json:"errors"`
+}
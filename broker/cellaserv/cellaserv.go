@@ -4,6 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
 
 	cellaserv "github.com/evolutek/cellaserv3-protobuf"
 	"github.com/evolutek/cellaserv3/broker"
@@ -73,11 +76,34 @@ func (cs *Cellaserv) registerService(req *cellaserv.Request) (interface{}, error
 		Name:           data.Name,
 		Identification: data.Identification,
 	}
+	if data.LoadBalancing != "" {
+		common.SetRegisterLoadBalancing(register, data.LoadBalancing)
+	}
 	cs.broker.HandleRegister(client, register)
 
 	return nil, nil
 }
 
+// unsubscribe removes the subscription of the sender to an event pattern.
+func (cs *Cellaserv) unsubscribe(req *cellaserv.Request) (interface{}, error) {
+	var data api.UnsubscribeRequest
+	err := json.Unmarshal(req.Data, &data)
+	if err != nil {
+		cs.logger.Warnf("Could not unmarshal request data: %s, %s", req.Data, err)
+		return nil, err
+	}
+
+	client, err := cs.broker.GetRequestSender(req)
+	if err != nil {
+		cs.logger.Warnf("Could not find client: %s", err)
+		return nil, err
+	}
+
+	cs.broker.HandleUnsubscribe(client, data.Event)
+
+	return nil, nil
+}
+
 // listClients replies with the list of currently connected clients
 func (cs *Cellaserv) listClients(*cellaserv.Request) (interface{}, error) {
 	return cs.broker.GetClientsJSON(), nil
@@ -93,14 +119,32 @@ func (cs *Cellaserv) listEvents(*cellaserv.Request) (interface{}, error) {
 	return cs.broker.GetEventsJSON(), nil
 }
 
-// shutdown quits the broker
-func (cs *Cellaserv) shutdown(*cellaserv.Request) (interface{}, error) {
+// listRetained replies with the retained events
+func (cs *Cellaserv) listRetained(*cellaserv.Request) (interface{}, error) {
+	return cs.broker.GetRetainedJSON(), nil
+}
+
+// shutdown quits the broker, after giving the pending requests a grace period
+// to complete
+func (cs *Cellaserv) shutdown(req *cellaserv.Request) (interface{}, error) {
+	var data api.ShutdownRequest
+	if len(req.Data) > 0 {
+		err := json.Unmarshal(req.Data, &data)
+		if err != nil {
+			cs.logger.Warnf("Could not unmarshal request data: %s, %s", req.Data, err)
+			return nil, err
+		}
+	}
+	grace := time.Duration(data.Grace * float64(time.Second))
+
 	cs.logger.Info("[Cellaserv] Shutting down.")
-	close(cs.broker.Quit())
+	// The reply to this request is sent while draining
+	go cs.broker.Shutdown(grace)
 	return nil, nil
 }
 
-// handleSpy registers the connection as a `py of a service
+// handleSpy registers the connection as a spy of the services matching the
+// name and identification
 func (cs *Cellaserv) handleSpy(req *cellaserv.Request) (interface{}, error) {
 	var data api.SpyRequest
 	err := json.Unmarshal(req.Data, &data)
@@ -109,22 +153,85 @@ func (cs *Cellaserv) handleSpy(req *cellaserv.Request) (interface{}, error) {
 		return nil, err
 	}
 
-	srvc, err := cs.broker.GetService(data.ServiceName, data.ServiceIdentification)
+	client, ok := cs.broker.GetClient(data.ClientId)
+	if !ok {
+		cs.logger.Warnf("[Cellaserv] Could not spy, no such client: %s", data.ClientId)
+		return nil, fmt.Errorf("No such client: %s", data.ClientId)
+	}
+	return nil, cs.broker.SpyService(client, data.ServiceName, data.ServiceIdentification)
+}
+
+// handleUnspy stops the spying of the connection on the services
+func (cs *Cellaserv) handleUnspy(req *cellaserv.Request) (interface{}, error) {
+	var data api.SpyRequest
+	err := json.Unmarshal(req.Data, &data)
 	if err != nil {
+		cs.logger.Warnf("[Cellaserv] Could not unspy: %s", err)
 		return nil, err
 	}
 
 	client, ok := cs.broker.GetClient(data.ClientId)
 	if !ok {
-		cs.logger.Warnf("[Cellaserv] Could not spy, no such service: %s %s", data.ServiceName,
-			data.ServiceIdentification)
-		return nil, fmt.Errorf("No such service: %s[%s]", data.ServiceName, data.ServiceIdentification)
+		cs.logger.Warnf("[Cellaserv] Could not unspy, no such client: %s", data.ClientId)
+		return nil, fmt.Errorf("No such client: %s", data.ClientId)
 	}
-	cs.broker.SpyService(client, srvc)
-
+	cs.broker.UnspyService(client, data.ServiceName, data.ServiceIdentification)
 	return nil, nil
 }
 
+// startRecording records the messages routed by the broker in a capture file
+func (cs *Cellaserv) startRecording(req *cellaserv.Request) (interface{}, error) {
+	var data api.StartRecordingRequest
+	err := json.Unmarshal(req.Data, &data)
+	if err != nil {
+		cs.logger.Warnf("[Cellaserv] Could not start recording: %s", err)
+		return nil, err
+	}
+	if data.Path == "" {
+		return nil, fmt.Errorf("Missing capture file path")
+	}
+
+	capturePath, err := recordingPath(cs.broker.Options.LogsDir, data.Path)
+	if err != nil {
+		cs.logger.Warnf("[Cellaserv] Could not start recording: %s", err)
+		return nil, err
+	}
+	if err := cs.broker.StartRecording(capturePath); err != nil {
+		cs.logger.Warnf("[Cellaserv] Could not start recording: %s", err)
+		return nil, err
+	}
+	return api.RecordingResponse{Path: capturePath}, nil
+}
+
+// recordingPath returns the path of the capture file in the logs directory.
+// The capture file is created by the broker, it must not replace files outside
+// of the logs directory.
+func recordingPath(logsDir string, path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return "", fmt.Errorf("Capture file path must be relative to the logs directory: %q", path)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("Capture file path must not contain '..': %q", path)
+		}
+	}
+	capturePath := filepath.Join(logsDir, path)
+	rel, err := filepath.Rel(filepath.Clean(logsDir), capturePath)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("Capture file path must be in the logs directory: %q", path)
+	}
+	return capturePath, nil
+}
+
+// stopRecording stops the current recording
+func (cs *Cellaserv) stopRecording(*cellaserv.Request) (interface{}, error) {
+	capturePath, err := cs.broker.StopRecording()
+	if err != nil {
+		return nil, err
+	}
+	return api.RecordingResponse{Path: capturePath}, nil
+}
+
 // version return the version of cellaserv
 func version(req *cellaserv.Request) (interface{}, error) {
 	return common.Version, nil
@@ -166,10 +273,16 @@ func (cs *Cellaserv) Run(ctx context.Context) error {
 	service.HandleRequestFunc("get_logs", cs.getLogs)
 	service.HandleRequestFunc("list_clients", cs.listClients)
 	service.HandleRequestFunc("list_events", cs.listEvents)
+	service.HandleRequestFunc("list_retained", cs.listRetained)
 	service.HandleRequestFunc("list_services", cs.listServices)
 	service.HandleRequestFunc("name_client", cs.nameClient)
 	service.HandleRequestFunc("register_service", cs.registerService)
 	service.HandleRequestFunc("shutdown", cs.shutdown)
+	service.HandleRequestFunc("spy", cs.handleSpy)
+	service.HandleRequestFunc("start_recording", cs.startRecording)
+	service.HandleRequestFunc("stop_recording", cs.stopRecording)
+	service.HandleRequestFunc("unspy", cs.handleUnspy)
+	service.HandleRequestFunc("unsubscribe", cs.unsubscribe)
 	service.HandleRequestFunc("version", version)
 	service.HandleRequestFunc("whoami", cs.whoami)
 
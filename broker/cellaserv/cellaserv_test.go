@@ -4,10 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"syscall"
 	"testing"
 	"time"
 
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
 	"github.com/evolutek/cellaserv3/broker"
 	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
 	"github.com/evolutek/cellaserv3/client"
@@ -106,3 +109,138 @@ func TestRegisterRequest(t *testing.T) {
 
 	})
 }
+
+func TestSpy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := broker.New(broker.Options{ListenAddress: ":4213"}, common.NewLogger("broker"))
+	go func() {
+		if err := b.Run(ctx); err != nil {
+			t.Errorf("Could not start broker: %s", err)
+		}
+	}()
+	cs := New(&Options{BrokerAddr: ":4213"}, b, common.NewLogger("cellaserv"))
+	go func() {
+		if err := cs.Run(ctx); err != nil {
+			t.Errorf("Could not start cellaserv: %s", err)
+		}
+	}()
+	<-b.StartedWithCellaserv()
+
+	clientOpts := client.ClientOpts{CellaservAddr: ":4213"}
+	connSpy := client.NewClient(clientOpts)
+	defer connSpy.Close()
+	spied := make(chan string, 10)
+	err := connSpy.Spy("date", "*", func(req *cellaserv.Request, rep *cellaserv.Reply) {
+		spied <- req.GetMethod()
+	})
+	if err != nil {
+		t.Fatalf("Could not spy: %s", err)
+	}
+
+	// The service registers after the spy
+	connService := client.NewClient(clientOpts)
+	defer connService.Close()
+	date := connService.NewService("date", "foo")
+	date.HandleRequestFunc("time", func(*cellaserv.Request) (interface{}, error) {
+		return time.Now(), nil
+	})
+	connService.RegisterService(date)
+	time.Sleep(50 * time.Millisecond)
+
+	connClient := client.NewClient(clientOpts)
+	defer connClient.Close()
+	stub := client.NewServiceStub(connClient, "date", "foo")
+	if _, err := stub.Request("time", nil); err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	select {
+	case method := <-spied:
+		if method != "time" {
+			t.Errorf("Spied method %q, expected time", method)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The spy did not receive the request")
+	}
+
+	// After unspying, the requests are not received anymore
+	if err := connSpy.Unspy("date", "*"); err != nil {
+		t.Fatalf("Could not unspy: %s", err)
+	}
+	if _, err := stub.Request("time", nil); err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(spied) != 0 {
+		t.Errorf("The spy received a request after unspying")
+	}
+}
+
+func TestRecording(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logsDir := t.TempDir()
+	b := broker.New(broker.Options{ListenAddress: ":4214", LogsDir: logsDir}, common.NewLogger("broker"))
+	go func() {
+		if err := b.Run(ctx); err != nil {
+			t.Errorf("Could not start broker: %s", err)
+		}
+	}()
+	cs := New(&Options{BrokerAddr: ":4214"}, b, common.NewLogger("cellaserv"))
+	go func() {
+		if err := cs.Run(ctx); err != nil {
+			t.Errorf("Could not start cellaserv: %s", err)
+		}
+	}()
+	<-b.StartedWithCellaserv()
+
+	conn := client.NewClient(client.ClientOpts{CellaservAddr: ":4214"})
+	defer conn.Close()
+	stub := client.NewServiceStub(conn, "cellaserv", "")
+
+	// Relative paths are in the logs directory
+	respBytes, err := stub.Request("start_recording", &api.StartRecordingRequest{Path: "match.cap"})
+	if err != nil {
+		t.Fatalf("Could not start recording: %s", err)
+	}
+	var resp api.RecordingResponse
+	if err := json.Unmarshal(respBytes, &resp); err != nil {
+		t.Fatal(err)
+	}
+	capturePath := filepath.Join(logsDir, "match.cap")
+	if resp.Path != capturePath {
+		t.Errorf("Recording to %q, expected %q", resp.Path, capturePath)
+	}
+	if recorded, ok := b.Recording(); !ok || recorded != capturePath {
+		t.Errorf("Broker is not recording to %q", capturePath)
+	}
+
+	if _, err := stub.Request("stop_recording", nil); err != nil {
+		t.Fatalf("Could not stop recording: %s", err)
+	}
+	if _, ok := b.Recording(); ok {
+		t.Error("Broker should not be recording")
+	}
+	if _, err := os.Stat(capturePath); err != nil {
+		t.Errorf("Capture file not found: %s", err)
+	}
+	if _, err := stub.Request("stop_recording", nil); err == nil {
+		t.Error("Stopping when not recording should fail")
+	}
+
+	// The capture file must be in the logs directory
+	outside := filepath.Join(filepath.Dir(logsDir), "outside.cap")
+	for _, path := range []string{outside, "../outside.cap", "foo/../../outside.cap", "."} {
+		if _, err := stub.Request("start_recording", &api.StartRecordingRequest{Path: path}); err == nil {
+			t.Errorf("Recording to %q should fail", path)
+		}
+	}
+	if _, ok := b.Recording(); ok {
+		t.Error("Broker should not be recording")
+	}
+	if _, err := os.Stat(outside); !os.IsNotExist(err) {
+		t.Errorf("File outside of the logs directory should not be created: %v", err)
+	}
+}
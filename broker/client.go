@@ -4,11 +4,12 @@ import (
 	"encoding/json"
 	"net"
 	"sync"
+	"time"
 
 	cellaserv "github.com/evolutek/cellaserv3-protobuf"
 	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
 	"github.com/evolutek/cellaserv3/common"
-	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -18,10 +19,26 @@ type client struct {
 	conn       net.Conn      // connection of this client
 	id         string        // unique id for this client
 	name       string        // name of this client
-	spying     []*service    // services spied by this client
+	spying     []spyKey      // services spied by this client
 	services   []*service    // services registered by this clietn
 	subscribes []string      // events subscribed by the client
 	logger     common.Logger // client logger
+
+	requestsMtx sync.Mutex
+	requests    map[uint64]bool // ids of the requests waiting for a reply
+
+	// Publish rate limits of the client, by event name
+	publishBucketsMtx     sync.Mutex
+	publishBuckets        map[string]*tokenBucket
+	publishBucketsSweptAt time.Time
+
+	// Messages waiting to be written to the connection
+	queue           *outboundQueue
+	droppedMessages prometheus.Counter
+	queueDelay      *prometheus.HistogramVec
+	quitOnce        sync.Once
+	quitCh          chan struct{}
+	writerDone      chan struct{}
 }
 
 func (c *client) String() string {
@@ -31,6 +48,28 @@ func (c *client) String() string {
 	return c.conn.RemoteAddr().String()
 }
 
+// addPendingRequest tracks the id of a request sent by the client, and returns
+// false if a request with the same id is still waiting for a reply.
+func (c *client) addPendingRequest(id uint64) bool {
+	c.requestsMtx.Lock()
+	defer c.requestsMtx.Unlock()
+	if c.requests[id] {
+		return false
+	}
+	if c.requests == nil {
+		c.requests = make(map[uint64]bool)
+	}
+	c.requests[id] = true
+	return true
+}
+
+// removePendingRequest is called when the request received its reply.
+func (c *client) removePendingRequest(id uint64) {
+	c.requestsMtx.Lock()
+	delete(c.requests, id)
+	c.requestsMtx.Unlock()
+}
+
 func (c *client) JSONStruct() api.ClientJSON {
 	return api.ClientJSON{
 		Id:   c.id,
@@ -54,130 +93,49 @@ func (b *Broker) GetClient(clientId string) (*client, bool) {
 	return value.(*client), true
 }
 
-// Send utils
-func (b *Broker) sendRawMessage(conn net.Conn, msg []byte) {
-	err := common.SendRawMessage(conn, msg)
-	if err != nil {
-		b.logger.Errorf("Could not send message %s to %s: %s", msg, conn, err)
-	}
-}
-
-// TODO(halfr): move from Broker to client
-func (b *Broker) sendReply(c *client, req *cellaserv.Request, data []byte) {
-	rep := &cellaserv.Reply{Id: req.Id, Data: data}
-	repBytes, err := proto.Marshal(rep)
-	if err != nil {
-		c.logger.Errorf("Could not marshal outgoing reply: %s", err)
-	}
-
-	msgType := cellaserv.Message_Reply
-	msg := &cellaserv.Message{Type: msgType, Content: repBytes}
-
-	err = common.SendMessage(c.conn, msg)
-	if err != nil {
-		c.logger.Errorf("Could not send message: %s", err)
-	}
-}
-
-// TODO(halfr): move from Broker to client
-func (b *Broker) sendReplyError(c *client, req *cellaserv.Request, errType cellaserv.Reply_Error_Type) {
-	replyErr := &cellaserv.Reply_Error{Type: errType}
-
-	reply := &cellaserv.Reply{Error: replyErr, Id: req.Id}
-	replyBytes, _ := proto.Marshal(reply)
-
-	msgType := cellaserv.Message_Reply
-	msg := &cellaserv.Message{
-		Type:    msgType,
-		Content: replyBytes,
-	}
-	err := common.SendMessage(c.conn, msg)
-	if err != nil {
-		c.logger.Errorf("Could not send message: %s", err)
-	}
-}
-
-// Remove services registered by this connection. The client's mutex must be
-// held by caller.
-func (b *Broker) removeServicesOnClient(c *client) {
-	// TODO: notify goroutines waiting for acks for this service
+// Remove services registered by this connection, and returns the events to
+// publish. The client's mutex must be held by caller.
+func (b *Broker) removeServicesOnClient(c *client) []cellaservEvent {
+	var events []cellaservEvent
 	for _, s := range c.services {
-		c.logger.Infof("Remove service %s", s)
-		pubJSON, _ := json.Marshal(s.JSONStruct())
-		b.cellaservPublishBytes(logLostService, pubJSON)
+		// The requests sent to the service will never get a reply
+		b.failServiceRequests(s)
 
 		b.servicesMtx.Lock()
-		delete(b.services[s.Name], s.Identification)
+		group, ok := b.services[s.Name][s.Identification]
+		if !ok || !group.removeMember(s) {
+			// The service was replaced
+			b.servicesMtx.Unlock()
+			continue
+		}
+		group.mtx.Lock()
+		groupEmpty := len(group.members) == 0
+		group.mtx.Unlock()
+		if groupEmpty {
+			delete(b.services[s.Name], s.Identification)
+		}
 		b.servicesMtx.Unlock()
 
-		// Close connections that spied this service
-		// TODO(halfr): do not close thoses connections, instead,
-		// spying and services and make sure that if the service
-		// reconnects, the spies are automatically re-added to this
-		// service.
-		s.spiesMtx.RLock()
-		for _, c := range s.spies {
-			c.logger.Debugf("Close spy conn: %s", c)
-			if err := c.conn.Close(); err != nil {
-				c.logger.Errorf("Could not close connection: %s", err)
-			}
-		}
-		s.spiesMtx.RLock()
+		c.logger.Infof("Remove service %s", s)
+		pubJSON, _ := json.Marshal(s.JSONStruct())
+		events = append(events, cellaservEvent{logLostService, pubJSON})
 	}
+	return events
 }
 
-func (b *Broker) removeSubscriptionsOfClient(c *client) {
-	var removedSubscriptions []logSubscriberJSON
+// removeSubscriptionsOfClient removes the subscriptions of the client, and
+// returns the events to publish. The client lock must be held.
+func (b *Broker) removeSubscriptionsOfClient(c *client) []cellaservEvent {
+	var events []cellaservEvent
 
 	// Remove subscribes from this connection
-	removeConnFromMap := func(subMap map[string][]*client) {
-		for key, subs := range subMap {
-			for i, subClient := range subs {
-				if c == subClient {
-					removedSubscriptions = append(removedSubscriptions,
-						logSubscriberJSON{key, c.id})
-
-					// Remove from list of subscribers
-					subs[i] = subs[len(subs)-1]
-					subMap[key] = subs[:len(subs)-1]
-
-					if len(subMap[key]) == 0 {
-						delete(subMap, key)
-						break
-					}
-				}
-			}
-		}
-	}
-
-	b.subscriberMapMtx.Lock()
-	removeConnFromMap(b.subscriberMap)
-	b.subscriberMapMtx.Unlock()
-	b.subscriberMatchMapMtx.Lock()
-	removeConnFromMap(b.subscriberMatchMap)
-	b.subscriberMatchMapMtx.Unlock()
-
-	for _, removedSub := range removedSubscriptions {
-		pubJSON, _ := json.Marshal(removedSub)
-		b.cellaservPublishBytes(logLostSubscriber, pubJSON)
-	}
-
-}
-
-func (b *Broker) removeSpiesOnClient(c *client) {
-	// Remove conn from the services it spied
-	for _, srvc := range c.spying {
-		srvc.spiesMtx.Lock()
-		for i, spy := range srvc.spies {
-			if spy == c {
-				// Remove from slice
-				srvc.spies[i] = srvc.spies[len(srvc.spies)-1]
-				srvc.spies = srvc.spies[:len(srvc.spies)-1]
-				break
-			}
-		}
-		srvc.spiesMtx.Unlock()
+	for _, pattern := range c.subscribes {
+		b.subscriptions.remove(pattern, c)
+		pubJSON, _ := json.Marshal(logSubscriberJSON{pattern, c.id})
+		events = append(events, cellaservEvent{logLostSubscriber, pubJSON})
 	}
+	c.subscribes = nil
+	return events
 }
 
 func (b *Broker) newClient(conn net.Conn) *client {
@@ -190,7 +148,13 @@ func (b *Broker) newClient(conn net.Conn) *client {
 			"module": "client",
 			"client": id,
 		}),
+		queue:           newOutboundQueue(b.Options.OutboundQueueSize, b.Options.OutboundQueueOverflow),
+		droppedMessages: b.Monitoring.droppedMessages.WithLabelValues(id),
+		queueDelay:      b.Monitoring.queueDelay,
+		quitCh:          make(chan struct{}),
+		writerDone:      make(chan struct{}),
 	}
+	go c.write(b.Options.WriteTimeout)
 	b.mapClientIdToClient.Store(c.id, c)
 	b.cellaservPublish(logNewClient, c.JSONStruct())
 	return c
@@ -209,13 +173,21 @@ func (b *Broker) RenameClientFromRequest(req *cellaserv.Request, name string) {
 func (b *Broker) removeClient(c *client) {
 	// Client exited, cleaning up resources
 	c.mtx.Lock()
-	b.removeServicesOnClient(c)
-	b.removeSubscriptionsOfClient(c)
+	events := b.removeServicesOnClient(c)
+	events = append(events, b.removeSubscriptionsOfClient(c)...)
 	b.removeSpiesOnClient(c)
 	c.mtx.Unlock()
+	b.cellaservPublishEvents(events)
+	b.detachDurables(c)
+	b.leaveQueueGroups(c)
 
 	// Remove from list of handled connection
 	b.mapClientIdToClient.Delete(c.id)
+	b.Monitoring.droppedMessages.DeleteLabelValues(c.id)
+	b.Monitoring.publishLimited.DeleteLabelValues(c.id)
+	for _, mode := range []string{api.RateLimitSample, api.RateLimitCoalesce} {
+		b.Monitoring.rateLimited.DeleteLabelValues(c.id, mode)
+	}
 
 	b.cellaservPublish(logLostClient, c.JSONStruct())
 }
@@ -0,0 +1,193 @@
+package broker
+
+import (
+	"context"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	defaultAckTimeout        = 5 * time.Second
+	defaultDurableMaxPending = 1024
+)
+
+// A pendingDelivery is an event delivered to a durable subscriber and not
+// acknowledged yet.
+type pendingDelivery struct {
+	id       uint64
+	msgBytes []byte
+	priority common.Priority
+	// Time of the last delivery, zero if the event was not delivered yet
+	sentAt time.Time
+}
+
+// A durableSubscription keeps the events matching its pattern until they are
+// acknowledged by its subscriber. It is identified by the name of the
+// subscriber, and outlives its connection.
+type durableSubscription struct {
+	name    string
+	pattern *common.TopicPattern
+	// Client receiving the events, nil while the subscriber is
+	// disconnected
+	client         *client
+	lastDeliveryId uint64
+	// Ordered by id
+	pending []*pendingDelivery
+}
+
+// send sends the event to the subscriber, if connected.
+func (d *durableSubscription) send(p *pendingDelivery) {
+	if d.client == nil {
+		return
+	}
+	p.sentAt = time.Now()
+	d.client.send(p.msgBytes, p.priority)
+}
+
+// handleDurableSubscribe subscribes the client as the durable subscriber
+// name, and sends it the events not acknowledged yet.
+func (b *Broker) handleDurableSubscribe(c *client, name string, pattern *common.TopicPattern) {
+	c.logger.Infof("Subscribes to event %q as durable subscriber %q", pattern, name)
+
+	b.durablesMtx.Lock()
+	defer b.durablesMtx.Unlock()
+
+	d, ok := b.durables[name]
+	if !ok {
+		d = &durableSubscription{name: name}
+		b.durables[name] = d
+	} else if d.client != nil && d.client != c {
+		c.logger.Warnf("Takes over durable subscriber %q from %s", name, d.client.id)
+	}
+	d.pattern = pattern
+	d.client = c
+
+	for _, p := range d.pending {
+		if !p.sentAt.IsZero() {
+			b.Monitoring.redeliveries.WithLabelValues(name).Inc()
+		}
+		d.send(p)
+	}
+}
+
+// handleDurableUnsubscribe removes the durable subscription and its
+// unacknowledged events.
+func (b *Broker) handleDurableUnsubscribe(c *client, name string) {
+	c.logger.Infof("Unsubscribes durable subscriber %q", name)
+
+	b.durablesMtx.Lock()
+	defer b.durablesMtx.Unlock()
+	if _, ok := b.durables[name]; !ok {
+		c.logger.Warnf("No durable subscriber %q", name)
+		return
+	}
+	delete(b.durables, name)
+	b.Monitoring.pendingAcks.DeleteLabelValues(name)
+}
+
+// handleAck removes the acknowledged event of the durable subscriber.
+func (b *Broker) handleAck(c *client, name string, deliveryId uint64) {
+	b.durablesMtx.Lock()
+	defer b.durablesMtx.Unlock()
+
+	d, ok := b.durables[name]
+	if !ok {
+		c.logger.Warnf("Acknowledgment for unknown durable subscriber %q", name)
+		return
+	}
+	for i, p := range d.pending {
+		if p.id == deliveryId {
+			d.pending = append(d.pending[:i], d.pending[i+1:]...)
+			b.updatePendingAcks(d)
+			return
+		}
+	}
+	// Acknowledged twice, after a redelivery
+	c.logger.Debugf("Delivery %d of %q already acknowledged", deliveryId, name)
+}
+
+// deliverDurable queues the event for the durable subscribers whose pattern
+// matches, and sends it to the connected ones.
+func (b *Broker) deliverDurable(pub *cellaserv.Publish, priority common.Priority) {
+	b.durablesMtx.Lock()
+	defer b.durablesMtx.Unlock()
+
+	for _, d := range b.durables {
+		if !d.pattern.Match(pub.Event) {
+			continue
+		}
+		d.lastDeliveryId++
+		delivered := proto.Clone(pub).(*cellaserv.Publish)
+		common.SetPublishDelivery(delivered, d.name, d.lastDeliveryId)
+		msgBytes, err := common.MarshalMessage(cellaserv.Message_Publish, delivered)
+		if err != nil {
+			b.logger.Errorf("Could not marshal durable event: %s", err)
+			continue
+		}
+		if len(d.pending) >= b.Options.DurableMaxPending {
+			b.logger.Warnf("Too many unacknowledged events for %q, dropping the oldest", d.name)
+			d.pending[0] = nil
+			d.pending = d.pending[1:]
+		}
+		p := &pendingDelivery{id: d.lastDeliveryId, msgBytes: msgBytes, priority: priority}
+		d.pending = append(d.pending, p)
+		d.send(p)
+		b.updatePendingAcks(d)
+	}
+}
+
+// detachDurables marks the durable subscribers of the client as
+// disconnected. Their events are kept until they subscribe again.
+func (b *Broker) detachDurables(c *client) {
+	b.durablesMtx.Lock()
+	defer b.durablesMtx.Unlock()
+	for _, d := range b.durables {
+		if d.client == c {
+			d.client = nil
+		}
+	}
+}
+
+// redeliver sends again the events that were not acknowledged in time.
+func (b *Broker) redeliver() {
+	b.durablesMtx.Lock()
+	defer b.durablesMtx.Unlock()
+
+	deadline := time.Now().Add(-b.Options.AckTimeout)
+	for _, d := range b.durables {
+		for _, p := range d.pending {
+			if d.client == nil || p.sentAt.IsZero() || p.sentAt.After(deadline) {
+				continue
+			}
+			d.client.logger.Debugf("Redelivers event %d of %q", p.id, d.name)
+			b.Monitoring.redeliveries.WithLabelValues(d.name).Inc()
+			d.send(p)
+		}
+	}
+}
+
+// redeliverLoop periodically redelivers the events that were not
+// acknowledged in time.
+func (b *Broker) redeliverLoop(ctx context.Context) {
+	ticker := time.NewTicker(b.Options.AckTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.redeliver()
+		case <-ctx.Done():
+			return
+		case <-b.quitCh:
+			return
+		}
+	}
+}
+
+// updatePendingAcks updates the metric of the unacknowledged events of the
+// durable subscriber.
+func (b *Broker) updatePendingAcks(d *durableSubscription) {
+	b.Monitoring.pendingAcks.WithLabelValues(d.name).Set(float64(len(d.pending)))
+}
@@ -0,0 +1,79 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/evolutek/cellaserv3/testutil"
+	"github.com/golang/protobuf/proto"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// recvDelivery receives an event delivered to a durable subscriber, and
+// returns its event and delivery id.
+func recvDelivery(t *testing.T, conn net.Conn, name string) (string, uint64) {
+	t.Helper()
+	msg := testutil.RecvMessage(t, conn)
+	testutil.MsgTypeIs(t, msg, cellaserv.Message_Publish)
+	pub := &cellaserv.Publish{}
+	testutil.Ok(t, proto.Unmarshal(msg.GetContent(), pub))
+	deliveryName, id, ok := common.PublishDelivery(pub)
+	testutil.Assert(t, ok, "Event should be a delivery")
+	testutil.Equals(t, name, deliveryName)
+	return pub.GetEvent(), id
+}
+
+func TestDurableSubscribe(t *testing.T) {
+	options := Options{AckTimeout: 100 * time.Millisecond}
+	brokerTestWithOptions(t, options, func(b *Broker) {
+		sub := testutil.Dial(t)
+		sub.Write(testutil.MakeMessageSubscribeDurable(t, "logger", "robot.*"))
+		time.Sleep(50 * time.Millisecond)
+
+		pub := testutil.Dial(t)
+		defer pub.Close()
+		pub.Write(testutil.MakeMessagePublish(t, "robot.a"))
+
+		event, id := recvDelivery(t, sub, "logger")
+		testutil.Equals(t, "robot.a", event)
+		testutil.Equals(t, uint64(1), id)
+
+		// Not acknowledged, the event is delivered again
+		event, id = recvDelivery(t, sub, "logger")
+		testutil.Equals(t, "robot.a", event)
+		testutil.Equals(t, uint64(1), id)
+		testutil.Assert(t, promtestutil.ToFloat64(b.Monitoring.redeliveries.WithLabelValues("logger")) >= 1,
+			"Redelivery should be counted")
+
+		sub.Write(testutil.MakeMessageAck(t, "logger", "robot.*", id))
+		time.Sleep(50 * time.Millisecond)
+		testutil.Equals(t, 0.0, promtestutil.ToFloat64(b.Monitoring.pendingAcks.WithLabelValues("logger")))
+
+		// Events published while the subscriber is disconnected are
+		// kept
+		sub.Close()
+		time.Sleep(50 * time.Millisecond)
+		pub.Write(testutil.MakeMessagePublish(t, "robot.b"))
+		time.Sleep(50 * time.Millisecond)
+		testutil.Equals(t, 1.0, promtestutil.ToFloat64(b.Monitoring.pendingAcks.WithLabelValues("logger")))
+
+		sub = testutil.Dial(t)
+		defer sub.Close()
+		sub.Write(testutil.MakeMessageSubscribeDurable(t, "logger", "robot.*"))
+		event, id = recvDelivery(t, sub, "logger")
+		testutil.Equals(t, "robot.b", event)
+		testutil.Equals(t, uint64(2), id)
+		sub.Write(testutil.MakeMessageAck(t, "logger", "robot.*", id))
+
+		// Acknowledged events are not delivered again
+		pub.Write(testutil.MakeMessagePublish(t, "robot.c"))
+		event, id = recvDelivery(t, sub, "logger")
+		testutil.Equals(t, "robot.c", event)
+		sub.Write(testutil.MakeMessageAck(t, "logger", "robot.*", id))
+		time.Sleep(300 * time.Millisecond)
+		testutil.Equals(t, 0.0, promtestutil.ToFloat64(b.Monitoring.pendingAcks.WithLabelValues("logger")))
+	})
+}
@@ -0,0 +1,346 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+// Policies applied when the outbound queue of a client is full
+const (
+	// Drop the oldest message of the queue
+	OverflowDropOldest = "drop-oldest"
+	// Drop the message being sent
+	OverflowDropNewest = "drop-newest"
+	// Close the connection of the client
+	OverflowDisconnect = "disconnect"
+)
+
+const (
+	defaultOutboundQueueSize = 1024
+	defaultWriteTimeout      = 10 * time.Second
+)
+
+// IsValidOverflowPolicy returns whether policy is one of the overflow
+// policies.
+func IsValidOverflowPolicy(policy string) bool {
+	switch policy {
+	case OverflowDropOldest, OverflowDropNewest, OverflowDisconnect:
+		return true
+	}
+	return false
+}
+
+// Kinds of queued messages, which are handled differently when the queue is
+// full
+type messageKind int
+
+const (
+	// Events, and copies of requests and replies sent to spies: dropped
+	// according to the overflow policy
+	messageEvent messageKind = iota
+	// Requests sent to services: never dropped, they are refused when the
+	// queue is full of requests and replies
+	messageRequest
+	// Replies: never dropped, they are queued even when the queue is full
+	// of requests and replies, their number being bounded by the requests
+	// of the client
+	messageReply
+)
+
+// Results of the queuing of a message
+type pushResult int
+
+const (
+	pushQueued pushResult = iota
+	// The message is queued, and an event was dropped to make room for it
+	pushReplaced
+	// The message is not queued
+	pushDropped
+	// The queue is full, the client must be disconnected
+	pushOverflow
+)
+
+type queuedMessage struct {
+	msg      []byte
+	kind     messageKind
+	queuedAt time.Time
+	// Called when the message is written to the connection, if not nil
+	written func(time.Time)
+}
+
+// outboundQueue is the bounded queue of the messages waiting to be written to
+// the connection of a client. Messages of higher priority are written first.
+type outboundQueue struct {
+	mtx    sync.Mutex
+	queues [common.PriorityHigh + 1][]queuedMessage // by priority
+	count  int
+	size   int
+	policy string
+
+	// Receives a value when messages are queued
+	readyCh chan struct{}
+	// Receives a value when messages are removed
+	spaceCh chan struct{}
+}
+
+func newOutboundQueue(size int, policy string) *outboundQueue {
+	return &outboundQueue{
+		size:    size,
+		policy:  policy,
+		readyCh: make(chan struct{}, 1),
+		spaceCh: make(chan struct{}, 1),
+	}
+}
+
+// lowestEventPriority returns the lowest priority of the queued events.
+// Returns false if no event is queued.
+func (q *outboundQueue) lowestEventPriority() (common.Priority, bool) {
+	for p := common.PriorityLow; p <= common.PriorityHigh; p++ {
+		for _, qm := range q.queues[p] {
+			if qm.kind == messageEvent {
+				return p, true
+			}
+		}
+	}
+	return common.PriorityUnset, false
+}
+
+// removeEvent removes the oldest, or the newest, queued event of this
+// priority.
+func (q *outboundQueue) removeEvent(priority common.Priority, newest bool) {
+	queue := q.queues[priority]
+	idx := -1
+	for i, qm := range queue {
+		if qm.kind == messageEvent {
+			idx = i
+			if !newest {
+				break
+			}
+		}
+	}
+	copy(queue[idx:], queue[idx+1:])
+	queue[len(queue)-1] = queuedMessage{}
+	q.queues[priority] = queue[:len(queue)-1]
+	q.count--
+}
+
+// push queues the event. Returns whether a message was dropped, or whether
+// the client must be disconnected, because the queue is full. Events of lower
+// priority are dropped first.
+func (q *outboundQueue) push(msg []byte, priority common.Priority) (dropped bool, overflow bool) {
+	switch q.pushMessage(queuedMessage{msg: msg}, priority) {
+	case pushReplaced, pushDropped:
+		return true, false
+	case pushOverflow:
+		return false, true
+	}
+	return false, false
+}
+
+// pushMessage queues the message. When the queue is full, the overflow policy
+// is applied to the events only: requests and replies take the place of an
+// event, and are never dropped.
+func (q *outboundQueue) pushMessage(qm queuedMessage, priority common.Priority) pushResult {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	result := pushQueued
+	if q.count >= q.size {
+		if q.policy == OverflowDisconnect {
+			return pushOverflow
+		}
+
+		dropNewest := q.policy == OverflowDropNewest
+		lowest, ok := q.lowestEventPriority()
+		switch {
+		case qm.kind == messageEvent:
+			if !ok || priority < lowest || (dropNewest && priority == lowest) {
+				return pushDropped
+			}
+			q.removeEvent(lowest, dropNewest)
+			result = pushReplaced
+		case ok:
+			q.removeEvent(lowest, dropNewest)
+			result = pushReplaced
+		case qm.kind == messageRequest:
+			// The queue is full of requests and replies
+			return pushDropped
+		}
+	}
+	qm.queuedAt = time.Now()
+	q.queues[priority] = append(q.queues[priority], qm)
+	q.count++
+
+	select {
+	case q.readyCh <- struct{}{}:
+	default:
+	}
+	return result
+}
+
+// hasRoom returns whether at most half of the queue is used, leaving room
+// for the messages sent without waiting.
+func (q *outboundQueue) hasRoom() bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.count <= q.size/2
+}
+
+// len returns the number of queued messages.
+func (q *outboundQueue) len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.count
+}
+
+// pop removes the oldest message of the highest priority.
+func (q *outboundQueue) pop() (queuedMessage, common.Priority, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for _, p := range common.Priorities {
+		queue := q.queues[p]
+		if len(queue) == 0 {
+			continue
+		}
+		msg := queue[0]
+		queue[0] = queuedMessage{}
+		q.queues[p] = queue[1:]
+		q.count--
+		select {
+		case q.spaceCh <- struct{}{}:
+		default:
+		}
+		return msg, p, true
+	}
+	return queuedMessage{}, common.PriorityUnset, false
+}
+
+// send queues an event, or a copy of a request or reply sent to a spy, to be
+// written to the connection of the client.
+func (c *client) send(msg []byte, priority common.Priority) {
+	c.push(queuedMessage{msg: msg}, priority)
+}
+
+// sendRequest queues a request, and calls written with the time it is
+// written to the connection of the client. Returns false if the request
+// cannot be queued, the queue being full of requests and replies.
+func (c *client) sendRequest(msg []byte, priority common.Priority, written func(time.Time)) bool {
+	return c.push(queuedMessage{msg: msg, kind: messageRequest, written: written}, priority)
+}
+
+// sendReplyMessage queues a reply, which is never dropped.
+func (c *client) sendReplyMessage(msg []byte, priority common.Priority) {
+	c.push(queuedMessage{msg: msg, kind: messageReply}, priority)
+}
+
+// push queues the message, and returns whether it is queued.
+func (c *client) push(qm queuedMessage, priority common.Priority) bool {
+	if priority == common.PriorityUnset {
+		priority = common.PriorityNormal
+	}
+	switch c.queue.pushMessage(qm, priority) {
+	case pushReplaced:
+		c.droppedMessages.Inc()
+		c.logger.Warnf("Outbound queue full, event dropped")
+	case pushDropped:
+		c.droppedMessages.Inc()
+		c.logger.Warnf("Outbound queue full, message dropped")
+		return false
+	case pushOverflow:
+		c.droppedMessages.Inc()
+		c.logger.Errorf("Outbound queue full, disconnecting")
+		c.conn.Close()
+		return false
+	}
+	return true
+}
+
+// sendWait queues a message once the outbound queue has room for it, so that
+// sending many messages in a row does not drop any. Returns false if the
+// client is closed.
+func (c *client) sendWait(msg []byte, priority common.Priority) bool {
+	for !c.queue.hasRoom() {
+		select {
+		case <-c.queue.spaceCh:
+		case <-c.quitCh:
+			return false
+		}
+	}
+	c.send(msg, priority)
+	return true
+}
+
+func (c *client) sendReply(req *cellaserv.Request, data []byte) {
+	rep := &cellaserv.Reply{Id: req.Id, Data: data}
+	msg, err := common.MarshalMessage(cellaserv.Message_Reply, rep)
+	if err != nil {
+		c.logger.Errorf("Could not marshal outgoing reply: %s", err)
+		return
+	}
+	c.sendReplyMessage(msg, common.GetPriority(req))
+}
+
+func (c *client) sendReplyError(req *cellaserv.Request, errType cellaserv.Reply_Error_Type) {
+	rep := &cellaserv.Reply{
+		Id:    req.Id,
+		Error: &cellaserv.Reply_Error{Type: errType},
+	}
+	msg, err := common.MarshalMessage(cellaserv.Message_Reply, rep)
+	if err != nil {
+		c.logger.Errorf("Could not marshal outgoing reply: %s", err)
+		return
+	}
+	c.sendReplyMessage(msg, common.GetPriority(req))
+}
+
+// write writes the queued messages to the connection of the client, until
+// the client is closed.
+func (c *client) write(writeTimeout time.Duration) {
+	defer close(c.writerDone)
+	for {
+		select {
+		case <-c.queue.readyCh:
+			if !c.writeQueued(writeTimeout) {
+				return
+			}
+		case <-c.quitCh:
+			// Flush the queue before quitting
+			c.writeQueued(writeTimeout)
+			return
+		}
+	}
+}
+
+// writeQueued writes the messages of the queue until it is empty. Returns
+// false if the connection cannot be written to anymore.
+func (c *client) writeQueued(writeTimeout time.Duration) bool {
+	for {
+		msg, priority, ok := c.queue.pop()
+		if !ok {
+			return true
+		}
+		c.queueDelay.WithLabelValues(priority.String()).Observe(time.Since(msg.queuedAt).Seconds())
+		// A stuck client must not keep the writer forever
+		c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		err := common.SendRawMessage(c.conn, msg.msg)
+		if err != nil {
+			c.logger.Errorf("Could not send message: %s", err)
+			// The reader of the connection removes the client
+			c.conn.Close()
+			return false
+		}
+		if msg.written != nil {
+			msg.written(time.Now())
+		}
+	}
+}
+
+// close flushes the outbound queue and closes the connection of the client.
+func (c *client) close() {
+	c.quitOnce.Do(func() { close(c.quitCh) })
+	<-c.writerDone
+	c.conn.Close()
+}
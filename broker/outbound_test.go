@@ -0,0 +1,172 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/evolutek/cellaserv3/testutil"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// popAll returns the content of the queued messages, in the order they are
+// sent.
+func popAll(q *outboundQueue) []string {
+	var msgs []string
+	for {
+		msg, _, ok := q.pop()
+		if !ok {
+			return msgs
+		}
+		msgs = append(msgs, string(msg.msg))
+	}
+}
+
+func TestOutboundQueueOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		expected []string
+		dropped  bool
+		overflow bool
+	}{
+		{OverflowDropOldest, []string{"2", "3"}, true, false},
+		{OverflowDropNewest, []string{"1", "2"}, true, false},
+		{OverflowDisconnect, []string{"1", "2"}, false, true},
+	} {
+		q := newOutboundQueue(2, tc.policy)
+		q.push([]byte("1"), common.PriorityNormal)
+		q.push([]byte("2"), common.PriorityNormal)
+		dropped, overflow := q.push([]byte("3"), common.PriorityNormal)
+		testutil.Equals(t, tc.dropped, dropped)
+		testutil.Equals(t, tc.overflow, overflow)
+		testutil.Equals(t, tc.expected, popAll(q))
+	}
+}
+
+func TestOutboundQueuePriority(t *testing.T) {
+	q := newOutboundQueue(10, OverflowDropOldest)
+	q.push([]byte("low1"), common.PriorityLow)
+	q.push([]byte("normal"), common.PriorityNormal)
+	q.push([]byte("high"), common.PriorityHigh)
+	q.push([]byte("low2"), common.PriorityLow)
+	testutil.Equals(t, []string{"high", "normal", "low1", "low2"}, popAll(q))
+}
+
+func TestOutboundQueuePriorityOverflow(t *testing.T) {
+	for _, policy := range []string{OverflowDropOldest, OverflowDropNewest} {
+		q := newOutboundQueue(2, policy)
+		q.push([]byte("high"), common.PriorityHigh)
+		q.push([]byte("low"), common.PriorityLow)
+
+		// Messages of lower priority are dropped first
+		dropped, _ := q.push([]byte("normal"), common.PriorityNormal)
+		testutil.Assert(t, dropped, "No message dropped")
+		dropped, _ = q.push([]byte("low"), common.PriorityLow)
+		testutil.Assert(t, dropped, "No message dropped")
+
+		testutil.Equals(t, []string{"high", "normal"}, popAll(q))
+	}
+}
+
+func TestOutboundQueueSlowClient(t *testing.T) {
+	options := Options{
+		OutboundQueueSize: 4,
+		WriteTimeout:      time.Hour,
+	}
+	brokerTestWithOptions(t, options, func(b *Broker) {
+		// The client never reads its connection
+		connBroker, connClient := net.Pipe()
+		c := b.newClient(connBroker)
+		defer func() {
+			connClient.Close()
+			c.close()
+		}()
+
+		// Sending does not block
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 10; i++ {
+				c.send([]byte("event"), common.PriorityNormal)
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Sending to a slow client blocked")
+		}
+
+		// One message is being written, the queue is full
+		dropped := promtestutil.ToFloat64(b.Monitoring.droppedMessages.WithLabelValues(c.id))
+		testutil.Assert(t, dropped >= 5, "Not enough dropped messages: %f", dropped)
+	})
+}
+
+func TestOutboundQueueWriteTimeout(t *testing.T) {
+	options := Options{WriteTimeout: 50 * time.Millisecond}
+	brokerTestWithOptions(t, options, func(b *Broker) {
+		connBroker, connClient := net.Pipe()
+		defer connClient.Close()
+		c := b.newClient(connBroker)
+
+		c.send([]byte("event"), common.PriorityNormal)
+
+		// The write times out and the connection is closed
+		select {
+		case <-c.writerDone:
+		case <-time.After(time.Second):
+			t.Fatal("The write did not time out")
+		}
+		_, err := connClient.Read(make([]byte, 1))
+		testutil.NotOk(t, err, "The connection is not closed")
+	})
+}
+
+func TestOutboundQueueRequestsNotDropped(t *testing.T) {
+	for _, policy := range []string{OverflowDropOldest, OverflowDropNewest} {
+		q := newOutboundQueue(2, policy)
+		push := func(msg string, kind messageKind) pushResult {
+			return q.pushMessage(queuedMessage{msg: []byte(msg), kind: kind}, common.PriorityNormal)
+		}
+		testutil.Equals(t, pushQueued, push("event", messageEvent))
+		testutil.Equals(t, pushQueued, push("request1", messageRequest))
+
+		// Requests and replies take the place of the events
+		testutil.Equals(t, pushReplaced, push("reply1", messageReply))
+		// The queue is full of requests and replies
+		testutil.Equals(t, pushDropped, push("event", messageEvent))
+		testutil.Equals(t, pushDropped, push("request2", messageRequest))
+		testutil.Equals(t, pushQueued, push("reply2", messageReply))
+
+		testutil.Equals(t, []string{"request1", "reply1", "reply2"}, popAll(q))
+	}
+}
+
+func TestOutboundQueueServiceOverloaded(t *testing.T) {
+	options := Options{
+		OutboundQueueSize: 2,
+		WriteTimeout:      time.Hour,
+	}
+	brokerTestWithOptions(t, options, func(b *Broker) {
+		// The service never reads its connection
+		connBroker, connService := net.Pipe()
+		service := b.newClient(connBroker)
+		defer func() {
+			connService.Close()
+			service.close()
+		}()
+		b.HandleRegister(service, &cellaserv.Register{Name: "date"})
+
+		connClient := testutil.Dial(t)
+		defer connClient.Close()
+		for i := 0; i < 4; i++ {
+			connClient.Write(testutil.MakeMessageRequestWithTimeout(t, "date", "", "time", nil, time.Hour))
+		}
+
+		// One request is being written, two are queued, the last one fails
+		rep := recvReply(t, connClient)
+		testutil.Equals(t, common.ReplyErrorServiceOverloaded, rep.GetError().GetType())
+	})
+}
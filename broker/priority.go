@@ -0,0 +1,60 @@
+package broker
+
+import (
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+// A priorityPattern is the priority of the names matching its pattern.
+type priorityPattern struct {
+	pattern  *common.TopicPattern
+	priority common.Priority
+}
+
+// parsePriorityPatterns parses the patterns of the priorities. Invalid
+// patterns are rejected.
+func parsePriorityPatterns(priorities map[string]common.Priority, kind string, logger common.Logger) []priorityPattern {
+	var patterns []priorityPattern
+	for pattern, priority := range priorities {
+		p, err := common.ParseTopicPattern(pattern)
+		if err != nil {
+			logger.Errorf("Invalid %s priority pattern %q: %s", kind, pattern, err)
+			continue
+		}
+		patterns = append(patterns, priorityPattern{pattern: p, priority: priority})
+	}
+	return patterns
+}
+
+// matchPriority returns the highest priority of the patterns matching name,
+// or the normal priority if none match.
+func matchPriority(patterns []priorityPattern, name string) common.Priority {
+	priority := common.PriorityUnset
+	for _, p := range patterns {
+		if p.priority > priority && p.pattern.Match(name) {
+			priority = p.priority
+		}
+	}
+	if priority == common.PriorityUnset {
+		return common.PriorityNormal
+	}
+	return priority
+}
+
+// requestPriority returns the priority of the request: the priority set by its
+// sender, or the one configured for its service.
+func (b *Broker) requestPriority(req *cellaserv.Request) common.Priority {
+	if p := common.GetPriority(req); p != common.PriorityUnset {
+		return p
+	}
+	return matchPriority(b.servicePriorities, req.ServiceName)
+}
+
+// publishPriority returns the priority of the event: the priority set by its
+// publisher, or the one configured for the event.
+func (b *Broker) publishPriority(pub *cellaserv.Publish) common.Priority {
+	if p := common.GetPriority(pub); p != common.PriorityUnset {
+		return p
+	}
+	return matchPriority(b.eventPriorities, pub.Event)
+}
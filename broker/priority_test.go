@@ -0,0 +1,38 @@
+package broker
+
+import (
+	"testing"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/evolutek/cellaserv3/testutil"
+)
+
+func TestPriority(t *testing.T) {
+	b := New(Options{
+		EventPriorities: map[string]common.Priority{
+			"estop*":    common.PriorityHigh,
+			"telemetry": common.PriorityLow,
+			// Invalid patterns are rejected
+			"other[": common.PriorityHigh,
+		},
+		ServicePriorities: map[string]common.Priority{
+			"motor": common.PriorityHigh,
+		},
+	}, common.NewLogger("test"))
+
+	testutil.Equals(t, common.PriorityHigh, b.publishPriority(&cellaserv.Publish{Event: "estop"}))
+	testutil.Equals(t, common.PriorityLow, b.publishPriority(&cellaserv.Publish{Event: "telemetry"}))
+	testutil.Equals(t, common.PriorityNormal, b.publishPriority(&cellaserv.Publish{Event: "other"}))
+	testutil.Equals(t, common.PriorityHigh, b.requestPriority(&cellaserv.Request{ServiceName: "motor"}))
+	testutil.Equals(t, common.PriorityNormal, b.requestPriority(&cellaserv.Request{ServiceName: "date"}))
+	testutil.Equals(t, 2, len(b.eventPriorities))
+
+	// The priority set by the sender is used
+	pub := &cellaserv.Publish{Event: "telemetry"}
+	common.SetPriority(pub, common.PriorityHigh)
+	testutil.Equals(t, common.PriorityHigh, b.publishPriority(pub))
+	req := &cellaserv.Request{ServiceName: "motor"}
+	common.SetPriority(req, common.PriorityLow)
+	testutil.Equals(t, common.PriorityLow, b.requestPriority(req))
+}
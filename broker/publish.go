@@ -2,10 +2,10 @@ package broker
 
 import (
 	"encoding/json"
-	"path/filepath"
 	"strings"
 
 	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
 	"github.com/golang/protobuf/proto"
 )
 
@@ -21,12 +21,22 @@ const (
 
 func (b *Broker) handlePublish(c *client, msgBytes []byte, pub *cellaserv.Publish) {
 	c.logger.Infof("Publishes event %q", pub.Event)
+	if !b.allowPublish(c, pub.Event) {
+		c.logger.Warnf("Publish rate limit of %q exceeded, event dropped", pub.Event)
+		b.Monitoring.publishLimited.WithLabelValues(c.id).Inc()
+		return
+	}
+	b.recordMessage(c, msgBytes)
 	b.doPublish(msgBytes, pub)
 }
 
 func (b *Broker) doPublish(msgBytes []byte, pub *cellaserv.Publish) {
-	// Set of subscribers for this publish
-	subs := make(map[*client]bool)
+	// Streamed events are sent with the stream lock held, see replayStream
+	if b.stream != nil && b.stream.matches(pub.Event) {
+		b.stream.mtx.Lock()
+		defer b.stream.mtx.Unlock()
+		msgBytes, pub = b.appendToStream(msgBytes, pub)
+	}
 
 	// Handle log publishes
 	if b.Options.PublishLoggingEnabled && strings.HasPrefix(pub.Event, "log.") {
@@ -35,27 +45,24 @@ func (b *Broker) doPublish(msgBytes []byte, pub *cellaserv.Publish) {
 		b.handleLoggingPublish(loggingEvent, data)
 	}
 
-	// Handle glob susbscribers
-	b.subscriberMapMtx.RLock()
-	for pattern, clients := range b.subscriberMatchMap {
-		matched, _ := filepath.Match(pattern, pub.Event)
-		if matched {
-			for _, client := range clients {
-				subs[client] = true
-			}
-		}
-	}
-	b.subscriberMapMtx.RUnlock()
+	b.retain(msgBytes, pub)
 
-	// Add exact matches
-	for _, client := range b.subscriberMap[pub.Event] {
-		subs[client] = true
+	priority := b.publishPriority(pub)
+	data := common.NewFilterData(pub.Data)
+	for _, s := range b.subscriptions.match(pub.Event) {
+		if !s.accepts(data) {
+			continue
+		}
+		s.client.logger.Debugf("Receives event %q", pub.Event)
+		if s.limiter != nil {
+			s.limiter.send(pub.Event, msgBytes, priority)
+		} else {
+			s.client.send(msgBytes, priority)
+		}
 	}
 
-	for c := range subs {
-		c.logger.Debugf("Receives event %q", pub.Event)
-		b.sendRawMessage(c.conn, msgBytes)
-	}
+	b.deliverQueueGroups(pub, priority)
+	b.deliverDurable(pub, priority)
 }
 
 // cellaservPublishBytes sends a publish message from cellaserv
@@ -83,6 +90,20 @@ func (b *Broker) cellaservPublishBytes(event string, data []byte) {
 	b.doPublish(msgBytes, pub)
 }
 
+// cellaservEvent is an event published by cellaserv once the locks held when
+// it is produced are released. Publishing may take the stream lock, which is
+// taken before the client locks, see replayStream.
+type cellaservEvent struct {
+	event string
+	data  []byte
+}
+
+func (b *Broker) cellaservPublishEvents(events []cellaservEvent) {
+	for _, e := range events {
+		b.cellaservPublishBytes(e.event, e.data)
+	}
+}
+
 func (b *Broker) cellaservPublish(event string, obj interface{}) {
 	pubData, err := json.Marshal(obj)
 	if err != nil {
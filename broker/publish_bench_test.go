@@ -0,0 +1,176 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+// Setup of the benchmarks: robots publishing telemetry topics such as
+// "telemetry.pal.motor3.speed", and clients subscribed to exact topics and
+// to glob patterns.
+const (
+	benchRobots        = 3
+	benchDevices       = 10
+	benchMeasures      = 10
+	benchGlobPatterns  = 50
+	benchExactPatterns = 100
+)
+
+func benchEvents() []string {
+	var events []string
+	for r := 0; r < benchRobots; r++ {
+		for d := 0; d < benchDevices; d++ {
+			for m := 0; m < benchMeasures; m++ {
+				events = append(events, fmt.Sprintf("telemetry.robot%d.device%d.measure%d", r, d, m))
+			}
+		}
+	}
+	return events
+}
+
+func benchPatterns() []string {
+	var patterns []string
+	for i := 0; i < benchGlobPatterns; i++ {
+		switch i % 5 {
+		case 0:
+			patterns = append(patterns, fmt.Sprintf("telemetry.*.device%d.*", i%benchDevices))
+		case 1:
+			patterns = append(patterns, fmt.Sprintf("telemetry.robot%d.**", i%benchRobots))
+		case 2:
+			patterns = append(patterns, fmt.Sprintf("**.measure%d", i%benchMeasures))
+		case 3:
+			patterns = append(patterns, fmt.Sprintf("log.client%d.*", i))
+		case 4:
+			patterns = append(patterns, fmt.Sprintf("telemetry.robot[0-%d].device%d.measure*", i%benchRobots, i%benchDevices))
+		}
+	}
+	events := benchEvents()
+	for i := 0; i < benchExactPatterns; i++ {
+		patterns = append(patterns, events[(i*7)%len(events)])
+	}
+	return patterns
+}
+
+// linearSubscriptions is the subscription store used before the trie: exact
+// names in a map, and patterns matched one by one on each publish.
+type linearSubscriptions struct {
+	exact    map[string][]*client
+	patterns map[string][]*client
+}
+
+func (l *linearSubscriptions) match(event string) map[*client]bool {
+	subs := make(map[*client]bool)
+	for pattern, clients := range l.patterns {
+		if matched, _ := common.MatchTopic(pattern, event); matched {
+			for _, c := range clients {
+				subs[c] = true
+			}
+		}
+	}
+	for _, c := range l.exact[event] {
+		subs[c] = true
+	}
+	return subs
+}
+
+func BenchmarkSubscriptionsLinear(b *testing.B) {
+	l := &linearSubscriptions{
+		exact:    make(map[string][]*client),
+		patterns: make(map[string][]*client),
+	}
+	for i, pattern := range benchPatterns() {
+		c := &client{id: fmt.Sprint(i)}
+		if common.IsTopicPattern(pattern) {
+			l.patterns[pattern] = append(l.patterns[pattern], c)
+		} else {
+			l.exact[pattern] = append(l.exact[pattern], c)
+		}
+	}
+	events := benchEvents()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.match(events[i%len(events)])
+	}
+}
+
+func newBenchSubscriptionIndex(b *testing.B) *subscriptionIndex {
+	idx := newSubscriptionIndex()
+	for i, pattern := range benchPatterns() {
+		p, err := common.ParseTopicPattern(pattern)
+		if err != nil {
+			b.Fatal(err)
+		}
+		idx.add(p, &client{id: fmt.Sprint(i)}, subscribeOptions{})
+	}
+	return idx
+}
+
+func BenchmarkSubscriptionsTrie(b *testing.B) {
+	idx := newBenchSubscriptionIndex(b)
+	events := benchEvents()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.match(events[i%len(events)])
+	}
+}
+
+func BenchmarkSubscriptionsTrieNoCache(b *testing.B) {
+	idx := newBenchSubscriptionIndex(b)
+	events := benchEvents()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.match(events[i%len(events)])
+		idx.invalidate()
+	}
+}
+
+func BenchmarkDoPublish(b *testing.B) {
+	broker := New(Options{}, common.NewLogger("bench"))
+	var clients []*client
+	for i, pattern := range benchPatterns() {
+		p, err := common.ParseTopicPattern(pattern)
+		if err != nil {
+			b.Fatal(err)
+		}
+		c := &client{
+			id:              fmt.Sprint(i),
+			logger:          broker.logger,
+			queue:           newOutboundQueue(1024, OverflowDropOldest),
+			droppedMessages: broker.Monitoring.droppedMessages.WithLabelValues(fmt.Sprint(i)),
+		}
+		broker.subscriptions.add(p, c, subscribeOptions{})
+		clients = append(clients, c)
+	}
+
+	var pubs []*cellaserv.Publish
+	var msgs [][]byte
+	for _, event := range benchEvents() {
+		pub := &cellaserv.Publish{Event: event}
+		msgBytes, err := common.MarshalMessage(cellaserv.Message_Publish, pub)
+		if err != nil {
+			b.Fatal(err)
+		}
+		pubs = append(pubs, pub)
+		msgs = append(msgs, msgBytes)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := i % len(pubs)
+		broker.doPublish(msgs[j], pubs[j])
+		if j == len(pubs)-1 {
+			// Empty the queues, as the clients would
+			b.StopTimer()
+			for _, c := range clients {
+				popAll(c.queue)
+			}
+			b.StartTimer()
+		}
+	}
+}
@@ -56,6 +56,12 @@ func (b *Broker) publishLoggingSetup(event string) (*os.File, error) {
 }
 
 func (b *Broker) handleLoggingPublish(event string, data string) {
+	b.publishLoggingMtx.RLock()
+	defer b.publishLoggingMtx.RUnlock()
+	if b.publishLoggingClosed {
+		return
+	}
+
 	var logger *os.File
 	loggerIface, ok := b.publishLoggingLoggers.Load(event)
 	if ok {
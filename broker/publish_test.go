@@ -51,7 +51,7 @@ func TestPublishPattern(t *testing.T) {
 		conn := testutil.Dial(t)
 		defer conn.Close()
 
-		const pattern = "test*"
+		const pattern = "test.*"
 		conn.Write(testutil.MakeMessageSubscribe(t, pattern))
 		time.Sleep(50 * time.Millisecond)
 		const topic = "test.foobarlol"
@@ -0,0 +1,170 @@
+package broker
+
+import (
+	"math/rand"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/golang/protobuf/proto"
+)
+
+type queueGroupKey struct {
+	pattern string
+	name    string
+}
+
+// A queueGroup is a set of clients subscribed to a pattern under the same
+// name. Each event matching the pattern is sent to a single member of the
+// group.
+type queueGroup struct {
+	name    string
+	pattern *common.TopicPattern
+	policy  string
+	// Protected by the queue groups lock of the broker
+	members []*client
+	next    int // next member, for round robin
+}
+
+// pick returns the member of the group that receives the next event. The
+// queue groups lock must be held for writing.
+func (g *queueGroup) pick() *client {
+	switch len(g.members) {
+	case 0:
+		return nil
+	case 1:
+		return g.members[0]
+	}
+
+	switch g.policy {
+	case api.LoadBalancingLeastPending:
+		// The member with the fewest messages waiting to be written
+		least := g.members[0]
+		leastLen := least.queue.len()
+		for _, c := range g.members[1:] {
+			if l := c.queue.len(); l < leastLen {
+				least, leastLen = c, l
+			}
+		}
+		return least
+	case api.LoadBalancingRandom:
+		return g.members[rand.Intn(len(g.members))]
+	default:
+		// Members may have left since the last pick
+		c := g.members[g.next%len(g.members)]
+		g.next = (g.next + 1) % len(g.members)
+		return c
+	}
+}
+
+// handleQueueSubscribe adds the client to the queue group of the pattern.
+func (b *Broker) handleQueueSubscribe(c *client, name string, policy string, pattern *common.TopicPattern) {
+	if policy != "" && !isValidLoadBalancing(policy) {
+		c.logger.Warnf("Unknown queue group policy %q, using %q", policy, api.LoadBalancingRoundRobin)
+		policy = api.LoadBalancingRoundRobin
+	}
+	c.logger.Infof("Subscribes to event %q in queue group %q", pattern, name)
+
+	b.queueGroupsMtx.Lock()
+	defer b.queueGroupsMtx.Unlock()
+
+	key := queueGroupKey{pattern.String(), name}
+	g, ok := b.queueGroups[key]
+	if !ok {
+		if policy == "" {
+			policy = api.LoadBalancingRoundRobin
+		}
+		g = &queueGroup{name: name, pattern: pattern, policy: policy}
+		b.queueGroups[key] = g
+	} else if policy != "" && policy != g.policy {
+		c.logger.Warnf("Queue group %q uses policy %q, not %q", name, g.policy, policy)
+	}
+	for _, member := range g.members {
+		if member == c {
+			c.logger.Infof("Client already in queue group %q", name)
+			return
+		}
+	}
+	g.members = append(g.members, c)
+}
+
+// handleQueueUnsubscribe removes the client from the queue group of the
+// pattern.
+func (b *Broker) handleQueueUnsubscribe(c *client, name string, pattern string) {
+	b.queueGroupsMtx.Lock()
+	defer b.queueGroupsMtx.Unlock()
+
+	key := queueGroupKey{pattern, name}
+	g, ok := b.queueGroups[key]
+	if !ok || !b.removeQueueMember(key, g, c) {
+		c.logger.Warnf("Client is not in queue group %q of %q", name, pattern)
+		return
+	}
+	c.logger.Infof("Unsubscribes from event %q in queue group %q", pattern, name)
+}
+
+// removeQueueMember removes the client from the group, and the group if it
+// becomes empty. Returns whether the client was a member of the group. The
+// queue groups lock must be held for writing.
+func (b *Broker) removeQueueMember(key queueGroupKey, g *queueGroup, c *client) bool {
+	for i, member := range g.members {
+		if member == c {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			if len(g.members) == 0 {
+				delete(b.queueGroups, key)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// leaveQueueGroups removes the client from all its queue groups.
+func (b *Broker) leaveQueueGroups(c *client) {
+	b.queueGroupsMtx.Lock()
+	defer b.queueGroupsMtx.Unlock()
+	for key, g := range b.queueGroups {
+		b.removeQueueMember(key, g, c)
+	}
+}
+
+// deliverQueueGroups sends the event to a member of each queue group whose
+// pattern matches.
+func (b *Broker) deliverQueueGroups(pub *cellaserv.Publish, priority common.Priority) {
+	b.queueGroupsMtx.Lock()
+	defer b.queueGroupsMtx.Unlock()
+
+	for _, g := range b.queueGroups {
+		if !g.pattern.Match(pub.Event) {
+			continue
+		}
+		c := g.pick()
+		// The client tells the event apart from the ones of its other
+		// subscriptions with the group name
+		delivered := proto.Clone(pub).(*cellaserv.Publish)
+		common.SetPublishQueue(delivered, g.name)
+		msgBytes, err := common.MarshalMessage(cellaserv.Message_Publish, delivered)
+		if err != nil {
+			b.logger.Errorf("Could not marshal queue group event: %s", err)
+			continue
+		}
+		c.logger.Debugf("Receives event %q in queue group %q", pub.Event, g.name)
+		c.send(msgBytes, priority)
+	}
+}
+
+// queueGroupsJSON returns the queue groups of each pattern.
+func (b *Broker) queueGroupsJSON() map[string][]api.QueueGroupJSON {
+	b.queueGroupsMtx.RLock()
+	defer b.queueGroupsMtx.RUnlock()
+
+	groups := make(map[string][]api.QueueGroupJSON)
+	for key, g := range b.queueGroups {
+		gJSON := api.QueueGroupJSON{Name: g.name, Policy: g.policy}
+		for _, c := range g.members {
+			gJSON.Members = append(gJSON.Members, c.id)
+		}
+		groups[key.pattern] = append(groups[key.pattern], gJSON)
+	}
+	return groups
+}
@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/evolutek/cellaserv3/testutil"
+	"github.com/golang/protobuf/proto"
+)
+
+// recvQueueEvent receives a publish, and returns its event and queue group.
+func recvQueueEvent(t *testing.T, conn net.Conn) (string, string) {
+	t.Helper()
+	msg := testutil.RecvMessage(t, conn)
+	testutil.MsgTypeIs(t, msg, cellaserv.Message_Publish)
+	pub := &cellaserv.Publish{}
+	testutil.Ok(t, proto.Unmarshal(msg.GetContent(), pub))
+	group, _ := common.PublishQueue(pub)
+	return pub.GetEvent(), group
+}
+
+func TestQueueGroup(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		worker1 := testutil.Dial(t)
+		defer worker1.Close()
+		worker2 := testutil.Dial(t)
+		defer worker2.Close()
+		monitor := testutil.Dial(t)
+		defer monitor.Close()
+
+		worker1.Write(testutil.MakeMessageSubscribeQueue(t, "vision", api.LoadBalancingRoundRobin, "frame.*"))
+		worker2.Write(testutil.MakeMessageSubscribeQueue(t, "vision", "", "frame.*"))
+		monitor.Write(testutil.MakeMessageSubscribe(t, "frame.*"))
+		time.Sleep(50 * time.Millisecond)
+
+		events := b.GetEventsJSON()
+		testutil.Equals(t, 1, len(events))
+		testutil.Equals(t, 1, len(events[0].QueueGroups))
+		group := events[0].QueueGroups[0]
+		testutil.Equals(t, "vision", group.Name)
+		testutil.Equals(t, api.LoadBalancingRoundRobin, group.Policy)
+		testutil.Equals(t, 2, len(group.Members))
+
+		pub := testutil.Dial(t)
+		defer pub.Close()
+		for i := 0; i < 4; i++ {
+			pub.Write(testutil.MakeMessagePublish(t, "frame.front"))
+		}
+
+		// Each member of the group receives half of the events, the
+		// other subscribers all of them
+		for _, worker := range []net.Conn{worker1, worker2} {
+			for i := 0; i < 2; i++ {
+				event, group := recvQueueEvent(t, worker)
+				testutil.Equals(t, "frame.front", event)
+				testutil.Equals(t, "vision", group)
+			}
+		}
+		for i := 0; i < 4; i++ {
+			_, group := recvQueueEvent(t, monitor)
+			testutil.Equals(t, "", group)
+		}
+
+		// The remaining member receives all the events
+		worker1.Close()
+		time.Sleep(50 * time.Millisecond)
+		pub.Write(testutil.MakeMessagePublish(t, "frame.back"))
+		pub.Write(testutil.MakeMessagePublish(t, "frame.back"))
+		for i := 0; i < 2; i++ {
+			event, _ := recvQueueEvent(t, worker2)
+			testutil.Equals(t, "frame.back", event)
+		}
+
+		// Empty groups are removed
+		worker2.Write(testutil.MakeMessageUnsubscribeQueue(t, "vision", "frame.*"))
+		time.Sleep(50 * time.Millisecond)
+		events = b.GetEventsJSON()
+		testutil.Equals(t, 1, len(events))
+		testutil.Equals(t, 0, len(events[0].QueueGroups))
+	})
+}
+
+func TestQueueGroupRoundRobin(t *testing.T) {
+	c1 := &client{}
+	c2 := &client{}
+	c3 := &client{}
+	g := &queueGroup{policy: api.LoadBalancingRoundRobin, members: []*client{c1, c2, c3}}
+	// The first event goes to the first member to join
+	for _, c := range []*client{c1, c2, c3, c1} {
+		testutil.Assert(t, g.pick() == c, "The members should be picked in the order they joined")
+	}
+}
+
+func TestQueueGroupLeastPending(t *testing.T) {
+	busy := &client{queue: newOutboundQueue(16, OverflowDropOldest)}
+	idle := &client{queue: newOutboundQueue(16, OverflowDropOldest)}
+	busy.queue.push([]byte("frame"), common.PriorityNormal)
+
+	g := &queueGroup{policy: api.LoadBalancingLeastPending, members: []*client{busy, idle}}
+	testutil.Assert(t, g.pick() == idle, "The idle member should be picked")
+	idle.queue.push([]byte("frame"), common.PriorityNormal)
+	idle.queue.push([]byte("frame"), common.PriorityNormal)
+	testutil.Assert(t, g.pick() == busy, "The least busy member should be picked")
+}
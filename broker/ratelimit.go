@@ -0,0 +1,208 @@
+package broker
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A rateLimiter sends at most one event of each name per interval to a
+// subscriber. The other events are dropped, or when coalescing, the last one
+// is sent at the end of the interval.
+type rateLimiter struct {
+	client   *client
+	interval time.Duration
+	coalesce bool
+	// Events not sent to the client
+	limited prometheus.Counter
+
+	mtx     sync.Mutex
+	events  map[string]*limitedEvent
+	sweptAt time.Time
+	stopped bool
+}
+
+// Interval at which the idle rate limits are removed
+const rateLimitSweepInterval = time.Minute
+
+type limitedEvent struct {
+	// Time the last event was sent
+	sentAt time.Time
+	// Last event received during the interval, when coalescing
+	pending         []byte
+	pendingPriority common.Priority
+	timer           *time.Timer
+}
+
+func newRateLimiter(c *client, interval time.Duration, mode string, limited *prometheus.CounterVec) *rateLimiter {
+	if mode != api.RateLimitCoalesce {
+		mode = api.RateLimitSample
+	}
+	return &rateLimiter{
+		client:   c,
+		interval: interval,
+		coalesce: mode == api.RateLimitCoalesce,
+		limited:  limited.WithLabelValues(c.id, mode),
+		events:   make(map[string]*limitedEvent),
+	}
+}
+
+// send sends the event to the client, unless an event of the same name was
+// sent less than an interval ago.
+func (l *rateLimiter) send(event string, msg []byte, priority common.Priority) {
+	now := time.Now()
+	l.mtx.Lock()
+	l.sweep(now)
+	e, ok := l.events[event]
+	if !ok {
+		e = &limitedEvent{}
+		l.events[event] = e
+	}
+	if e.timer == nil && now.Sub(e.sentAt) >= l.interval {
+		e.sentAt = now
+		l.mtx.Unlock()
+		l.client.send(msg, priority)
+		return
+	}
+	defer l.mtx.Unlock()
+
+	if !l.coalesce {
+		l.limited.Inc()
+		return
+	}
+	if e.pending != nil {
+		l.limited.Inc()
+	}
+	e.pending = msg
+	e.pendingPriority = priority
+	if e.timer == nil && !l.stopped {
+		e.timer = time.AfterFunc(e.sentAt.Add(l.interval).Sub(now), func() {
+			l.flush(e)
+		})
+	}
+}
+
+// sweep removes the events which are not limited anymore, they would be sent
+// right away like events never received. Called with the lock held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.sweptAt) < rateLimitSweepInterval {
+		return
+	}
+	l.sweptAt = now
+	for event, e := range l.events {
+		if e.timer == nil && now.Sub(e.sentAt) >= l.interval {
+			delete(l.events, event)
+		}
+	}
+}
+
+// flush sends the last event received during the interval.
+func (l *rateLimiter) flush(e *limitedEvent) {
+	l.mtx.Lock()
+	msg, priority := e.pending, e.pendingPriority
+	e.pending = nil
+	e.timer = nil
+	e.sentAt = time.Now()
+	stopped := l.stopped
+	l.mtx.Unlock()
+
+	if msg != nil && !stopped {
+		l.client.send(msg, priority)
+	}
+}
+
+// stop drops the pending events. Called when the subscription is removed.
+func (l *rateLimiter) stop() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.stopped = true
+	for _, e := range l.events {
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+	}
+}
+
+// A tokenBucket limits the rate of the publishes of a client. Its burst is
+// one second of events.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow returns whether an event can be published at the rate.
+func (t *tokenBucket) allow(rate float64, now time.Time) bool {
+	burst := math.Max(1, rate)
+	t.tokens = math.Min(burst, t.tokens+now.Sub(t.last).Seconds()*rate)
+	t.last = now
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// full returns whether the bucket is full at the rate, it then allows the
+// same events as a new bucket.
+func (t *tokenBucket) full(rate float64, now time.Time) bool {
+	return t.tokens+now.Sub(t.last).Seconds()*rate >= math.Max(1, rate)
+}
+
+// A publishRateLimit is the maximum rate of the events matching its pattern.
+type publishRateLimit struct {
+	pattern *common.TopicPattern
+	rate    float64
+}
+
+// publishRateLimit returns the lowest publish rate limit of the patterns
+// matching the event, if any.
+func (b *Broker) publishRateLimit(event string) (float64, bool) {
+	rate, limited := math.Inf(1), false
+	for _, l := range b.publishRateLimits {
+		if l.rate < rate && l.pattern.Match(event) {
+			rate, limited = l.rate, true
+		}
+	}
+	return rate, limited
+}
+
+// allowPublish returns whether the client can publish the event without
+// exceeding its rate limit.
+func (b *Broker) allowPublish(c *client, event string) bool {
+	rate, limited := b.publishRateLimit(event)
+	if !limited {
+		return true
+	}
+
+	now := time.Now()
+	c.publishBucketsMtx.Lock()
+	defer c.publishBucketsMtx.Unlock()
+	b.sweepPublishBuckets(c, now)
+	bucket, ok := c.publishBuckets[event]
+	if !ok {
+		if c.publishBuckets == nil {
+			c.publishBuckets = make(map[string]*tokenBucket)
+		}
+		bucket = &tokenBucket{tokens: math.Max(1, rate), last: now}
+		c.publishBuckets[event] = bucket
+	}
+	return bucket.allow(rate, now)
+}
+
+// sweepPublishBuckets removes the full buckets of the client, which are
+// created again when needed. Called with the lock of the buckets held.
+func (b *Broker) sweepPublishBuckets(c *client, now time.Time) {
+	if now.Sub(c.publishBucketsSweptAt) < rateLimitSweepInterval {
+		return
+	}
+	c.publishBucketsSweptAt = now
+	for event, bucket := range c.publishBuckets {
+		if rate, limited := b.publishRateLimit(event); !limited || bucket.full(rate, now) {
+			delete(c.publishBuckets, event)
+		}
+	}
+}
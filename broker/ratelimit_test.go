@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/evolutek/cellaserv3/testutil"
+	"github.com/golang/protobuf/proto"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// recvData receives a publish and returns its data.
+func recvData(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	msg := testutil.RecvMessage(t, conn)
+	testutil.MsgTypeIs(t, msg, cellaserv.Message_Publish)
+	pub := &cellaserv.Publish{}
+	testutil.Ok(t, proto.Unmarshal(msg.GetContent(), pub))
+	return string(pub.GetData())
+}
+
+// publishCount publishes the numbers from 1 to n as the data of the event.
+func publishCount(t *testing.T, conn net.Conn, event string, n int) {
+	for i := 1; i <= n; i++ {
+		conn.Write(testutil.MakeMessagePublishData(t, event, []byte(fmt.Sprint(i))))
+	}
+}
+
+func TestSubscribeRateSample(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		sub := testutil.Dial(t)
+		defer sub.Close()
+		sub.Write(testutil.MakeMessageSubscribeRate(t, "odometry", 200*time.Millisecond, api.RateLimitSample))
+		time.Sleep(50 * time.Millisecond)
+
+		pub := testutil.Dial(t)
+		defer pub.Close()
+		publishCount(t, pub, "odometry", 5)
+		testutil.Equals(t, "1", recvData(t, sub))
+
+		// The next event is sent after the interval
+		time.Sleep(250 * time.Millisecond)
+		pub.Write(testutil.MakeMessagePublishData(t, "odometry", []byte("6")))
+		testutil.Equals(t, "6", recvData(t, sub))
+
+		dropped := promtestutil.ToFloat64(b.Monitoring.rateLimited.WithLabelValues(sub.LocalAddr().String(), api.RateLimitSample))
+		testutil.Equals(t, 4.0, dropped)
+	})
+}
+
+func TestSubscribeRateCoalesce(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		sub := testutil.Dial(t)
+		defer sub.Close()
+		sub.Write(testutil.MakeMessageSubscribeRate(t, "odometry", 100*time.Millisecond, api.RateLimitCoalesce))
+		time.Sleep(50 * time.Millisecond)
+
+		pub := testutil.Dial(t)
+		defer pub.Close()
+		publishCount(t, pub, "odometry", 5)
+
+		// The first event is sent, then the last one of the interval
+		testutil.Equals(t, "1", recvData(t, sub))
+		start := time.Now()
+		testutil.Equals(t, "5", recvData(t, sub))
+		testutil.Assert(t, time.Since(start) > 50*time.Millisecond, "Coalesced event should be sent at the end of the interval")
+	})
+}
+
+func TestPublishRateLimit(t *testing.T) {
+	options := Options{PublishRateLimits: map[string]float64{"odometry": 2}}
+	brokerTestWithOptions(t, options, func(b *Broker) {
+		sub := testutil.Dial(t)
+		defer sub.Close()
+		sub.Write(testutil.MakeMessageSubscribe(t, "odometry"))
+		sub.Write(testutil.MakeMessageSubscribe(t, "other"))
+		time.Sleep(50 * time.Millisecond)
+
+		pub := testutil.Dial(t)
+		defer pub.Close()
+		publishCount(t, pub, "odometry", 5)
+		pub.Write(testutil.MakeMessagePublishData(t, "other", []byte("other")))
+
+		// The burst of one second of events goes through, events not
+		// rate limited are not affected
+		testutil.Equals(t, "1", recvData(t, sub))
+		testutil.Equals(t, "2", recvData(t, sub))
+		testutil.Equals(t, "other", recvData(t, sub))
+		testutil.Equals(t, 3.0, promtestutil.ToFloat64(b.Monitoring.publishLimited.WithLabelValues(pub.LocalAddr().String())))
+	})
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := &tokenBucket{tokens: 1, last: now}
+	testutil.Assert(t, bucket.allow(1, now), "First event should be allowed")
+	testutil.Assert(t, !bucket.allow(1, now.Add(500*time.Millisecond)), "Event should be limited")
+	testutil.Assert(t, bucket.allow(1, now.Add(1100*time.Millisecond)), "Event should be allowed after a second")
+	testutil.Assert(t, !bucket.full(1, now.Add(1500*time.Millisecond)), "Bucket should not be full")
+	testutil.Assert(t, bucket.full(1, now.Add(2100*time.Millisecond)), "Bucket should be full")
+}
+
+func TestRateLimitSweep(t *testing.T) {
+	now := time.Now()
+	l := &rateLimiter{
+		interval: time.Second,
+		events: map[string]*limitedEvent{
+			"idle":    {sentAt: now.Add(-2 * time.Second)},
+			"limited": {sentAt: now.Add(-500 * time.Millisecond)},
+		},
+	}
+	l.sweep(now)
+	_, ok := l.events["idle"]
+	testutil.Assert(t, !ok, "Idle event should be removed")
+	_, ok = l.events["limited"]
+	testutil.Assert(t, ok, "Limited event should be kept")
+
+	options := Options{PublishRateLimits: map[string]float64{"odometry.*": 1}}
+	b := New(options, common.NewLogger("test"))
+	c := &client{publishBuckets: map[string]*tokenBucket{
+		"odometry.idle":    {tokens: 0, last: now.Add(-2 * time.Second)},
+		"odometry.limited": {tokens: 0, last: now},
+	}}
+	b.sweepPublishBuckets(c, now)
+	_, ok = c.publishBuckets["odometry.idle"]
+	testutil.Assert(t, !ok, "Full bucket should be removed")
+	_, ok = c.publishBuckets["odometry.limited"]
+	testutil.Assert(t, ok, "Bucket not full should be kept")
+}
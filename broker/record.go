@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/golang/protobuf/proto"
+)
+
+// Interval between the writes of the buffered records to the capture file
+const recordFlushInterval = time.Second
+
+var errNotRecording = errors.New("Not recording")
+
+// recording is a capture file of the messages routed by the broker.
+type recording struct {
+	path      string
+	file      *os.File
+	w         *common.CaptureWriter
+	lastFlush time.Time
+}
+
+// StartRecording records the requests, replies, publishes and registrations
+// routed by the broker in a new capture file. The current recording, if any,
+// is stopped.
+func (b *Broker) StartRecording(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w, err := common.NewCaptureWriter(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	b.recordingMtx.Lock()
+	defer b.recordingMtx.Unlock()
+	if b.recording != nil {
+		b.closeRecording()
+	}
+	b.recording = &recording{path: path, file: file, w: w, lastFlush: time.Now()}
+	b.logger.Infof("Recording to %s", path)
+	return nil
+}
+
+// StopRecording stops the current recording. Returns the path of its capture
+// file.
+func (b *Broker) StopRecording() (string, error) {
+	b.recordingMtx.Lock()
+	defer b.recordingMtx.Unlock()
+	if b.recording == nil {
+		return "", errNotRecording
+	}
+	path := b.recording.path
+	return path, b.closeRecording()
+}
+
+// Recording returns the path of the current capture file, if recording.
+func (b *Broker) Recording() (string, bool) {
+	b.recordingMtx.Lock()
+	defer b.recordingMtx.Unlock()
+	if b.recording == nil {
+		return "", false
+	}
+	return b.recording.path, true
+}
+
+// closeRecording flushes and closes the capture file. The recording lock must
+// be held.
+func (b *Broker) closeRecording() error {
+	r := b.recording
+	b.recording = nil
+	err := r.w.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		b.logger.Errorf("Could not close capture file %s: %s", r.path, err)
+		return err
+	}
+	b.logger.Infof("Recording to %s stopped", r.path)
+	return nil
+}
+
+// recordMessage appends the message to the capture file, if recording. The
+// client is nil for the messages sent by the broker itself.
+func (b *Broker) recordMessage(c *client, msgBytes []byte) {
+	b.recordingMtx.Lock()
+	defer b.recordingMtx.Unlock()
+	r := b.recording
+	if r == nil {
+		return
+	}
+
+	clientId := ""
+	if c != nil {
+		clientId = c.id
+	}
+	now := time.Now()
+	err := r.w.WriteMessage(now, clientId, msgBytes)
+	if err == nil && now.Sub(r.lastFlush) >= recordFlushInterval {
+		r.lastFlush = now
+		err = r.w.Flush()
+	}
+	if err != nil {
+		b.logger.Errorf("Could not record message, recording stopped: %s", err)
+		b.closeRecording()
+	}
+}
+
+// record appends the message to the capture file, if recording.
+func (b *Broker) record(c *client, msgType cellaserv.Message_MessageType, content proto.Message) {
+	if _, ok := b.Recording(); !ok {
+		return
+	}
+	msgBytes, err := common.MarshalMessage(msgType, content)
+	if err != nil {
+		b.logger.Errorf("Could not marshal recorded message: %s", err)
+		return
+	}
+	b.recordMessage(c, msgBytes)
+}
@@ -0,0 +1,100 @@
+package broker
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/evolutek/cellaserv3/testutil"
+	"github.com/golang/protobuf/proto"
+)
+
+func readCapture(t *testing.T, capturePath string) []*common.CaptureRecord {
+	file, err := os.Open(capturePath)
+	testutil.Ok(t, err)
+	defer file.Close()
+	r, err := common.NewCaptureReader(file)
+	testutil.Ok(t, err)
+	var records []*common.CaptureRecord
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return records
+		}
+		testutil.Ok(t, err)
+		records = append(records, rec)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	capturePath := path.Join(t.TempDir(), "match.cap")
+	options := Options{RecordPath: capturePath}
+	brokerTestWithOptions(t, options, func(b *Broker) {
+		connService := testutil.Dial(t)
+		defer connService.Close()
+		connClient := testutil.Dial(t)
+		defer connClient.Close()
+		serviceId := connService.LocalAddr().String()
+		clientId := connClient.LocalAddr().String()
+
+		connService.Write(testutil.MakeMessageRegister(t, "date", ""))
+		time.Sleep(50 * time.Millisecond)
+		connClient.Write(testutil.MakeMessageRequest(t, "date", "", "time", []byte("{}")))
+		req := recvRequest(t, connService)
+		connService.Write(testutil.MakeMessageReply(t, req.GetId(), []byte("42")))
+		recvReply(t, connClient)
+		connClient.Write(testutil.MakeMessageRequestWithTimeout(t, "date", "", "time", nil, 50*time.Millisecond))
+		recvRequest(t, connService)
+		recvReply(t, connClient)
+		connClient.Write(testutil.MakeMessagePublishData(t, "match.start", []byte("1")))
+		time.Sleep(50 * time.Millisecond)
+
+		recorded, ok := b.Recording()
+		testutil.Assert(t, ok, "Broker should be recording")
+		testutil.Equals(t, capturePath, recorded)
+		stopped, err := b.StopRecording()
+		testutil.Ok(t, err)
+		testutil.Equals(t, capturePath, stopped)
+		_, err = b.StopRecording()
+		testutil.Equals(t, errNotRecording, err)
+
+		// Messages are not recorded anymore
+		connClient.Write(testutil.MakeMessagePublish(t, "match.end"))
+		time.Sleep(50 * time.Millisecond)
+
+		records := readCapture(t, capturePath)
+		expected := []struct {
+			msgType cellaserv.Message_MessageType
+			client  string
+		}{
+			{cellaserv.Message_Register, serviceId},
+			{cellaserv.Message_Request, clientId},
+			{cellaserv.Message_Reply, serviceId},
+			{cellaserv.Message_Request, clientId},
+			{cellaserv.Message_Reply, ""},
+			{cellaserv.Message_Publish, clientId},
+		}
+		testutil.Equals(t, len(expected), len(records))
+		for i, rec := range records {
+			testutil.Equals(t, expected[i].msgType, rec.Message.GetType())
+			testutil.Equals(t, expected[i].client, rec.Client)
+			if i > 0 {
+				testutil.Assert(t, !rec.Time.Before(records[i-1].Time), "Records should be in order")
+			}
+		}
+
+		// Replies are recorded with the id of their request
+		recordedReq := &cellaserv.Request{}
+		testutil.Ok(t, proto.Unmarshal(records[1].Message.GetContent(), recordedReq))
+		recordedRep := &cellaserv.Reply{}
+		testutil.Ok(t, proto.Unmarshal(records[2].Message.GetContent(), recordedRep))
+		testutil.Equals(t, "time", recordedReq.GetMethod())
+		testutil.Equals(t, req.GetId(), recordedReq.GetId())
+		testutil.Equals(t, req.GetId(), recordedRep.GetId())
+		testutil.Equals(t, []byte("42"), recordedRep.GetData())
+	})
+}
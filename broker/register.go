@@ -4,13 +4,48 @@ import (
 	"encoding/json"
 
 	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
 )
 
+func isValidLoadBalancing(policy string) bool {
+	switch policy {
+	case api.LoadBalancingRoundRobin, api.LoadBalancingLeastPending, api.LoadBalancingRandom:
+		return true
+	}
+	return false
+}
+
+// Remove the service from the list of services of its client. The client's
+// mutex must be held by caller.
+func removeServiceFromClient(s *service) {
+	c := s.client
+	for i, ss := range c.services {
+		if ss == s {
+			c.services[i] = c.services[len(c.services)-1]
+			c.services = c.services[:len(c.services)-1]
+			break
+		}
+	}
+}
+
 // Add service to services map
 func (b *Broker) HandleRegister(c *client, msg *cellaserv.Register) {
+	b.record(c, cellaserv.Message_Register, msg)
+
 	name := msg.Name
 	ident := msg.Identification
 
+	policy, loadBalanced := common.RegisterLoadBalancing(msg)
+	if loadBalanced && !isValidLoadBalancing(policy) {
+		b.logger.Warnf("Unknown load balancing policy %q, using %q", policy, api.LoadBalancingRoundRobin)
+		policy = api.LoadBalancingRoundRobin
+	}
+
+	// The events are published once the locks are released
+	var events []cellaservEvent
+	defer func() { b.cellaservPublishEvents(events) }()
+
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
@@ -18,30 +53,48 @@ func (b *Broker) HandleRegister(c *client, msg *cellaserv.Register) {
 	defer b.servicesMtx.Unlock()
 
 	if _, ok := b.services[name]; !ok {
-		b.services[name] = make(map[string]*service)
+		b.services[name] = make(map[string]*serviceGroup)
 	}
 
 	registeredService := newService(c, name, ident)
 
 	b.logger.Infof("New service: %s", registeredService)
 
-	// Check for duplicate services
-	if s, ok := b.services[name][ident]; ok {
-		s.logger.Warnf("Service is replaced.")
-
-		pubJSON, _ := json.Marshal(s.JSONStruct())
-		b.cellaservPublishBytes(logLostService, pubJSON)
-
-		service_client := s.client
-
-		for i, ss := range service_client.services {
-			if ss.Name == name && ss.Identification == ident {
-				// Remove from slice
-				service_client.services[i] = service_client.services[len(service_client.services)-1]
-				service_client.services = service_client.services[:len(service_client.services)-1]
-				break
+	group, ok := b.services[name][ident]
+	if ok {
+		group.mtx.Lock()
+		if loadBalanced && group.policy != "" {
+			// Join the group
+			if policy != group.policy {
+				registeredService.logger.Warnf("Service group uses load balancing policy %q, not %q", group.policy, policy)
+			}
+			// The client registers the service again, replace it
+			for i, s := range group.members {
+				if s.client == c {
+					group.members = append(group.members[:i], group.members[i+1:]...)
+					removeServiceFromClient(s)
+					break
+				}
 			}
+		} else {
+			// Check for duplicate services
+			for _, s := range group.members {
+				s.logger.Warnf("Service is replaced.")
+
+				pubJSON, _ := json.Marshal(s.JSONStruct())
+				events = append(events, cellaservEvent{logLostService, pubJSON})
+
+				// Services of other clients are left in their
+				// list, they are not members of the group anymore
+				if s.client == c {
+					removeServiceFromClient(s)
+				}
+			}
+			group.members = nil
+			group.policy = policy
 		}
+		group.members = append(group.members, registeredService)
+		group.mtx.Unlock()
 	} else {
 		// Sanity checks
 		if ident == "" {
@@ -53,10 +106,16 @@ func (b *Broker) HandleRegister(c *client, msg *cellaserv.Register) {
 				b.logger.Warn("New service has an identification but there is already a service without an identification")
 			}
 		}
-	}
 
-	// This makes all requests go to the new service
-	b.services[name][ident] = registeredService
+		group = &serviceGroup{
+			Name:           name,
+			Identification: ident,
+			policy:         policy,
+			members:        []*service{registeredService},
+		}
+		// This makes all requests go to the new service
+		b.services[name][ident] = group
+	}
 
 	// Keep track of origin client in order to remove it when the connection is closed
 	c.services = append(c.services, registeredService)
@@ -68,5 +127,5 @@ func (b *Broker) HandleRegister(c *client, msg *cellaserv.Register) {
 
 	// Publish new service event
 	pubJSON, _ := json.Marshal(registeredService.JSONStruct())
-	b.cellaservPublishBytes(logNewService, pubJSON)
+	events = append(events, cellaservEvent{logNewService, pubJSON})
 }
@@ -4,6 +4,8 @@ import (
 	"testing"
 	"time"
 
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
 	"github.com/evolutek/cellaserv3/testutil"
 )
 
@@ -67,3 +69,109 @@ func TestRegisterReplace(t *testing.T) {
 		serviceIsRegistered(b, t, serviceName, serviceIdent)
 	})
 }
+
+func groupMembers(b *Broker, serviceName string, serviceIdent string) int {
+	group, err := b.GetService(serviceName, serviceIdent)
+	if err != nil {
+		return 0
+	}
+	group.mtx.Lock()
+	defer group.mtx.Unlock()
+	return len(group.members)
+}
+
+func TestRegisterLoadBalanced(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		const serviceName = "planner"
+		registerMsg := testutil.MakeMessageRegisterLoadBalanced(t, serviceName, "", api.LoadBalancingRoundRobin)
+
+		conn1 := testutil.Dial(t)
+		defer conn1.Close()
+		conn1.Write(registerMsg)
+		conn2 := testutil.Dial(t)
+		defer conn2.Close()
+		conn2.Write(registerMsg)
+
+		time.Sleep(50 * time.Millisecond)
+
+		// Both services are members of the group
+		testutil.Equals(t, 2, groupMembers(b, serviceName, ""))
+		testutil.Equals(t, 2, len(b.GetServicesJSON()))
+
+		// Registering again does not add a member
+		conn2.Write(registerMsg)
+		time.Sleep(50 * time.Millisecond)
+		testutil.Equals(t, 2, groupMembers(b, serviceName, ""))
+
+		// Requests are distributed among the members
+		connClient := testutil.Dial(t)
+		defer connClient.Close()
+		connClient.Write(testutil.MakeMessageRequest(t, serviceName, "", "plan", nil))
+		connClient.Write(testutil.MakeMessageRequest(t, serviceName, "", "plan", nil))
+		testutil.MsgTypeIs(t, testutil.RecvMessage(t, conn1), cellaserv.Message_Request)
+		testutil.MsgTypeIs(t, testutil.RecvMessage(t, conn2), cellaserv.Message_Request)
+
+		// Members are removed when they disconnect
+		conn1.Close()
+		time.Sleep(50 * time.Millisecond)
+		testutil.Equals(t, 1, groupMembers(b, serviceName, ""))
+		conn2.Close()
+		time.Sleep(50 * time.Millisecond)
+		_, err := b.GetService(serviceName, "")
+		testutil.NotOk(t, err, "The service group was not removed")
+	})
+}
+
+func TestRegisterReplaceLoadBalanced(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		const serviceName = "planner"
+
+		conn1 := testutil.Dial(t)
+		defer conn1.Close()
+		conn1.Write(testutil.MakeMessageRegisterLoadBalanced(t, serviceName, "", api.LoadBalancingRoundRobin))
+		conn2 := testutil.Dial(t)
+		defer conn2.Close()
+		conn2.Write(testutil.MakeMessageRegisterLoadBalanced(t, serviceName, "", api.LoadBalancingRoundRobin))
+
+		time.Sleep(50 * time.Millisecond)
+		testutil.Equals(t, 2, groupMembers(b, serviceName, ""))
+
+		// A service registered without load balancing replaces the group
+		conn3 := testutil.Dial(t)
+		defer conn3.Close()
+		conn3.Write(testutil.MakeMessageRegister(t, serviceName, ""))
+
+		time.Sleep(50 * time.Millisecond)
+		testutil.Equals(t, 1, groupMembers(b, serviceName, ""))
+
+		// The replaced services disconnecting does not remove the new one
+		conn1.Close()
+		time.Sleep(50 * time.Millisecond)
+		testutil.Equals(t, 1, groupMembers(b, serviceName, ""))
+	})
+}
+
+func TestServiceGroupPickRoundRobin(t *testing.T) {
+	s1 := &service{}
+	s2 := &service{}
+	s3 := &service{}
+	group := &serviceGroup{
+		policy:  api.LoadBalancingRoundRobin,
+		members: []*service{s1, s2, s3},
+	}
+	// The members are picked in the order they registered
+	for _, s := range []*service{s1, s2, s3, s1} {
+		testutil.Equals(t, s, group.pick())
+	}
+}
+
+func TestServiceGroupPickLeastPending(t *testing.T) {
+	s1 := &service{pending: 3}
+	s2 := &service{pending: 1}
+	s3 := &service{pending: 2}
+	group := &serviceGroup{
+		policy:  api.LoadBalancingLeastPending,
+		members: []*service{s1, s2, s3},
+	}
+	testutil.Equals(t, s2, group.pick())
+}
@@ -0,0 +1,178 @@
+package broker
+
+import (
+	"io"
+	"path"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/golang/protobuf/proto"
+)
+
+// Directory of the durable stream, in the logs directory
+const streamsDirname = "streams"
+
+// openStream opens the durable stream, if events are configured to be
+// streamed.
+func (b *Broker) openStream() error {
+	if len(b.Options.StreamPatterns) == 0 {
+		return nil
+	}
+	stream, err := openEventStream(path.Join(b.Options.LogsDir, streamsDirname), b.Options.StreamPatterns)
+	if err != nil {
+		return err
+	}
+	b.logger.Infof("Durable stream opened, last sequence number: %d", stream.lastSeq)
+	b.stream = stream
+	return nil
+}
+
+// closeStream closes the durable stream. Events are not streamed anymore.
+func (b *Broker) closeStream() {
+	if b.stream == nil {
+		return
+	}
+	if err := b.stream.close(); err != nil {
+		b.logger.Errorf("Could not close stream: %s", err)
+	}
+}
+
+// appendToStream appends the event to the durable stream. Returns the
+// publish with its sequence number, and the message to send to the
+// subscribers. The stream lock must be held.
+func (b *Broker) appendToStream(msgBytes []byte, pub *cellaserv.Publish) ([]byte, *cellaserv.Publish) {
+	rec := &streamRecord{seq: b.stream.nextSequence(), time: time.Now()}
+	streamed := proto.Clone(pub).(*cellaserv.Publish)
+	common.SetPublishSequence(streamed, rec.seq, rec.time)
+	var err error
+	rec.msgBytes, err = common.MarshalMessage(cellaserv.Message_Publish, streamed)
+	if err != nil {
+		b.logger.Errorf("Could not marshal streamed event: %s", err)
+		return msgBytes, pub
+	}
+	if err := b.stream.append(rec); err == errStreamClosed {
+		return msgBytes, pub
+	} else if err != nil {
+		b.logger.Errorf("Could not append event %q to the stream: %s", pub.Event, err)
+		return msgBytes, pub
+	}
+	return rec.msgBytes, streamed
+}
+
+// subscribeReplayPosition returns the position from which the durable stream
+// is replayed to the subscriber, if requested.
+func subscribeReplayPosition(sub *cellaserv.Subscribe) (streamPosition, bool) {
+	if seq, ok := common.SubscribeFromSequence(sub); ok {
+		return streamPosition{seq: seq}, true
+	}
+	if t, ok := common.SubscribeFromTime(sub); ok {
+		return streamPosition{time: t, fromTime: true}, true
+	}
+	return streamPosition{}, false
+}
+
+// sendStreamRecord sends the streamed event to the client if it matches the
+// pattern and the filter of the options, if any. If wait is true, waits for the outbound queue of the client to
+// have room for the event. Returns false if the client is closed.
+func (b *Broker) sendStreamRecord(c *client, pattern *common.TopicPattern, opts subscribeOptions, rec *streamRecord, wait bool) bool {
+	msg := &cellaserv.Message{}
+	pub := &cellaserv.Publish{}
+	if err := proto.Unmarshal(rec.msgBytes, msg); err != nil {
+		b.logger.Errorf("Could not unmarshal streamed event %d: %s", rec.seq, err)
+		return true
+	}
+	if err := proto.Unmarshal(msg.Content, pub); err != nil {
+		b.logger.Errorf("Could not unmarshal streamed event %d: %s", rec.seq, err)
+		return true
+	}
+	if !pattern.Match(pub.Event) {
+		return true
+	}
+	if opts.filter != nil && !opts.filter.Match(common.NewFilterData(pub.Data)) {
+		return true
+	}
+	priority := b.publishPriority(pub)
+	if wait {
+		return c.sendWait(rec.msgBytes, priority)
+	}
+	c.send(rec.msgBytes, priority)
+	return true
+}
+
+// replayStream sends the streamed events matching the pattern and the filter
+// of the options, from the position, to the client. The stored events are not
+// rate limited. If register is true, the client is then
+// subscribed to the pattern, without missing or receiving twice the events
+// streamed meanwhile.
+func (b *Broker) replayStream(c *client, pattern *common.TopicPattern, opts subscribeOptions, pos streamPosition, register bool) {
+	s := b.stream
+	c.logger.Infof("Replays stream for %q", pattern)
+
+	s.mtx.Lock()
+	r, err := s.newReader(pos)
+	s.mtx.Unlock()
+	if err != nil {
+		c.logger.Errorf("Could not replay stream: %s", err)
+	} else {
+		defer r.close()
+		// Send the stored events, as fast as the client reads them,
+		// until the client caught up
+		for {
+			rec, err := r.next()
+			if err == io.EOF {
+				s.mtx.Lock()
+				end := s.size
+				s.mtx.Unlock()
+				if r.offset == end {
+					break
+				}
+				r.end = end
+				continue
+			}
+			if err != nil {
+				c.logger.Errorf("Could not read stream: %s", err)
+				break
+			}
+			if !b.sendStreamRecord(c, pattern, opts, rec, true) {
+				return
+			}
+		}
+	}
+
+	if !register {
+		return
+	}
+
+	// Events are streamed and sent to the subscribers with the stream
+	// lock held, so the events appended until the subscription is added
+	// are read from the stream, and the next ones are received live.
+	s.mtx.Lock()
+	if r != nil {
+		r.end = s.size
+		for {
+			rec, err := r.next()
+			if err != nil {
+				break
+			}
+			b.sendStreamRecord(c, pattern, opts, rec, false)
+		}
+	}
+	// The client may have unsubscribed or quit meanwhile
+	c.mtx.Lock()
+	subscribed := false
+	for _, p := range c.subscribes {
+		if p == pattern.String() {
+			b.subscriptions.add(pattern, c, opts)
+			subscribed = true
+			break
+		}
+	}
+	c.mtx.Unlock()
+	s.mtx.Unlock()
+
+	if subscribed {
+		b.cellaservPublish(logNewSubscriber, logSubscriberJSON{pattern.String(), c.id})
+		b.sendRetained(c, pattern, opts)
+	}
+}
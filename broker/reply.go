@@ -2,10 +2,11 @@ package broker
 
 import (
 	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
 	log "github.com/sirupsen/logrus"
 )
 
-func (b *Broker) handleReply(c *client, msgRaw []byte, rep *cellaserv.Reply) {
+func (b *Broker) handleReply(c *client, rep *cellaserv.Reply) {
 	id := rep.Id
 
 	logger := log.WithFields(log.Fields{
@@ -14,29 +15,33 @@ func (b *Broker) handleReply(c *client, msgRaw []byte, rep *cellaserv.Reply) {
 		"id":         id,
 	})
 
-	b.reqIdsMtx.RLock()
-	reqTrack, ok := b.reqIds[id]
-	b.reqIdsMtx.RUnlock()
+	reqTrack, ok := b.untrackRequest(id)
 	if !ok {
 		logger.Errorf("Could not find a matching request.")
 		return
 	}
-	b.reqIdsMtx.Lock()
-	delete(b.reqIds, id)
-	b.reqIdsMtx.Unlock()
-
-	reqTrack.timer.Stop()
 
 	// Track reply latency
 	reqTrack.latencyObserver.ObserveDuration()
 
-	// Forward reply to spies
-	// TODO(halfr): make sure timeouts are also sent to spies
-	for _, spy := range reqTrack.spies {
-		logger.Debugf("Sending reply to spy %s", spy.conn)
-		b.sendRawMessage(spy.conn, msgRaw)
+	b.record(c, cellaserv.Message_Reply, rep)
+	b.endRequestTrace(reqTrack, rep.Error)
+
+	// Translate the id back to the one chosen by the sender
+	rep.Id = reqTrack.id
+	b.sendSpiesReply(reqTrack, rep)
+	msgRaw, err := common.MarshalMessage(cellaserv.Message_Reply, rep)
+	if err != nil {
+		logger.Errorf("Could not marshal reply: %s", err)
+		return
+	}
+
+	if reqTrack.broadcast != nil {
+		reqTrack.broadcast.addReply(b, reqTrack.service.Identification, rep)
+		return
 	}
 
+	reqTrack.sender.removePendingRequest(reqTrack.id)
 	logger.Infof("Sending reply to destingation client: %s", reqTrack.sender)
-	b.sendRawMessage(reqTrack.sender.conn, msgRaw)
+	reqTrack.sender.sendReplyMessage(msgRaw, reqTrack.priority)
 }
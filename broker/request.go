@@ -2,22 +2,49 @@ package broker
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	cellaserv "github.com/evolutek/cellaserv3-protobuf"
 	"github.com/evolutek/cellaserv3/common"
+	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
 type requestTracking struct {
+	id              uint64 // id of the request chosen by the sender
+	serviceId       uint64 // id of the request sent to the service
 	sender          *client
+	service         *service
 	timer           *time.Timer
 	spies           []*client
 	latencyObserver *prometheus.Timer
+	priority        common.Priority
+	trace           *requestTrace
+
+	// The request is part of a broadcast request, its reply is gathered
+	// instead of being sent to the sender
+	broadcast *broadcastRequest
+}
+
+// newRequestId returns the id of a request sent to a service. These ids are
+// only used between the broker and the services, where they are unique.
+func (b *Broker) newRequestId() uint64 {
+	return atomic.AddUint64(&b.lastRequestId, 1)
 }
 
-func (b *Broker) handleRequest(c *client, msgRaw []byte, req *cellaserv.Request) {
+// requestDeadline returns the time at which the request times out.
+func (b *Broker) requestDeadline(req *cellaserv.Request) time.Time {
+	// Use the time budget of the request, if any
+	timeout := b.Options.RequestTimeout
+	if reqTimeout, ok := common.RequestTimeout(req); ok {
+		timeout = reqTimeout
+	}
+	return time.Now().Add(timeout)
+}
+
+func (b *Broker) handleRequest(c *client, req *cellaserv.Request) {
 	name := req.ServiceName
 	method := req.Method
 	id := req.Id
@@ -30,57 +57,188 @@ func (b *Broker) handleRequest(c *client, msgRaw []byte, req *cellaserv.Request)
 		"method": method,
 	})
 
+	// The replies have the priority of the request
+	common.SetPriority(req, b.requestPriority(req))
+
+	if b.rejectRequest(c, req) {
+		logger.Warnln("Shutting down, request rejected.")
+		return
+	}
+
+	deadline := b.requestDeadline(req)
+
+	// The id is used to send the reply to the sender, it must not be used
+	// by another of its requests until then
+	if !c.addPendingRequest(id) {
+		logger.Warnln("Duplicate request id.")
+		b.sendReplyError(c, req, common.ReplyErrorDuplicateRequestId)
+		return
+	}
+
+	if ident == broadcastIdentification {
+		b.handleBroadcastRequest(c, req, deadline, logger)
+		return
+	}
+
+	b.servicesMtx.RLock()
 	idents, ok := b.services[name]
 	if !ok || len(idents) == 0 {
+		b.servicesMtx.RUnlock()
 		logger.Warnln("No such service with this name.")
+		c.removePendingRequest(id)
 		b.sendReplyError(c, req, cellaserv.Reply_Error_NoSuchService)
 		return
 	}
-	srvc, ok := idents[ident]
+	group, ok := idents[ident]
+	b.servicesMtx.RUnlock()
 	if !ok {
 		logger.Warnln("No such service with that identification.")
+		c.removePendingRequest(id)
+		b.sendReplyError(c, req, cellaserv.Reply_Error_InvalidIdentification)
+		return
+	}
+	srvc := group.pick()
+	if srvc == nil {
+		logger.Warnln("No such service with that identification.")
+		c.removePendingRequest(id)
 		b.sendReplyError(c, req, cellaserv.Reply_Error_InvalidIdentification)
 		return
 	}
 
+	if err := b.forwardRequest(&requestTracking{sender: c}, group, srvc, req, deadline, logger); err != nil {
+		logger.Errorln(err)
+		c.removePendingRequest(id)
+		b.sendReplyError(c, req, cellaserv.Reply_Error_BadArguments)
+	}
+}
+
+// forwardRequest sends the request to a service of the group and tracks it
+// until the service replies or the request times out. Returns an error if the
+// request could not be sent, the sender does not get a reply then.
+func (b *Broker) forwardRequest(reqTrack *requestTracking, group *serviceGroup, srvc *service, req *cellaserv.Request, deadline time.Time, logger common.Logger) error {
+	// Ids chosen by clients can collide, the request is sent to the service
+	// with an id chosen by the broker. The id of the reply is translated
+	// back to the id chosen by the sender.
+	id := b.newRequestId()
+	reqTrack.id = req.Id
+	reqTrack.serviceId = id
+	reqTrack.priority = common.GetPriority(req)
+	reqTrack.trace = newRequestTrace(req, time.Now())
+
+	// Forward the remaining time budget to the service, so that it can give
+	// up early
+	common.SetRequestTimeout(req, time.Until(deadline))
+
+	// Spies see the id chosen by the sender, and the id of the sender to
+	// pair the requests and replies of several clients
+	spyMsgRaw, err := marshalSpyMessage(cellaserv.Message_Request, req, reqTrack.sender)
+	if err != nil {
+		return fmt.Errorf("Could not marshal request: %s", err)
+	}
+	serviceReq := proto.Clone(req).(*cellaserv.Request)
+	serviceReq.Id = id
+	// The requests sent by the service while handling this one are part of
+	// its trace
+	common.SetRequestTrace(serviceReq, reqTrack.trace.context)
+	msgRaw, err := common.MarshalMessage(cellaserv.Message_Request, serviceReq)
+	if err != nil {
+		return fmt.Errorf("Could not marshal request: %s", err)
+	}
+
 	// Handle timeouts
 	handleTimeout := func() {
-		b.reqIdsMtx.RLock()
-		_, ok := b.reqIds[id]
-		b.reqIdsMtx.RUnlock()
-		if ok {
-			b.reqIdsMtx.Lock()
-			delete(b.reqIds, id)
-			b.reqIdsMtx.Unlock()
-
+		if reqTrack, ok := b.untrackRequest(id); ok {
 			logger.Errorln("Timeout.")
-			b.sendReplyError(c, req, cellaserv.Reply_Error_Timeout)
+			b.failRequest(reqTrack, cellaserv.Reply_Error_Timeout)
 		}
 	}
-	timer := time.AfterFunc(b.Options.RequestTimeoutSec*time.Second, handleTimeout)
 
-	// The ID is used to track the sender of the request
-	reqTrack := &requestTracking{
-		sender:          c,
-		timer:           timer,
-		spies:           srvc.spies,
-		latencyObserver: prometheus.NewTimer(b.Monitoring.requests.WithLabelValues(req.GetServiceName(), req.GetServiceIdentification(), req.GetMethod()))}
+	reqTrack.spies = b.spiesOf(group.Name, group.Identification)
+	reqTrack.service = srvc
+	reqTrack.latencyObserver = prometheus.NewTimer(b.Monitoring.requests.WithLabelValues(req.GetServiceName(), req.GetServiceIdentification(), req.GetMethod()))
+	atomic.AddInt64(&srvc.pending, 1)
+	srvc.addRequest(id)
 	b.reqIdsMtx.Lock()
 	b.reqIds[id] = reqTrack
+	// Start the timer with the lock held, so that the timer is set when the
+	// request is found by others
+	reqTrack.timer = time.AfterFunc(time.Until(deadline), handleTimeout)
 	b.reqIdsMtx.Unlock()
 
 	logger.Info("Sending to service: ", srvc)
-	srvc.sendMessage(msgRaw)
+	b.recordMessage(reqTrack.sender, msgRaw)
+	reqTrack.trace.setEnqueued(time.Now())
+	sent := srvc.sendRequest(msgRaw, reqTrack.priority, reqTrack.trace.setWritten)
 
 	// Forward message to the spies of this service
-	srvc.spiesMtx.RLock()
-	for _, spy := range srvc.spies {
-		err := common.SendRawMessage(spy.conn, msgRaw)
-		if err != nil {
-			logger.Warnf("Could not forward request to spy %s: %s", spy, err)
+	for _, spy := range reqTrack.spies {
+		spy.send(spyMsgRaw, reqTrack.priority)
+	}
+
+	if !sent {
+		// The service does not read its requests
+		if reqTrack, ok := b.untrackRequest(id); ok {
+			logger.Errorln("Outbound queue of the service full, request failed.")
+			b.failRequest(reqTrack, common.ReplyErrorServiceOverloaded)
+		}
+	}
+	return nil
+}
+
+// untrackRequest stops tracking the request sent to a service with this id.
+// Returns false if the request is not tracked anymore: it received a reply,
+// timed out, or its service was lost.
+func (b *Broker) untrackRequest(id uint64) (*requestTracking, bool) {
+	b.reqIdsMtx.Lock()
+	reqTrack, ok := b.reqIds[id]
+	delete(b.reqIds, id)
+	b.reqIdsMtx.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	reqTrack.timer.Stop()
+	atomic.AddInt64(&reqTrack.service.pending, -1)
+	reqTrack.service.removeRequest(id)
+	return reqTrack, true
+}
+
+// failRequest sends an error reply to the sender and the spies of the request,
+// on behalf of its service.
+func (b *Broker) failRequest(reqTrack *requestTracking, errType cellaserv.Reply_Error_Type) {
+	rep := &cellaserv.Reply{
+		Id:    reqTrack.serviceId,
+		Error: &cellaserv.Reply_Error{Type: errType},
+	}
+	b.record(nil, cellaserv.Message_Reply, rep)
+	b.endRequestTrace(reqTrack, rep.Error)
+
+	rep.Id = reqTrack.id
+	b.sendSpiesReply(reqTrack, rep)
+	msgRaw, err := common.MarshalMessage(cellaserv.Message_Reply, rep)
+	if err != nil {
+		b.logger.Errorf("Could not marshal reply: %s", err)
+		return
+	}
+
+	if reqTrack.broadcast != nil {
+		reqTrack.broadcast.addError(b, reqTrack.service.Identification, errType)
+		return
+	}
+
+	reqTrack.sender.removePendingRequest(reqTrack.id)
+	reqTrack.sender.sendReplyMessage(msgRaw, reqTrack.priority)
+}
+
+// failServiceRequests sends an error reply to the senders of the requests
+// waiting for a reply of the service, which is lost.
+func (b *Broker) failServiceRequests(s *service) {
+	for _, id := range s.requestIds() {
+		if reqTrack, ok := b.untrackRequest(id); ok {
+			s.logger.Warnf("Service lost, request %x failed.", reqTrack.id)
+			b.failRequest(reqTrack, common.ReplyErrorServiceLost)
 		}
 	}
-	srvc.spiesMtx.RUnlock()
 }
 
 func (b *Broker) GetRequestSender(req *cellaserv.Request) (*client, error) {
@@ -2,6 +2,7 @@ package broker
 
 import (
 	"bytes"
+	"net"
 	"testing"
 	"time"
 
@@ -110,3 +111,197 @@ func TestRequestNoService(t *testing.T) {
 		}
 	})
 }
+
+func TestRequestTimeoutBudget(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		connService := testutil.Dial(t)
+		defer connService.Close()
+
+		connClient := testutil.Dial(t)
+		defer connClient.Close()
+
+		const serviceName = "testName"
+		const serviceIdent = "testIdent"
+		connService.Write(testutil.MakeMessageRegister(t, serviceName, serviceIdent))
+
+		time.Sleep(50 * time.Millisecond)
+
+		// Send a request with a short time budget
+		const budget = 100 * time.Millisecond
+		start := time.Now()
+		connClient.Write(testutil.MakeMessageRequestWithTimeout(t, serviceName, serviceIdent, "method", nil, budget))
+
+		// The service receives the remaining time budget
+		msg := testutil.RecvMessage(t, connService)
+		testutil.MsgTypeIs(t, msg, cellaserv.Message_Request)
+		msgRequest := &cellaserv.Request{}
+		testutil.Ok(t, proto.Unmarshal(msg.GetContent(), msgRequest))
+		timeout, ok := common.RequestTimeout(msgRequest)
+		testutil.Assert(t, ok, "The request has no time budget")
+		testutil.Assert(t, timeout <= budget, "Invalid time budget: %s", timeout)
+
+		// The service does not reply, the client receives a timeout
+		msg = testutil.RecvMessage(t, connClient)
+		testutil.MsgTypeIs(t, msg, cellaserv.Message_Reply)
+		msgReply := &cellaserv.Reply{}
+		testutil.Ok(t, proto.Unmarshal(msg.GetContent(), msgReply))
+		testutil.Equals(t, cellaserv.Reply_Error_Timeout, msgReply.GetError().GetType())
+		elapsed := time.Since(start)
+		testutil.Assert(t, elapsed < 10*budget, "Timeout took too long: %s", elapsed)
+	})
+}
+
+func TestRequestDefaultTimeout(t *testing.T) {
+	options := Options{RequestTimeout: 100 * time.Millisecond}
+	brokerTestWithOptions(t, options, func(b *Broker) {
+		connService := testutil.Dial(t)
+		defer connService.Close()
+
+		connClient := testutil.Dial(t)
+		defer connClient.Close()
+
+		connService.Write(testutil.MakeMessageRegister(t, "testName", ""))
+
+		time.Sleep(50 * time.Millisecond)
+
+		// Request without a time budget
+		connClient.Write(testutil.MakeMessageRequest(t, "testName", "", "method", nil))
+
+		// The service receives the default time budget
+		msg := testutil.RecvMessage(t, connService)
+		msgRequest := &cellaserv.Request{}
+		testutil.Ok(t, proto.Unmarshal(msg.GetContent(), msgRequest))
+		timeout, ok := common.RequestTimeout(msgRequest)
+		testutil.Assert(t, ok, "The request has no time budget")
+		testutil.Assert(t, timeout <= options.RequestTimeout, "Invalid time budget: %s", timeout)
+
+		// The client receives a timeout
+		msg = testutil.RecvMessage(t, connClient)
+		msgReply := &cellaserv.Reply{}
+		testutil.Ok(t, proto.Unmarshal(msg.GetContent(), msgReply))
+		testutil.Equals(t, cellaserv.Reply_Error_Timeout, msgReply.GetError().GetType())
+	})
+}
+
+func recvRequest(t *testing.T, conn net.Conn) *cellaserv.Request {
+	msg := testutil.RecvMessage(t, conn)
+	testutil.MsgTypeIs(t, msg, cellaserv.Message_Request)
+	req := &cellaserv.Request{}
+	testutil.Ok(t, proto.Unmarshal(msg.GetContent(), req))
+	return req
+}
+
+func recvReply(t *testing.T, conn net.Conn) *cellaserv.Reply {
+	msg := testutil.RecvMessage(t, conn)
+	testutil.MsgTypeIs(t, msg, cellaserv.Message_Reply)
+	rep := &cellaserv.Reply{}
+	testutil.Ok(t, proto.Unmarshal(msg.GetContent(), rep))
+	return rep
+}
+
+func TestRequestTimeoutSec(t *testing.T) {
+	// The deprecated option is a number of seconds
+	b := New(Options{RequestTimeoutSec: 2}, common.NewLogger("test"))
+	testutil.Equals(t, 2*time.Second, b.Options.RequestTimeout)
+
+	b = New(Options{RequestTimeout: time.Second, RequestTimeoutSec: 2}, common.NewLogger("test"))
+	testutil.Equals(t, time.Second, b.Options.RequestTimeout)
+}
+
+func TestRequestIdCollision(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		connService := testutil.Dial(t)
+		defer connService.Close()
+		connClient1 := testutil.Dial(t)
+		defer connClient1.Close()
+		connClient2 := testutil.Dial(t)
+		defer connClient2.Close()
+
+		connService.Write(testutil.MakeMessageRegister(t, "testName", ""))
+
+		time.Sleep(50 * time.Millisecond)
+
+		// Both clients use the same request id
+		const requestId = 0
+		connClient1.Write(testutil.MakeMessageRequestWithId(t, "testName", "", "method", requestId, []byte("1")))
+		req1 := recvRequest(t, connService)
+		connClient2.Write(testutil.MakeMessageRequestWithId(t, "testName", "", "method", requestId, []byte("2")))
+		req2 := recvRequest(t, connService)
+
+		// The service sees distinct ids
+		testutil.Assert(t, req1.GetId() != req2.GetId(), "The requests have the same id")
+
+		// The service replies in reverse order
+		connService.Write(testutil.MakeMessageReply(t, req2.GetId(), []byte("2")))
+		connService.Write(testutil.MakeMessageReply(t, req1.GetId(), []byte("1")))
+
+		// Each client receives its own reply, with its own id
+		rep := recvReply(t, connClient1)
+		testutil.Equals(t, uint64(requestId), rep.GetId())
+		testutil.Equals(t, "1", string(rep.GetData()))
+		rep = recvReply(t, connClient2)
+		testutil.Equals(t, uint64(requestId), rep.GetId())
+		testutil.Equals(t, "2", string(rep.GetData()))
+	})
+}
+
+func TestRequestDuplicateId(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		connService := testutil.Dial(t)
+		defer connService.Close()
+		connClient := testutil.Dial(t)
+		defer connClient.Close()
+
+		connService.Write(testutil.MakeMessageRegister(t, "testName", ""))
+
+		time.Sleep(50 * time.Millisecond)
+
+		const requestId = 7
+		connClient.Write(testutil.MakeMessageRequestWithId(t, "testName", "", "method", requestId, nil))
+		req := recvRequest(t, connService)
+
+		// The first request is still waiting for a reply
+		connClient.Write(testutil.MakeMessageRequestWithId(t, "testName", "", "method", requestId, nil))
+		rep := recvReply(t, connClient)
+		testutil.Equals(t, uint64(requestId), rep.GetId())
+		testutil.Equals(t, common.ReplyErrorDuplicateRequestId, rep.GetError().GetType())
+
+		// The id can be used again once the reply is received
+		connService.Write(testutil.MakeMessageReply(t, req.GetId(), nil))
+		rep = recvReply(t, connClient)
+		testutil.Equals(t, uint64(requestId), rep.GetId())
+		testutil.Equals(t, cellaserv.Reply_Error_NoError, rep.GetError().GetType())
+
+		connClient.Write(testutil.MakeMessageRequestWithId(t, "testName", "", "method", requestId, nil))
+		recvRequest(t, connService)
+	})
+}
+
+func TestRequestServiceLost(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		connService := testutil.Dial(t)
+		connClient := testutil.Dial(t)
+		defer connClient.Close()
+
+		connService.Write(testutil.MakeMessageRegister(t, "testName", ""))
+
+		time.Sleep(50 * time.Millisecond)
+
+		connClient.Write(testutil.MakeMessageRequestWithId(t, "testName", "", "method", 42, nil))
+		recvRequest(t, connService)
+
+		// The service disconnects without replying
+		start := time.Now()
+		connService.Close()
+
+		rep := recvReply(t, connClient)
+		testutil.Equals(t, uint64(42), rep.GetId())
+		testutil.Equals(t, common.ReplyErrorServiceLost, rep.GetError().GetType())
+		elapsed := time.Since(start)
+		testutil.Assert(t, elapsed < b.Options.RequestTimeout/2, "Service lost took too long: %s", elapsed)
+
+		b.reqIdsMtx.RLock()
+		testutil.Equals(t, 0, len(b.reqIds))
+		b.reqIdsMtx.RUnlock()
+	})
+}
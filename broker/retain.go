@@ -0,0 +1,83 @@
+package broker
+
+import (
+	"sort"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+// A retainedEvent is the last retained publish of an event, sent to the
+// clients when they subscribe to the event.
+type retainedEvent struct {
+	msgBytes []byte
+	pub      *cellaserv.Publish
+}
+
+// retain keeps the publish if it is retained. A retained publish without data
+// clears the retained value of the event.
+func (b *Broker) retain(msgBytes []byte, pub *cellaserv.Publish) {
+	if !common.PublishRetain(pub) {
+		return
+	}
+
+	b.retainedMtx.Lock()
+	defer b.retainedMtx.Unlock()
+	if len(pub.Data) == 0 {
+		b.logger.Debugf("Clear retained event %q", pub.Event)
+		delete(b.retained, pub.Event)
+		return
+	}
+	b.retained[pub.Event] = retainedEvent{msgBytes, pub}
+}
+
+// sendRetained sends the retained events matching the pattern to the client,
+// with the filter and rate limit of the options.
+func (b *Broker) sendRetained(c *client, pattern *common.TopicPattern, opts subscribeOptions) {
+	var events []retainedEvent
+	b.retainedMtx.RLock()
+	if common.IsTopicPattern(pattern.String()) {
+		for event, retained := range b.retained {
+			if pattern.Match(event) {
+				events = append(events, retained)
+			}
+		}
+	} else if retained, ok := b.retained[pattern.String()]; ok {
+		events = append(events, retained)
+	}
+	b.retainedMtx.RUnlock()
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].pub.Event < events[j].pub.Event
+	})
+	for _, retained := range events {
+		if opts.filter != nil && !opts.filter.Match(common.NewFilterData(retained.pub.Data)) {
+			continue
+		}
+		c.logger.Debugf("Receives retained event %q", retained.pub.Event)
+		priority := b.publishPriority(retained.pub)
+		if opts.limiter != nil {
+			opts.limiter.send(retained.pub.Event, retained.msgBytes, priority)
+		} else {
+			c.send(retained.msgBytes, priority)
+		}
+	}
+}
+
+// GetRetainedJSON returns the retained events, sorted by name.
+func (b *Broker) GetRetainedJSON() []api.RetainedEventJSON {
+	retained := make([]api.RetainedEventJSON, 0)
+	b.retainedMtx.RLock()
+	for event, r := range b.retained {
+		retained = append(retained, api.RetainedEventJSON{
+			Event: event,
+			Data:  string(r.pub.Data),
+		})
+	}
+	b.retainedMtx.RUnlock()
+	sort.Slice(retained, func(i, j int) bool {
+		return retained[i].Event < retained[j].Event
+	})
+	return retained
+}
@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/testutil"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestRetained(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		connPublisher := testutil.Dial(t)
+		defer connPublisher.Close()
+
+		connPublisher.Write(testutil.MakeMessagePublishRetained(t, "robot.position", []byte("1")))
+		connPublisher.Write(testutil.MakeMessagePublishRetained(t, "robot.position", []byte("2")))
+		connPublisher.Write(testutil.MakeMessagePublish(t, "robot.speed"))
+
+		time.Sleep(50 * time.Millisecond)
+
+		testutil.Equals(t, []api.RetainedEventJSON{{Event: "robot.position", Data: "2"}}, b.GetRetainedJSON())
+
+		// Late subscribers receive the last retained event
+		for _, pattern := range []string{"robot.position", "robot.*"} {
+			connSubscriber := testutil.Dial(t)
+			defer connSubscriber.Close()
+			connSubscriber.Write(testutil.MakeMessageSubscribe(t, pattern))
+
+			msg := testutil.RecvMessage(t, connSubscriber)
+			testutil.MsgTypeIs(t, msg, cellaserv.Message_Publish)
+			pub := &cellaserv.Publish{}
+			testutil.Ok(t, proto.Unmarshal(msg.GetContent(), pub))
+			testutil.Equals(t, "robot.position", pub.GetEvent())
+			testutil.Equals(t, "2", string(pub.GetData()))
+		}
+
+		// A retained event without data clears the retained event
+		connPublisher.Write(testutil.MakeMessagePublishRetained(t, "robot.position", nil))
+
+		time.Sleep(50 * time.Millisecond)
+
+		testutil.Equals(t, []api.RetainedEventJSON{}, b.GetRetainedJSON())
+	})
+}
+
+func TestRetainedFilter(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		connPublisher := testutil.Dial(t)
+		defer connPublisher.Close()
+
+		connPublisher.Write(testutil.MakeMessagePublishRetained(t, "robot.a", []byte(`{"speed": 0}`)))
+		connPublisher.Write(testutil.MakeMessagePublishRetained(t, "robot.b", []byte(`{"speed": 1}`)))
+
+		time.Sleep(50 * time.Millisecond)
+
+		// Retained events are sent only if they match the filter
+		connSubscriber := testutil.Dial(t)
+		defer connSubscriber.Close()
+		connSubscriber.Write(testutil.MakeMessageSubscribeFilter(t, "robot.*", "speed > 0.1"))
+		time.Sleep(50 * time.Millisecond)
+		connPublisher.Write(testutil.MakeMessagePublishData(t, "robot.c", []byte(`{"speed": 2}`)))
+
+		for _, event := range []string{"robot.b", "robot.c"} {
+			msg := testutil.RecvMessage(t, connSubscriber)
+			testutil.MsgTypeIs(t, msg, cellaserv.Message_Publish)
+			pub := &cellaserv.Publish{}
+			testutil.Ok(t, proto.Unmarshal(msg.GetContent(), pub))
+			testutil.Equals(t, event, pub.GetEvent())
+		}
+	})
+}
@@ -2,7 +2,10 @@ package broker
 
 import (
 	"fmt"
+	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
 	"github.com/evolutek/cellaserv3/common"
@@ -12,12 +15,17 @@ import (
 // A service is a unique entity attached to a cellaserv client that can
 // received requests.
 type service struct {
+	// Number of requests sent to this service and waiting for a reply.
+	// Accessed atomically, first field for alignment.
+	pending int64
+
 	client         *client
 	Name           string
 	Identification string
-	spiesMtx       sync.RWMutex
-	spies          []*client
 	logger         common.Logger
+
+	requestsMtx sync.Mutex
+	requests    map[uint64]bool // ids of the requests waiting for a reply
 }
 
 func (s *service) String() string {
@@ -33,33 +41,121 @@ func (s *service) JSONStruct() *api.ServiceJSON {
 	}
 }
 
-func (s *service) sendMessage(msg []byte) {
-	// No locking, multiple goroutine can write to a conn
-	err := common.SendRawMessage(s.client.conn, msg)
-	if err != nil {
-		s.logger.Errorf("Could not send message: %s", err)
+// sendRequest queues the request for the service, written is called when it
+// is written to the connection of the service. Returns false if the request
+// cannot be queued.
+func (s *service) sendRequest(msg []byte, priority common.Priority, written func(time.Time)) bool {
+	return s.client.sendRequest(msg, priority, written)
+}
+
+func (s *service) addRequest(id uint64) {
+	s.requestsMtx.Lock()
+	s.requests[id] = true
+	s.requestsMtx.Unlock()
+}
+
+func (s *service) removeRequest(id uint64) {
+	s.requestsMtx.Lock()
+	delete(s.requests, id)
+	s.requestsMtx.Unlock()
+}
+
+// requestIds returns the ids of the requests waiting for a reply of the
+// service.
+func (s *service) requestIds() []uint64 {
+	s.requestsMtx.Lock()
+	defer s.requestsMtx.Unlock()
+	ids := make([]uint64, 0, len(s.requests))
+	for id := range s.requests {
+		ids = append(ids, id)
 	}
+	return ids
 }
 
-// spyByRequest finds the sender of the request and add it to the
-func (b *Broker) SpyService(c *client, srvc *service) {
-	srvc.logger.Debugf("client %s spies on service %s", c, srvc)
+// A serviceGroup is the set of services registered with the same name and
+// identification. Each request is sent to a single member of the group.
+//
+// Unless the services registered with a load balancing policy, the group has
+// a single member: the last registered service.
+type serviceGroup struct {
+	Name           string
+	Identification string
 
-	srvc.spiesMtx.Lock()
-	srvc.spies = append(srvc.spies, c)
-	srvc.spiesMtx.Unlock()
+	mtx     sync.Mutex
+	policy  string // load balancing policy, empty if not load balanced
+	members []*service
+	next    int // next member, for round robin
+}
 
-	c.mtx.Lock()
-	c.spying = append(c.spying, srvc)
-	c.mtx.Unlock()
+func (g *serviceGroup) String() string {
+	return fmt.Sprintf("%s[%s]", g.Name, g.Identification)
+}
+
+// pick returns the member of the group that should handle the next request,
+// or nil if the group is empty.
+func (g *serviceGroup) pick() *service {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	switch len(g.members) {
+	case 0:
+		return nil
+	case 1:
+		return g.members[0]
+	}
+
+	switch g.policy {
+	case api.LoadBalancingLeastPending:
+		least := g.members[0]
+		for _, s := range g.members[1:] {
+			if atomic.LoadInt64(&s.pending) < atomic.LoadInt64(&least.pending) {
+				least = s
+			}
+		}
+		return least
+	case api.LoadBalancingRandom:
+		return g.members[rand.Intn(len(g.members))]
+	default:
+		// Members may have been removed since the last pick
+		s := g.members[g.next%len(g.members)]
+		g.next = (g.next + 1) % len(g.members)
+		return s
+	}
+}
+
+// removeMember removes the service from the group, and returns whether it was
+// a member of the group.
+func (g *serviceGroup) removeMember(s *service) bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for i, member := range g.members {
+		if member == s {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// JSONStruct creates the JSON representation of each member of the group.
+func (g *serviceGroup) JSONStruct() []api.ServiceJSON {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	var services []api.ServiceJSON
+	for _, s := range g.members {
+		sJSON := s.JSONStruct()
+		sJSON.LoadBalancing = g.policy
+		services = append(services, *sJSON)
+	}
+	return services
 }
 
 // GetService returns the service identified by the name and identification in
 // argument, or an error if not found.
-func (b *Broker) GetService(name string, identification string) (srvc *service, err error) {
+func (b *Broker) GetService(name string, identification string) (group *serviceGroup, err error) {
 	var ok bool
 	b.servicesMtx.RLock()
-	srvc, ok = b.services[name][identification]
+	group, ok = b.services[name][identification]
 	b.servicesMtx.RUnlock()
 	if !ok {
 		err = fmt.Errorf("No such service: %s[%s]", name, identification)
@@ -79,5 +175,6 @@ func newService(c *client, name string, ident string) *service {
 		Name:           name,
 		Identification: ident,
 		logger:         logger,
+		requests:       make(map[uint64]bool),
 	}
 }
@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+const logShutdown = "log.cellaserv.shutdown"
+
+// Interval between checks of the pending requests while draining
+const drainPollInterval = 10 * time.Millisecond
+
+// ShuttingDown returns whether the broker is shutting down.
+func (b *Broker) ShuttingDown() bool {
+	return atomic.LoadInt32(&b.shuttingDown) != 0
+}
+
+// Shutdown gracefully stops the broker. It stops accepting connections,
+// rejects new requests, and waits up to the grace period for the pending
+// requests to complete before closing all the connections. The broker quits
+// when Shutdown returns.
+func (b *Broker) Shutdown(grace time.Duration) {
+	if !atomic.CompareAndSwapInt32(&b.shuttingDown, 0, 1) {
+		// Already shutting down
+		return
+	}
+	b.logger.Infof("Shutting down, grace period: %s", grace)
+
+	// Stop accepting connections
+	b.listenerMtx.Lock()
+	if b.listener != nil {
+		b.listener.Close()
+	}
+	b.listenerMtx.Unlock()
+
+	b.cellaservPublish(logShutdown, api.ShutdownEventJSON{Grace: grace.Seconds()})
+
+	// Wait for the pending requests
+	deadline := time.Now().Add(grace)
+	for b.pendingRequests() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+
+	// Fail the requests that did not complete in time
+	b.reqIdsMtx.RLock()
+	ids := make([]uint64, 0, len(b.reqIds))
+	for id := range b.reqIds {
+		ids = append(ids, id)
+	}
+	b.reqIdsMtx.RUnlock()
+	for _, id := range ids {
+		if reqTrack, ok := b.untrackRequest(id); ok {
+			b.failRequest(reqTrack, common.ReplyErrorShuttingDown)
+		}
+	}
+
+	b.closePublishLoggers()
+	b.closeStream()
+	b.StopRecording()
+
+	// Close the connections, after sending the queued messages
+	b.mapClientIdToClient.Range(func(_, value interface{}) bool {
+		value.(*client).close()
+		return true
+	})
+
+	close(b.quitCh)
+}
+
+func (b *Broker) pendingRequests() int {
+	b.reqIdsMtx.RLock()
+	defer b.reqIdsMtx.RUnlock()
+	return len(b.reqIds)
+}
+
+// rejectRequest replies with an error to requests received while the broker
+// is shutting down. Returns false if the request can be handled.
+func (b *Broker) rejectRequest(c *client, req *cellaserv.Request) bool {
+	if !b.ShuttingDown() {
+		return false
+	}
+	b.sendReplyError(c, req, common.ReplyErrorShuttingDown)
+	return true
+}
+
+// closePublishLoggers flushes and closes the publish logging files. Events
+// published after that are not logged anymore.
+func (b *Broker) closePublishLoggers() {
+	b.publishLoggingMtx.Lock()
+	defer b.publishLoggingMtx.Unlock()
+	b.publishLoggingClosed = true
+	b.publishLoggingLoggers.Range(func(event, value interface{}) bool {
+		logFile := value.(*os.File)
+		if err := logFile.Sync(); err != nil {
+			b.logger.Errorf("Could not flush logging file for %s: %s", event, err)
+		}
+		if err := logFile.Close(); err != nil {
+			b.logger.Errorf("Could not close logging file for %s: %s", event, err)
+		}
+		return true
+	})
+}
@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/evolutek/cellaserv3/testutil"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestShutdownDrain(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		connService := testutil.Dial(t)
+		defer connService.Close()
+		connClient := testutil.Dial(t)
+		defer connClient.Close()
+		connSubscriber := testutil.Dial(t)
+		defer connSubscriber.Close()
+
+		connService.Write(testutil.MakeMessageRegister(t, "testName", ""))
+		connSubscriber.Write(testutil.MakeMessageSubscribe(t, logShutdown))
+
+		time.Sleep(50 * time.Millisecond)
+
+		connClient.Write(testutil.MakeMessageRequestWithId(t, "testName", "", "method", 1, nil))
+		req := recvRequest(t, connService)
+
+		go b.Shutdown(time.Second)
+
+		// Subscribers are notified of the shutdown
+		msg := testutil.RecvMessage(t, connSubscriber)
+		testutil.MsgTypeIs(t, msg, cellaserv.Message_Publish)
+		pub := &cellaserv.Publish{}
+		testutil.Ok(t, proto.Unmarshal(msg.GetContent(), pub))
+		testutil.Equals(t, logShutdown, pub.GetEvent())
+		var event api.ShutdownEventJSON
+		testutil.Ok(t, json.Unmarshal(pub.GetData(), &event))
+		testutil.Equals(t, 1.0, event.Grace)
+
+		// New connections are not accepted
+		_, err := net.Dial("tcp", b.Options.ListenAddress)
+		testutil.NotOk(t, err, "New connection accepted while shutting down")
+
+		// New requests are rejected
+		connClient.Write(testutil.MakeMessageRequestWithId(t, "testName", "", "method", 2, nil))
+		rep := recvReply(t, connClient)
+		testutil.Equals(t, uint64(2), rep.GetId())
+		testutil.Equals(t, common.ReplyErrorShuttingDown, rep.GetError().GetType())
+
+		// Pending requests complete
+		connService.Write(testutil.MakeMessageReply(t, req.GetId(), []byte("ok")))
+		rep = recvReply(t, connClient)
+		testutil.Equals(t, uint64(1), rep.GetId())
+		testutil.Equals(t, "ok", string(rep.GetData()))
+
+		// The broker quits before the end of the grace period
+		select {
+		case <-b.Quit():
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("The broker did not quit after draining")
+		}
+	})
+}
+
+func TestShutdownGraceExpired(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		connService := testutil.Dial(t)
+		defer connService.Close()
+		connClient := testutil.Dial(t)
+		defer connClient.Close()
+
+		connService.Write(testutil.MakeMessageRegister(t, "testName", ""))
+
+		time.Sleep(50 * time.Millisecond)
+
+		connClient.Write(testutil.MakeMessageRequestWithId(t, "testName", "", "method", 1, nil))
+		recvRequest(t, connService)
+
+		start := time.Now()
+		go b.Shutdown(100 * time.Millisecond)
+
+		// The service does not reply before the end of the grace period
+		rep := recvReply(t, connClient)
+		testutil.Equals(t, uint64(1), rep.GetId())
+		testutil.Equals(t, common.ReplyErrorShuttingDown, rep.GetError().GetType())
+		elapsed := time.Since(start)
+		testutil.Assert(t, elapsed < b.Options.RequestTimeout, "Shutdown took too long: %s", elapsed)
+
+		<-b.Quit()
+	})
+}
+
+func TestShutdownClosePublishLoggers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cellaserv-logs")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	b := New(Options{LogsDir: dir}, common.NewLogger("test"))
+	testutil.Ok(t, b.rotatePublishLoggers())
+	b.handleLoggingPublish("odometry", "event")
+
+	// Events are logged while the loggers are closed
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.handleLoggingPublish("odometry", "event")
+		}()
+	}
+	b.closePublishLoggers()
+	wg.Wait()
+
+	// Events published after that are not logged
+	data, err := ioutil.ReadFile(path.Join(b.publishLoggingRoot, "odometry"))
+	testutil.Ok(t, err)
+	b.handleLoggingPublish("odometry", "late")
+	after, err := ioutil.ReadFile(path.Join(b.publishLoggingRoot, "odometry"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, string(data), string(after))
+}
@@ -0,0 +1,229 @@
+package broker
+
+import (
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/golang/protobuf/proto"
+)
+
+// spyKey identifies the services spied by a client. The name and
+// identification are topic patterns when the client spies on several
+// services.
+type spyKey struct {
+	name           string
+	identification string
+}
+
+func (k spyKey) isPattern() bool {
+	return common.IsTopicPattern(k.name) || common.IsTopicPattern(k.identification)
+}
+
+// spyPattern is the set of clients spying on the services matching the
+// patterns.
+type spyPattern struct {
+	name           *common.TopicPattern
+	identification *common.TopicPattern
+	clients        []*client
+}
+
+func (p *spyPattern) match(name string, identification string) bool {
+	return p.name.Match(name) && p.identification.Match(identification)
+}
+
+// SpyService makes the client receive the requests sent to the services
+// matching the name and identification, and their replies, until the client
+// disconnects or unspies. The services do not have to be registered yet.
+func (b *Broker) SpyService(c *client, name string, identification string) error {
+	key := spyKey{name, identification}
+
+	b.spiesMtx.Lock()
+	if key.isPattern() {
+		p, ok := b.spyPatterns[key]
+		if !ok {
+			namePattern, err := common.ParseTopicPattern(name)
+			if err != nil {
+				b.spiesMtx.Unlock()
+				return err
+			}
+			identPattern, err := common.ParseTopicPattern(identification)
+			if err != nil {
+				b.spiesMtx.Unlock()
+				return err
+			}
+			p = &spyPattern{name: namePattern, identification: identPattern}
+			b.spyPatterns[key] = p
+		}
+		if containsClient(p.clients, c) {
+			b.spiesMtx.Unlock()
+			return nil
+		}
+		p.clients = append(p.clients, c)
+	} else {
+		if _, ok := b.spies[name]; !ok {
+			b.spies[name] = make(map[string][]*client)
+		}
+		if containsClient(b.spies[name][identification], c) {
+			b.spiesMtx.Unlock()
+			return nil
+		}
+		b.spies[name][identification] = append(b.spies[name][identification], c)
+	}
+	b.spiesMtx.Unlock()
+
+	b.logger.Debugf("client %s spies on service %s[%s]", c, name, identification)
+	c.mtx.Lock()
+	c.spying = append(c.spying, key)
+	c.mtx.Unlock()
+	return nil
+}
+
+// UnspyService stops the spying of the client on the services matching the
+// name and identification given to SpyService().
+func (b *Broker) UnspyService(c *client, name string, identification string) {
+	key := spyKey{name, identification}
+	b.logger.Debugf("client %s stops spying on service %s[%s]", c, name, identification)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for i, k := range c.spying {
+		if k == key {
+			c.spying = append(c.spying[:i], c.spying[i+1:]...)
+			break
+		}
+	}
+	b.spiesMtx.Lock()
+	b.removeSpy(c, key)
+	b.spiesMtx.Unlock()
+}
+
+func containsClient(clients []*client, c *client) bool {
+	for _, other := range clients {
+		if other == c {
+			return true
+		}
+	}
+	return false
+}
+
+func removeClientFrom(clients []*client, c *client) []*client {
+	for i, other := range clients {
+		if other == c {
+			clients[i] = clients[len(clients)-1]
+			return clients[:len(clients)-1]
+		}
+	}
+	return clients
+}
+
+// removeSpy removes the client from the spies of the key. The spies mutex
+// must be held by caller.
+func (b *Broker) removeSpy(c *client, key spyKey) {
+	if key.isPattern() {
+		p, ok := b.spyPatterns[key]
+		if !ok {
+			return
+		}
+		p.clients = removeClientFrom(p.clients, c)
+		if len(p.clients) == 0 {
+			delete(b.spyPatterns, key)
+		}
+		return
+	}
+	spies := removeClientFrom(b.spies[key.name][key.identification], c)
+	if len(spies) > 0 {
+		b.spies[key.name][key.identification] = spies
+		return
+	}
+	delete(b.spies[key.name], key.identification)
+	if len(b.spies[key.name]) == 0 {
+		delete(b.spies, key.name)
+	}
+}
+
+// spiesOf returns the spies of the service.
+func (b *Broker) spiesOf(name string, identification string) []*client {
+	b.spiesMtx.RLock()
+	defer b.spiesMtx.RUnlock()
+	spies := append([]*client(nil), b.spies[name][identification]...)
+	for _, p := range b.spyPatterns {
+		if !p.match(name, identification) {
+			continue
+		}
+		for _, c := range p.clients {
+			if !containsClient(spies, c) {
+				spies = append(spies, c)
+			}
+		}
+	}
+	return spies
+}
+
+// removeSpiesOnClient removes the client from the spies of the services it
+// spied. The client's mutex must be held by caller.
+func (b *Broker) removeSpiesOnClient(c *client) {
+	b.spiesMtx.Lock()
+	defer b.spiesMtx.Unlock()
+	for _, key := range c.spying {
+		b.removeSpy(c, key)
+	}
+	c.spying = nil
+}
+
+// marshalSpyMessage returns the copy of the request or reply sent to the
+// spies, marked with the id of the client that sent the request.
+func marshalSpyMessage(msgType cellaserv.Message_MessageType, msg proto.Message, sender *client) ([]byte, error) {
+	spyMsg := proto.Clone(msg)
+	common.SetSpySender(spyMsg, sender.id)
+	return common.MarshalMessage(msgType, spyMsg)
+}
+
+// sendSpiesReply forwards the reply of a request to its spies.
+func (b *Broker) sendSpiesReply(reqTrack *requestTracking, rep *cellaserv.Reply) {
+	if len(reqTrack.spies) == 0 {
+		return
+	}
+	msgRaw, err := marshalSpyMessage(cellaserv.Message_Reply, rep, reqTrack.sender)
+	if err != nil {
+		b.logger.Errorf("Could not marshal reply: %s", err)
+		return
+	}
+	for _, spy := range reqTrack.spies {
+		b.logger.Debugf("Sending reply to spy %s", spy)
+		spy.send(msgRaw, reqTrack.priority)
+	}
+}
+
+// sendReplyError replies with an error to a request that is not forwarded to
+// a service. The spies of the service receive the request and the error
+// reply.
+func (b *Broker) sendReplyError(c *client, req *cellaserv.Request, errType cellaserv.Reply_Error_Type) {
+	b.traceRejectedRequest(c, req, errType)
+	b.sendSpiesReplyError(c, req, errType)
+	c.sendReplyError(req, errType)
+}
+
+func (b *Broker) sendSpiesReplyError(sender *client, req *cellaserv.Request, errType cellaserv.Reply_Error_Type) {
+	spies := b.spiesOf(req.ServiceName, req.ServiceIdentification)
+	if len(spies) == 0 {
+		return
+	}
+	reqRaw, err := marshalSpyMessage(cellaserv.Message_Request, req, sender)
+	if err != nil {
+		b.logger.Errorf("Could not marshal request: %s", err)
+		return
+	}
+	rep := &cellaserv.Reply{
+		Id:    req.Id,
+		Error: &cellaserv.Reply_Error{Type: errType},
+	}
+	repRaw, err := marshalSpyMessage(cellaserv.Message_Reply, rep, sender)
+	if err != nil {
+		b.logger.Errorf("Could not marshal reply: %s", err)
+		return
+	}
+	priority := common.GetPriority(req)
+	for _, spy := range spies {
+		spy.send(reqRaw, priority)
+		spy.send(repRaw, priority)
+	}
+}
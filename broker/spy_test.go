@@ -0,0 +1,122 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/evolutek/cellaserv3/testutil"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestSpy(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		connService := testutil.Dial(t)
+		defer connService.Close()
+		connService.Write(testutil.MakeMessageRegister(t, "date", ""))
+
+		connSpy := testutil.Dial(t)
+		defer connSpy.Close()
+		connClient := testutil.Dial(t)
+		defer connClient.Close()
+		time.Sleep(50 * time.Millisecond)
+
+		spy, ok := b.GetClient(connSpy.LocalAddr().String())
+		testutil.Assert(t, ok, "Spy client not found")
+		testutil.Ok(t, b.SpyService(spy, "date", ""))
+
+		// The spy receives the request and the timeout reply
+		connClient.Write(testutil.MakeMessageRequestWithTimeout(t, "date", "", "time", nil, 50*time.Millisecond))
+		req := recvRequest(t, connSpy)
+		testutil.Equals(t, "time", req.GetMethod())
+		recvRequest(t, connService)
+		rep := recvReply(t, connSpy)
+		testutil.Equals(t, req.GetId(), rep.GetId())
+		testutil.Equals(t, cellaserv.Reply_Error_Timeout, rep.GetError().GetType())
+		recvReply(t, connClient)
+
+		// The spy is kept when the service is lost, and receives the
+		// errors of the requests sent meanwhile
+		connService.Close()
+		time.Sleep(50 * time.Millisecond)
+		connClient.Write(testutil.MakeMessageRequest(t, "date", "", "time", nil))
+		req = recvRequest(t, connSpy)
+		rep = recvReply(t, connSpy)
+		testutil.Equals(t, req.GetId(), rep.GetId())
+		testutil.Equals(t, cellaserv.Reply_Error_NoSuchService, rep.GetError().GetType())
+		recvReply(t, connClient)
+
+		// The spy spies the service registered again
+		connService = testutil.Dial(t)
+		defer connService.Close()
+		connService.Write(testutil.MakeMessageRegister(t, "date", ""))
+		time.Sleep(50 * time.Millisecond)
+		connClient.Write(testutil.MakeMessageRequestWithId(t, "date", "", "time", 42, nil))
+		req = recvRequest(t, connSpy)
+		serviceReq := recvRequest(t, connService)
+		connService.Write(testutil.MakeMessageReply(t, serviceReq.GetId(), []byte("42")))
+		rep = recvReply(t, connSpy)
+		testutil.Equals(t, req.GetId(), rep.GetId())
+		testutil.Equals(t, []byte("42"), rep.GetData())
+		recvReply(t, connClient)
+
+		// The spy sees the id chosen by the sender, and the sender
+		testutil.Equals(t, uint64(42), req.GetId())
+		for _, msg := range []proto.Message{req, rep} {
+			sender, ok := common.SpySender(msg)
+			testutil.Assert(t, ok, "Spied messages should carry their sender")
+			testutil.Equals(t, connClient.LocalAddr().String(), sender)
+		}
+		_, ok = common.SpySender(serviceReq)
+		testutil.Assert(t, !ok, "The service request should not carry a sender")
+
+		// Spies are removed when they disconnect
+		connSpy.Close()
+		time.Sleep(50 * time.Millisecond)
+		testutil.Equals(t, 0, len(b.spiesOf("date", "")))
+	})
+}
+
+func TestSpyPattern(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		connSpyMotors := testutil.Dial(t)
+		defer connSpyMotors.Close()
+		connSpyAll := testutil.Dial(t)
+		defer connSpyAll.Close()
+		connClient := testutil.Dial(t)
+		defer connClient.Close()
+		time.Sleep(50 * time.Millisecond)
+
+		// The services do not have to be registered
+		spyMotors, _ := b.GetClient(connSpyMotors.LocalAddr().String())
+		testutil.Ok(t, b.SpyService(spyMotors, "motor", "*"))
+		spyAll, _ := b.GetClient(connSpyAll.LocalAddr().String())
+		testutil.Ok(t, b.SpyService(spyAll, "*", "*"))
+		testutil.Ok(t, b.SpyService(spyAll, "motor", "left"))
+		testutil.Assert(t, b.SpyService(spyAll, "[motor", "*") != nil, "Invalid pattern should be rejected")
+
+		connService := testutil.Dial(t)
+		defer connService.Close()
+		connService.Write(testutil.MakeMessageRegister(t, "motor", "left"))
+		connService.Write(testutil.MakeMessageRegister(t, "date", ""))
+		time.Sleep(50 * time.Millisecond)
+
+		// Spies matching several times receive the request once
+		connClient.Write(testutil.MakeMessageRequest(t, "motor", "left", "stop", nil))
+		testutil.Equals(t, "stop", recvRequest(t, connSpyMotors).GetMethod())
+		testutil.Equals(t, "stop", recvRequest(t, connSpyAll).GetMethod())
+		recvRequest(t, connService)
+
+		connClient.Write(testutil.MakeMessageRequest(t, "date", "", "time", nil))
+		testutil.Equals(t, "time", recvRequest(t, connSpyAll).GetMethod())
+		recvRequest(t, connService)
+
+		// After unspying, only the exact spy is left
+		b.UnspyService(spyAll, "*", "*")
+		b.UnspyService(spyMotors, "motor", "*")
+		testutil.Equals(t, []*client{spyAll}, b.spiesOf("motor", "left"))
+		testutil.Equals(t, 0, len(b.spiesOf("date", "")))
+		testutil.Equals(t, 0, len(b.spyPatterns))
+	})
+}
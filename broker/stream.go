@@ -0,0 +1,371 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/evolutek/cellaserv3/common"
+)
+
+// The durable stream is stored in two files of the streams directory:
+//
+// events.log is the list of the records, each made of a header and of the
+// publish message as sent to the subscribers:
+//
+//	length    uint32, length of the message
+//	checksum  uint32, CRC-32 of the sequence, time and message
+//	sequence  uint64
+//	time      int64, nanoseconds since the Unix epoch
+//	message   [length]byte
+//
+// events.index is a sparse index of the log, with an entry every
+// streamIndexInterval records:
+//
+//	sequence  uint64
+//	time      int64
+//	offset    int64, offset of the record in events.log
+//
+// All integers are big endian.
+const (
+	streamLogFilename   = "events.log"
+	streamIndexFilename = "events.index"
+	streamHeaderSize    = 24
+	streamIndexSize     = 24
+	streamIndexInterval = 128
+)
+
+var errStreamClosed = errors.New("Stream is closed")
+
+type streamRecord struct {
+	seq      uint64
+	time     time.Time
+	msgBytes []byte
+}
+
+type streamIndexEntry struct {
+	seq    uint64
+	time   int64
+	offset int64
+}
+
+// eventStream is the durable stream of the events matching its patterns.
+type eventStream struct {
+	// Held while appending an event and sending it to the subscribers
+	mtx sync.Mutex
+
+	patterns []*common.TopicPattern
+	logPath  string
+
+	log        *os.File
+	index      *os.File
+	size       int64
+	lastSeq    uint64
+	entries    []streamIndexEntry
+	sinceIndex int
+}
+
+func encodeStreamHeader(rec *streamRecord) []byte {
+	header := make([]byte, streamHeaderSize)
+	binary.BigEndian.PutUint32(header[0:], uint32(len(rec.msgBytes)))
+	binary.BigEndian.PutUint64(header[8:], rec.seq)
+	binary.BigEndian.PutUint64(header[16:], uint64(rec.time.UnixNano()))
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[8:])
+	checksum.Write(rec.msgBytes)
+	binary.BigEndian.PutUint32(header[4:], checksum.Sum32())
+	return header
+}
+
+// readStreamRecord reads a record. Returns io.ErrUnexpectedEOF if the record
+// is incomplete or corrupted, which happens when cellaserv stopped while
+// writing it.
+func readStreamRecord(r io.Reader) (*streamRecord, error) {
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	msgBytes := make([]byte, binary.BigEndian.Uint32(header[0:]))
+	if _, err := io.ReadFull(r, msgBytes); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[8:])
+	checksum.Write(msgBytes)
+	if checksum.Sum32() != binary.BigEndian.Uint32(header[4:]) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return &streamRecord{
+		seq:      binary.BigEndian.Uint64(header[8:]),
+		time:     time.Unix(0, int64(binary.BigEndian.Uint64(header[16:]))),
+		msgBytes: msgBytes,
+	}, nil
+}
+
+// openEventStream opens the durable stream stored in dir, creating it if
+// needed. Records that were not completely written are removed.
+func openEventStream(dir string, patterns []string) (*eventStream, error) {
+	s := &eventStream{logPath: path.Join(dir, streamLogFilename)}
+	for _, pattern := range patterns {
+		p, err := common.ParseTopicPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		s.patterns = append(s.patterns, p)
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	var err error
+	s.log, err = os.OpenFile(s.logPath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	s.index, err = os.OpenFile(path.Join(dir, streamIndexFilename), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		s.log.Close()
+		return nil, err
+	}
+	if err := s.recover(); err != nil {
+		s.close()
+		return nil, fmt.Errorf("Could not recover stream %s: %s", dir, err)
+	}
+	return s, nil
+}
+
+// recover loads the index, then reads the records following the last
+// indexed one to find the end of the log.
+func (s *eventStream) recover() error {
+	logInfo, err := s.log.Stat()
+	if err != nil {
+		return err
+	}
+	indexBytes, err := ioutil.ReadAll(s.index)
+	if err != nil {
+		return err
+	}
+	for len(indexBytes) >= streamIndexSize {
+		entry := streamIndexEntry{
+			seq:    binary.BigEndian.Uint64(indexBytes[0:]),
+			time:   int64(binary.BigEndian.Uint64(indexBytes[8:])),
+			offset: int64(binary.BigEndian.Uint64(indexBytes[16:])),
+		}
+		if entry.offset >= logInfo.Size() {
+			break
+		}
+		s.entries = append(s.entries, entry)
+		indexBytes = indexBytes[streamIndexSize:]
+	}
+
+	// Read the records after the last indexed one
+	if len(s.entries) > 0 {
+		last := s.entries[len(s.entries)-1]
+		s.size = last.offset
+		s.entries = s.entries[:len(s.entries)-1]
+	}
+	if _, err := s.log.Seek(s.size, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(s.log)
+	for {
+		rec, err := readStreamRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		s.indexRecord(rec, s.size)
+		s.size += streamHeaderSize + int64(len(rec.msgBytes))
+		s.lastSeq = rec.seq
+	}
+
+	// Remove the incomplete record, if any, and write the index again
+	if err := s.log.Truncate(s.size); err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(s.size, io.SeekStart); err != nil {
+		return err
+	}
+	if err := s.index.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.index.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	for _, entry := range s.entries {
+		if err := s.writeIndexEntry(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexRecord adds the record at offset to the in-memory index if needed.
+// Returns whether the record was indexed.
+func (s *eventStream) indexRecord(rec *streamRecord, offset int64) bool {
+	indexed := s.sinceIndex == 0
+	if indexed {
+		s.entries = append(s.entries, streamIndexEntry{rec.seq, rec.time.UnixNano(), offset})
+	}
+	s.sinceIndex = (s.sinceIndex + 1) % streamIndexInterval
+	return indexed
+}
+
+func (s *eventStream) writeIndexEntry(entry streamIndexEntry) error {
+	b := make([]byte, streamIndexSize)
+	binary.BigEndian.PutUint64(b[0:], entry.seq)
+	binary.BigEndian.PutUint64(b[8:], uint64(entry.time))
+	binary.BigEndian.PutUint64(b[16:], uint64(entry.offset))
+	_, err := s.index.Write(b)
+	return err
+}
+
+// matches returns whether the event is part of the stream.
+func (s *eventStream) matches(event string) bool {
+	for _, p := range s.patterns {
+		if p.Match(event) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextSequence returns the sequence number of the next event. The stream
+// lock must be held.
+func (s *eventStream) nextSequence() uint64 {
+	return s.lastSeq + 1
+}
+
+// append adds the record to the stream. The stream lock must be held.
+func (s *eventStream) append(rec *streamRecord) error {
+	if s.log == nil {
+		return errStreamClosed
+	}
+	header := encodeStreamHeader(rec)
+	if _, err := s.log.Write(append(header, rec.msgBytes...)); err != nil {
+		// Do not keep a partial record in the middle of the log
+		s.log.Truncate(s.size)
+		s.log.Seek(s.size, io.SeekStart)
+		return err
+	}
+	offset := s.size
+	s.size += streamHeaderSize + int64(len(rec.msgBytes))
+	s.lastSeq = rec.seq
+	if s.indexRecord(rec, offset) {
+		return s.writeIndexEntry(s.entries[len(s.entries)-1])
+	}
+	return nil
+}
+
+// A streamPosition is where a replay of the stream starts: at a sequence
+// number, or at a time if fromTime is set.
+type streamPosition struct {
+	seq      uint64
+	time     time.Time
+	fromTime bool
+}
+
+// includes returns whether the record is at or after the position.
+func (p streamPosition) includes(rec *streamRecord) bool {
+	if p.fromTime {
+		return !rec.time.Before(p.time)
+	}
+	return rec.seq >= p.seq
+}
+
+// offset returns the offset of the last indexed record before the position.
+// The stream lock must be held.
+func (s *eventStream) offset(pos streamPosition) int64 {
+	i := sort.Search(len(s.entries), func(i int) bool {
+		if pos.fromTime {
+			return s.entries[i].time >= pos.time.UnixNano()
+		}
+		return s.entries[i].seq >= pos.seq
+	})
+	if i == 0 {
+		return 0
+	}
+	return s.entries[i-1].offset
+}
+
+// A streamReader reads the records of the stream from a position.
+type streamReader struct {
+	file   *os.File
+	r      *bufio.Reader
+	pos    streamPosition
+	offset int64
+	// Offset of the end of the stream when the reader was last updated
+	end int64
+}
+
+// newReader returns a reader of the records from the position to the
+// current end of the stream. The stream lock must be held.
+func (s *eventStream) newReader(pos streamPosition) (*streamReader, error) {
+	if s.log == nil {
+		return nil, errStreamClosed
+	}
+	file, err := os.Open(s.logPath)
+	if err != nil {
+		return nil, err
+	}
+	offset := s.offset(pos)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &streamReader{
+		file:   file,
+		r:      bufio.NewReader(file),
+		pos:    pos,
+		offset: offset,
+		end:    s.size,
+	}, nil
+}
+
+// next returns the next record at or after the position of the reader, or
+// io.EOF when the end of the stream is reached.
+func (r *streamReader) next() (*streamRecord, error) {
+	for r.offset < r.end {
+		rec, err := readStreamRecord(r.r)
+		if err != nil {
+			return nil, err
+		}
+		r.offset += streamHeaderSize + int64(len(rec.msgBytes))
+		if r.pos.includes(rec) {
+			return rec, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+func (r *streamReader) close() {
+	r.file.Close()
+}
+
+// close closes the files of the stream. Events are not appended anymore.
+func (s *eventStream) close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.log == nil {
+		return nil
+	}
+	err := s.log.Sync()
+	s.log.Close()
+	s.index.Close()
+	s.log = nil
+	return err
+}
@@ -0,0 +1,133 @@
+package broker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/evolutek/cellaserv3/testutil"
+	"github.com/golang/protobuf/proto"
+)
+
+// appendRecords appends n records to the stream, with times one second apart
+// from start.
+func appendRecords(t *testing.T, s *eventStream, n int, start time.Time) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for i := 0; i < n; i++ {
+		seq := s.nextSequence()
+		rec := &streamRecord{
+			seq:      seq,
+			time:     start.Add(time.Duration(seq) * time.Second),
+			msgBytes: []byte(fmt.Sprint(seq)),
+		}
+		testutil.Ok(t, s.append(rec))
+	}
+}
+
+// readSequences returns the sequence numbers of the records from the
+// position.
+func readSequences(t *testing.T, s *eventStream, pos streamPosition) []uint64 {
+	s.mtx.Lock()
+	r, err := s.newReader(pos)
+	s.mtx.Unlock()
+	testutil.Ok(t, err)
+	defer r.close()
+	var seqs []uint64
+	for {
+		rec, err := r.next()
+		if err == io.EOF {
+			return seqs
+		}
+		testutil.Ok(t, err)
+		testutil.Equals(t, fmt.Sprint(rec.seq), string(rec.msgBytes))
+		seqs = append(seqs, rec.seq)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Unix(1600000000, 0)
+
+	s, err := openEventStream(dir, []string{"robot.**"})
+	testutil.Ok(t, err)
+	testutil.Assert(t, s.matches("robot.pal.position"), "Event should be streamed")
+	testutil.Assert(t, !s.matches("log.robot"), "Event should not be streamed")
+
+	const count = 3*streamIndexInterval + 10
+	appendRecords(t, s, count, start)
+	testutil.Equals(t, 4, len(s.entries))
+
+	seqs := readSequences(t, s, streamPosition{seq: 300})
+	testutil.Equals(t, count-299, len(seqs))
+	testutil.Equals(t, uint64(300), seqs[0])
+	seqs = readSequences(t, s, streamPosition{time: start.Add(200 * time.Second), fromTime: true})
+	testutil.Equals(t, uint64(200), seqs[0])
+	testutil.Equals(t, count, len(readSequences(t, s, streamPosition{})))
+	testutil.Ok(t, s.close())
+
+	// Simulate a crash while writing a record
+	logFile, err := os.OpenFile(path.Join(dir, streamLogFilename), os.O_WRONLY|os.O_APPEND, 0)
+	testutil.Ok(t, err)
+	_, err = logFile.Write([]byte{0, 0, 0, 42, 1, 2})
+	testutil.Ok(t, err)
+	logFile.Close()
+
+	// The stream continues after its last complete record
+	s, err = openEventStream(dir, []string{"robot.**"})
+	testutil.Ok(t, err)
+	defer s.close()
+	testutil.Equals(t, uint64(count), s.lastSeq)
+	testutil.Equals(t, 4, len(s.entries))
+	appendRecords(t, s, 1, start)
+	seqs = readSequences(t, s, streamPosition{seq: count - 1})
+	testutil.Equals(t, []uint64{count - 1, count, count + 1}, seqs)
+}
+
+func TestStreamReplay(t *testing.T) {
+	options := Options{
+		LogsDir:        t.TempDir(),
+		StreamPatterns: []string{"robot.*"},
+	}
+	brokerTestWithOptions(t, options, func(b *Broker) {
+		conn := testutil.Dial(t)
+		defer conn.Close()
+
+		// recvEvent receives a publish, and returns its event and
+		// sequence number
+		recvEvent := func() (string, uint64) {
+			t.Helper()
+			msg := testutil.RecvMessage(t, conn)
+			testutil.MsgTypeIs(t, msg, cellaserv.Message_Publish)
+			pub := &cellaserv.Publish{}
+			testutil.Ok(t, proto.Unmarshal(msg.GetContent(), pub))
+			seq, _, _ := common.PublishSequence(pub)
+			return pub.GetEvent(), seq
+		}
+
+		for _, event := range []string{"robot.a", "other", "robot.b", "robot.c"} {
+			conn.Write(testutil.MakeMessagePublish(t, event))
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		conn.Write(testutil.MakeMessageSubscribeFromSequence(t, "robot.*", 2))
+		event, seq := recvEvent()
+		testutil.Equals(t, "robot.b", event)
+		testutil.Equals(t, uint64(2), seq)
+		event, seq = recvEvent()
+		testutil.Equals(t, "robot.c", event)
+		testutil.Equals(t, uint64(3), seq)
+
+		// Live events follow the replay
+		time.Sleep(50 * time.Millisecond)
+		conn.Write(testutil.MakeMessagePublish(t, "robot.d"))
+		event, seq = recvEvent()
+		testutil.Equals(t, "robot.d", event)
+		testutil.Equals(t, uint64(4), seq)
+	})
+}
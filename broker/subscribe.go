@@ -1,9 +1,11 @@
 package broker
 
 import (
-	"strings"
+	"encoding/json"
 
 	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
 )
 
 type logSubscriberJSON struct {
@@ -12,33 +14,171 @@ type logSubscriberJSON struct {
 }
 
 func (b *Broker) handleSubscribe(c *client, sub *cellaserv.Subscribe) {
-	c.logger.Infof("Subscribes to event %q", sub.Event)
+	durableName, durable := common.SubscribeDurable(sub)
+	if deliveryId, ok := common.SubscribeAck(sub); ok {
+		b.handleAck(c, durableName, deliveryId)
+		return
+	}
+
+	queueName, queuePolicy, queue := common.SubscribeQueue(sub)
+
+	filterExpr, filtered := common.SubscribeFilter(sub)
+
+	if common.SubscribeUnsubscribe(sub) {
+		if queue {
+			b.handleQueueUnsubscribe(c, queueName, sub.Event)
+		} else if durable {
+			b.handleDurableUnsubscribe(c, durableName)
+		} else if filtered {
+			b.unsubscribeFilter(c, sub.Event, filterExpr)
+		} else {
+			b.HandleUnsubscribe(c, sub.Event)
+		}
+		return
+	}
+
+	pattern, err := common.ParseTopicPattern(sub.Event)
+	if err != nil {
+		c.logger.Warnf("Invalid subscribe: %s", err)
+		b.sendSubscribeError(c, sub.Event, filterExpr, err)
+		return
+	}
+	var opts subscribeOptions
+	if filterExpr != "" {
+		opts.filter, err = common.ParseFilter(filterExpr)
+		if err != nil {
+			c.logger.Warnf("Invalid subscribe: %s", err)
+			b.sendSubscribeError(c, sub.Event, filterExpr, err)
+			return
+		}
+	}
+
+	if durable {
+		b.handleDurableSubscribe(c, durableName, pattern)
+		return
+	}
+
+	if queue {
+		b.handleQueueSubscribe(c, queueName, queuePolicy, pattern)
+		return
+	}
+
+	pos, replay := subscribeReplayPosition(sub)
+	if replay && b.stream == nil {
+		c.logger.Warnf("Cannot replay %q, no durable stream is configured", sub.Event)
+		replay = false
+	}
+
+	if opts.filter != nil {
+		c.logger.Infof("Subscribes to event %q with filter %q", sub.Event, filterExpr)
+	} else {
+		c.logger.Infof("Subscribes to event %q", sub.Event)
+	}
+	if interval, mode, ok := common.SubscribeRate(sub); ok {
+		c.logger.Infof("Rate of event %q limited to one per %s", sub.Event, interval)
+		opts.limiter = newRateLimiter(c, interval, mode, b.Monitoring.rateLimited)
+	}
 
 	// Check for duplicate subscribes by the client
 	c.mtx.Lock()
-	defer c.mtx.Unlock()
 	present := false
-	for _, pattern := range c.subscribes {
-		if pattern == sub.Event {
+	for _, p := range c.subscribes {
+		if p == sub.Event {
 			present = true
 			break
 		}
 	}
 	if present {
+		c.mtx.Unlock()
 		c.logger.Infof("Client already subscribed to %q", sub.Event)
+		// The handler may have a filter and a rate of its own
+		b.subscriptions.add(pattern, c, opts)
+		// The client subscribes again for a new handler, which
+		// expects the retained events
+		if replay {
+			go b.replayStream(c, pattern, opts, pos, false)
+		}
+		b.sendRetained(c, pattern, opts)
 		return
 	}
 	c.subscribes = append(c.subscribes, sub.Event)
-
-	if strings.Contains(sub.Event, "*") {
-		b.subscriberMatchMapMtx.Lock()
-		b.subscriberMatchMap[sub.Event] = append(b.subscriberMatchMap[sub.Event], c)
-		b.subscriberMatchMapMtx.Unlock()
-	} else {
-		b.subscriberMapMtx.Lock()
-		b.subscriberMap[sub.Event] = append(b.subscriberMap[sub.Event], c)
-		b.subscriberMapMtx.Unlock()
+	if replay {
+		// The client is subscribed after the replay
+		c.mtx.Unlock()
+		go b.replayStream(c, pattern, opts, pos, true)
+		return
 	}
+	b.subscriptions.add(pattern, c, opts)
+	c.mtx.Unlock()
 
 	b.cellaservPublish(logNewSubscriber, logSubscriberJSON{sub.Event, c.id})
+
+	b.sendRetained(c, pattern, opts)
+}
+
+// unsubscribeFilter removes the filter from the subscription of the client to
+// the pattern, the empty filter being the subscribe without a filter. The
+// client is unsubscribed when no filter is left.
+func (b *Broker) unsubscribeFilter(c *client, pattern string, filter string) {
+	c.mtx.Lock()
+	found, remaining := false, false
+	for i, p := range c.subscribes {
+		if p == pattern {
+			found = true
+			remaining = b.subscriptions.removeFilter(pattern, c, filter)
+			if !remaining {
+				c.subscribes = append(c.subscribes[:i], c.subscribes[i+1:]...)
+			}
+			break
+		}
+	}
+	c.mtx.Unlock()
+	if !found {
+		c.logger.Warnf("Client is not subscribed to %q", pattern)
+		return
+	}
+	if remaining {
+		c.logger.Infof("Removes filter %q from event %q", filter, pattern)
+		return
+	}
+
+	c.logger.Infof("Unsubscribes from event %q", pattern)
+
+	b.cellaservPublish(logLostSubscriber, logSubscriberJSON{pattern, c.id})
+}
+
+// sendSubscribeError reports to the client that its subscribe failed.
+func (b *Broker) sendSubscribeError(c *client, pattern string, filter string, err error) {
+	data, _ := json.Marshal(api.SubscribeErrorJSON{Filter: filter, Error: err.Error()})
+	pub := &cellaserv.Publish{Event: pattern, Data: data}
+	common.SetPublishSubscribeError(pub)
+	msg, err := common.MarshalMessage(cellaserv.Message_Publish, pub)
+	if err != nil {
+		c.logger.Errorf("Could not marshal subscribe error: %s", err)
+		return
+	}
+	c.send(msg, common.PriorityUnset)
+}
+
+// HandleUnsubscribe removes the subscription of the client to the pattern.
+func (b *Broker) HandleUnsubscribe(c *client, pattern string) {
+	c.mtx.Lock()
+	present := false
+	for i, p := range c.subscribes {
+		if p == pattern {
+			c.subscribes = append(c.subscribes[:i], c.subscribes[i+1:]...)
+			b.subscriptions.remove(pattern, c)
+			present = true
+			break
+		}
+	}
+	c.mtx.Unlock()
+	if !present {
+		c.logger.Warnf("Client is not subscribed to %q", pattern)
+		return
+	}
+
+	c.logger.Infof("Unsubscribes from event %q", pattern)
+
+	b.cellaservPublish(logLostSubscriber, logSubscriberJSON{pattern, c.id})
 }
@@ -1,10 +1,15 @@
 package broker
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
 	"github.com/evolutek/cellaserv3/testutil"
+	"github.com/golang/protobuf/proto"
 )
 
 func TestSubscribe(t *testing.T) {
@@ -18,3 +23,99 @@ func TestSubscribe(t *testing.T) {
 		time.Sleep(50 * time.Millisecond)
 	})
 }
+
+func TestUnsubscribe(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		conn := testutil.Dial(t)
+		defer conn.Close()
+		connLogs := testutil.Dial(t)
+		defer connLogs.Close()
+
+		connLogs.Write(testutil.MakeMessageSubscribe(t, logLostSubscriber))
+		conn.Write(testutil.MakeMessageSubscribe(t, "test"))
+		conn.Write(testutil.MakeMessageSubscribe(t, "test.*"))
+
+		time.Sleep(50 * time.Millisecond)
+
+		conn.Write(testutil.MakeMessageUnsubscribe(t, "test"))
+		conn.Write(testutil.MakeMessageUnsubscribe(t, "test.*"))
+
+		// Unsubscribes are published
+		for _, pattern := range []string{"test", "test.*"} {
+			msg := testutil.RecvMessage(t, connLogs)
+			pub := &cellaserv.Publish{}
+			testutil.Ok(t, proto.Unmarshal(msg.GetContent(), pub))
+			testutil.Equals(t, logLostSubscriber, pub.GetEvent())
+			var sub logSubscriberJSON
+			testutil.Ok(t, json.Unmarshal(pub.GetData(), &sub))
+			testutil.Equals(t, pattern, sub.Event)
+		}
+
+		// Only the subscription of connLogs is left
+		events := b.GetEventsJSON()
+		testutil.Equals(t, 1, len(events))
+		testutil.Equals(t, logLostSubscriber, events[0].Event)
+	})
+}
+
+func TestSubscribeInvalidPattern(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		conn := testutil.Dial(t)
+		defer conn.Close()
+
+		conn.Write(testutil.MakeMessageSubscribe(t, "test.[ab"))
+		conn.Write(testutil.MakeMessageSubscribe(t, "test.[ab]"))
+		time.Sleep(50 * time.Millisecond)
+
+		// Only the valid pattern is subscribed
+		events := b.GetEventsJSON()
+		testutil.Equals(t, 1, len(events))
+		testutil.Equals(t, "test.[ab]", events[0].Event)
+	})
+}
+
+func TestSubscribeFilter(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		conn := testutil.Dial(t)
+		defer conn.Close()
+
+		conn.Write(testutil.MakeMessageSubscribeFilter(t, "position.*", `robot == "pal" && speed > 0.1`))
+		time.Sleep(50 * time.Millisecond)
+
+		events := b.GetEventsJSON()
+		testutil.Equals(t, 1, len(events))
+		testutil.Equals(t, 1, len(events[0].Filters))
+		for _, filters := range events[0].Filters {
+			testutil.Equals(t, []string{`robot == "pal" && speed > 0.1`}, filters)
+		}
+
+		pub := testutil.Dial(t)
+		defer pub.Close()
+		for _, data := range []string{
+			`{"robot": "pal", "speed": 0}`,
+			`{"robot": "pmi", "speed": 0.5}`,
+			`not json`,
+			`{"robot": "pal", "speed": 0.5}`,
+		} {
+			pub.Write(testutil.MakeMessagePublishData(t, "position.pal", []byte(data)))
+		}
+
+		// Only the matching event is sent
+		msg := testutil.RecvMessage(t, conn)
+		testutil.MsgTypeIs(t, msg, cellaserv.Message_Publish)
+		recvPub := &cellaserv.Publish{}
+		testutil.Ok(t, proto.Unmarshal(msg.GetContent(), recvPub))
+		testutil.Equals(t, `{"robot": "pal", "speed": 0.5}`, string(recvPub.GetData()))
+
+		// Invalid filters are reported to the subscriber
+		conn.Write(testutil.MakeMessageSubscribeFilter(t, "position.*", "speed >"))
+		msg = testutil.RecvMessage(t, conn)
+		testutil.MsgTypeIs(t, msg, cellaserv.Message_Publish)
+		recvPub = &cellaserv.Publish{}
+		testutil.Ok(t, proto.Unmarshal(msg.GetContent(), recvPub))
+		testutil.Assert(t, common.PublishSubscribeError(recvPub), "Publish should report the subscribe error")
+		var subErr api.SubscribeErrorJSON
+		testutil.Ok(t, json.Unmarshal(recvPub.GetData(), &subErr))
+		testutil.Equals(t, "speed >", subErr.Filter)
+	})
+}
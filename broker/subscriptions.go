@@ -0,0 +1,402 @@
+package broker
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+// Maximum number of events whose subscribers are cached. The cache is cleared
+// when it is full, so that events with generated names do not make it grow
+// forever.
+const subscriptionCacheSize = 4096
+
+// A subscriber is a client subscribed to a pattern, and the filters of its
+// subscribes.
+type subscriber struct {
+	client *client
+	// The client subscribed without a filter
+	unfiltered bool
+	filters    []*common.Filter
+	// Rate limit of the events sent to the client, nil if the events are
+	// sent as they are published
+	limiter *rateLimiter
+}
+
+// accepts returns whether the event payload is sent to the subscriber.
+func (s *subscriber) accepts(data *common.FilterData) bool {
+	if s.unfiltered {
+		return true
+	}
+	for _, f := range s.filters {
+		if f.Match(data) {
+			return true
+		}
+	}
+	return false
+}
+
+// addFilter adds the filter of a subscribe, nil for a subscribe without a
+// filter.
+func (s *subscriber) addFilter(filter *common.Filter) {
+	if filter == nil {
+		s.unfiltered = true
+		return
+	}
+	for _, f := range s.filters {
+		if f.String() == filter.String() {
+			return
+		}
+	}
+	s.filters = append(s.filters, filter)
+}
+
+// setLimiter replaces the rate limit of the subscriber.
+func (s *subscriber) setLimiter(limiter *rateLimiter) {
+	if s.limiter != nil {
+		s.limiter.stop()
+	}
+	s.limiter = limiter
+}
+
+// merge adds the filters of other, a subscriber of the same client. The
+// events are not rate limited if one of the subscribers is not.
+func (s *subscriber) merge(other *subscriber) {
+	if other.limiter == nil {
+		s.limiter = nil
+	}
+	s.unfiltered = s.unfiltered || other.unfiltered
+	if !s.unfiltered {
+		for _, f := range other.filters {
+			s.addFilter(f)
+		}
+	}
+}
+
+// subscribeOptions are the options of a subscribe of a client to a pattern.
+type subscribeOptions struct {
+	// Filter of the events payload, nil to receive all the events
+	filter *common.Filter
+	// Rate limit of the events, nil if the events are sent as they are
+	// published
+	limiter *rateLimiter
+}
+
+// A subscription is a pattern and the clients subscribed to it.
+type subscription struct {
+	pattern     *common.TopicPattern
+	subscribers []*subscriber
+}
+
+// A subscriptionNode is a node of the subscription trie. Each level of the
+// trie is a segment of the patterns.
+type subscriptionNode struct {
+	// Children for literal segments, by segment
+	literals map[string]*subscriptionNode
+	// Children for segments with wildcards or character classes, by
+	// segment as written in the pattern
+	globs map[string]*subscriptionNode
+	// Segment of the node, if it is a glob node
+	segment common.TopicSegment
+	// Child for the "*" segment
+	any *subscriptionNode
+	// Child for the "**" segment
+	anyMany *subscriptionNode
+	// Subscriptions whose pattern ends at this node, by pattern
+	subscriptions map[string]*subscription
+}
+
+func (n *subscriptionNode) isEmpty() bool {
+	return len(n.literals) == 0 && len(n.globs) == 0 && n.any == nil &&
+		n.anyMany == nil && len(n.subscriptions) == 0
+}
+
+// child returns the child of the node for the segment, creating it if create
+// is true.
+func (n *subscriptionNode) child(segment common.TopicSegment, create bool) *subscriptionNode {
+	switch {
+	case segment.IsAny():
+		if n.any == nil && create {
+			n.any = &subscriptionNode{}
+		}
+		return n.any
+	case segment.IsAnyMany():
+		if n.anyMany == nil && create {
+			n.anyMany = &subscriptionNode{}
+		}
+		return n.anyMany
+	}
+	if literal, ok := segment.Literal(); ok {
+		child := n.literals[literal]
+		if child == nil && create {
+			if n.literals == nil {
+				n.literals = make(map[string]*subscriptionNode)
+			}
+			child = &subscriptionNode{}
+			n.literals[literal] = child
+		}
+		return child
+	}
+	child := n.globs[segment.String()]
+	if child == nil && create {
+		if n.globs == nil {
+			n.globs = make(map[string]*subscriptionNode)
+		}
+		child = &subscriptionNode{segment: segment}
+		n.globs[segment.String()] = child
+	}
+	return child
+}
+
+// removeChild removes the child of the node for the segment.
+func (n *subscriptionNode) removeChild(segment common.TopicSegment) {
+	switch {
+	case segment.IsAny():
+		n.any = nil
+	case segment.IsAnyMany():
+		n.anyMany = nil
+	default:
+		if literal, ok := segment.Literal(); ok {
+			delete(n.literals, literal)
+		} else {
+			delete(n.globs, segment.String())
+		}
+	}
+}
+
+// collect adds the clients subscribed to the patterns matching the event
+// segments to subs, with their filters.
+func (n *subscriptionNode) collect(event string, names []string, subs map[*client]*subscriber) {
+	// "**" matches zero or more segments
+	if n.anyMany != nil {
+		for i := 0; i <= len(names); i++ {
+			n.anyMany.collect(event, names[i:], subs)
+		}
+	}
+
+	if len(names) == 0 {
+		for _, s := range n.subscriptions {
+			if s.pattern.Excluded(event) {
+				continue
+			}
+			for _, sub := range s.subscribers {
+				if merged, ok := subs[sub.client]; ok {
+					merged.merge(sub)
+				} else {
+					// Copy, the returned subscribers are cached
+					subs[sub.client] = &subscriber{
+						client:     sub.client,
+						unfiltered: sub.unfiltered,
+						filters:    append([]*common.Filter(nil), sub.filters...),
+						limiter:    sub.limiter,
+					}
+				}
+			}
+		}
+		return
+	}
+
+	name, rest := names[0], names[1:]
+	if child, ok := n.literals[name]; ok {
+		child.collect(event, rest, subs)
+	}
+	if n.any != nil {
+		n.any.collect(event, rest, subs)
+	}
+	for _, child := range n.globs {
+		if child.segment.Match(name) {
+			child.collect(event, rest, subs)
+		}
+	}
+}
+
+// A subscriptionIndex stores the subscriptions in a trie of pattern segments,
+// and caches the subscribers of the last published events.
+type subscriptionIndex struct {
+	mtx           sync.RWMutex
+	root          subscriptionNode
+	subscriptions map[string]*subscription
+
+	// Subscribers by event, cleared on subscribe and unsubscribe
+	cacheMtx sync.Mutex
+	cache    map[string][]*subscriber
+}
+
+func newSubscriptionIndex() *subscriptionIndex {
+	return &subscriptionIndex{
+		subscriptions: make(map[string]*subscription),
+		cache:         make(map[string][]*subscriber),
+	}
+}
+
+// invalidate clears the cache. The index lock must be held for writing.
+func (idx *subscriptionIndex) invalidate() {
+	idx.cacheMtx.Lock()
+	idx.cache = make(map[string][]*subscriber)
+	idx.cacheMtx.Unlock()
+}
+
+// add subscribes the client to the pattern. The filter is added to the
+// filters of the client, the rate limit replaces its previous one.
+func (idx *subscriptionIndex) add(pattern *common.TopicPattern, c *client, opts subscribeOptions) {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	defer idx.invalidate()
+
+	if s, ok := idx.subscriptions[pattern.String()]; ok {
+		for _, sub := range s.subscribers {
+			if sub.client == c {
+				sub.addFilter(opts.filter)
+				sub.setLimiter(opts.limiter)
+				return
+			}
+		}
+		sub := &subscriber{client: c, limiter: opts.limiter}
+		sub.addFilter(opts.filter)
+		s.subscribers = append(s.subscribers, sub)
+		return
+	}
+
+	node := &idx.root
+	for _, segment := range pattern.Segments() {
+		node = node.child(segment, true)
+	}
+	sub := &subscriber{client: c, limiter: opts.limiter}
+	sub.addFilter(opts.filter)
+	s := &subscription{pattern: pattern, subscribers: []*subscriber{sub}}
+	if node.subscriptions == nil {
+		node.subscriptions = make(map[string]*subscription)
+	}
+	node.subscriptions[pattern.String()] = s
+	idx.subscriptions[pattern.String()] = s
+}
+
+// remove unsubscribes the client from the pattern, whatever the filters.
+func (idx *subscriptionIndex) remove(pattern string, c *client) {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	idx.removeSubscriber(pattern, c)
+}
+
+// removeFilter removes the filter of the subscription of the client to the
+// pattern, the empty filter being the subscribe without a filter. The client
+// is unsubscribed when it has no filter left. Returns whether the client is
+// still subscribed to the pattern.
+func (idx *subscriptionIndex) removeFilter(pattern string, c *client, filter string) bool {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	s, ok := idx.subscriptions[pattern]
+	if !ok {
+		return false
+	}
+	for _, sub := range s.subscribers {
+		if sub.client != c {
+			continue
+		}
+		defer idx.invalidate()
+		if filter == "" {
+			sub.unfiltered = false
+		}
+		for i, f := range sub.filters {
+			if f.String() == filter {
+				sub.filters = append(sub.filters[:i], sub.filters[i+1:]...)
+				break
+			}
+		}
+		if sub.unfiltered || len(sub.filters) > 0 {
+			return true
+		}
+		idx.removeSubscriber(pattern, c)
+		return false
+	}
+	return false
+}
+
+// removeSubscriber removes the client from the subscription to the pattern.
+// The index lock must be held for writing.
+func (idx *subscriptionIndex) removeSubscriber(pattern string, c *client) {
+	s, ok := idx.subscriptions[pattern]
+	if !ok {
+		return
+	}
+	for i, sub := range s.subscribers {
+		if sub.client == c {
+			sub.setLimiter(nil)
+			s.subscribers = append(s.subscribers[:i], s.subscribers[i+1:]...)
+			break
+		}
+	}
+	defer idx.invalidate()
+	if len(s.subscribers) > 0 {
+		return
+	}
+
+	// Remove the subscription, and the nodes that become empty
+	delete(idx.subscriptions, pattern)
+	segments := s.pattern.Segments()
+	path := []*subscriptionNode{&idx.root}
+	for _, segment := range segments {
+		path = append(path, path[len(path)-1].child(segment, false))
+	}
+	delete(path[len(segments)].subscriptions, pattern)
+	for i := len(segments); i > 0 && path[i].isEmpty(); i-- {
+		path[i-1].removeChild(segments[i-1])
+	}
+}
+
+// match returns the clients subscribed to a pattern matching the event, with
+// the filters of all their matching subscriptions. The returned slice must
+// not be modified.
+func (idx *subscriptionIndex) match(event string) []*subscriber {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+
+	idx.cacheMtx.Lock()
+	subscribers, ok := idx.cache[event]
+	idx.cacheMtx.Unlock()
+	if ok {
+		return subscribers
+	}
+
+	subs := make(map[*client]*subscriber)
+	idx.root.collect(event, strings.Split(event, "."), subs)
+	subscribers = make([]*subscriber, 0, len(subs))
+	for _, sub := range subs {
+		subscribers = append(subscribers, sub)
+	}
+
+	idx.cacheMtx.Lock()
+	if len(idx.cache) >= subscriptionCacheSize {
+		idx.cache = make(map[string][]*subscriber)
+	}
+	idx.cache[event] = subscribers
+	idx.cacheMtx.Unlock()
+
+	return subscribers
+}
+
+// eventsJSON returns the ids of the clients subscribed to each pattern, and
+// their filters.
+func (idx *subscriptionIndex) eventsJSON() map[string]*api.EventInfoJSON {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+
+	events := make(map[string]*api.EventInfoJSON, len(idx.subscriptions))
+	for pattern, s := range idx.subscriptions {
+		event := &api.EventInfoJSON{Event: pattern}
+		for _, sub := range s.subscribers {
+			event.Subscribers = append(event.Subscribers, sub.client.id)
+			for _, f := range sub.filters {
+				if event.Filters == nil {
+					event.Filters = make(map[string][]string)
+				}
+				event.Filters[sub.client.id] = append(event.Filters[sub.client.id], f.String())
+			}
+		}
+		events[pattern] = event
+	}
+	return events
+}
@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/evolutek/cellaserv3/testutil"
+)
+
+func matchIds(idx *subscriptionIndex, event string) []string {
+	var ids []string
+	for _, s := range idx.match(event) {
+		ids = append(ids, s.client.id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func addSubscription(t *testing.T, idx *subscriptionIndex, pattern string, c *client) {
+	p, err := common.ParseTopicPattern(pattern)
+	testutil.Ok(t, err)
+	idx.add(p, c, subscribeOptions{})
+}
+
+func TestSubscriptionIndex(t *testing.T) {
+	idx := newSubscriptionIndex()
+	a := &client{id: "a"}
+	b := &client{id: "b"}
+	c := &client{id: "c"}
+
+	addSubscription(t, idx, "robot.pal.position", a)
+	addSubscription(t, idx, "robot.*.position", b)
+	addSubscription(t, idx, "robot.**", c)
+	addSubscription(t, idx, "robot.p?l.*", a)
+	addSubscription(t, idx, "log.**!log.cellaserv.**", b)
+
+	testutil.Equals(t, []string{"a", "b", "c"}, matchIds(idx, "robot.pal.position"))
+	testutil.Equals(t, []string{"b", "c"}, matchIds(idx, "robot.pmi.position"))
+	testutil.Equals(t, []string{"c"}, matchIds(idx, "robot"))
+	testutil.Equals(t, []string{"b"}, matchIds(idx, "log.motor"))
+	testutil.Equals(t, []string(nil), matchIds(idx, "log.cellaserv.new-client"))
+
+	// The cache is invalidated when subscriptions change
+	idx.remove("robot.pal.position", a)
+	idx.remove("robot.p?l.*", a)
+	testutil.Equals(t, []string{"b", "c"}, matchIds(idx, "robot.pal.position"))
+	addSubscription(t, idx, "robot.pal.position", a)
+	testutil.Equals(t, []string{"a", "b", "c"}, matchIds(idx, "robot.pal.position"))
+
+	// Empty nodes are removed
+	for _, pattern := range []string{"robot.pal.position", "robot.*.position", "robot.**", "log.**!log.cellaserv.**"} {
+		for _, sub := range []*client{a, b, c} {
+			idx.remove(pattern, sub)
+		}
+	}
+	testutil.Assert(t, idx.root.isEmpty(), "The trie should be empty")
+	testutil.Equals(t, 0, len(idx.subscriptions))
+}
+
+func TestSubscriptionIndexMatchesTopicPatterns(t *testing.T) {
+	patterns := []string{
+		"a", "a.b", "a.*", "*.b", "**", "a.**", "**.c", "a.**.c", "a*.b",
+		"[ab].*", "a.b.c", "*.*.*", "a.**!a.b.**", `a\*`,
+	}
+	events := []string{"a", "b", "a.b", "a.c", "b.b", "a.b.c", "a.x.y.c", "ab.b", "a*", "c"}
+
+	idx := newSubscriptionIndex()
+	clients := make(map[string]*client)
+	for _, pattern := range patterns {
+		clients[pattern] = &client{id: pattern}
+		addSubscription(t, idx, pattern, clients[pattern])
+	}
+
+	for _, event := range events {
+		var expected []string
+		for _, pattern := range patterns {
+			if matched, _ := common.MatchTopic(pattern, event); matched {
+				expected = append(expected, pattern)
+			}
+		}
+		sort.Strings(expected)
+		testutil.Equals(t, expected, matchIds(idx, event))
+	}
+}
+
+func TestSubscriptionIndexFilters(t *testing.T) {
+	idx := newSubscriptionIndex()
+	a := &client{id: "a"}
+	slow, err := common.ParseFilter("speed < 1")
+	testutil.Ok(t, err)
+	fast, err := common.ParseFilter("speed > 10")
+	testutil.Ok(t, err)
+	p, err := common.ParseTopicPattern("robot.*")
+	testutil.Ok(t, err)
+	pAll, err := common.ParseTopicPattern("robot.**")
+	testutil.Ok(t, err)
+
+	accepts := func(data string) bool {
+		subs := idx.match("robot.pal")
+		testutil.Equals(t, 1, len(subs))
+		return subs[0].accepts(common.NewFilterData([]byte(data)))
+	}
+
+	// The filters of the subscriptions of a client are merged
+	idx.add(p, a, subscribeOptions{filter: slow})
+	idx.add(pAll, a, subscribeOptions{filter: fast})
+	testutil.Assert(t, accepts(`{"speed": 0}`), "Slow event should be accepted")
+	testutil.Assert(t, accepts(`{"speed": 20}`), "Fast event should be accepted")
+	testutil.Assert(t, !accepts(`{"speed": 5}`), "Event should be filtered")
+
+	// A subscription without filter accepts all events
+	idx.add(p, a, subscribeOptions{})
+	testutil.Assert(t, accepts(`{"speed": 5}`), "Event should be accepted")
+	testutil.Assert(t, idx.removeFilter("robot.*", a, ""), "Client should still be subscribed")
+	testutil.Assert(t, !accepts(`{"speed": 5}`), "Event should be filtered")
+	testutil.Assert(t, !idx.removeFilter("robot.*", a, "speed < 1"), "Client should be unsubscribed")
+	testutil.Assert(t, !accepts(`{"speed": 0}`), "Slow event should be filtered")
+}
@@ -0,0 +1,327 @@
+package broker
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+// Number of recent spans kept for the web interface
+const traceBufferSize = 4096
+
+// Kinds of span, as defined by OpenTelemetry
+type spanKind int
+
+const (
+	spanKindInternal spanKind = 1
+	spanKindServer   spanKind = 2
+)
+
+type spanAttribute struct {
+	key   string
+	value string
+}
+
+// span is a timed operation of a trace.
+type span struct {
+	traceId    common.TraceId
+	spanId     common.SpanId
+	parentId   common.SpanId
+	name       string
+	kind       spanKind
+	start      time.Time
+	end        time.Time
+	attributes []spanAttribute
+	// Error of the operation, empty if it succeeded
+	err string
+}
+
+func (s *span) JSONStruct() api.SpanJSON {
+	sj := api.SpanJSON{
+		TraceId:      s.traceId.String(),
+		SpanId:       s.spanId.String(),
+		ParentSpanId: s.parentId.String(),
+		Name:         s.name,
+		Start:        s.start,
+		Duration:     s.end.Sub(s.start).Seconds(),
+		Error:        s.err,
+	}
+	if len(s.attributes) > 0 {
+		sj.Attributes = make(map[string]string)
+		for _, attr := range s.attributes {
+			sj.Attributes[attr.key] = attr.value
+		}
+	}
+	return sj
+}
+
+// tracer keeps the recent spans, and exports them if an exporter is set.
+type tracer struct {
+	mtx      sync.RWMutex
+	spans    []*span // ring buffer
+	next     int
+	exporter *traceExporter
+}
+
+func newTracer() *tracer {
+	return &tracer{spans: make([]*span, 0, traceBufferSize)}
+}
+
+func (t *tracer) add(spans ...*span) {
+	t.mtx.Lock()
+	for _, s := range spans {
+		if len(t.spans) < traceBufferSize {
+			t.spans = append(t.spans, s)
+		} else {
+			t.spans[t.next] = s
+			t.next = (t.next + 1) % traceBufferSize
+		}
+	}
+	exporter := t.exporter
+	t.mtx.Unlock()
+
+	if exporter != nil {
+		exporter.export(spans)
+	}
+}
+
+// recentSpans returns a copy of the kept spans, the oldest first. The tracer
+// lock must be held.
+func (t *tracer) recentSpans() []*span {
+	spans := make([]*span, 0, len(t.spans))
+	spans = append(spans, t.spans[t.next:]...)
+	return append(spans, t.spans[:t.next]...)
+}
+
+func (t *tracer) setExporter(exporter *traceExporter) {
+	t.mtx.Lock()
+	t.exporter = exporter
+	t.mtx.Unlock()
+}
+
+// requestTrace times the steps of a request sent to a service:
+//
+//	enqueue   from the reception of the request to its queuing for the service
+//	dispatch  from its queuing to its writing to the service connection
+//	reply     from its writing to the reception of the reply, or
+//	timeout   to the timeout of the request
+type requestTrace struct {
+	req *cellaserv.Request
+	// Trace of the request, and its span
+	context  common.TraceContext
+	parentId common.SpanId
+	start    time.Time
+
+	mtx      sync.Mutex
+	enqueued time.Time
+	written  time.Time
+}
+
+// newRequestTrace starts the trace of a request received at start. The
+// request is part of the trace of its sender, if any.
+func newRequestTrace(req *cellaserv.Request, start time.Time) *requestTrace {
+	t := &requestTrace{req: req, start: start}
+	if parent, ok := common.RequestTrace(req); ok {
+		t.context.TraceId = parent.TraceId
+		t.parentId = parent.SpanId
+	} else {
+		t.context.TraceId = common.NewTraceId()
+	}
+	t.context.SpanId = common.NewSpanId()
+	return t
+}
+
+func (t *requestTrace) setEnqueued(at time.Time) {
+	t.mtx.Lock()
+	t.enqueued = at
+	t.mtx.Unlock()
+}
+
+func (t *requestTrace) setWritten(at time.Time) {
+	t.mtx.Lock()
+	t.written = at
+	t.mtx.Unlock()
+}
+
+// requestSpanName returns the name of the span of a request, eg.
+// "motor[left].move".
+func requestSpanName(req *cellaserv.Request) string {
+	if req.ServiceIdentification == "" {
+		return req.ServiceName + "." + req.Method
+	}
+	return fmt.Sprintf("%s[%s].%s", req.ServiceName, req.ServiceIdentification, req.Method)
+}
+
+// replyErrorText returns the error of the span of a request, or "".
+func replyErrorText(replyErr *cellaserv.Reply_Error) string {
+	if replyErr == nil || replyErr.Type == cellaserv.Reply_Error_NoError {
+		return ""
+	}
+	text := common.ReplyErrorTypeName(replyErr.Type)
+	if replyErr.What != "" {
+		text += ": " + replyErr.What
+	}
+	return text
+}
+
+func requestAttributes(c *client, req *cellaserv.Request) []spanAttribute {
+	return []spanAttribute{
+		{"cellaserv.service", req.ServiceName},
+		{"cellaserv.identification", req.ServiceIdentification},
+		{"cellaserv.method", req.Method},
+		{"cellaserv.client", c.id},
+	}
+}
+
+// endRequestTrace records the spans of a request sent to a service, once it
+// is replied to or failed.
+func (b *Broker) endRequestTrace(reqTrack *requestTracking, replyErr *cellaserv.Reply_Error) {
+	t := reqTrack.trace
+	req := t.req
+	end := time.Now()
+	t.mtx.Lock()
+	enqueued, written := t.enqueued, t.written
+	t.mtx.Unlock()
+
+	errText := replyErrorText(replyErr)
+	root := &span{
+		traceId:  t.context.TraceId,
+		spanId:   t.context.SpanId,
+		parentId: t.parentId,
+		name:     requestSpanName(req),
+		kind:     spanKindServer,
+		start:    t.start,
+		end:      end,
+		attributes: append(requestAttributes(reqTrack.sender, req),
+			spanAttribute{"cellaserv.service_client", reqTrack.service.client.id},
+			spanAttribute{"cellaserv.priority", reqTrack.priority.String()}),
+		err: errText,
+	}
+	step := func(name string, start time.Time, end time.Time, err string) *span {
+		return &span{
+			traceId:  t.context.TraceId,
+			spanId:   common.NewSpanId(),
+			parentId: t.context.SpanId,
+			name:     name,
+			kind:     spanKindInternal,
+			start:    start,
+			end:      end,
+			err:      err,
+		}
+	}
+
+	spans := []*span{root}
+	if enqueued.IsZero() {
+		enqueued = end
+	}
+	spans = append(spans, step("enqueue", t.start, enqueued, ""))
+	waitStart := enqueued
+	if !written.IsZero() {
+		spans = append(spans, step("dispatch", enqueued, written, ""))
+		waitStart = written
+	}
+	if replyErr.GetType() == cellaserv.Reply_Error_Timeout {
+		spans = append(spans, step("timeout", waitStart, end, errText))
+	} else {
+		spans = append(spans, step("reply", waitStart, end, errText))
+	}
+	b.tracer.add(spans...)
+}
+
+// traceRejectedRequest records the span of a request replied to with an error
+// by the broker, without sending it to a service.
+func (b *Broker) traceRejectedRequest(c *client, req *cellaserv.Request, errType cellaserv.Reply_Error_Type) {
+	t := newRequestTrace(req, time.Now())
+	b.tracer.add(&span{
+		traceId:    t.context.TraceId,
+		spanId:     t.context.SpanId,
+		parentId:   t.parentId,
+		name:       requestSpanName(req),
+		kind:       spanKindServer,
+		start:      t.start,
+		end:        t.start,
+		attributes: requestAttributes(c, req),
+		err:        common.ReplyErrorTypeName(errType),
+	})
+}
+
+// GetTracesJSON returns the recent traces, the most recent first.
+func (b *Broker) GetTracesJSON() []api.TraceJSON {
+	b.tracer.mtx.RLock()
+	recent := b.tracer.recentSpans()
+	b.tracer.mtx.RUnlock()
+
+	traces := make(map[common.TraceId]*api.TraceJSON)
+	ends := make(map[common.TraceId]time.Time)
+	rootStarts := make(map[common.TraceId]time.Time)
+	spanIds := make(map[common.SpanId]bool)
+	for _, s := range recent {
+		spanIds[s.spanId] = true
+	}
+	for _, s := range recent {
+		trace, ok := traces[s.traceId]
+		if !ok {
+			trace = &api.TraceJSON{TraceId: s.traceId.String(), Start: s.start}
+			traces[s.traceId] = trace
+		}
+		trace.Spans++
+		if s.err != "" && s.kind == spanKindServer {
+			trace.Errors++
+		}
+		if s.start.Before(trace.Start) {
+			trace.Start = s.start
+		}
+		if s.end.After(ends[s.traceId]) {
+			ends[s.traceId] = s.end
+		}
+		// The name of the trace is the name of its first root span
+		if spanIds[s.parentId] {
+			continue
+		}
+		if rootStart, ok := rootStarts[s.traceId]; !ok || s.start.Before(rootStart) {
+			rootStarts[s.traceId] = s.start
+			trace.Name = s.name
+		}
+	}
+
+	tracesJSON := make([]api.TraceJSON, 0, len(traces))
+	for id, trace := range traces {
+		trace.Duration = ends[id].Sub(trace.Start).Seconds()
+		tracesJSON = append(tracesJSON, *trace)
+	}
+	sort.Slice(tracesJSON, func(i, j int) bool {
+		return tracesJSON[i].Start.After(tracesJSON[j].Start)
+	})
+	return tracesJSON
+}
+
+// GetTraceJSON returns the spans of the trace, sorted by start time. Returns
+// false if the trace is not known.
+func (b *Broker) GetTraceJSON(traceId common.TraceId) ([]api.SpanJSON, bool) {
+	b.tracer.mtx.RLock()
+	recent := b.tracer.recentSpans()
+	b.tracer.mtx.RUnlock()
+
+	var spans []*span
+	for _, s := range recent {
+		if s.traceId == traceId {
+			spans = append(spans, s)
+		}
+	}
+	if len(spans) == 0 {
+		return nil, false
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].start.Before(spans[j].start)
+	})
+	spansJSON := make([]api.SpanJSON, len(spans))
+	for i, s := range spans {
+		spansJSON[i] = s.JSONStruct()
+	}
+	return spansJSON, true
+}
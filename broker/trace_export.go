@@ -0,0 +1,242 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evolutek/cellaserv3/common"
+)
+
+const (
+	// Maximum number of spans in an export
+	traceExportBatchSize = 512
+	// Maximum time the spans wait before being exported
+	traceExportInterval = time.Second
+	// Number of groups of spans waiting to be exported, the spans are dropped
+	// when it is reached
+	traceExportQueueSize = 1024
+	traceExportTimeout   = 5 * time.Second
+)
+
+// OTLP/JSON encoding of the spans, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              spanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// Status codes of the spans
+const (
+	otlpStatusOk    = 1
+	otlpStatusError = 2
+)
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpUnixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// marshalOTLP returns the OTLP/JSON export request of the spans.
+func marshalOTLP(spans []*span) ([]byte, error) {
+	scopeSpans := otlpScopeSpans{
+		Scope: otlpScope{Name: "cellaserv", Version: common.Version},
+		Spans: make([]otlpSpan, len(spans)),
+	}
+	for i, s := range spans {
+		otlp := otlpSpan{
+			TraceId:           s.traceId.String(),
+			SpanId:            s.spanId.String(),
+			ParentSpanId:      s.parentId.String(),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: otlpUnixNano(s.start),
+			EndTimeUnixNano:   otlpUnixNano(s.end),
+			Status:            otlpStatus{Code: otlpStatusOk},
+		}
+		for _, attr := range s.attributes {
+			otlp.Attributes = append(otlp.Attributes, otlpKeyValue{attr.key, otlpAnyValue{attr.value}})
+		}
+		if s.err != "" {
+			otlp.Status = otlpStatus{Code: otlpStatusError, Message: s.err}
+		}
+		scopeSpans.Spans[i] = otlp
+	}
+	return json.Marshal(otlpTraces{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: []otlpKeyValue{
+				{"service.name", otlpAnyValue{"cellaserv"}},
+			}},
+			ScopeSpans: []otlpScopeSpans{scopeSpans},
+		}},
+	})
+}
+
+// traceExporter exports the spans in the OTLP/JSON format, to a file with one
+// export request per line, or to the OTLP/HTTP endpoint of a collector.
+type traceExporter struct {
+	target string
+	// File the spans are appended to, nil if they are sent to a collector
+	file       *os.File
+	httpClient *http.Client
+	logger     common.Logger
+
+	spansCh chan []*span
+	quitCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+// newTraceExporter starts exporting spans to the target: the URL of the
+// OTLP/HTTP traces endpoint of a collector, eg.
+// http://localhost:4318/v1/traces, or a file.
+func newTraceExporter(target string, logger common.Logger) (*traceExporter, error) {
+	e := &traceExporter{
+		target:  target,
+		logger:  logger,
+		spansCh: make(chan []*span, traceExportQueueSize),
+		quitCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		e.httpClient = &http.Client{Timeout: traceExportTimeout}
+	} else {
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, err
+		}
+		e.file = file
+	}
+	go e.run()
+	return e, nil
+}
+
+// export queues the spans to be exported. The spans are dropped if too many
+// are waiting.
+func (e *traceExporter) export(spans []*span) {
+	select {
+	case <-e.quitCh:
+	case e.spansCh <- spans:
+	default:
+		e.logger.Warnf("Too many spans waiting to be exported, %d spans dropped", len(spans))
+	}
+}
+
+func (e *traceExporter) run() {
+	defer close(e.doneCh)
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case spans := <-e.spansCh:
+			batch = append(batch, spans...)
+			if len(batch) >= traceExportBatchSize {
+				e.write(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.write(batch)
+			batch = nil
+		case <-e.quitCh:
+			// Export the queued spans before quitting
+			for {
+				select {
+				case spans := <-e.spansCh:
+					batch = append(batch, spans...)
+				default:
+					e.write(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *traceExporter) write(spans []*span) {
+	if len(spans) == 0 {
+		return
+	}
+	data, err := marshalOTLP(spans)
+	if err != nil {
+		e.logger.Errorf("Could not marshal spans: %s", err)
+		return
+	}
+	if e.file != nil {
+		if _, err := e.file.Write(append(data, '\n')); err != nil {
+			e.logger.Errorf("Could not export spans to %s: %s", e.target, err)
+		}
+		return
+	}
+
+	resp, err := e.httpClient.Post(e.target, "application/json", bytes.NewReader(data))
+	if err != nil {
+		e.logger.Errorf("Could not export spans to %s: %s", e.target, err)
+		return
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		e.logger.Errorf("Could not export spans to %s: HTTP status %s", e.target, resp.Status)
+	}
+}
+
+// close exports the queued spans and stops the exporter.
+func (e *traceExporter) close() {
+	close(e.quitCh)
+	<-e.doneCh
+	if e.file != nil {
+		if err := e.file.Close(); err != nil {
+			e.logger.Errorf("Could not close %s: %s", e.target, err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/evolutek/cellaserv3/testutil"
+)
+
+func spanNames(spans []api.SpanJSON) map[string]api.SpanJSON {
+	names := make(map[string]api.SpanJSON)
+	for _, s := range spans {
+		names[s.Name] = s
+	}
+	return names
+}
+
+func TestTrace(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		connService := testutil.Dial(t)
+		defer connService.Close()
+		connClient := testutil.Dial(t)
+		defer connClient.Close()
+
+		connService.Write(testutil.MakeMessageRegister(t, "date", ""))
+		time.Sleep(50 * time.Millisecond)
+
+		// The service receives the trace of the sender with the span of the
+		// request
+		parent := common.TraceContext{TraceId: common.NewTraceId(), SpanId: common.NewSpanId()}
+		connClient.Write(testutil.MakeMessageRequestWithTrace(t, "date", "", "time", nil, parent))
+		req := recvRequest(t, connService)
+		received, ok := common.RequestTrace(req)
+		testutil.Assert(t, ok, "Request should carry a trace")
+		testutil.Equals(t, parent.TraceId, received.TraceId)
+		testutil.Assert(t, received.SpanId != parent.SpanId, "Request should have its own span")
+
+		// Request of the service while handling the request
+		connService.Write(testutil.MakeMessageRegister(t, "clock", ""))
+		time.Sleep(50 * time.Millisecond)
+		connService.Write(testutil.MakeMessageRequestWithTrace(t, "clock", "", "now", nil, received))
+		nested := recvRequest(t, connService)
+		connService.Write(testutil.MakeMessageReply(t, nested.GetId(), nil))
+		recvReply(t, connService)
+
+		connService.Write(testutil.MakeMessageReply(t, req.GetId(), []byte("42")))
+		recvReply(t, connClient)
+
+		spans, ok := b.GetTraceJSON(parent.TraceId)
+		testutil.Assert(t, ok, "Trace should be known")
+		testutil.Equals(t, 8, len(spans))
+		names := spanNames(spans)
+		root := names["date.time"]
+		testutil.Equals(t, received.SpanId.String(), root.SpanId)
+		testutil.Equals(t, parent.SpanId.String(), root.ParentSpanId)
+		testutil.Equals(t, "time", root.Attributes["cellaserv.method"])
+		testutil.Equals(t, received.SpanId.String(), names["clock.now"].ParentSpanId)
+		for _, name := range []string{"enqueue", "dispatch", "reply"} {
+			step, ok := names[name]
+			testutil.Assert(t, ok, "Trace should have a %s span", name)
+			testutil.Equals(t, "", step.Error)
+		}
+		testutil.Assert(t, spans[0].Name == "date.time", "Spans should be sorted by start time")
+
+		traces := b.GetTracesJSON()
+		testutil.Equals(t, 1, len(traces))
+		testutil.Equals(t, parent.TraceId.String(), traces[0].TraceId)
+		testutil.Equals(t, "date.time", traces[0].Name)
+		testutil.Equals(t, 8, traces[0].Spans)
+		testutil.Equals(t, 0, traces[0].Errors)
+	})
+}
+
+func TestTraceTimeout(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		connService := testutil.Dial(t)
+		defer connService.Close()
+		connClient := testutil.Dial(t)
+		defer connClient.Close()
+
+		connService.Write(testutil.MakeMessageRegister(t, "date", ""))
+		time.Sleep(50 * time.Millisecond)
+		connClient.Write(testutil.MakeMessageRequestWithTimeout(t, "date", "", "time", nil, 50*time.Millisecond))
+		req := recvRequest(t, connService)
+		recvReply(t, connClient)
+
+		// The request starts a new trace
+		trace, ok := common.RequestTrace(req)
+		testutil.Assert(t, ok, "Request should carry a trace")
+		spans, ok := b.GetTraceJSON(trace.TraceId)
+		testutil.Assert(t, ok, "Trace should be known")
+		names := spanNames(spans)
+		testutil.Equals(t, "", names["date.time"].ParentSpanId)
+		testutil.Equals(t, "Timeout", names["date.time"].Error)
+		_, ok = names["timeout"]
+		testutil.Assert(t, ok, "Trace should have a timeout span")
+		_, ok = names["reply"]
+		testutil.Assert(t, !ok, "Trace should not have a reply span")
+
+		// Requests to unknown services are traced
+		connClient.Write(testutil.MakeMessageRequest(t, "unknown", "", "time", nil))
+		recvReply(t, connClient)
+		traces := b.GetTracesJSON()
+		testutil.Equals(t, 2, len(traces))
+		testutil.Equals(t, "unknown.time", traces[0].Name)
+		testutil.Equals(t, 1, traces[0].Errors)
+
+		_, ok = b.GetTraceJSON(common.NewTraceId())
+		testutil.Assert(t, !ok, "Trace should not be known")
+	})
+}
+
+func TestTraceBroadcast(t *testing.T) {
+	brokerTest(t, func(b *Broker) {
+		connA := testutil.Dial(t)
+		defer connA.Close()
+		connB := testutil.Dial(t)
+		defer connB.Close()
+		connClient := testutil.Dial(t)
+		defer connClient.Close()
+
+		connA.Write(testutil.MakeMessageRegister(t, "motor", "a"))
+		connB.Write(testutil.MakeMessageRegister(t, "motor", "b"))
+		time.Sleep(50 * time.Millisecond)
+
+		// The requests sent to the services are part of the trace of the
+		// broadcast request
+		parent := common.TraceContext{TraceId: common.NewTraceId(), SpanId: common.NewSpanId()}
+		connClient.Write(testutil.MakeMessageRequestWithTrace(t, "motor", "*", "status", nil, parent))
+		for _, conn := range []net.Conn{connA, connB} {
+			req := recvRequest(t, conn)
+			trace, ok := common.RequestTrace(req)
+			testutil.Assert(t, ok, "Request should carry a trace")
+			testutil.Equals(t, parent.TraceId, trace.TraceId)
+			conn.Write(testutil.MakeMessageReply(t, req.GetId(), nil))
+		}
+		recvReply(t, connClient)
+
+		spans, ok := b.GetTraceJSON(parent.TraceId)
+		testutil.Assert(t, ok, "Trace should be known")
+		roots := 0
+		for _, s := range spans {
+			if s.ParentSpanId == parent.SpanId.String() {
+				roots++
+			}
+		}
+		testutil.Equals(t, 2, roots)
+	})
+}
+
+func testSpans(n int) []*span {
+	traceId := common.NewTraceId()
+	start := time.Unix(1600000000, 0)
+	spans := make([]*span, n)
+	for i := range spans {
+		spans[i] = &span{
+			traceId:    traceId,
+			spanId:     common.NewSpanId(),
+			name:       "date.time",
+			kind:       spanKindServer,
+			start:      start,
+			end:        start.Add(time.Millisecond),
+			attributes: []spanAttribute{{"cellaserv.method", "time"}},
+		}
+	}
+	spans[0].err = "Timeout"
+	return spans
+}
+
+func checkOTLP(t *testing.T, data []byte, n int) {
+	t.Helper()
+	var traces otlpTraces
+	testutil.Ok(t, json.Unmarshal(data, &traces))
+	testutil.Equals(t, 1, len(traces.ResourceSpans))
+	scopeSpans := traces.ResourceSpans[0].ScopeSpans
+	testutil.Equals(t, 1, len(scopeSpans))
+	spans := scopeSpans[0].Spans
+	testutil.Equals(t, n, len(spans))
+	testutil.Equals(t, 32, len(spans[0].TraceId))
+	testutil.Equals(t, 16, len(spans[0].SpanId))
+	testutil.Equals(t, "1600000000000000000", spans[0].StartTimeUnixNano)
+	testutil.Equals(t, "1600000000001000000", spans[0].EndTimeUnixNano)
+	testutil.Equals(t, otlpStatus{Code: otlpStatusError, Message: "Timeout"}, spans[0].Status)
+	testutil.Equals(t, otlpStatusOk, spans[1].Status.Code)
+	testutil.Equals(t, "time", spans[1].Attributes[0].Value.StringValue)
+}
+
+func TestTraceExportFile(t *testing.T) {
+	exportPath := path.Join(t.TempDir(), "spans.json")
+	exporter, err := newTraceExporter(exportPath, common.NewLogger("trace"))
+	testutil.Ok(t, err)
+	exporter.export(testSpans(3))
+	exporter.export(testSpans(2))
+	exporter.close()
+
+	file, err := os.Open(exportPath)
+	testutil.Ok(t, err)
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	testutil.Assert(t, scanner.Scan(), "Spans should be exported")
+	checkOTLP(t, scanner.Bytes(), 5)
+	testutil.Assert(t, !scanner.Scan(), "Spans should be exported in a single request")
+}
+
+func TestTraceExportCollector(t *testing.T) {
+	received := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.Equals(t, "application/json", r.Header.Get("Content-Type"))
+		data, err := ioutil.ReadAll(r.Body)
+		testutil.Ok(t, err)
+		received <- data
+	}))
+	defer collector.Close()
+
+	exporter, err := newTraceExporter(collector.URL+"/v1/traces", common.NewLogger("trace"))
+	testutil.Ok(t, err)
+	exporter.export(testSpans(2))
+	exporter.close()
+
+	select {
+	case data := <-received:
+		checkOTLP(t, data, 2)
+	default:
+		t.Fatal("Spans should be sent to the collector")
+	}
+}
@@ -0,0 +1,139 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/prometheus/common/route"
+)
+
+// spanView is a span of the trace page, placed in the timeline of the trace.
+type spanView struct {
+	api.SpanJSON
+	// Number of ancestors of the span in the trace
+	Depth int
+	// Start and duration of the span, in percent of the duration of the
+	// trace
+	Offset float64
+	Width  float64
+}
+
+// traceViews returns the spans of the trace in depth-first order, each span
+// being followed by its children, sorted by start time.
+func traceViews(spans []api.SpanJSON) []spanView {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	known := make(map[string]bool)
+	for _, s := range spans {
+		known[s.SpanId] = true
+	}
+	children := make(map[string][]api.SpanJSON)
+	var roots []api.SpanJSON
+	start, end := spans[0].Start, spans[0].Start
+	for _, s := range spans {
+		if known[s.ParentSpanId] {
+			children[s.ParentSpanId] = append(children[s.ParentSpanId], s)
+		} else {
+			roots = append(roots, s)
+		}
+		if s.Start.Before(start) {
+			start = s.Start
+		}
+		if spanEnd := s.Start.Add(secondsDuration(s.Duration)); spanEnd.After(end) {
+			end = spanEnd
+		}
+	}
+	total := end.Sub(start).Seconds()
+
+	var views []spanView
+	var visit func(s api.SpanJSON, depth int)
+	visit = func(s api.SpanJSON, depth int) {
+		view := spanView{SpanJSON: s, Depth: depth, Width: 100}
+		if total > 0 {
+			view.Offset = s.Start.Sub(start).Seconds() / total * 100
+			view.Width = s.Duration / total * 100
+		}
+		views = append(views, view)
+		sortSpans(children[s.SpanId])
+		for _, child := range children[s.SpanId] {
+			visit(child, depth+1)
+		}
+	}
+	sortSpans(roots)
+	for _, root := range roots {
+		visit(root, 0)
+	}
+	return views
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func sortSpans(spans []api.SpanJSON) {
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].Start.Before(spans[j].Start)
+	})
+}
+
+// traceSpans returns the spans of the trace of the request path, or writes
+// an error.
+func (h *Handler) traceSpans(w http.ResponseWriter, r *http.Request) ([]api.SpanJSON, bool) {
+	traceId, err := common.ParseTraceId(route.Param(r.Context(), "id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	spans, ok := h.broker.GetTraceJSON(traceId)
+	if !ok {
+		http.Error(w, "No such trace: "+traceId.String(), http.StatusNotFound)
+		return nil, false
+	}
+	return spans, true
+}
+
+// handleTraces returns a page showing the recent traces
+func (h *Handler) handleTraces(w http.ResponseWriter, r *http.Request) {
+	h.executeTemplate(w, "traces.html", h.broker.GetTracesJSON())
+}
+
+// handleTrace returns a page showing the timeline of the spans of a trace
+func (h *Handler) handleTrace(w http.ResponseWriter, r *http.Request) {
+	spans, ok := h.traceSpans(w, r)
+	if !ok {
+		return
+	}
+	data := struct {
+		TraceId string
+		Spans   []spanView
+	}{
+		TraceId: spans[0].TraceId,
+		Spans:   traceViews(spans),
+	}
+	h.executeTemplate(w, "trace.html", data)
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		h.logger.Errorf("Could not write response: %s", err)
+	}
+}
+
+func (h *Handler) apiTraces(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, h.broker.GetTracesJSON())
+}
+
+func (h *Handler) apiTrace(w http.ResponseWriter, r *http.Request) {
+	spans, ok := h.traceSpans(w, r)
+	if !ok {
+		return
+	}
+	h.writeJSON(w, spans)
+}
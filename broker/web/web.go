@@ -15,6 +15,7 @@ import (
 	"strings"
 	"time"
 
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
 	"github.com/evolutek/cellaserv3/broker"
 	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
 	"github.com/evolutek/cellaserv3/client"
@@ -54,16 +55,9 @@ func (h *Handler) makeRequestFromHTTP(r *http.Request) ([]byte, error) {
 		return nil, err
 	}
 
-	// Make request
+	// Make request, it is abandoned if the HTTP client goes away
 	serviceStub := client.NewServiceStub(h.client, service, identification)
-	var resp []byte
-	if len(body) == 0 {
-		resp, err = serviceStub.RequestNoData(method)
-	} else {
-		resp, err = serviceStub.RequestRaw(method, body)
-	}
-
-	return resp, err
+	return serviceStub.RequestRawContext(r.Context(), method, body)
 }
 
 type requestTemplateData struct {
@@ -95,7 +89,7 @@ func (h *Handler) handleRequestPost(w http.ResponseWriter, r *http.Request) {
 
 	serviceStub := client.NewServiceStub(h.client, requestData.Name, requestData.Identification)
 
-	resp, err := serviceStub.RequestRaw(requestData.Method, []byte(requestData.Arguments))
+	resp, err := serviceStub.RequestRawContext(r.Context(), requestData.Method, []byte(requestData.Arguments))
 
 	if err != nil {
 		requestData.Response = err.Error()
@@ -150,7 +144,64 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 )
 
-func (h *Handler) ping(ws *websocket.Conn, done chan struct{}) {
+// apiSubscribe handles websocket subscribes
+func (h *Handler) apiSubscribe(w http.ResponseWriter, r *http.Request) {
+	// Extract request parameters
+	event := route.Param(r.Context(), "event")
+
+	// Upgrade connection to websocket
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Print("Could not upgrade:", err)
+		return
+	}
+	defer ws.Close()
+
+	ws.SetPongHandler(func(string) error { ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+
+	// The websocket is closed when reading fails
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Each subscriber has its own connection, so that unsubscribing does
+	// not remove the handlers of the other websockets
+	conn := client.NewClient(client.ClientOpts{
+		CellaservAddr: h.options.BrokerAddr,
+		Name:          "web.subscribe",
+	})
+	defer conn.Close()
+
+	err = conn.Subscribe(event, func(eventName string, eventBytes []byte) {
+		msg := struct {
+			Name string `json:"name"`
+			Data string `json:"data"`
+		}{Name: eventName, Data: string(eventBytes)}
+		msgTxt, err := json.Marshal(msg)
+		if err != nil {
+			h.logger.Error("json:", err)
+			return
+		}
+		ws.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := ws.WriteMessage(websocket.TextMessage, msgTxt); err != nil {
+			h.logger.Error("Write error:", err)
+			ws.Close()
+		}
+	})
+	if err != nil {
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error()),
+			time.Now().Add(writeWait))
+		return
+	}
+	defer conn.Unsubscribe(event)
+
 	ticker := time.NewTicker(pingPeriod)
 	defer ticker.Stop()
 	for {
@@ -158,7 +209,7 @@ func (h *Handler) ping(ws *websocket.Conn, done chan struct{}) {
 		case <-ticker.C:
 			if err := ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
 				h.logger.Errorf("ping: %s", err)
-				done <- struct{}{}
+				return
 			}
 		case <-done:
 			return
@@ -166,10 +217,55 @@ func (h *Handler) ping(ws *websocket.Conn, done chan struct{}) {
 	}
 }
 
-// apiSubscribe handles websocket subscribes
-func (h *Handler) apiSubscribe(w http.ResponseWriter, r *http.Request) {
+// spyCallJSON is a call to a spied service, sent on the spy websocket.
+type spyCallJSON struct {
+	Time           time.Time       `json:"time"`
+	Service        string          `json:"service"`
+	Identification string          `json:"identification"`
+	Method         string          `json:"method"`
+	Request        json.RawMessage `json:"request,omitempty"`
+	Reply          json.RawMessage `json:"reply,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	Latency        float64         `json:"latency"` // In seconds
+}
+
+// jsonData returns the data as is if it is JSON, else as a JSON string.
+func jsonData(data []byte) json.RawMessage {
+	if len(data) == 0 {
+		return nil
+	}
+	if json.Valid(data) {
+		return data
+	}
+	str, _ := json.Marshal(string(data))
+	return str
+}
+
+func newSpyCallJSON(call *client.SpiedCall) *spyCallJSON {
+	req := call.Request
+	rep := call.Reply
+	msg := &spyCallJSON{
+		Time:           time.Now().Add(-call.Latency),
+		Service:        req.GetServiceName(),
+		Identification: req.GetServiceIdentification(),
+		Method:         req.GetMethod(),
+		Request:        jsonData(req.GetData()),
+		Reply:          jsonData(rep.GetData()),
+		Latency:        call.Latency.Seconds(),
+	}
+	if repErr := rep.GetError(); repErr != nil && repErr.GetType() != cellaserv.Reply_Error_NoError {
+		msg.Error = repErr.GetType().String()
+		if repErr.GetWhat() != "" {
+			msg.Error += ": " + repErr.GetWhat()
+		}
+	}
+	return msg
+}
+
+// apiSpy handles websocket spies, sending the calls to the services
+func (h *Handler) apiSpy(w http.ResponseWriter, r *http.Request) {
 	// Extract request parameters
-	event := route.Param(r.Context(), "event")
+	service, identification := spyParams(r)
 
 	// Upgrade connection to websocket
 	ws, err := upgrader.Upgrade(w, r, nil)
@@ -181,35 +277,87 @@ func (h *Handler) apiSubscribe(w http.ResponseWriter, r *http.Request) {
 
 	ws.SetPongHandler(func(string) error { ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 
+	// The websocket is closed when reading fails
 	done := make(chan struct{})
-
-	go h.ping(ws, done)
-
-	err = h.client.SubscribeUntil(event,
-		func(eventName string, eventBytes []byte) bool {
-			msg := struct {
-				Name string `json:"name"`
-				Data string `json:"data"`
-			}{Name: eventName, Data: string(eventBytes)}
-			msgTxt, err := json.Marshal(msg)
-			if err != nil {
-				h.logger.Error("json:", err)
-				return false
-			}
-			err = ws.WriteMessage(websocket.TextMessage, msgTxt)
-			if err != nil {
-				h.logger.Error("Write error:", err)
-				done <- struct{}{}
-				return true
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
 			}
-			return false
-		})
+		}
+	}()
+
+	// Each spy has its own connection, so that the spying ends with it
+	conn := client.NewClient(client.ClientOpts{
+		CellaservAddr: h.options.BrokerAddr,
+		Name:          "web.spy",
+	})
+	defer conn.Close()
+
+	err = conn.SpyCalls(service, identification, func(call *client.SpiedCall) {
+		msgTxt, err := json.Marshal(newSpyCallJSON(call))
+		if err != nil {
+			h.logger.Error("json:", err)
+			return
+		}
+		ws.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := ws.WriteMessage(websocket.TextMessage, msgTxt); err != nil {
+			h.logger.Error("Write error:", err)
+			ws.Close()
+		}
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error()),
+			time.Now().Add(writeWait))
 		return
 	}
 
-	<-done
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
+				h.logger.Errorf("ping: %s", err)
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// spyParams returns the name and identification of the spied services. When
+// the name is a pattern without identification, the services are spied for
+// all their identifications.
+func spyParams(r *http.Request) (string, string) {
+	name := route.Param(r.Context(), "service")
+	identification := route.Param(r.Context(), "identification")
+	if identification == "" && common.IsTopicPattern(name) {
+		identification = "**"
+	}
+	return name, identification
+}
+
+type spyTemplateData struct {
+	Path           string
+	Name           string
+	Identification string
+}
+
+func (h *Handler) handleSpy(w http.ResponseWriter, r *http.Request) {
+	path := route.Param(r.Context(), "service")
+	if identification := route.Param(r.Context(), "identification"); identification != "" {
+		path += "/" + identification
+	}
+	name, identification := spyParams(r)
+	h.executeTemplate(w, "spy.html", spyTemplateData{
+		Path:           path,
+		Name:           name,
+		Identification: identification,
+	})
 }
 
 // overview returns a page showing the list of connections, events and services
@@ -253,6 +401,14 @@ func tmplFuncs(options *Options, templateName string) template_text.FuncMap {
 	return template_text.FuncMap{
 		"pathPrefix":   func() string { return options.ExternalURLPath },
 		"templateName": func() string { return templateName },
+		"join":         strings.Join,
+		// Number of rows of an event in the overview
+		"eventRows": func(event api.EventInfoJSON) int {
+			return len(event.Subscribers) + len(event.QueueGroups)
+		},
+		"milliseconds": func(seconds float64) string {
+			return fmt.Sprintf("%.3f ms", seconds*1000)
+		},
 	}
 }
 
@@ -367,6 +523,10 @@ func New(o *Options, logger common.Logger, broker *broker.Broker) *Handler {
 	router.Get("/logs/:pattern", h.handleLogs)
 	router.Get("/request", h.handleRequest)
 	router.Post("/request", h.handleRequestPost)
+	router.Get("/spy/:service", h.handleSpy)
+	router.Get("/spy/:service/:identification", h.handleSpy)
+	router.Get("/traces", h.handleTraces)
+	router.Get("/trace/:id", h.handleTrace)
 
 	// Static files
 	router.Get("/static/*filepath", route.FileServe(path.Join(o.AssetsPath, "static")))
@@ -379,7 +539,10 @@ func New(o *Options, logger common.Logger, broker *broker.Broker) *Handler {
 	router.Post("/api/v1/request/:service/:method", h.apiRequest)
 	router.Post("/api/v1/publish/:event", h.apiPublish)
 	router.Get("/api/v1/subscribe/:event", h.apiSubscribe)
-	// TODO(halfr): spy
+	router.Get("/api/v1/spy/:service", h.apiSpy)
+	router.Get("/api/v1/spy/:service/:identification", h.apiSpy)
+	router.Get("/api/v1/traces", h.apiTraces)
+	router.Get("/api/v1/trace/:id", h.apiTrace)
 
 	// Go debug
 	router.Get("/debug/*subpath", handleDebug)
@@ -2,15 +2,23 @@ package web
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
+	cellaservpb "github.com/evolutek/cellaserv3-protobuf"
 	"github.com/evolutek/cellaserv3/broker"
 	"github.com/evolutek/cellaserv3/broker/cellaserv"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/client"
 	"github.com/evolutek/cellaserv3/common"
 	"github.com/evolutek/cellaserv3/testutil"
+	"github.com/gorilla/websocket"
 )
 
 func TestWeb(t *testing.T) {
@@ -52,9 +60,137 @@ func TestWeb(t *testing.T) {
 	testutil.Ok(t, err)
 	testutil.Equals(t, http.StatusOK, resp.StatusCode)
 
+	// Queue groups are shown with the events
+	conn := client.NewClient(client.ClientOpts{CellaservAddr: ":4204"})
+	defer conn.Close()
+	testutil.Ok(t, conn.SubscribeQueue("vision", "", "frame", func(string, []byte) {}))
+	time.Sleep(50 * time.Millisecond)
+
 	resp, err = http.Get("http://localhost:4284/overview")
 	testutil.Ok(t, err)
 	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	testutil.Assert(t, strings.Contains(string(body), "vision"), "Overview should show the queue group")
+
+	// Spy on a service
+	date := conn.NewService("date", "")
+	date.HandleRequestFunc("time", func(*cellaservpb.Request) (interface{}, error) {
+		return 42, nil
+	})
+	date.HandleRequestFunc("echo", func(req *cellaservpb.Request) (interface{}, error) {
+		return json.RawMessage(req.Data), nil
+	})
+	conn.RegisterService(date)
+
+	resp, err = http.Get("http://localhost:4284/spy/date")
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	testutil.Assert(t, strings.Contains(string(body), `const spyPath = "date";`), "Spy page should spy on the service")
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://localhost:4284/api/v1/spy/date", nil)
+	testutil.Ok(t, err)
+	defer ws.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = client.NewServiceStub(conn, "date", "").Request("time", map[string]string{"tz": "UTC"})
+	testutil.Ok(t, err)
+	_, err = client.NewServiceStub(conn, "date", "").Request("foo", nil)
+	testutil.Assert(t, err != nil, "Request should fail")
+
+	var call spyCallJSON
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	testutil.Ok(t, ws.ReadJSON(&call))
+	testutil.Equals(t, "time", call.Method)
+	testutil.Equals(t, `{"tz":"UTC"}`, string(call.Request))
+	testutil.Equals(t, "42", string(call.Reply))
+	testutil.Assert(t, call.Latency > 0, "The latency should be set")
+	testutil.Ok(t, ws.ReadJSON(&call))
+	testutil.Equals(t, "foo", call.Method)
+	testutil.Assert(t, strings.HasPrefix(call.Error, "NoSuchMethod"), "The error should be sent, got %q", call.Error)
+
+	// The calls of different clients using the same request id are paired
+	// with their own reply
+	var raws []net.Conn
+	for _, data := range []string{"1", "2"} {
+		raw, err := net.Dial("tcp", ":4204")
+		testutil.Ok(t, err)
+		defer raw.Close()
+		_, err = raw.Write(testutil.MakeMessageRequestWithId(t, "date", "", "echo", 7, []byte(data)))
+		testutil.Ok(t, err)
+		raws = append(raws, raw)
+	}
+	for _, raw := range raws {
+		testutil.RecvMessage(t, raw)
+	}
+	for i := 0; i < 2; i++ {
+		testutil.Ok(t, ws.ReadJSON(&call))
+		testutil.Equals(t, "echo", call.Method)
+		testutil.Equals(t, string(call.Request), string(call.Reply))
+	}
+
+	// The events are sent on the subscribe websocket, the subscription is
+	// removed when the websocket is closed
+	lost := make(chan string, 10)
+	testutil.Ok(t, conn.Subscribe("log.cellaserv.lost-subscriber", func(_ string, data []byte) {
+		var sub struct{ Event string }
+		json.Unmarshal(data, &sub)
+		lost <- sub.Event
+	}))
+	wsSub, _, err := websocket.DefaultDialer.Dial("ws://localhost:4284/api/v1/subscribe/score", nil)
+	testutil.Ok(t, err)
+	time.Sleep(100 * time.Millisecond)
+	conn.Publish("score", 42)
+	var event struct{ Name, Data string }
+	wsSub.SetReadDeadline(time.Now().Add(time.Second))
+	testutil.Ok(t, wsSub.ReadJSON(&event))
+	testutil.Equals(t, "score", event.Name)
+	testutil.Equals(t, "42", event.Data)
+	wsSub.Close()
+	select {
+	case pattern := <-lost:
+		testutil.Equals(t, "score", pattern)
+	case <-time.After(time.Second):
+		t.Fatal("The subscription should be removed")
+	}
+
+	// The requests are traced
+	resp, err = http.Get("http://localhost:4284/api/v1/traces")
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	var traces []api.TraceJSON
+	testutil.Ok(t, json.NewDecoder(resp.Body).Decode(&traces))
+	var traceId string
+	for _, trace := range traces {
+		if trace.Name == "date.time" {
+			traceId = trace.TraceId
+		}
+	}
+	testutil.Assert(t, traceId != "", "The request should be traced")
+
+	resp, err = http.Get("http://localhost:4284/traces")
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	testutil.Assert(t, strings.Contains(string(body), "/trace/"+traceId), "Traces page should link to the trace")
+
+	resp, err = http.Get("http://localhost:4284/trace/" + traceId)
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	testutil.Assert(t, strings.Contains(string(body), "dispatch"), "Trace page should show the spans")
+	testutil.Assert(t, !strings.Contains(string(body), "ZgotmplZ"), "Trace page should place the spans in the timeline")
+
+	resp, err = http.Get("http://localhost:4284/api/v1/trace/foo")
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusBadRequest, resp.StatusCode)
+	resp, err = http.Get("http://localhost:4284/api/v1/trace/" + common.NewTraceId().String())
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusNotFound, resp.StatusCode)
 
 	resp, err = http.Get("http://localhost:4284/metrics")
 	testutil.Ok(t, err)
@@ -1,13 +1,13 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"os"
-	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -29,16 +29,99 @@ type subscriberUntilHandler func(eventName string, eventData []byte) bool
 
 type subscriber struct {
 	eventPattern string
-	handle       subscriberUntilHandler
+	pattern      *common.TopicPattern
+	handle       func(pub *cellaserv.Publish) bool
+	// Position from which the durable stream is replayed, nil if the
+	// subscriber does not replay the stream
+	replay *StreamPosition
+	// Sequence number of the last streamed event received
+	lastSequence uint64
+	// Name of the durable subscriber, empty if the subscription is not
+	// durable
+	durable string
+	// Name of the queue group of the subscriber, and its policy, empty if
+	// the subscriber is not part of a queue group
+	queue       string
+	queuePolicy string
+	// Filter of the events payload, nil if the subscriber receives all
+	// the events
+	filter *common.Filter
+	// Minimum interval between two events of the same name, and how the
+	// events exceeding the rate are handled, zero if not rate limited
+	interval time.Duration
+	rateMode string
+	// Service whose event handler is the subscriber, nil if the subscriber
+	// is not an event handler of a service
+	service *service
+}
+
+// dedicated returns whether the subscriber only receives the events
+// delivered to it by name, as a durable subscriber or a member of a queue
+// group.
+func (s *subscriber) dedicated() bool {
+	return s.durable != "" || s.queue != ""
+}
+
+// subscribeMessage returns the subscribe message of the subscriber.
+func (s *subscriber) subscribeMessage() *cellaserv.Subscribe {
+	sub := &cellaserv.Subscribe{Event: s.eventPattern}
+	if s.replay != nil {
+		s.replay.set(sub)
+	}
+	if s.durable != "" {
+		common.SetSubscribeDurable(sub, s.durable)
+	}
+	if s.queue != "" {
+		common.SetSubscribeQueue(sub, s.queue, s.queuePolicy)
+	}
+	if s.filter != nil {
+		common.SetSubscribeFilter(sub, s.filter.String())
+	}
+	if s.interval != 0 {
+		common.SetSubscribeRate(sub, s.interval, s.rateMode)
+	}
+	return sub
 }
 
 type spyHandler func(req *cellaserv.Request, rep *cellaserv.Reply)
 
+// SpiedCall is a request sent to a spied service, and its reply.
+type SpiedCall struct {
+	Request *cellaserv.Request
+	Reply   *cellaserv.Reply
+	// Time elapsed between the receptions of the request and of the reply
+	Latency time.Duration
+}
+
+type spiedCallHandler func(call *SpiedCall)
+
+// spy is the set of handlers spying on the services matching the name and
+// identification patterns.
+type spy struct {
+	name                  string
+	identification        string
+	namePattern           *common.TopicPattern
+	identificationPattern *common.TopicPattern
+	handlers              []spiedCallHandler
+}
+
+func (s *spy) match(name string, identification string) bool {
+	return s.namePattern.Match(name) && s.identificationPattern.Match(identification)
+}
+
+// spyCallKey identifies a spied request, the ids of the requests of different
+// clients can collide.
+type spyCallKey struct {
+	sender string
+	id     uint64
+}
+
 // When the client is spying on a service, this struct represents a request
 // without a response.
 type spyPendingRequest struct {
-	req   *cellaserv.Request
-	spies []spyHandler
+	req      *cellaserv.Request
+	received time.Time
+	spies    []spiedCallHandler
 }
 
 type Client struct {
@@ -54,31 +137,42 @@ type Client struct {
 
 	logger common.Logger
 
-	// Connection to cellaserv
-	conn net.Conn
+	opts ClientOpts
+
+	// Connection to cellaserv, replaced when reconnecting
+	connMtx sync.RWMutex
+	conn    net.Conn
 	// Services registered on this client
-	services map[string]map[string]*service
+	servicesMtx sync.RWMutex
+	services    map[string]map[string]*service
 	// Subscribers on this client
 	subscribers []*subscriber
 	// Spies on this client
-	spies map[string]map[string][]spyHandler
+	spiesMtx sync.RWMutex
+	spies    []*spy
 	// Spy requests missing their associated replies
-	spyRequestsPending map[uint64]*spyPendingRequest
+	spyRequestsPending map[spyCallKey]*spyPendingRequest
 	// Map of request ids to their replies
-	requestsInFlight map[uint64]chan *cellaserv.Reply
-	// Broker identifier for this client
-	clientId string
+	requestsInFlightMtx sync.Mutex
+	requestsInFlight    map[uint64]chan *cellaserv.Reply
+	// The connection is lost, requests cannot be sent anymore. Protected by
+	// requestsInFlightMtx.
+	connLost bool
+	// Broker identifier for this client, reset when reconnecting
+	clientIdMtx sync.Mutex
+	clientId    string
 
 	// Incoming messages
-	msgCh chan *cellaserv.Message
-	// TODO(halfr): this should be renamed "remoteClosed"
-	closeCh chan struct{}
-	quit    bool
-	quitCh  chan struct{}
+	msgCh    chan *cellaserv.Message
+	quitOnce sync.Once
+	quitCh   chan struct{}
 }
 
 // clientId returns the broker identifier for this client
 func (c *Client) ClientId() string {
+	c.clientIdMtx.Lock()
+	defer c.clientIdMtx.Unlock()
+
 	// Cached?
 	if c.clientId != "" {
 		return c.clientId
@@ -90,35 +184,104 @@ func (c *Client) ClientId() string {
 		log.Printf("cellaserv.whoami() query failed: %s", err)
 		return ""
 	}
-	json.Unmarshal(respBytes, &c.clientId)
+	var whoami cs_api.ClientJSON
+	err = json.Unmarshal(respBytes, &whoami)
+	if err != nil {
+		log.Printf("Could not unmarshal cellaserv.whoami() reply: %s", err)
+		return ""
+	}
+	c.clientId = whoami.Id
 	return c.clientId
 }
 
-func (c *Client) sendRequestWaitForReply(req *cellaserv.Request) *cellaserv.Reply {
+// sendMessage sends a message on the current connection to cellaserv.
+func (c *Client) sendMessage(msg *cellaserv.Message) error {
+	c.connMtx.RLock()
+	conn := c.conn
+	c.connMtx.RUnlock()
+	return common.SendMessage(conn, msg)
+}
+
+// sendRequestWaitForReply sends the request to cellaserv and waits for its
+// reply. It returns an error if the request could not be sent, if the context
+// is done or if the connection to cellaserv is lost before the reply is
+// received.
+func (c *Client) sendRequestWaitForReply(ctx context.Context, req *cellaserv.Request) (*cellaserv.Reply, error) {
 	// Add message Id and increment nonce
 	req.Id = atomic.AddUint64(&c.currentRequestId, 1)
+
+	// Forward the time budget of the caller to the broker
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		common.SetRequestTimeout(req, timeout)
+	}
+	common.SetPriority(req, priorityFromContext(ctx))
+	if trace, ok := TraceFromContext(ctx); ok {
+		common.SetRequestTrace(req, trace)
+	}
+
 	reqBytes, err := proto.Marshal(req)
 	if err != nil {
-		panic(fmt.Sprintf("Could not marshal request: %s", err))
+		return nil, fmt.Errorf("Could not marshal request: %s", err)
 	}
 
+	// Track request id. The channel is closed if the connection is lost.
+	replyCh := make(chan *cellaserv.Reply, 1)
+	c.requestsInFlightMtx.Lock()
+	if c.connLost {
+		c.requestsInFlightMtx.Unlock()
+		return nil, ErrConnectionLost
+	}
 	if _, ok := c.requestsInFlight[req.Id]; ok {
-		panic(fmt.Sprintf("Duplicate Request Id: %d", req.Id))
+		c.requestsInFlightMtx.Unlock()
+		return nil, fmt.Errorf("Duplicate request id: %d", req.Id)
 	}
-
-	// Track request id
-	c.requestsInFlight[req.Id] = make(chan *cellaserv.Reply)
+	c.requestsInFlight[req.Id] = replyCh
+	c.requestsInFlightMtx.Unlock()
 
 	msgType := cellaserv.Message_Request
 	msg := cellaserv.Message{Type: msgType, Content: reqBytes}
 
-	err = common.SendMessage(c.conn, &msg)
+	err = c.sendMessage(&msg)
 	if err != nil {
-		panic(fmt.Sprintf("Could not send message: %s", err))
+		c.forgetRequest(req.Id)
+		return nil, fmt.Errorf("Could not send request: %s", err)
 	}
 
 	// Wait for reply
-	return <-c.requestsInFlight[req.Id]
+	select {
+	case rep, ok := <-replyCh:
+		if !ok {
+			return nil, ErrConnectionLost
+		}
+		return rep, nil
+	case <-ctx.Done():
+		// Stop tracking the request, its reply will be ignored
+		c.forgetRequest(req.Id)
+		return nil, ctx.Err()
+	}
+}
+
+// forgetRequest stops waiting for the reply of a request.
+func (c *Client) forgetRequest(id uint64) {
+	c.requestsInFlightMtx.Lock()
+	delete(c.requestsInFlight, id)
+	c.requestsInFlightMtx.Unlock()
+}
+
+// failRequestsInFlight makes all the requests waiting for a reply fail with
+// ErrConnectionLost, and all the future requests fail immediately.
+func (c *Client) failRequestsInFlight() {
+	c.requestsInFlightMtx.Lock()
+	defer c.requestsInFlightMtx.Unlock()
+	c.connLost = true
+	for id, replyCh := range c.requestsInFlight {
+		close(replyCh)
+		delete(c.requestsInFlight, id)
+	}
 }
 
 func (c *Client) handleRequest(req *cellaserv.Request) error {
@@ -127,24 +290,37 @@ func (c *Client) handleRequest(req *cellaserv.Request) error {
 	method := req.GetMethod()
 	c.logger.Debugf("Received request %s[%s].%s", name, ident, method)
 
-	// Dispatch request to spies
+	// Dispatch request to spies. The copies of the requests sent to the
+	// spies are marked with their sender.
+	sender, spyCopy := common.SpySender(req)
 	hasSpied := false
-	identsSpied, ok := c.spies[name]
-	if ok {
-		spies, ok := identsSpied[ident]
-		if ok {
-			c.logger.Infof("Received spied request: %s[%s].%s", name, ident, method)
-			hasSpied = true
-			// Spy handler is called when the reply to this request is received
-			c.spyRequestsPending[req.GetId()] = &spyPendingRequest{
-				req:   req,
-				spies: spies,
-			}
+	var spies []spiedCallHandler
+	c.spiesMtx.RLock()
+	for _, s := range c.spies {
+		if s.match(name, ident) {
+			spies = append(spies, s.handlers...)
+		}
+	}
+	c.spiesMtx.RUnlock()
+	if len(spies) > 0 {
+		c.logger.Infof("Received spied request: %s[%s].%s", name, ident, method)
+		hasSpied = true
+		// Spy handler is called when the reply to this request is received
+		c.spyRequestsPending[spyCallKey{sender, req.GetId()}] = &spyPendingRequest{
+			req:      req,
+			received: time.Now(),
+			spies:    spies,
 		}
 	}
+	if spyCopy {
+		return nil
+	}
 
 	// Dispatch request to acutal service
+	c.servicesMtx.RLock()
 	idents, ok := c.services[name]
+	srvc, identOk := idents[ident]
+	c.servicesMtx.RUnlock()
 	if !ok {
 		if hasSpied {
 			return nil
@@ -152,21 +328,39 @@ func (c *Client) handleRequest(req *cellaserv.Request) error {
 		return fmt.Errorf("No such service: %s", name)
 	}
 
-	srvc, ok := idents[ident]
-	if !ok {
+	if !identOk {
 		if hasSpied {
 			return nil
 		}
 		return fmt.Errorf("No such service identification for %s: %s, has: %v", name, ident, idents)
 	}
 
-	replyData, replyErr := srvc.handleRequest(req, method)
-	c.sendRequestReply(req, replyData, replyErr)
+	// Handlers run outside of the reception loop, so that they can make
+	// requests without blocking the reception of their replies. The
+	// requests of a service are handled one at a time, unless it allows
+	// more.
+	srvc.dispatch(func() {
+		// The handler context is done when the time budget of the
+		// request is exhausted
+		ctx := context.Background()
+		if timeout, ok := common.RequestTimeout(req); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		// The requests sent by the handler are part of the trace of
+		// the request
+		if trace, ok := common.RequestTrace(req); ok {
+			ctx = ContextWithTrace(ctx, trace)
+		}
+
+		replyData, replyErr := srvc.handleRequest(ctx, req, method)
+		c.sendRequestReply(req, replyData, replyErr)
+	})
 
 	return nil
 }
 
-// TODO(halfr): handle different kind of errors
 func (c *Client) sendRequestReply(req *cellaserv.Request, replyData []byte, replyErr error) {
 	msgType := cellaserv.Message_Reply
 	msgContent := &cellaserv.Reply{Id: req.Id, Data: replyData}
@@ -176,17 +370,13 @@ func (c *Client) sendRequestReply(req *cellaserv.Request, replyData []byte, repl
 		c.logger.Warnf("Sending reply error: %s", replyErr)
 
 		// Add error info to reply
-		errString := replyErr.Error()
-		msgContent.Error = &cellaserv.Reply_Error{
-			Type: cellaserv.Reply_Error_Custom,
-			What: errString,
-		}
+		msgContent.Error = replyErrorFromHandlerError(replyErr)
 	}
 
 	msgContentBytes, _ := proto.Marshal(msgContent)
 	msg := &cellaserv.Message{Type: msgType, Content: msgContentBytes}
 
-	err := common.SendMessage(c.conn, msg)
+	err := c.sendMessage(msg)
 	if err != nil {
 		c.logger.Warnf("Could not send reply: %s", err)
 	}
@@ -194,20 +384,33 @@ func (c *Client) sendRequestReply(req *cellaserv.Request, replyData []byte, repl
 
 func (c *Client) handleReply(rep *cellaserv.Reply) error {
 	// Dispatch reply to spies
+	sender, spyCopy := common.SpySender(rep)
+	key := spyCallKey{sender, rep.GetId()}
 	hasSpied := false
-	spyPending, ok := c.spyRequestsPending[rep.GetId()]
+	spyPending, ok := c.spyRequestsPending[key]
 	if ok {
 		c.logger.Infof("Dispatching request and reply %d", rep.GetId())
 		hasSpied = true
+		call := &SpiedCall{
+			Request: spyPending.req,
+			Reply:   rep,
+			Latency: time.Since(spyPending.received),
+		}
 		for _, spy := range spyPending.spies {
-			spy(spyPending.req, rep)
+			spy(call)
 		}
 		// Remove pending request
-		delete(c.spyRequestsPending, rep.GetId())
+		delete(c.spyRequestsPending, key)
+	}
+	if spyCopy {
+		return nil
 	}
 
 	// Dispatch reply to known requests
+	c.requestsInFlightMtx.Lock()
 	replyChan, ok := c.requestsInFlight[rep.GetId()]
+	delete(c.requestsInFlight, rep.GetId())
+	c.requestsInFlightMtx.Unlock()
 	if !ok {
 		if hasSpied {
 			return nil
@@ -221,11 +424,31 @@ func (c *Client) handleReply(rep *cellaserv.Reply) error {
 func (c *Client) handlePublish(pub *cellaserv.Publish) {
 	eventName := pub.GetEvent()
 	c.logger.Infof("Received event: %q", eventName)
+	if common.PublishSubscribeError(pub) {
+		c.handleSubscribeError(pub)
+		return
+	}
+	// Events delivered to a durable subscriber or to a queue group are
+	// only handled by it
+	durableName, deliveryId, isDelivery := common.PublishDelivery(pub)
+	queueName, _ := common.PublishQueue(pub)
+	data := common.NewFilterData(pub.GetData())
 	var subscriberToRemove []int
 	c.mtx.Lock()
 	for idx, s := range c.subscribers {
-		if matched, _ := filepath.Match(s.eventPattern, eventName); matched {
-			shouldRemove := s.handle(eventName, pub.GetData())
+		if s.durable != durableName || s.queue != queueName {
+			continue
+		}
+		// Cellaserv sends the events matching any filter of the
+		// subscribers of the pattern
+		if s.filter != nil && !s.filter.Match(data) {
+			continue
+		}
+		if s.pattern.Match(eventName) && s.accept(pub) {
+			shouldRemove := s.handle(pub)
+			if isDelivery {
+				c.sendAck(durableName, s.eventPattern, deliveryId)
+			}
 			if shouldRemove {
 				// Prepend, so that subscriberToRemove is in
 				// reverse index order, this is a required
@@ -234,14 +457,43 @@ func (c *Client) handlePublish(pub *cellaserv.Publish) {
 			}
 		}
 	}
+	removedPatterns := make(map[string]bool)
 	for _, idx := range subscriberToRemove {
+		removedPatterns[c.subscribers[idx].eventPattern] = true
 		c.subscribers[idx] = c.subscribers[len(c.subscribers)-1]
 		c.subscribers = c.subscribers[:len(c.subscribers)-1]
 
 	}
+	c.unsubscribeRemoved(removedPatterns)
 	c.mtx.Unlock()
 }
 
+// unsubscribeRemoved unsubscribes from the patterns that have no handler
+// anymore, after handlers were removed. The client's mutex must be held by
+// caller, so that a new subscribe to the pattern is sent after the
+// unsubscribe.
+func (c *Client) unsubscribeRemoved(removedPatterns map[string]bool) {
+	for pattern := range removedPatterns {
+		if !c.hasSubscriber(pattern) {
+			c.sendUnsubscribe(pattern)
+		} else if !c.hasUnfilteredSubscriber(pattern) {
+			// Only handlers with filters are left
+			c.sendUnsubscribeFilter(pattern, "")
+		}
+	}
+}
+
+// hasSubscriber returns whether a handler is subscribed to the pattern. The
+// client's mutex must be held by caller.
+func (c *Client) hasSubscriber(eventPattern string) bool {
+	for _, s := range c.subscribers {
+		if s.eventPattern == eventPattern && !s.dedicated() {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Client) handleMessage(msg *cellaserv.Message) error {
 	var err error
 
@@ -278,10 +530,13 @@ func (c *Client) handleMessage(msg *cellaserv.Message) error {
 	return nil
 }
 
-// Close shuts down the client.
+// Close shuts down the client. Requests waiting for a reply fail with
+// ErrConnectionLost.
 func (c *Client) Close() {
-	c.quit = true
-	close(c.quitCh)
+	c.quitOnce.Do(func() { close(c.quitCh) })
+	c.connMtx.RLock()
+	c.conn.Close()
+	c.connMtx.RUnlock()
 }
 
 // Quit returns the receive-only quit channel.
@@ -289,28 +544,78 @@ func (c *Client) Quit() <-chan struct{} {
 	return c.quitCh
 }
 
+// RegisterService registers the service on cellaserv, and subscribes to the
+// events of its event handlers. A service registered before with the same
+// name and identification is replaced, and its event handlers are
+// unsubscribed.
 func (c *Client) RegisterService(s *service) {
+	c.servicesMtx.Lock()
 	// Make sure the second map is created
 	if _, ok := c.services[s.Name]; !ok {
 		c.services[s.Name] = make(map[string]*service)
 	}
+	replaced, isReplaced := c.services[s.Name][s.Identification]
 	// Keep a pointer to the service
 	c.services[s.Name][s.Identification] = s
+	c.servicesMtx.Unlock()
+
+	if isReplaced {
+		c.removeEventHandlers(replaced)
+	}
+	for event, h := range s.eventHandlers {
+		h := h
+		err := c.subscribe(&subscriber{
+			eventPattern: s.eventPattern(event, h),
+			handle: func(pub *cellaserv.Publish) bool {
+				h.handle(pub)
+				return false
+			},
+			service: s,
+		})
+		if err != nil {
+			c.logger.Errorf("Could not subscribe to event %q of service %s: %s", event, s, err)
+		}
+	}
 
-	// Send register message to cellaserv
+	c.sendRegister(s)
+
+	c.logger.Infof("Registered service %s", s)
+}
+
+// removeEventHandlers removes the subscribers of the event handlers of the
+// service.
+func (c *Client) removeEventHandlers(s *service) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	removedPatterns := make(map[string]bool)
+	var kept []*subscriber
+	for _, sub := range c.subscribers {
+		if sub.service == s {
+			removedPatterns[sub.eventPattern] = true
+		} else {
+			kept = append(kept, sub)
+		}
+	}
+	c.subscribers = kept
+	c.unsubscribeRemoved(removedPatterns)
+}
+
+// sendRegister sends the register message of the service to cellaserv.
+func (c *Client) sendRegister(s *service) {
 	msgType := cellaserv.Message_Register
 	msgContent := &cellaserv.Register{
 		Name:           s.Name,
 		Identification: s.Identification,
 	}
+	if s.LoadBalancing != "" {
+		common.SetRegisterLoadBalancing(msgContent, s.LoadBalancing)
+	}
 	msgContentBytes, _ := proto.Marshal(msgContent)
 	msg := &cellaserv.Message{Type: msgType, Content: msgContentBytes}
-	err := common.SendMessage(c.conn, msg)
+	err := c.sendMessage(msg)
 	if err != nil {
 		c.logger.Errorf("Could not send message: %s", err)
 	}
-
-	c.logger.Infof("Registered service %s", s)
 }
 
 func (c *Client) Publish(event string, data interface{}) {
@@ -325,11 +630,54 @@ func (c *Client) Publish(event string, data interface{}) {
 }
 
 func (c *Client) PublishRaw(event string, data []byte) {
+	c.PublishRawPriority(event, data, common.PriorityUnset)
+}
+
+// PublishPriority publishes an event with a priority. cellaserv sends the
+// events of higher priority before the others.
+func (c *Client) PublishPriority(event string, data interface{}, priority common.Priority) {
+	c.logger.Debugf("Publishing %s(%v) with priority %s", event, data, priority)
+
+	// Serialize request payload
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		panic(fmt.Sprintf("Could not marshal publish data to JSON: %v", data))
+	}
+	c.PublishRawPriority(event, dataBytes, priority)
+}
+
+// PublishRawPriority is the same as PublishPriority but sends the data as is.
+func (c *Client) PublishRawPriority(event string, data []byte, priority common.Priority) {
+	c.publish(event, data, priority, false)
+}
+
+// PublishRetained publishes an event that cellaserv keeps, and sends to the
+// clients that subscribe to the event later. Only the last retained event is
+// kept.
+func (c *Client) PublishRetained(event string, data interface{}) {
+	c.logger.Debugf("Publishing retained %s(%v)", event, data)
+
+	// Serialize request payload
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		panic(fmt.Sprintf("Could not marshal publish data to JSON: %v", data))
+	}
+	c.publish(event, dataBytes, common.PriorityUnset, true)
+}
+
+// ClearRetained makes cellaserv forget the retained event.
+func (c *Client) ClearRetained(event string) {
+	c.publish(event, nil, common.PriorityUnset, true)
+}
+
+func (c *Client) publish(event string, data []byte, priority common.Priority, retain bool) {
 	// Prepare Publish message
 	pub := &cellaserv.Publish{
 		Event: event,
 		Data:  data,
 	}
+	common.SetPriority(pub, priority)
+	common.SetPublishRetain(pub, retain)
 	pubBytes, err := proto.Marshal(pub)
 	if err != nil {
 		panic(fmt.Sprintf("Could not marshal publish: %s", err))
@@ -338,7 +686,7 @@ func (c *Client) PublishRaw(event string, data []byte) {
 	// Send message
 	msgType := cellaserv.Message_Publish
 	msg := &cellaserv.Message{Type: msgType, Content: pubBytes}
-	err = common.SendMessage(c.conn, msg)
+	err = c.sendMessage(msg)
 	if err != nil {
 		c.logger.Errorf("Could not send message: %s", err)
 	}
@@ -359,17 +707,74 @@ func (c *Client) Subscribe(eventPattern string, handler subscriberHandler) error
 }
 
 func (c *Client) SubscribeUntil(eventPattern string, handler subscriberUntilHandler) error {
-	// Create and add to subscriber map
-	s := &subscriber{
-		eventPattern: eventPattern,
-		handle:       handler,
+	handle := func(pub *cellaserv.Publish) bool {
+		return handler(pub.GetEvent(), pub.GetData())
+	}
+	return c.subscribe(&subscriber{eventPattern: eventPattern, handle: handle})
+}
+
+// subscribe adds the subscriber, and sends its subscribe message.
+func (c *Client) subscribe(s *subscriber) error {
+	var err error
+	s.pattern, err = common.ParseTopicPattern(s.eventPattern)
+	if err != nil {
+		return err
 	}
-	c.logger.Infof("Subscribing to event pattern: %q", eventPattern)
+	if s.replay != nil && !s.replay.fromTime && s.replay.sequence > 0 {
+		s.lastSequence = s.replay.sequence - 1
+	}
+
+	// Add to subscriber map
+	c.logger.Infof("Subscribing to event pattern: %q", s.eventPattern)
+	c.mtx.Lock()
 	c.subscribers = append(c.subscribers, s)
+	c.mtx.Unlock()
 
-	// Prepare subscribe message
+	return c.sendSubscribe(s.subscribeMessage())
+}
+
+// Unsubscribe removes the handlers of the event pattern, and stops receiving
+// the events matching the pattern. It must not be called from an event
+// handler, return true from a SubscribeUntil handler instead.
+func (c *Client) Unsubscribe(eventPattern string) error {
+	c.logger.Infof("Unsubscribing from event pattern: %q", eventPattern)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var kept []*subscriber
+	for _, s := range c.subscribers {
+		if s.eventPattern != eventPattern || s.dedicated() {
+			kept = append(kept, s)
+		}
+	}
+	c.subscribers = kept
+	return c.sendUnsubscribe(eventPattern)
+}
+
+func (c *Client) sendUnsubscribe(eventPattern string) error {
+	// Prepare unsubscribe message, a subscribe message with the
+	// unsubscribe flag, so that it is ordered with the subscribes
 	msgType := cellaserv.Message_Subscribe
 	sub := &cellaserv.Subscribe{Event: eventPattern}
+	common.SetSubscribeUnsubscribe(sub)
+	subBytes, err := proto.Marshal(sub)
+	if err != nil {
+		return fmt.Errorf("Could not marshal unsubscribe: %s", err)
+	}
+
+	msg := cellaserv.Message{Type: msgType, Content: subBytes}
+
+	// Send unsubscribe message
+	err = c.sendMessage(&msg)
+	if err != nil {
+		c.logger.Errorf("Could not send message: %s", err)
+	}
+
+	return nil
+}
+
+func (c *Client) sendSubscribe(sub *cellaserv.Subscribe) error {
+	// Prepare subscribe message
+	msgType := cellaserv.Message_Subscribe
 	subBytes, err := proto.Marshal(sub)
 	if err != nil {
 		return fmt.Errorf("Could not marshal subscribe: %s", err)
@@ -378,7 +783,7 @@ func (c *Client) SubscribeUntil(eventPattern string, handler subscriberUntilHand
 	msg := cellaserv.Message{Type: msgType, Content: subBytes}
 
 	// Send subscribe message
-	err = common.SendMessage(c.conn, &msg)
+	err = c.sendMessage(&msg)
 	if err != nil {
 		c.logger.Errorf("Could not send message: %s", err)
 	}
@@ -386,15 +791,68 @@ func (c *Client) SubscribeUntil(eventPattern string, handler subscriberUntilHand
 	return nil
 }
 
+// Spy calls the handler with the requests sent to the services matching the
+// name and identification, and their replies. The name and identification
+// are topic patterns, for example "*" spies on every service. The services do
+// not have to be registered yet.
 func (c *Client) Spy(serviceName string, serviceIdentification string, handler spyHandler) error {
+	return c.SpyCalls(serviceName, serviceIdentification, func(call *SpiedCall) {
+		handler(call.Request, call.Reply)
+	})
+}
+
+// SpyCalls is the same as Spy, but the handler also receives the latency of
+// the calls.
+func (c *Client) SpyCalls(serviceName string, serviceIdentification string, handler spiedCallHandler) error {
+	namePattern, err := common.ParseTopicPattern(serviceName)
+	if err != nil {
+		return err
+	}
+	identificationPattern, err := common.ParseTopicPattern(serviceIdentification)
+	if err != nil {
+		return err
+	}
+
 	// Create and add spy handler
-	spyIdents, ok := c.spies[serviceName]
-	if !ok {
-		spyIdents = make(map[string][]spyHandler)
-		c.spies[serviceName] = spyIdents
+	c.spiesMtx.Lock()
+	for _, s := range c.spies {
+		if s.name == serviceName && s.identification == serviceIdentification {
+			// Cellaserv already sends the requests of the service
+			s.handlers = append(s.handlers, handler)
+			c.spiesMtx.Unlock()
+			return nil
+		}
+	}
+	c.spies = append(c.spies, &spy{
+		name:                  serviceName,
+		identification:        serviceIdentification,
+		namePattern:           namePattern,
+		identificationPattern: identificationPattern,
+		handlers:              []spiedCallHandler{handler},
+	})
+	c.spiesMtx.Unlock()
+
+	return c.sendSpyRequest("spy", serviceName, serviceIdentification)
+}
+
+// Unspy removes the handlers spying on the name and identification given to
+// Spy().
+func (c *Client) Unspy(serviceName string, serviceIdentification string) error {
+	c.spiesMtx.Lock()
+	for i, s := range c.spies {
+		if s.name == serviceName && s.identification == serviceIdentification {
+			c.spies = append(c.spies[:i], c.spies[i+1:]...)
+			break
+		}
 	}
-	spyIdents[serviceIdentification] = append(spyIdents[serviceIdentification], handler)
+	c.spiesMtx.Unlock()
+
+	return c.sendSpyRequest("unspy", serviceName, serviceIdentification)
+}
 
+// sendSpyRequest asks cellaserv to start, or stop, forwarding the requests
+// and replies of the services to this client.
+func (c *Client) sendSpyRequest(method string, serviceName string, serviceIdentification string) error {
 	// Create service stub
 	cs := NewServiceStub(c, "cellaserv", "")
 	// Make request
@@ -403,59 +861,43 @@ func (c *Client) Spy(serviceName string, serviceIdentification string, handler s
 		ServiceIdentification: serviceIdentification,
 		ClientId:              c.ClientId(),
 	}
-	_, err := cs.Request("spy", spyArgs)
+	_, err := cs.Request(method, spyArgs)
 	if err != nil {
 		c.logger.Warnf("Spy request returned error: %s", err)
 	}
-
-	return nil
+	return err
 }
 
-func newClient(conn net.Conn, name string) *Client {
-	logName := name
+func newClient(conn net.Conn, opts ClientOpts) *Client {
+	logName := opts.Name
 	if logName == "" {
 		logName = "client"
 	}
 
 	c := &Client{
 		logger:             common.NewLogger(logName),
+		opts:               opts,
 		conn:               conn,
 		services:           make(map[string]map[string]*service),
 		requestsInFlight:   make(map[uint64]chan *cellaserv.Reply),
-		spies:              make(map[string]map[string][]spyHandler),
-		spyRequestsPending: make(map[uint64]*spyPendingRequest),
+		spyRequestsPending: make(map[spyCallKey]*spyPendingRequest),
 		currentRequestId:   rand.Uint64(),
 		msgCh:              make(chan *cellaserv.Message),
-		closeCh:            make(chan struct{}),
 		quitCh:             make(chan struct{}),
 	}
 	// Initialize the cellaserv stub
 	c.Cs = NewServiceStub(c, "cellaserv", "")
 
 	// Receive incoming messages
-	go func() {
-		for {
-			closed, _, msg, err := common.RecvMessage(c.conn)
-			if closed {
-				close(c.closeCh)
-				break
-			}
-			if err != nil {
-				c.logger.Errorf("Could not receive message: %s", err)
-				continue
-			}
-			c.msgCh <- msg
-		}
-	}()
+	go c.receive(conn)
 
 	// Setup name, if given
-	if name != "" {
-		go c.Cs.Request("name_client", api.NameClientRequest{Name: name})
+	if opts.Name != "" {
+		go c.Cs.Request("name_client", api.NameClientRequest{Name: opts.Name})
 	}
 
 	// Handle message or quit
 	go func() {
-	Loop:
 		for {
 			select {
 			case msg := <-c.msgCh:
@@ -463,13 +905,9 @@ func newClient(conn net.Conn, name string) *Client {
 				if err != nil {
 					c.logger.Errorf("Could not handle incoming message: %s", err)
 				}
-			case <-c.closeCh:
-				if !c.quit {
-					close(c.quitCh)
-				}
-				break Loop
 			case <-c.quitCh:
-				break Loop
+				c.failRequestsInFlight()
+				return
 			}
 		}
 	}()
@@ -477,6 +915,25 @@ func newClient(conn net.Conn, name string) *Client {
 	return c
 }
 
+// ConnectionState is the state of the connection of a client to cellaserv.
+type ConnectionState int
+
+const (
+	Connected ConnectionState = iota
+	Disconnected
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	default:
+		return fmt.Sprintf("ConnectionState(%d)", int(s))
+	}
+}
+
 type ClientOpts struct {
 	// Address of the cellaserv server
 	CellaservAddr string
@@ -484,31 +941,55 @@ type ClientOpts struct {
 	Name string
 	// Address where the internal web service will listen, empty to disable web server
 	WebListenAddress string
+
+	// Reconnect to cellaserv when the connection is lost instead of
+	// quitting. Services, subscriptions, spies and the client name are
+	// restored after reconnecting. NewClient also waits for cellaserv to be
+	// available instead of panicking.
+	Reconnect bool
+	// Delay before the first reconnection attempt, doubled after each failed
+	// attempt. Defaults to 100ms.
+	ReconnectMinBackoff time.Duration
+	// Maximum delay between two reconnection attempts. Defaults to 5s.
+	ReconnectMaxBackoff time.Duration
+	// Called when the client is disconnected from or connected again to
+	// cellaserv
+	OnConnectionStateChange func(ConnectionState)
+}
+
+// cellaservAddr returns the address of cellaserv, from the options or the
+// environment.
+func (opts *ClientOpts) cellaservAddr() string {
+	if opts.CellaservAddr != "" {
+		return opts.CellaservAddr
+	}
+	csHost := os.Getenv("CS_HOST")
+	if csHost == "" {
+		csHost = defaultCellaservHost
+	}
+	csPort := os.Getenv("CS_PORT")
+	if csPort == "" {
+		csPort = defaultCellaservPort
+	}
+	return fmt.Sprintf("%s:%s", csHost, csPort)
 }
 
 // NewConnection returns a Client instance connected to cellaserv or panics
 func NewClient(opts ClientOpts) *Client {
-	// Check cellaserv address
-	csAddr := opts.CellaservAddr
-	if csAddr == "" {
-		csHost := os.Getenv("CS_HOST")
-		if csHost == "" {
-			csHost = defaultCellaservHost
-		}
-		csPort := os.Getenv("CS_PORT")
-		if csPort == "" {
-			csPort = defaultCellaservPort
-		}
-		csAddr = fmt.Sprintf("%s:%s", csHost, csPort)
+	opts.CellaservAddr = opts.cellaservAddr()
+
+	if opts.Reconnect {
+		conn := dialWithBackoff(opts, common.NewLogger("client"), nil)
+		return newClient(conn, opts)
 	}
 
 	// Connect
-	conn, err := net.Dial("tcp", csAddr)
+	conn, err := net.Dial("tcp", opts.CellaservAddr)
 	if err != nil {
 		panic(fmt.Errorf("Could not connect to cellaserv: %s", err))
 	}
 
-	return newClient(conn, opts.Name)
+	return newClient(conn, opts)
 }
 
 func init() {
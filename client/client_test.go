@@ -2,7 +2,9 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net"
 	"testing"
 	"time"
@@ -14,7 +16,7 @@ import (
 
 func TestNewClient(t *testing.T) {
 	_, client := net.Pipe()
-	c := newClient(client, "test")
+	c := newClient(client, ClientOpts{Name: "test"})
 	c.Close()
 }
 
@@ -32,7 +34,7 @@ func TestRegisterService(t *testing.T) {
 	}()
 
 	// Connect to cellaserv
-	conn := newClient(client, "") // no name
+	conn := newClient(client, ClientOpts{}) // no name
 	// TODO(halfr): test with a name
 
 	// Prepare service for registration
@@ -90,7 +92,7 @@ func TestServiceStubRequest(t *testing.T) {
 		common.SendMessage(server, replyMsg)
 	}()
 
-	c := newClient(client, "test")
+	c := newClient(client, ClientOpts{Name: "test"})
 	// Create date service stub
 	date := NewServiceStub(c, "date", "")
 	// Request date.time()
@@ -147,7 +149,258 @@ func TestPublish(t *testing.T) {
 		}
 	}()
 
-	c := newClient(client, "test")
+	c := newClient(client, ClientOpts{Name: "test"})
 	c.Publish(publishEvent, publishData)
 	<-done
 }
+
+func TestUnsubscribe(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	// recvSubscribe receives a subscribe message and returns its event
+	// pattern and whether it is an unsubscribe
+	recvSubscribe := func() (string, bool) {
+		_, _, msg, err := common.RecvMessage(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.GetType() != cellaserv.Message_Subscribe {
+			t.Fatalf("Invalid message type, should be Subscribe, is: %s", msg.GetType())
+		}
+		var sub cellaserv.Subscribe
+		if err := proto.Unmarshal(msg.GetContent(), &sub); err != nil {
+			t.Fatal(err)
+		}
+		return sub.GetEvent(), common.SubscribeUnsubscribe(&sub)
+	}
+
+	c := newClient(client, ClientOpts{})
+	defer c.Close()
+
+	// Handler removed after the first event
+	go c.SubscribeUntil("foo", func(string, []byte) bool { return true })
+	if event, unsub := recvSubscribe(); event != "foo" || unsub {
+		t.Fatalf("Expected subscribe to foo, got: %s (unsubscribe: %t)", event, unsub)
+	}
+	pub, _ := common.MarshalMessage(cellaserv.Message_Publish, &cellaserv.Publish{Event: "foo"})
+	go common.SendRawMessage(server, pub)
+	if event, unsub := recvSubscribe(); event != "foo" || !unsub {
+		t.Fatalf("Expected unsubscribe from foo, got: %s (unsubscribe: %t)", event, unsub)
+	}
+
+	// Explicit unsubscribe
+	go c.Unsubscribe("bar")
+	if event, unsub := recvSubscribe(); event != "bar" || !unsub {
+		t.Fatalf("Expected unsubscribe from bar, got: %s (unsubscribe: %t)", event, unsub)
+	}
+}
+
+func TestSubscribeInvalidPattern(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	c := newClient(client, ClientOpts{})
+	defer c.Close()
+
+	err := c.Subscribe("foo.[a-", func(string, []byte) {})
+	if !errors.Is(err, common.ErrBadTopicPattern) {
+		t.Fatalf("Expected pattern syntax error, got: %v", err)
+	}
+}
+
+func TestServiceStubRequestContext(t *testing.T) {
+	server, client := net.Pipe()
+
+	go func() {
+		// Receive request, never reply
+		_, _, msg, err := common.RecvMessage(server)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var req cellaserv.Request
+		err = proto.Unmarshal(msg.GetContent(), &req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// The time budget of the context is forwarded
+		timeout, ok := common.RequestTimeout(&req)
+		if !ok || timeout > 50*time.Millisecond {
+			t.Errorf("Invalid request time budget: %s", timeout)
+		}
+	}()
+
+	c := newClient(client, ClientOpts{})
+	date := NewServiceStub(c, "date", "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := date.RequestContext(ctx, "time", nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got: %v", err)
+	}
+
+	// The request is not tracked anymore
+	c.requestsInFlightMtx.Lock()
+	inFlight := len(c.requestsInFlight)
+	c.requestsInFlightMtx.Unlock()
+	if inFlight != 0 {
+		t.Fatalf("Request still in flight")
+	}
+}
+
+func TestServiceStubRequestReplyError(t *testing.T) {
+	server, client := net.Pipe()
+
+	go func() {
+		_, _, msg, err := common.RecvMessage(server)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var req cellaserv.Request
+		err = proto.Unmarshal(msg.GetContent(), &req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// Reply with an error
+		reply := &cellaserv.Reply{
+			Id:    req.GetId(),
+			Error: &cellaserv.Reply_Error{Type: cellaserv.Reply_Error_NoSuchService},
+		}
+		msgContent, _ := proto.Marshal(reply)
+		common.SendMessage(server, &cellaserv.Message{Type: cellaserv.Message_Reply, Content: msgContent})
+	}()
+
+	c := newClient(client, ClientOpts{})
+	date := NewServiceStub(c, "date", "")
+	_, err := date.Request("time", nil)
+	if !errors.Is(err, ErrNoSuchService) {
+		t.Fatalf("Expected no such service error, got: %v", err)
+	}
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Type != cellaserv.Reply_Error_NoSuchService {
+		t.Fatalf("Expected a reply error, got: %v", err)
+	}
+}
+
+func TestServiceStubRequestConnectionLost(t *testing.T) {
+	server, client := net.Pipe()
+
+	go func() {
+		// Receive the request and close the connection
+		_, _, _, err := common.RecvMessage(server)
+		if err != nil {
+			t.Error(err)
+		}
+		server.Close()
+	}()
+
+	c := newClient(client, ClientOpts{})
+	date := NewServiceStub(c, "date", "")
+	_, err := date.Request("time", nil)
+	if err != ErrConnectionLost {
+		t.Fatalf("Expected connection lost error, got: %v", err)
+	}
+
+	// Following requests fail immediately
+	_, err = date.Request("time", nil)
+	if err != ErrConnectionLost {
+		t.Fatalf("Expected connection lost error, got: %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// waitRegisterAndSubscribe reads messages until the client registered
+	// its service and subscribed to its event
+	waitRegisterAndSubscribe := func(conn net.Conn) bool {
+		registered, subscribed := false, false
+		for !registered || !subscribed {
+			closed, _, msg, err := common.RecvMessage(conn)
+			if closed || err != nil {
+				t.Errorf("Could not receive message: %v", err)
+				return false
+			}
+			switch msg.GetType() {
+			case cellaserv.Message_Register:
+				var register cellaserv.Register
+				proto.Unmarshal(msg.GetContent(), &register)
+				registered = register.GetName() == "date"
+			case cellaserv.Message_Subscribe:
+				var sub cellaserv.Subscribe
+				proto.Unmarshal(msg.GetContent(), &sub)
+				subscribed = sub.GetEvent() == "foo"
+			}
+		}
+		return true
+	}
+
+	restored := make(chan struct{})
+	go func() {
+		// First connection, closed by the server
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !waitRegisterAndSubscribe(conn) {
+			return
+		}
+		conn.Close()
+
+		// The client reconnects and restores its state
+		conn, err = l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		if waitRegisterAndSubscribe(conn) {
+			close(restored)
+		}
+	}()
+
+	states := make(chan ConnectionState, 2)
+	c := NewClient(ClientOpts{
+		CellaservAddr:           l.Addr().String(),
+		Reconnect:               true,
+		ReconnectMinBackoff:     10 * time.Millisecond,
+		OnConnectionStateChange: func(state ConnectionState) { states <- state },
+	})
+	defer c.Close()
+	c.RegisterService(c.NewService("date", ""))
+	c.Subscribe("foo", func(string, []byte) {})
+
+	select {
+	case <-restored:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The client did not restore its state")
+	}
+	for _, expected := range []ConnectionState{Disconnected, Connected} {
+		select {
+		case state := <-states:
+			if state != expected {
+				t.Fatalf("Expected state %s, got %s", expected, state)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected state %s", expected)
+		}
+	}
+
+	// The client did not quit
+	select {
+	case <-c.Quit():
+		t.Fatal("The client quit")
+	default:
+	}
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+// SubscribeDurable subscribes to the event pattern as the durable subscriber
+// name. Cellaserv keeps the events until they are acknowledged, and sends
+// them again if they are not acknowledged in time, or when a client
+// subscribes again with the same name. An event is acknowledged after the
+// handler returns, and may be received more than once.
+func (c *Client) SubscribeDurable(name string, eventPattern string, handler subscriberHandler) error {
+	handle := func(pub *cellaserv.Publish) bool {
+		handler(pub.GetEvent(), pub.GetData())
+		return false
+	}
+	return c.subscribe(&subscriber{eventPattern: eventPattern, handle: handle, durable: name})
+}
+
+// UnsubscribeDurable removes the durable subscriber name. Cellaserv drops
+// the events not acknowledged yet. It must not be called from an event
+// handler.
+func (c *Client) UnsubscribeDurable(name string) error {
+	c.logger.Infof("Unsubscribing durable subscriber %q", name)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var kept []*subscriber
+	for _, s := range c.subscribers {
+		if s.durable != name {
+			kept = append(kept, s)
+		}
+	}
+	c.subscribers = kept
+
+	sub := &cellaserv.Subscribe{}
+	common.SetSubscribeUnsubscribe(sub)
+	common.SetSubscribeDurable(sub, name)
+	return c.sendSubscribe(sub)
+}
+
+// sendAck acknowledges an event delivered to the durable subscriber name.
+func (c *Client) sendAck(name string, eventPattern string, deliveryId uint64) {
+	sub := &cellaserv.Subscribe{Event: eventPattern}
+	common.SetSubscribeAck(sub, name, deliveryId)
+	if err := c.sendSubscribe(sub); err != nil {
+		c.logger.Errorf("Could not acknowledge event: %s", err)
+	}
+}
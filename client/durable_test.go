@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/evolutek/cellaserv3/broker"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+func TestSubscribeDurable(t *testing.T) {
+	ctxBroker, cancelBroker := context.WithCancel(context.Background())
+	defer cancelBroker()
+
+	broker := broker.New(broker.Options{
+		ListenAddress: ":4208",
+		LogsDir:       t.TempDir(),
+		AckTimeout:    100 * time.Millisecond,
+	}, common.NewLogger("test"))
+	go func() {
+		err := broker.Run(ctxBroker)
+		if err != nil {
+			t.Errorf("Could not start broker: %s", err)
+		}
+	}()
+	<-broker.Started()
+
+	clientOpts := ClientOpts{CellaservAddr: ":4208"}
+	pub := NewClient(clientOpts)
+	defer pub.Close()
+
+	events := make(chan string, 10)
+	handler := func(eventName string, data []byte) {
+		events <- string(data)
+	}
+	recv := func(expected string) {
+		t.Helper()
+		select {
+		case data := <-events:
+			if data != expected {
+				t.Fatalf("Expected event %s, got %s", expected, data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Did not receive event %s", expected)
+		}
+	}
+
+	sub := NewClient(clientOpts)
+	if err := sub.SubscribeDurable("logger", "position", handler); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	pub.Publish("position", 1)
+	recv("1")
+	sub.Close()
+
+	// Events published while the subscriber is gone are kept
+	time.Sleep(50 * time.Millisecond)
+	pub.Publish("position", 2)
+	time.Sleep(50 * time.Millisecond)
+
+	sub = NewClient(clientOpts)
+	defer sub.Close()
+	if err := sub.SubscribeDurable("logger", "position", handler); err != nil {
+		t.Fatal(err)
+	}
+	recv("2")
+
+	// Acknowledged events are not delivered again
+	select {
+	case data := <-events:
+		t.Fatalf("Unexpected event %s", data)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+// Errors returned by requests, use errors.Is() to check for them.
+var (
+	ErrNoSuchService         = errors.New("No such service")
+	ErrInvalidIdentification = errors.New("Invalid service identification")
+	ErrNoSuchMethod          = errors.New("No such method")
+	ErrBadArguments          = errors.New("Bad arguments")
+	ErrTimeout               = errors.New("Request timeout")
+	// ErrCustom is the kind of errors returned by request handlers
+	ErrCustom = errors.New("Service error")
+	// ErrDuplicateRequestId is returned when a request has the same id as
+	// another request of the client waiting for a reply
+	ErrDuplicateRequestId = errors.New("Duplicate request id")
+	// ErrServiceLost is returned when the service disconnects before
+	// replying to the request
+	ErrServiceLost = errors.New("Service lost")
+	// ErrShuttingDown is returned when cellaserv is shutting down
+	ErrShuttingDown = errors.New("cellaserv is shutting down")
+	// ErrServiceOverloaded is returned when the service does not read the
+	// requests sent to it
+	ErrServiceOverloaded = errors.New("Service overloaded")
+	// ErrConnectionLost is returned when the connection to cellaserv is
+	// lost before the reply is received
+	ErrConnectionLost = errors.New("Connection to cellaserv lost")
+)
+
+// Kind of error of each reply error type
+var replyErrorKinds = map[cellaserv.Reply_Error_Type]error{
+	cellaserv.Reply_Error_NoSuchService:         ErrNoSuchService,
+	cellaserv.Reply_Error_InvalidIdentification: ErrInvalidIdentification,
+	cellaserv.Reply_Error_NoSuchMethod:          ErrNoSuchMethod,
+	cellaserv.Reply_Error_BadArguments:          ErrBadArguments,
+	cellaserv.Reply_Error_Timeout:               ErrTimeout,
+	cellaserv.Reply_Error_Custom:                ErrCustom,
+	common.ReplyErrorDuplicateRequestId:         ErrDuplicateRequestId,
+	common.ReplyErrorServiceLost:                ErrServiceLost,
+	common.ReplyErrorShuttingDown:               ErrShuttingDown,
+	common.ReplyErrorServiceOverloaded:          ErrServiceOverloaded,
+}
+
+// ReplyError is the error sent by cellaserv or by a service in reply to a
+// request.
+type ReplyError struct {
+	Type cellaserv.Reply_Error_Type
+	// Explanation of the error, set by the service
+	What string
+}
+
+func (e *ReplyError) Error() string {
+	kind := e.Kind()
+	if kind == nil {
+		kind = fmt.Errorf("Unknown error %s", e.Type)
+	}
+	if e.What == "" {
+		return kind.Error()
+	}
+	return fmt.Sprintf("%s: %s", kind, e.What)
+}
+
+// Kind returns the error variable matching the type of the error, or nil if
+// the type is not known.
+func (e *ReplyError) Kind() error {
+	return replyErrorKinds[e.Type]
+}
+
+// Is makes errors.Is(err, ErrTimeout) work for reply errors.
+func (e *ReplyError) Is(target error) bool {
+	kind := e.Kind()
+	return kind != nil && kind == target
+}
+
+func newReplyError(replyError *cellaserv.Reply_Error) *ReplyError {
+	return &ReplyError{
+		Type: replyError.GetType(),
+		What: replyError.GetWhat(),
+	}
+}
+
+// replyErrorFromHandlerError creates the error sent in reply to a request
+// whose handler failed. Handlers can return errors wrapping ErrNoSuchMethod or
+// ErrBadArguments, other errors are sent as custom errors. Reply errors of
+// nested requests are not forwarded as is, the requester would think that
+// cellaserv sent them.
+func replyErrorFromHandlerError(err error) *cellaserv.Reply_Error {
+	errType := cellaserv.Reply_Error_Custom
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) {
+		if errors.Is(err, ErrNoSuchMethod) {
+			errType = cellaserv.Reply_Error_NoSuchMethod
+		} else if errors.Is(err, ErrBadArguments) {
+			errType = cellaserv.Reply_Error_BadArguments
+		}
+	}
+	return &cellaserv.Reply_Error{Type: errType, What: err.Error()}
+}
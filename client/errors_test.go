@@ -0,0 +1,45 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+func TestReplyErrorIs(t *testing.T) {
+	kinds := []struct {
+		errType cellaserv.Reply_Error_Type
+		kind    error
+	}{
+		{cellaserv.Reply_Error_NoSuchService, ErrNoSuchService},
+		{cellaserv.Reply_Error_InvalidIdentification, ErrInvalidIdentification},
+		{cellaserv.Reply_Error_NoSuchMethod, ErrNoSuchMethod},
+		{cellaserv.Reply_Error_BadArguments, ErrBadArguments},
+		{cellaserv.Reply_Error_Timeout, ErrTimeout},
+		{cellaserv.Reply_Error_Custom, ErrCustom},
+		{common.ReplyErrorDuplicateRequestId, ErrDuplicateRequestId},
+		{common.ReplyErrorServiceLost, ErrServiceLost},
+		{common.ReplyErrorShuttingDown, ErrShuttingDown},
+		{common.ReplyErrorServiceOverloaded, ErrServiceOverloaded},
+	}
+	for _, tc := range kinds {
+		err := fmt.Errorf("request failed: %w", newReplyError(&cellaserv.Reply_Error{Type: tc.errType, What: "what"}))
+		for _, other := range kinds {
+			if is := errors.Is(err, other.kind); is != (other.kind == tc.kind) {
+				t.Errorf("errors.Is(%s, %q) = %t", common.ReplyErrorTypeName(tc.errType), other.kind, is)
+			}
+		}
+		if errors.Is(err, ErrConnectionLost) {
+			t.Errorf("errors.Is(%s, %q) = true", common.ReplyErrorTypeName(tc.errType), ErrConnectionLost)
+		}
+	}
+
+	// Unknown types have no kind
+	err := newReplyError(&cellaserv.Reply_Error{Type: 42})
+	if err.Kind() != nil {
+		t.Errorf("Unknown error type has a kind: %s", err.Kind())
+	}
+}
@@ -10,7 +10,11 @@ import (
 
 func TestDateService(t *testing.T) {
 	broker.WithTestBroker(t, ":4202", func(clientOpts client.ClientOpts) {
-		go runDateService(clientOpts)
+		done := make(chan struct{})
+		go func() {
+			runDateService(clientOpts)
+			close(done)
+		}()
 
 		// Wait for the service to register
 		time.Sleep(50 * time.Millisecond)
@@ -25,5 +29,12 @@ func TestDateService(t *testing.T) {
 			t.Fatalf("Could not query date.time: %s", err)
 		}
 
+		// The killall event stops the service
+		conn.Publish("killall", nil)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("The service did not handle the killall event")
+		}
 	})
 }
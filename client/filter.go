@@ -0,0 +1,71 @@
+package client
+
+import (
+	"encoding/json"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+// SubscribeFilter subscribes to the events matching the pattern whose JSON
+// payload matches the filter expression, for example
+// `robot == "pal" && speed > 0.1`. The filter is evaluated by cellaserv, so
+// the other events are not sent to the client. Returns an error if the
+// filter is invalid.
+func (c *Client) SubscribeFilter(eventPattern string, filter string, handler subscriberHandler) error {
+	f, err := common.ParseFilter(filter)
+	if err != nil {
+		return err
+	}
+	handle := func(pub *cellaserv.Publish) bool {
+		handler(pub.GetEvent(), pub.GetData())
+		return false
+	}
+	return c.subscribe(&subscriber{eventPattern: eventPattern, handle: handle, filter: f})
+}
+
+// hasUnfilteredSubscriber returns whether a handler without filter is
+// subscribed to the pattern. The client's mutex must be held by caller.
+func (c *Client) hasUnfilteredSubscriber(eventPattern string) bool {
+	for _, s := range c.subscribers {
+		if s.eventPattern == eventPattern && !s.dedicated() && s.filter == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sendUnsubscribeFilter removes the filter from the subscription to the
+// pattern, the empty filter being the subscribe without filter.
+func (c *Client) sendUnsubscribeFilter(eventPattern string, filter string) error {
+	sub := &cellaserv.Subscribe{Event: eventPattern}
+	common.SetSubscribeUnsubscribe(sub)
+	common.SetSubscribeFilter(sub, filter)
+	return c.sendSubscribe(sub)
+}
+
+// handleSubscribeError removes the subscribers whose subscribe was rejected
+// by cellaserv.
+func (c *Client) handleSubscribeError(pub *cellaserv.Publish) {
+	var subErr api.SubscribeErrorJSON
+	if err := json.Unmarshal(pub.GetData(), &subErr); err != nil {
+		c.logger.Errorf("Could not unmarshal subscribe error: %s", err)
+		return
+	}
+	c.logger.Errorf("Subscribe to %q rejected: %s", pub.GetEvent(), subErr.Error)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var kept []*subscriber
+	for _, s := range c.subscribers {
+		filter := ""
+		if s.filter != nil {
+			filter = s.filter.String()
+		}
+		if s.eventPattern != pub.GetEvent() || filter != subErr.Filter || s.dedicated() {
+			kept = append(kept, s)
+		}
+	}
+	c.subscribers = kept
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/evolutek/cellaserv3/broker"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+func TestSubscribeFilter(t *testing.T) {
+	ctxBroker, cancelBroker := context.WithCancel(context.Background())
+	defer cancelBroker()
+
+	broker := broker.New(broker.Options{ListenAddress: ":4210"}, common.NewLogger("test"))
+	go func() {
+		err := broker.Run(ctxBroker)
+		if err != nil {
+			t.Errorf("Could not start broker: %s", err)
+		}
+	}()
+	<-broker.Started()
+
+	conn := NewClient(ClientOpts{CellaservAddr: ":4210"})
+	defer conn.Close()
+
+	if err := conn.SubscribeFilter("position", "speed >", func(string, []byte) {}); err == nil {
+		t.Fatal("Invalid filter should be rejected")
+	}
+
+	type position struct {
+		Robot string  `json:"robot"`
+		Speed float64 `json:"speed"`
+	}
+	fast := make(chan struct{}, 10)
+	all := make(chan struct{}, 10)
+	err := conn.SubscribeFilter("position", "speed > 0.1", func(eventName string, data []byte) {
+		fast <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Handlers of the same pattern only receive the events matching their
+	// own filter
+	err = conn.Subscribe("position", func(eventName string, data []byte) {
+		all <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	conn.Publish("position", position{"pal", 0})
+	conn.Publish("position", position{"pal", 0.5})
+	time.Sleep(100 * time.Millisecond)
+
+	if len(fast) != 1 {
+		t.Errorf("Filtered handler received %d events, expected 1", len(fast))
+	}
+	if len(all) != 2 {
+		t.Errorf("Handler received %d events, expected 2", len(all))
+	}
+}
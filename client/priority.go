@@ -0,0 +1,23 @@
+package client
+
+import (
+	"context"
+
+	"github.com/evolutek/cellaserv3/common"
+)
+
+type priorityKey struct{}
+
+// ContextWithPriority returns a context that sets the priority of the
+// requests sent with it. cellaserv sends the requests of higher priority, and
+// their replies, before the others.
+func ContextWithPriority(ctx context.Context, priority common.Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// priorityFromContext returns the priority set with ContextWithPriority, or
+// PriorityUnset.
+func priorityFromContext(ctx context.Context) common.Priority {
+	priority, _ := ctx.Value(priorityKey{}).(common.Priority)
+	return priority
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+// SubscribeQueue subscribes to the event pattern as a member of the queue
+// group. Each event matching the pattern is received by a single member of
+// the group, picked with the policy, see the api.LoadBalancing* constants.
+// The policy is set by the first member of the group, an empty policy uses
+// round robin. Other subscribers of the pattern still receive all the
+// events.
+func (c *Client) SubscribeQueue(group string, policy string, eventPattern string, handler subscriberHandler) error {
+	handle := func(pub *cellaserv.Publish) bool {
+		handler(pub.GetEvent(), pub.GetData())
+		return false
+	}
+	return c.subscribe(&subscriber{
+		eventPattern: eventPattern,
+		handle:       handle,
+		queue:        group,
+		queuePolicy:  policy,
+	})
+}
+
+// UnsubscribeQueue removes the handlers of the event pattern in the queue
+// group, and leaves the group. It must not be called from an event handler.
+func (c *Client) UnsubscribeQueue(group string, eventPattern string) error {
+	c.logger.Infof("Unsubscribing from event pattern %q in queue group %q", eventPattern, group)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var kept []*subscriber
+	for _, s := range c.subscribers {
+		if s.eventPattern != eventPattern || s.queue != group {
+			kept = append(kept, s)
+		}
+	}
+	c.subscribers = kept
+
+	sub := &cellaserv.Subscribe{Event: eventPattern}
+	common.SetSubscribeUnsubscribe(sub)
+	common.SetSubscribeQueue(sub, group, "")
+	return c.sendSubscribe(sub)
+}
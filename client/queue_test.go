@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/evolutek/cellaserv3/broker"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+func TestSubscribeQueue(t *testing.T) {
+	ctxBroker, cancelBroker := context.WithCancel(context.Background())
+	defer cancelBroker()
+
+	broker := broker.New(broker.Options{ListenAddress: ":4209"}, common.NewLogger("test"))
+	go func() {
+		err := broker.Run(ctxBroker)
+		if err != nil {
+			t.Errorf("Could not start broker: %s", err)
+		}
+	}()
+	<-broker.Started()
+
+	clientOpts := ClientOpts{CellaservAddr: ":4209"}
+	var received [3]int32
+	for i := range received {
+		count := &received[i]
+		conn := NewClient(clientOpts)
+		defer conn.Close()
+		handler := func(eventName string, data []byte) {
+			atomic.AddInt32(count, 1)
+		}
+		var err error
+		if i < 2 {
+			err = conn.SubscribeQueue("vision", "", "frame", handler)
+		} else {
+			// Not part of the group, receives all the events
+			err = conn.Subscribe("frame", handler)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	pub := NewClient(clientOpts)
+	defer pub.Close()
+	for i := 0; i < 4; i++ {
+		pub.Publish("frame", i)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for i, expected := range []int32{2, 2, 4} {
+		if count := atomic.LoadInt32(&received[i]); count != expected {
+			t.Errorf("Subscriber %d received %d events, expected %d", i, count, expected)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+)
+
+// SubscribeRate subscribes to the event pattern, receiving at most rate events
+// of each name per second. The mode tells how cellaserv handles the events
+// exceeding the rate, see the api.RateLimit* constants: they are dropped
+// (sampling, the default), or the last one is sent at the end of the interval
+// (coalescing). The rate applies to all the handlers of the pattern, the last
+// subscribe sets it.
+func (c *Client) SubscribeRate(eventPattern string, rate float64, mode string, handler subscriberHandler) error {
+	if rate <= 0 {
+		return fmt.Errorf("Invalid rate: %g", rate)
+	}
+	handle := func(pub *cellaserv.Publish) bool {
+		handler(pub.GetEvent(), pub.GetData())
+		return false
+	}
+	return c.subscribe(&subscriber{
+		eventPattern: eventPattern,
+		handle:       handle,
+		interval:     time.Duration(float64(time.Second) / rate),
+		rateMode:     mode,
+	})
+}
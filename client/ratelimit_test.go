@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/evolutek/cellaserv3/broker"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+func TestSubscribeRate(t *testing.T) {
+	ctxBroker, cancelBroker := context.WithCancel(context.Background())
+	defer cancelBroker()
+
+	broker := broker.New(broker.Options{ListenAddress: ":4211"}, common.NewLogger("test"))
+	go func() {
+		err := broker.Run(ctxBroker)
+		if err != nil {
+			t.Errorf("Could not start broker: %s", err)
+		}
+	}()
+	<-broker.Started()
+
+	conn := NewClient(ClientOpts{CellaservAddr: ":4211"})
+	defer conn.Close()
+
+	if err := conn.SubscribeRate("position", 0, api.RateLimitSample, func(string, []byte) {}); err == nil {
+		t.Fatal("Invalid rate should be rejected")
+	}
+
+	received := make(chan int, 10)
+	err := conn.SubscribeRate("position", 5, api.RateLimitCoalesce, func(eventName string, data []byte) {
+		var i int
+		json.Unmarshal(data, &i)
+		received <- i
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 1; i <= 5; i++ {
+		conn.Publish("position", i)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	// The first event is received, then the last one of the interval
+	if len(received) != 2 {
+		t.Fatalf("Handler received %d events, expected 2", len(received))
+	}
+	if first, last := <-received, <-received; first != 1 || last != 5 {
+		t.Errorf("Handler received %d and %d, expected 1 and 5", first, last)
+	}
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"net"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+const (
+	defaultReconnectMinBackoff = 100 * time.Millisecond
+	defaultReconnectMaxBackoff = 5 * time.Second
+)
+
+// receive reads the messages of the connection until it is closed.
+func (c *Client) receive(conn net.Conn) {
+	for {
+		closed, _, msg, err := common.RecvMessage(conn)
+		if closed {
+			if err != nil {
+				c.logger.Warnf("Connection to cellaserv lost: %s", err)
+			}
+			c.connectionLost()
+			return
+		}
+		if err != nil {
+			c.logger.Errorf("Could not receive message: %s", err)
+			continue
+		}
+		select {
+		case c.msgCh <- msg:
+		case <-c.quitCh:
+			return
+		}
+	}
+}
+
+// connectionLost is called when the connection to cellaserv is closed. The
+// client quits, or reconnects if configured to do so.
+func (c *Client) connectionLost() {
+	// Requests waiting for a reply will never receive it
+	c.failRequestsInFlight()
+
+	select {
+	case <-c.quitCh:
+		// Closed by the user
+		return
+	default:
+	}
+
+	if !c.opts.Reconnect {
+		c.quitOnce.Do(func() { close(c.quitCh) })
+		return
+	}
+
+	c.setConnectionState(Disconnected)
+
+	conn := dialWithBackoff(c.opts, c.logger, c.quitCh)
+	if conn == nil {
+		// Closed by the user while reconnecting
+		return
+	}
+
+	c.connMtx.Lock()
+	c.conn = conn
+	c.connMtx.Unlock()
+
+	// Close() may have been called on the previous connection
+	select {
+	case <-c.quitCh:
+		conn.Close()
+		return
+	default:
+	}
+
+	// The broker identifier of the client is its address, which changed
+	c.clientIdMtx.Lock()
+	c.clientId = ""
+	c.clientIdMtx.Unlock()
+
+	// Requests can be sent again
+	c.requestsInFlightMtx.Lock()
+	c.connLost = false
+	c.requestsInFlightMtx.Unlock()
+
+	go c.receive(conn)
+
+	c.restore()
+
+	c.setConnectionState(Connected)
+}
+
+// restore sends again the services, subscriptions, name and spies of the
+// client to cellaserv, after reconnecting.
+func (c *Client) restore() {
+	c.servicesMtx.RLock()
+	for _, idents := range c.services {
+		for _, s := range idents {
+			c.logger.Infof("Registering again service %s", s)
+			c.sendRegister(s)
+		}
+	}
+	c.servicesMtx.RUnlock()
+
+	// Stream subscribers resume after the last event they received
+	patterns := make(map[string]*StreamPosition)
+	c.mtx.RLock()
+	for _, s := range c.subscribers {
+		if s.dedicated() || s.filter != nil || s.interval != 0 {
+			// The broker sends again the events not acknowledged by
+			// durable subscribers
+			c.logger.Infof("Subscribing again to event pattern: %q", s.eventPattern)
+			err := c.sendSubscribe(s.subscribeMessage())
+			if err != nil {
+				c.logger.Errorf("Could not subscribe again to %q: %s", s.eventPattern, err)
+			}
+			continue
+		}
+		pos := s.resumePosition()
+		if current, ok := patterns[s.eventPattern]; !ok || current == nil || (pos != nil && pos.before(*current)) {
+			patterns[s.eventPattern] = pos
+		}
+	}
+	c.mtx.RUnlock()
+	for pattern, replay := range patterns {
+		c.logger.Infof("Subscribing again to event pattern: %q", pattern)
+		sub := &cellaserv.Subscribe{Event: pattern}
+		if replay != nil {
+			replay.set(sub)
+		}
+		err := c.sendSubscribe(sub)
+		if err != nil {
+			c.logger.Errorf("Could not subscribe again to %q: %s", pattern, err)
+		}
+	}
+
+	if c.opts.Name != "" {
+		_, err := c.Cs.Request("name_client", api.NameClientRequest{Name: c.opts.Name})
+		if err != nil {
+			c.logger.Errorf("Could not set the client name again: %s", err)
+		}
+	}
+
+	c.spiesMtx.RLock()
+	spies := append([]*spy(nil), c.spies...)
+	c.spiesMtx.RUnlock()
+	for _, s := range spies {
+		c.logger.Infof("Spying again on %s[%s]", s.name, s.identification)
+		c.sendSpyRequest("spy", s.name, s.identification)
+	}
+}
+
+func (c *Client) setConnectionState(state ConnectionState) {
+	c.logger.Infof("Connection state: %s", state)
+	if c.opts.OnConnectionStateChange != nil {
+		c.opts.OnConnectionStateChange(state)
+	}
+}
+
+// dialWithBackoff connects to cellaserv, retrying with an exponential backoff
+// until it succeeds. Returns nil if quitCh is closed before that.
+func dialWithBackoff(opts ClientOpts, logger common.Logger, quitCh <-chan struct{}) net.Conn {
+	minBackoff := opts.ReconnectMinBackoff
+	if minBackoff == 0 {
+		minBackoff = defaultReconnectMinBackoff
+	}
+	maxBackoff := opts.ReconnectMaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = defaultReconnectMaxBackoff
+	}
+
+	backoff := minBackoff
+	for {
+		conn, err := net.Dial("tcp", opts.CellaservAddr)
+		if err == nil {
+			return conn
+		}
+		logger.Warnf("Could not connect to cellaserv, retrying in %s: %s", backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-quitCh:
+			return nil
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
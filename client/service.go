@@ -1,22 +1,52 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 
 	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
 )
 
 type RequestHandlerFunc func(*cellaserv.Request) (interface{}, error)
 
+// RequestHandlerContextFunc is a request handler that receives a context
+// which is done when the time budget of the request is exhausted.
+type RequestHandlerContextFunc func(context.Context, *cellaserv.Request) (interface{}, error)
+
 type EventHandlerFunc func(*cellaserv.Publish)
 
+// eventHandler is an event handler of a service.
+type eventHandler struct {
+	handle EventHandlerFunc
+	// The event name is relative to the namespace of the service
+	namespaced bool
+}
+
 type service struct {
 	Name           string
 	Identification string
+	// Load balancing policy, see the api.LoadBalancing* constants. When set,
+	// the service joins the group of services registered with the same name
+	// and identification instead of replacing them, and cellaserv
+	// distributes the requests among the members of the group.
+	LoadBalancing string
+	// Maximum number of requests handled at the same time. By default, the
+	// requests are handled one at a time, in the order they are received,
+	// so that the handlers do not have to be safe for concurrent use. Set
+	// it to handle up to this number of requests concurrently.
+	MaxConcurrentRequests int
 
-	requestHandlers map[string](RequestHandlerFunc)
-	eventHandlers   map[string](EventHandlerFunc)
+	requestHandlers map[string](RequestHandlerContextFunc)
+	eventHandlers   map[string]eventHandler
+
+	// Requests waiting to be handled, and number of goroutines handling
+	// them
+	dispatchMtx sync.Mutex
+	pending     []func()
+	workers     int
 }
 
 func (s *service) String() string {
@@ -28,28 +58,97 @@ func (c *Client) NewService(name string, identification string) *service {
 	return &service{
 		Name:            name,
 		Identification:  identification,
-		requestHandlers: make(map[string](RequestHandlerFunc)),
-		eventHandlers:   make(map[string](EventHandlerFunc)),
+		requestHandlers: make(map[string](RequestHandlerContextFunc)),
+		eventHandlers:   make(map[string]eventHandler),
 	}
 }
 
 func (s *service) HandleRequestFunc(action string, f RequestHandlerFunc) {
+	s.requestHandlers[action] = func(_ context.Context, req *cellaserv.Request) (interface{}, error) {
+		return f(req)
+	}
+}
+
+// HandleRequestFuncContext registers a request handler that can give up when
+// the time budget of the request is exhausted.
+func (s *service) HandleRequestFuncContext(action string, f RequestHandlerContextFunc) {
 	s.requestHandlers[action] = f
 }
 
+// HandleEventFunc registers a handler of the events matching the pattern,
+// subscribed to when the service is registered.
 func (s *service) HandleEventFunc(event string, f EventHandlerFunc) {
-	s.eventHandlers[event] = f
+	s.eventHandlers[event] = eventHandler{handle: f}
+}
+
+// HandleServiceEventFunc registers a handler of the events of the namespace
+// of the service, for example "date[foo].killall" for the event "killall" of
+// the service date[foo]. The events are published with ServiceStub.Publish().
+func (s *service) HandleServiceEventFunc(event string, f EventHandlerFunc) {
+	s.eventHandlers[event] = eventHandler{handle: f, namespaced: true}
+}
+
+// ServiceEventName returns the name of the event in the namespace of the
+// service: "name.event", or "name[identification].event".
+func ServiceEventName(name string, identification string, event string) string {
+	if identification == "" {
+		return name + "." + event
+	}
+	return fmt.Sprintf("%s[%s].%s", name, identification, event)
+}
+
+// eventPattern returns the pattern subscribed to for the event handler.
+func (s *service) eventPattern(event string, h eventHandler) string {
+	if !h.namespaced {
+		return event
+	}
+	return common.QuoteTopic(ServiceEventName(s.Name, s.Identification, "")) + event
+}
+
+// dispatch queues the handling of a request. The requests are handled by at
+// most MaxConcurrentRequests goroutines, in the order they are queued.
+func (s *service) dispatch(handle func()) {
+	maxWorkers := s.MaxConcurrentRequests
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+	s.dispatchMtx.Lock()
+	s.pending = append(s.pending, handle)
+	if s.workers >= maxWorkers {
+		s.dispatchMtx.Unlock()
+		return
+	}
+	s.workers++
+	s.dispatchMtx.Unlock()
+	go s.work()
+}
+
+// work handles the queued requests until there are none left.
+func (s *service) work() {
+	for {
+		s.dispatchMtx.Lock()
+		if len(s.pending) == 0 {
+			s.workers--
+			s.dispatchMtx.Unlock()
+			return
+		}
+		handle := s.pending[0]
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		s.dispatchMtx.Unlock()
+		handle()
+	}
 }
 
-func (s *service) handleRequest(req *cellaserv.Request, method string) ([]byte, error) {
+func (s *service) handleRequest(ctx context.Context, req *cellaserv.Request, method string) ([]byte, error) {
 	// Find handler
 	handle, ok := s.requestHandlers[method]
 	if !ok {
-		return nil, fmt.Errorf("No such method: %s", method)
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchMethod, method)
 	}
 
 	// Call handler
-	reply, err := handle(req)
+	reply, err := handle(ctx, req)
 	if err != nil {
 		return nil, err
 	}
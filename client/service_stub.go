@@ -1,12 +1,19 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
 	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
+	"github.com/evolutek/cellaserv3/common"
 )
 
+// Identification to use to send a request to every identification of a
+// service.
+const broadcastIdentification = "*"
+
 type ServiceStub struct {
 	name           string
 	identification string
@@ -18,16 +25,19 @@ func (s *ServiceStub) String() string {
 	return fmt.Sprintf("%s[%s]", s.name, s.identification)
 }
 
-func (s *ServiceStub) sendRequest(req *cellaserv.Request) ([]byte, error) {
+func (s *ServiceStub) sendRequest(ctx context.Context, req *cellaserv.Request) ([]byte, error) {
 	s.client.logger.Debugf("Sending request %s[%s].%s(%s)", req.ServiceName, req.ServiceIdentification, req.Method, req.Data)
 
-	reply := s.client.sendRequestWaitForReply(req)
+	reply, err := s.client.sendRequestWaitForReply(ctx, req)
+	if err != nil {
+		return nil, err
+	}
 
 	// Check for errors
 	replyError := reply.GetError()
-	if replyError != nil {
+	if replyError != nil && replyError.GetType() != cellaserv.Reply_Error_NoError {
 		s.client.logger.Errorf("Received reply error: %s", replyError.String())
-		return nil, fmt.Errorf(replyError.String())
+		return nil, newReplyError(replyError)
 	}
 
 	return reply.GetData(), nil
@@ -42,14 +52,21 @@ func (s *ServiceStub) RequestNoData(method string) ([]byte, error) {
 		// Id set by client
 	}
 
-	return s.sendRequest(req)
+	return s.sendRequest(context.Background(), req)
 }
 
 func (s *ServiceStub) Request(method string, data interface{}) ([]byte, error) {
+	return s.RequestContext(context.Background(), method, data)
+}
+
+// RequestContext sends a request and waits for its reply. The deadline of the
+// context, if any, is used as the time budget of the request. The request is
+// abandoned when the context is done.
+func (s *ServiceStub) RequestContext(ctx context.Context, method string, data interface{}) ([]byte, error) {
 	// Serialize request payload
 	dataBytes, err := json.Marshal(data)
 	if err != nil {
-		panic(fmt.Sprintf("Could not marshal to JSON: %v", data))
+		return nil, fmt.Errorf("%w: could not marshal to JSON: %s", ErrBadArguments, err)
 	}
 
 	// Create Request
@@ -61,10 +78,22 @@ func (s *ServiceStub) Request(method string, data interface{}) ([]byte, error) {
 		// Id set by client
 	}
 
-	return s.sendRequest(req)
+	return s.sendRequest(ctx, req)
+}
+
+// Publish publishes an event in the namespace of the service, handled by its
+// HandleServiceEventFunc handlers.
+func (s *ServiceStub) Publish(event string, data interface{}) {
+	s.client.Publish(ServiceEventName(s.name, s.identification, event), data)
 }
 
 func (s *ServiceStub) RequestRaw(method string, dataBytes []byte) ([]byte, error) {
+	return s.RequestRawContext(context.Background(), method, dataBytes)
+}
+
+// RequestRawContext is the same as RequestContext but sends the request data
+// as is.
+func (s *ServiceStub) RequestRawContext(ctx context.Context, method string, dataBytes []byte) ([]byte, error) {
 	// Create Request
 	req := &cellaserv.Request{
 		Data:                  dataBytes,
@@ -74,7 +103,7 @@ func (s *ServiceStub) RequestRaw(method string, dataBytes []byte) ([]byte, error
 		// Id set by client
 	}
 
-	return s.sendRequest(req)
+	return s.sendRequest(ctx, req)
 }
 
 func NewServiceStub(c *Client, name string, identification string) *ServiceStub {
@@ -84,3 +113,53 @@ func NewServiceStub(c *Client, name string, identification string) *ServiceStub
 		client:         c,
 	}
 }
+
+// BroadcastReply is the reply of a single service to a broadcast request.
+type BroadcastReply struct {
+	Identification string
+	Data           []byte
+	// Error sent by the service, or by cellaserv if the service did not
+	// reply in time
+	Err error
+}
+
+// Broadcast sends the request to every identification of the service and
+// waits for all their replies.
+func (s *ServiceStub) Broadcast(method string, data interface{}) ([]BroadcastReply, error) {
+	return s.BroadcastContext(context.Background(), method, data)
+}
+
+// BroadcastContext is the same as Broadcast, with the context used as in
+// RequestContext. The error is not nil only if the request could not be sent
+// to the services, errors of each service are in its reply.
+func (s *ServiceStub) BroadcastContext(ctx context.Context, method string, data interface{}) ([]BroadcastReply, error) {
+	broadcast := &ServiceStub{
+		name:           s.name,
+		identification: broadcastIdentification,
+		client:         s.client,
+	}
+	replyBytes, err := broadcast.RequestContext(ctx, method, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var repliesJSON []api.BroadcastReplyJSON
+	err = json.Unmarshal(replyBytes, &repliesJSON)
+	if err != nil {
+		return nil, fmt.Errorf("Could not unmarshal broadcast replies: %s", err)
+	}
+
+	replies := make([]BroadcastReply, len(repliesJSON))
+	for i, r := range repliesJSON {
+		replies[i].Identification = r.Identification
+		replies[i].Data = r.Data
+		if r.Error != nil {
+			errType, ok := common.ParseReplyErrorType(r.Error.Type)
+			if !ok {
+				errType = cellaserv.Reply_Error_Custom
+			}
+			replies[i].Err = &ReplyError{Type: errType, What: r.Error.What}
+		}
+	}
+	return replies, nil
+}
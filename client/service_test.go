@@ -2,6 +2,9 @@ package client
 
 import (
 	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -50,10 +53,292 @@ func TestServiceRequest(t *testing.T) {
 
 	// Testt invalid method
 	_, err := dateServiceStub.Request("foobarlol", nil)
-	if err == nil {
-		t.Errorf("Did not return error on non-existing method")
+	if !errors.Is(err, ErrNoSuchMethod) {
+		t.Errorf("Did not return no such method error on non-existing method: %v", err)
 	}
 
 	// Shutdown cellaserv
 	cancelBroker()
 }
+
+func TestServiceRequestContext(t *testing.T) {
+	ctxBroker, cancelBroker := context.WithCancel(context.Background())
+	defer cancelBroker()
+
+	broker := broker.New(broker.Options{ListenAddress: ":4205"}, common.NewLogger("test"))
+	go func() {
+		err := broker.Run(ctxBroker)
+		if err != nil {
+			t.Errorf("Could not start broker: %s", err)
+		}
+	}()
+	<-broker.Started()
+
+	clientOpts := ClientOpts{CellaservAddr: ":4205"}
+	connService := NewClient(clientOpts)
+	motorService := connService.NewService("motor", "")
+	// The handler gives up when the time budget of the request is exhausted
+	motorService.HandleRequestFuncContext("move", func(ctx context.Context, _ *cellaserv.Request) (interface{}, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("The handler context has no deadline")
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	connService.RegisterService(motorService)
+
+	time.Sleep(50 * time.Millisecond)
+
+	connRequest := NewClient(clientOpts)
+	motorStub := NewServiceStub(connRequest, "motor", "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := motorStub.RequestContext(ctx, "move", nil)
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Request took too long: %s", elapsed)
+	}
+}
+
+func TestServiceStubBroadcast(t *testing.T) {
+	ctxBroker, cancelBroker := context.WithCancel(context.Background())
+	defer cancelBroker()
+
+	broker := broker.New(broker.Options{ListenAddress: ":4206"}, common.NewLogger("test"))
+	go func() {
+		err := broker.Run(ctxBroker)
+		if err != nil {
+			t.Errorf("Could not start broker: %s", err)
+		}
+	}()
+	<-broker.Started()
+
+	clientOpts := ClientOpts{CellaservAddr: ":4206"}
+	connService := NewClient(clientOpts)
+	for _, ident := range []string{"left", "right"} {
+		ident := ident
+		motorService := connService.NewService("motor", ident)
+		motorService.HandleRequestFunc("status", func(_ *cellaserv.Request) (interface{}, error) {
+			if ident == "right" {
+				return nil, errors.New("motor is stalled")
+			}
+			return ident, nil
+		})
+		connService.RegisterService(motorService)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	connRequest := NewClient(clientOpts)
+	replies, err := NewServiceStub(connRequest, "motor", "").Broadcast("status", nil)
+	if err != nil {
+		t.Fatalf("Broadcast failed: %s", err)
+	}
+	if len(replies) != 2 {
+		t.Fatalf("Expected 2 replies, got %d", len(replies))
+	}
+	if replies[0].Identification != "left" || string(replies[0].Data) != `"left"` || replies[0].Err != nil {
+		t.Errorf("Invalid reply: %+v", replies[0])
+	}
+	if replies[1].Identification != "right" || !errors.Is(replies[1].Err, ErrCustom) {
+		t.Errorf("Invalid reply: %+v", replies[1])
+	}
+
+	// No such service
+	_, err = NewServiceStub(connRequest, "foobar", "").Broadcast("status", nil)
+	if !errors.Is(err, ErrNoSuchService) {
+		t.Errorf("Expected no such service error: %v", err)
+	}
+}
+
+func TestServiceEvents(t *testing.T) {
+	ctxBroker, cancelBroker := context.WithCancel(context.Background())
+	defer cancelBroker()
+
+	broker := broker.New(broker.Options{ListenAddress: ":4212"}, common.NewLogger("test"))
+	go func() {
+		err := broker.Run(ctxBroker)
+		if err != nil {
+			t.Errorf("Could not start broker: %s", err)
+		}
+	}()
+	<-broker.Started()
+
+	clientOpts := ClientOpts{CellaservAddr: ":4212"}
+	connService := NewClient(clientOpts)
+	killall := make(chan string, 10)
+	reset := make(chan string, 10)
+	dateService := connService.NewService("date", "foo")
+	dateService.HandleEventFunc("killall", func(pub *cellaserv.Publish) {
+		killall <- pub.GetEvent()
+	})
+	dateService.HandleServiceEventFunc("reset", func(pub *cellaserv.Publish) {
+		reset <- pub.GetEvent()
+	})
+	connService.RegisterService(dateService)
+
+	time.Sleep(50 * time.Millisecond)
+
+	connPublish := NewClient(clientOpts)
+	connPublish.Publish("killall", nil)
+	NewServiceStub(connPublish, "date", "foo").Publish("reset", nil)
+	// Events of other services are not handled
+	NewServiceStub(connPublish, "date", "").Publish("reset", nil)
+	NewServiceStub(connPublish, "date", "f").Publish("reset", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	if len(killall) != 1 || <-killall != "killall" {
+		t.Errorf("The killall handler was not called once")
+	}
+	if len(reset) != 1 || <-reset != "date[foo].reset" {
+		t.Errorf("The reset handler was not called once")
+	}
+
+	// The event handlers of a replaced service are unsubscribed
+	connService.RegisterService(connService.NewService("date", "foo"))
+	time.Sleep(50 * time.Millisecond)
+	connPublish.Publish("killall", nil)
+	NewServiceStub(connPublish, "date", "foo").Publish("reset", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	if len(killall) != 0 || len(reset) != 0 {
+		t.Errorf("The handlers of the replaced service were called")
+	}
+}
+
+func TestServiceRequestTrace(t *testing.T) {
+	ctxBroker, cancelBroker := context.WithCancel(context.Background())
+	defer cancelBroker()
+
+	broker := broker.New(broker.Options{ListenAddress: ":4215"}, common.NewLogger("test"))
+	go func() {
+		err := broker.Run(ctxBroker)
+		if err != nil {
+			t.Errorf("Could not start broker: %s", err)
+		}
+	}()
+	<-broker.Started()
+
+	clientOpts := ClientOpts{CellaservAddr: ":4215"}
+	connService := NewClient(clientOpts)
+	clockService := connService.NewService("clock", "")
+	clockTrace := make(chan common.TraceContext, 1)
+	clockService.HandleRequestFuncContext("now", func(ctx context.Context, _ *cellaserv.Request) (interface{}, error) {
+		trace, _ := TraceFromContext(ctx)
+		clockTrace <- trace
+		return nil, nil
+	})
+	// The date service requests the clock service while handling its requests
+	dateService := connService.NewService("date", "")
+	dateTrace := make(chan common.TraceContext, 1)
+	clockStub := NewServiceStub(connService, "clock", "")
+	dateService.HandleRequestFuncContext("time", func(ctx context.Context, _ *cellaserv.Request) (interface{}, error) {
+		trace, _ := TraceFromContext(ctx)
+		dateTrace <- trace
+		return clockStub.RequestContext(ctx, "now", nil)
+	})
+	connService.RegisterService(clockService)
+	connService.RegisterService(dateService)
+
+	time.Sleep(50 * time.Millisecond)
+
+	connRequest := NewClient(clientOpts)
+	dateStub := NewServiceStub(connRequest, "date", "")
+	if _, err := dateStub.RequestContext(context.Background(), "time", nil); err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+
+	date := <-dateTrace
+	clock := <-clockTrace
+	if !date.TraceId.IsValid() {
+		t.Fatalf("The date handler context has no trace")
+	}
+	if clock.TraceId != date.TraceId {
+		t.Errorf("The nested request is not part of the trace: %s, expected %s", clock.TraceId, date.TraceId)
+	}
+	spans, ok := broker.GetTraceJSON(date.TraceId)
+	if !ok {
+		t.Fatalf("The trace is not known by the broker")
+	}
+	nested := false
+	for _, span := range spans {
+		if span.Name != "clock.now" {
+			continue
+		}
+		nested = true
+		if span.ParentSpanId != date.SpanId.String() {
+			t.Errorf("The nested request span has parent %s, expected %s", span.ParentSpanId, date.SpanId)
+		}
+	}
+	if !nested {
+		t.Errorf("The trace has no span for the nested request")
+	}
+}
+
+func TestServiceMaxConcurrentRequests(t *testing.T) {
+	ctxBroker, cancelBroker := context.WithCancel(context.Background())
+	defer cancelBroker()
+
+	broker := broker.New(broker.Options{ListenAddress: ":4216"}, common.NewLogger("test"))
+	go func() {
+		err := broker.Run(ctxBroker)
+		if err != nil {
+			t.Errorf("Could not start broker: %s", err)
+		}
+	}()
+	<-broker.Started()
+
+	clientOpts := ClientOpts{CellaservAddr: ":4216"}
+	connService := NewClient(clientOpts)
+	// Records the maximum number of requests handled at the same time
+	newService := func(name string, maxConcurrent int) *int32 {
+		var running, maxRunning int32
+		srvc := connService.NewService(name, "")
+		srvc.MaxConcurrentRequests = maxConcurrent
+		srvc.HandleRequestFunc("sleep", func(*cellaserv.Request) (interface{}, error) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return nil, nil
+		})
+		connService.RegisterService(srvc)
+		return &maxRunning
+	}
+	sequential := newService("sequential", 0)
+	concurrent := newService("concurrent", 3)
+
+	time.Sleep(50 * time.Millisecond)
+
+	connRequest := NewClient(clientOpts)
+	var wg sync.WaitGroup
+	for _, name := range []string{"sequential", "concurrent"} {
+		stub := NewServiceStub(connRequest, name, "")
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := stub.Request("sleep", nil); err != nil {
+					t.Errorf("Request failed: %s", err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(sequential); n != 1 {
+		t.Errorf("The requests of the service are not handled one at a time: %d", n)
+	}
+	if n := atomic.LoadInt32(concurrent); n < 2 || n > 3 {
+		t.Errorf("Unexpected number of requests handled at the same time: %d", n)
+	}
+}
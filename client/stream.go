@@ -0,0 +1,104 @@
+package client
+
+import (
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+// A StreamEvent is an event received by a stream subscriber.
+type StreamEvent struct {
+	Name string
+	Data []byte
+	// Position of the event in the durable stream of cellaserv. The
+	// sequence number is 0 if the event is not streamed.
+	Sequence uint64
+	Time     time.Time
+}
+
+type streamHandler func(event StreamEvent)
+
+// A StreamPosition is the position from which the durable stream is
+// replayed.
+type StreamPosition struct {
+	sequence uint64
+	time     time.Time
+	fromTime bool
+}
+
+// FromSequence returns the position of the event with sequence number seq.
+// The first event of the stream has the sequence number 1.
+func FromSequence(seq uint64) StreamPosition {
+	return StreamPosition{sequence: seq}
+}
+
+// FromTime returns the position of the first event streamed at or after t.
+func FromTime(t time.Time) StreamPosition {
+	return StreamPosition{time: t, fromTime: true}
+}
+
+func (p StreamPosition) set(sub *cellaserv.Subscribe) {
+	if p.fromTime {
+		common.SetSubscribeFromTime(sub, p.time)
+	} else {
+		common.SetSubscribeFromSequence(sub, p.sequence)
+	}
+}
+
+// before returns whether p is before other. Positions of different kinds are
+// not ordered.
+func (p StreamPosition) before(other StreamPosition) bool {
+	if p.fromTime != other.fromTime {
+		return false
+	}
+	if p.fromTime {
+		return p.time.Before(other.time)
+	}
+	return p.sequence < other.sequence
+}
+
+// accept returns whether the subscriber handles the event. Streamed events
+// already received by a stream subscriber are ignored.
+func (s *subscriber) accept(pub *cellaserv.Publish) bool {
+	if s.replay == nil {
+		return true
+	}
+	seq, _, ok := common.PublishSequence(pub)
+	if !ok {
+		return true
+	}
+	if seq <= s.lastSequence {
+		return false
+	}
+	s.lastSequence = seq
+	return true
+}
+
+// resumePosition returns the position from which the stream must be
+// replayed when subscribing again, nil if the subscriber does not replay the
+// stream.
+func (s *subscriber) resumePosition() *StreamPosition {
+	if s.replay == nil {
+		return nil
+	}
+	if s.lastSequence > 0 {
+		pos := FromSequence(s.lastSequence + 1)
+		return &pos
+	}
+	return s.replay
+}
+
+// SubscribeStream subscribes to the event pattern, after receiving the
+// events of the durable stream of cellaserv matching the pattern from the
+// position. When reconnecting, the replay starts after the last streamed
+// event received.
+func (c *Client) SubscribeStream(eventPattern string, from StreamPosition, handler streamHandler) error {
+	handle := func(pub *cellaserv.Publish) bool {
+		event := StreamEvent{Name: pub.GetEvent(), Data: pub.GetData()}
+		event.Sequence, event.Time, _ = common.PublishSequence(pub)
+		handler(event)
+		return false
+	}
+	return c.subscribe(&subscriber{eventPattern: eventPattern, handle: handle, replay: &from})
+}
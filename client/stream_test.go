@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/evolutek/cellaserv3/broker"
+	"github.com/evolutek/cellaserv3/common"
+)
+
+func TestSubscribeStream(t *testing.T) {
+	ctxBroker, cancelBroker := context.WithCancel(context.Background())
+	defer cancelBroker()
+
+	broker := broker.New(broker.Options{
+		ListenAddress:  ":4207",
+		LogsDir:        t.TempDir(),
+		StreamPatterns: []string{"position"},
+	}, common.NewLogger("test"))
+	go func() {
+		err := broker.Run(ctxBroker)
+		if err != nil {
+			t.Errorf("Could not start broker: %s", err)
+		}
+	}()
+	<-broker.Started()
+
+	clientOpts := ClientOpts{CellaservAddr: ":4207"}
+	conn := NewClient(clientOpts)
+	defer conn.Close()
+	for _, x := range []int{1, 2, 3} {
+		conn.Publish("position", x)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	events := make(chan StreamEvent, 10)
+	err := conn.SubscribeStream("position", FromSequence(2), func(event StreamEvent) {
+		events <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recv := func(expectedSeq uint64, expectedData string) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.Sequence != expectedSeq || string(event.Data) != expectedData {
+				t.Fatalf("Expected event #%d %s, got #%d %s", expectedSeq, expectedData, event.Sequence, event.Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Did not receive event #%d", expectedSeq)
+		}
+	}
+	recv(2, "2")
+	recv(3, "3")
+
+	// Live events follow the replay
+	time.Sleep(50 * time.Millisecond)
+	conn.Publish("position", 4)
+	recv(4, "4")
+}
@@ -0,0 +1,24 @@
+package client
+
+import (
+	"context"
+
+	"github.com/evolutek/cellaserv3/common"
+)
+
+type traceKey struct{}
+
+// ContextWithTrace returns a context that traces the requests sent with it as
+// children of the span of the trace context. The context of the request
+// handlers carries the trace context of their request, so that the requests
+// they send with it are part of the same trace.
+func ContextWithTrace(ctx context.Context, trace common.TraceContext) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+// TraceFromContext returns the trace context set with ContextWithTrace, if
+// any.
+func TraceFromContext(ctx context.Context) (common.TraceContext, bool) {
+	trace, ok := ctx.Value(traceKey{}).(common.TraceContext)
+	return trace, ok
+}
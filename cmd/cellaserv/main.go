@@ -7,7 +7,11 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/evolutek/cellaserv3/broker"
 	"github.com/evolutek/cellaserv3/broker/cellaserv"
@@ -37,9 +41,42 @@ func locateHttpAssets(userLocation string) string {
 	return userLocation
 }
 
+// parsePriorities parses the priority of each pattern.
+func parsePriorities(patterns map[string]string) (map[string]common.Priority, error) {
+	priorities := make(map[string]common.Priority)
+	for pattern, name := range patterns {
+		if _, err := common.ParseTopicPattern(pattern); err != nil {
+			return nil, err
+		}
+		priority, err := common.ParsePriority(name)
+		if err != nil {
+			return nil, err
+		}
+		priorities[pattern] = priority
+	}
+	return priorities, nil
+}
+
+// parseRateLimits parses the publish rate limit of each pattern.
+func parseRateLimits(patterns map[string]string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for pattern, value := range patterns {
+		if _, err := common.ParseTopicPattern(pattern); err != nil {
+			return nil, err
+		}
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("Invalid rate: %s", value)
+		}
+		rates[pattern] = rate
+	}
+	return rates, nil
+}
+
 func main() {
 	brokerOptions := broker.Options{}
 	webOptions := web.Options{}
+	var shutdownGrace time.Duration
 
 	a := kingpin.New(filepath.Base(os.Args[0]), "The cellaserv message broker")
 	a.Version(common.GetVersion())
@@ -49,6 +86,27 @@ func main() {
 	a.Flag("listen-addr", "listening address of the server").
 		Default(":4200").
 		StringVar(&brokerOptions.ListenAddress)
+	a.Flag("request-timeout", "timeout of requests that do not carry their own deadline").
+		Default("5s").
+		DurationVar(&brokerOptions.RequestTimeout)
+	a.Flag("client-queue-size", "maximum number of messages waiting to be sent to a client").
+		Default("1024").
+		IntVar(&brokerOptions.OutboundQueueSize)
+	a.Flag("client-queue-overflow", "policy when the queue of a client is full: drop-oldest, drop-newest or disconnect").
+		Default(broker.OverflowDropOldest).
+		EnumVar(&brokerOptions.OutboundQueueOverflow, broker.OverflowDropOldest, broker.OverflowDropNewest, broker.OverflowDisconnect)
+	a.Flag("client-write-timeout", "time after which a client that does not read its messages is disconnected").
+		Default("10s").
+		DurationVar(&brokerOptions.WriteTimeout)
+	eventPriorities := a.Flag("event-priority", "priority of the events matching a pattern. Example: 'estop.*=high'").
+		StringMap()
+	servicePriorities := a.Flag("service-priority", "priority of the requests to the services matching a pattern. Example: 'motor=high'").
+		StringMap()
+	publishRateLimits := a.Flag("publish-rate-limit", "maximum number of events per second a client can publish for the events matching a pattern. Example: 'odometry.*=50'").
+		StringMap()
+	a.Flag("shutdown-grace", "time given to pending requests to complete when receiving SIGTERM").
+		Default("5s").
+		DurationVar(&shutdownGrace)
 
 	// Publish logging
 	a.Flag("store-logs", "whether to store logs, enables using cellaserv.get_logs()").
@@ -57,6 +115,15 @@ func main() {
 	a.Flag("logs-dir", "base path for client logs storage").
 		Default("/var/log/cellaserv").
 		StringVar(&brokerOptions.LogsDir)
+	a.Flag("stream", "pattern of the events appended to the durable stream, stored in the logs directory. Can be repeated").
+		StringsVar(&brokerOptions.StreamPatterns)
+	a.Flag("ack-timeout", "time after which the events not acknowledged by a durable subscriber are sent again").
+		Default("5s").
+		DurationVar(&brokerOptions.AckTimeout)
+	a.Flag("record", "capture file in which the requests, replies, events and registrations are recorded, for cellaservctl replay").
+		StringVar(&brokerOptions.RecordPath)
+	a.Flag("trace-export", "file, or URL of the OTLP/HTTP traces endpoint of a collector, the spans of the requests are exported to in OTLP/JSON. Example: http://localhost:4318/v1/traces").
+		StringVar(&brokerOptions.TraceExport)
 
 	// Web options
 	a.Flag("http-listen-addr", "listening address of the internal HTTP server").
@@ -77,6 +144,23 @@ func main() {
 		os.Exit(2)
 	}
 
+	brokerOptions.EventPriorities, err = parsePriorities(*eventPriorities)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrapf(err, "Invalid event priority"))
+		os.Exit(2)
+	}
+	brokerOptions.ServicePriorities, err = parsePriorities(*servicePriorities)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrapf(err, "Invalid service priority"))
+		os.Exit(2)
+	}
+
+	brokerOptions.PublishRateLimits, err = parseRateLimits(*publishRateLimits)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrapf(err, "Invalid publish rate limit"))
+		os.Exit(2)
+	}
+
 	webOptions.AssetsPath = locateHttpAssets(webOptions.AssetsPath)
 
 	log := common.NewLogger("cellaserv")
@@ -133,6 +217,24 @@ func main() {
 		})
 	}
 
+	{
+		// Graceful shutdown
+		term := make(chan os.Signal, 1)
+		signal.Notify(term, syscall.SIGTERM)
+		cancel := make(chan struct{})
+		g.Add(func() error {
+			select {
+			case <-term:
+				log.Info("Received SIGTERM, shutting down gracefully.")
+				broker.Shutdown(shutdownGrace)
+			case <-cancel:
+			}
+			return nil
+		}, func(error) {
+			close(cancel)
+		})
+	}
+
 	// Start!
 	if err := g.Run(); err != nil {
 		log.Errorf("Error: %s", err)
@@ -2,11 +2,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	cellaserv "github.com/evolutek/cellaserv3-protobuf"
 	"github.com/evolutek/cellaserv3/broker/cellaserv/api"
@@ -37,30 +39,55 @@ func main() {
 	a.HelpFlag.Short('h')
 
 	request := a.Command("request", "Makes a request to a service. Alias: r").Alias("r")
-	requestPath := request.Arg("path", "Request path. Example service.method or service/id.method.").Required().String()
+	requestPath := request.Arg("path", "Request path. Example service.method or service/id.method. Use service/*.method to send the request to every identification of the service.").Required().String()
 	requestArgs := request.Arg("args", "Key=value arguments of the method. Example: x=42 y=43").StringMap()
 	requestRaw := request.Flag("raw", "Do not decode response as JSON").Bool()
+	requestTimeout := request.Flag("timeout", "Time budget of the request. Example: 200ms, 2m").Duration()
+	requestPriority := request.Flag("priority", "Priority of the request: low, normal or high").Enum("low", "normal", "high")
 
 	publish := a.Command("publish", "Sends a publish event. Alias: p").Alias("p")
 	publishEvent := publish.Arg("event", "Event name to publish.").Required().String()
 	publishArgs := publish.Arg("args", "Key=value content of event to publish. Example: x=42 y=43").StringMap()
 	publishRaw := publish.Flag("raw", "Raw bytes to send as publish data").String()
+	publishPriority := publish.Flag("priority", "Priority of the event: low, normal or high").Enum("low", "normal", "high")
+	publishRetain := publish.Flag("retain", "Keep the event and send it to later subscribers").Bool()
+
+	clearRetained := a.Command("clear-retained", "Clears a retained event.")
+	clearRetainedEvent := clearRetained.Arg("event", "Name of the retained event.").Required().String()
+
+	a.Command("list-retained", "Lists the retained events.")
 
 	subscribe := a.Command("subscribe", "Listens for an event. Alias: s").Alias("s")
 	subscribeEventPattern := subscribe.Arg("event", "Event name pattern to subscribe to.").Required().String()
 	subscribeMonitor := subscribe.Flag("monitor", "Instead of exiting after received a single event, wait indefinitely.").Short('m').Bool()
+	subscribeFromSequence := subscribe.Flag("from-sequence", "Replay the durable stream from this sequence number.").Uint64()
+	subscribeSince := subscribe.Flag("since", "Replay the durable stream from this long ago. Example: 10m").Duration()
+	subscribeDurable := subscribe.Flag("durable", "Subscribe as this durable subscriber, and wait indefinitely.").String()
+	subscribeFilter := subscribe.Flag("filter", "Only receive the events whose JSON payload matches this filter. Example: 'robot == \"pal\" && speed > 0.1'").String()
+	subscribeQueue := subscribe.Flag("queue", "Join this queue group, receiving a share of the events, and wait indefinitely.").String()
+	subscribeRate := subscribe.Flag("rate", "Receive at most this number of events of each name per second.").Float64()
+	subscribeCoalesce := subscribe.Flag("coalesce", "With --rate, receive the last event of each interval instead of dropping it.").Bool()
 
 	log := a.Command("log", "Get logs. Alias: l").Alias("l")
 	logPattern := log.Arg("pattern", "Log name pattern. Example: 'cellaserv.new-client'").Required().String()
 	logFolow := log.Flag("follow", "Instead of exiting after received logs, wait for new.").Short('f').Bool()
 
 	spy := a.Command("spy", "Listens to all requests and responses of a service.")
-	spyPath := spy.Arg("path", "Spy path. Example service or service/id").Required().String()
+	spyPath := spy.Arg("path", "Spy path, with topic patterns. Example service, service/id, 'motor/*' or '*' for all the services").Required().String()
+
+	replay := a.Command("replay", "Replays the events and requests of a capture file recorded by cellaserv.")
+	replayPath := replay.Arg("file", "Capture file, recorded with cellaserv --record or cellaserv.start_recording().").Required().ExistingFile()
+	replaySpeed := replay.Flag("speed", "Factor applied to the recorded speed, 0 to replay as fast as possible. Example: 2 to replay twice as fast").Default("1").Float64()
+	replayRequests := replay.Flag("requests", "Send the recorded requests again.").Default("true").Bool()
+	replayMock := replay.Flag("mock", "Register the recorded services, answering requests with the recorded replies, and wait indefinitely.").Bool()
 
 	a.Command("list-services", "Lists services currently registered. Alias: ls").Alias("ls")
 
 	a.Command("list-clients", "Lists cellaserv's clients. Alias: lc").Alias("lc")
 
+	shutdown := a.Command("shutdown", "Shuts down cellaserv.")
+	shutdownGrace := shutdown.Flag("grace", "Time given to pending requests to complete. Example: 5s").Duration()
+
 	common.AddFlags(a)
 
 	command, err := a.Parse(os.Args[1:])
@@ -94,7 +121,17 @@ func main() {
 		service := client.NewServiceStub(conn, requestService, requestServiceIdentification)
 
 		// Make request
-		respBytes, err := service.Request(requestMethod, requestArgs)
+		ctx := context.Background()
+		if *requestTimeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *requestTimeout)
+			defer cancel()
+		}
+		if *requestPriority != "" {
+			priority, _ := common.ParsePriority(*requestPriority)
+			ctx = client.ContextWithPriority(ctx, priority)
+		}
+		respBytes, err := service.RequestContext(ctx, requestMethod, requestArgs)
 		kingpin.FatalIfError(err, "Request failed")
 
 		if !*requestRaw {
@@ -107,21 +144,85 @@ func main() {
 			fmt.Printf("%s\n", respBytes)
 		}
 	case "publish":
-		if *publishRaw != "" {
-			conn.PublishRaw(*publishEvent, []byte(*publishRaw))
+		priority := common.PriorityUnset
+		if *publishPriority != "" {
+			priority, _ = common.ParsePriority(*publishPriority)
+		}
+		if *publishRetain {
+			conn.PublishRetained(*publishEvent, *publishArgs)
+		} else if *publishRaw != "" {
+			conn.PublishRawPriority(*publishEvent, []byte(*publishRaw), priority)
 		} else {
-			conn.Publish(*publishEvent, *publishArgs)
+			conn.PublishPriority(*publishEvent, *publishArgs, priority)
+		}
+	case "clear-retained":
+		conn.ClearRetained(*clearRetainedEvent)
+	case "list-retained":
+		// Create service stub
+		stub := client.NewServiceStub(conn, "cellaserv", "")
+		// Make request
+		respBytes, err := stub.Request("list_retained", nil)
+		kingpin.FatalIfError(err, "Request failed")
+		// Decode response
+		var retained api.ListRetainedResponse
+		err = json.Unmarshal(respBytes, &retained)
+		kingpin.FatalIfError(err, "Unmarshal of reply data failed")
+		// Display retained events
+		for _, r := range retained {
+			fmt.Printf("%s: %s\n", r.Event, r.Data)
 		}
 	case "subscribe":
-		err := conn.Subscribe(*subscribeEventPattern,
-			func(eventName string, eventBytes []byte) {
-				fmt.Printf("%s: %s\n", eventName, string(eventBytes))
-
-				// Should exit?
-				if !*subscribeMonitor {
-					conn.Close()
-				}
-			})
+		if *subscribeDurable != "" {
+			err := conn.SubscribeDurable(*subscribeDurable, *subscribeEventPattern,
+				func(eventName string, eventBytes []byte) {
+					fmt.Printf("%s: %s\n", eventName, string(eventBytes))
+				})
+			kingpin.FatalIfError(err, "Could no subscribe")
+			<-conn.Quit()
+			break
+		}
+		if *subscribeQueue != "" {
+			err := conn.SubscribeQueue(*subscribeQueue, "", *subscribeEventPattern,
+				func(eventName string, eventBytes []byte) {
+					fmt.Printf("%s: %s\n", eventName, string(eventBytes))
+				})
+			kingpin.FatalIfError(err, "Could no subscribe")
+			<-conn.Quit()
+			break
+		}
+		if *subscribeFromSequence != 0 || *subscribeSince != 0 {
+			from := client.FromSequence(*subscribeFromSequence)
+			if *subscribeSince != 0 {
+				from = client.FromTime(time.Now().Add(-*subscribeSince))
+			}
+			err := conn.SubscribeStream(*subscribeEventPattern, from,
+				func(event client.StreamEvent) {
+					fmt.Printf("#%d %s: %s\n", event.Sequence, event.Name, string(event.Data))
+				})
+			kingpin.FatalIfError(err, "Could no subscribe")
+			<-conn.Quit()
+			break
+		}
+		handler := func(eventName string, eventBytes []byte) {
+			fmt.Printf("%s: %s\n", eventName, string(eventBytes))
+
+			// Should exit?
+			if !*subscribeMonitor {
+				conn.Close()
+			}
+		}
+		var err error
+		if *subscribeRate != 0 {
+			mode := api.RateLimitSample
+			if *subscribeCoalesce {
+				mode = api.RateLimitCoalesce
+			}
+			err = conn.SubscribeRate(*subscribeEventPattern, *subscribeRate, mode, handler)
+		} else if *subscribeFilter != "" {
+			err = conn.SubscribeFilter(*subscribeEventPattern, *subscribeFilter, handler)
+		} else {
+			err = conn.Subscribe(*subscribeEventPattern, handler)
+		}
 		kingpin.FatalIfError(err, "Could no subscribe")
 		<-conn.Quit()
 	case "log":
@@ -150,13 +251,32 @@ func main() {
 	case "spy":
 		// Parse args
 		service, identification := common.ParseServicePath(*spyPath)
+		if !strings.Contains(*spyPath, "/") && common.IsTopicPattern(service) {
+			// Spy on all the identifications of the services
+			identification = "**"
+		}
 		// Setup spy with callback
-		conn.Spy(service, identification,
+		err := conn.Spy(service, identification,
 			func(req *cellaserv.Request, rep *cellaserv.Reply) {
 				fmt.Printf("%s: %s\n", requestToString(req),
 					replyToString(rep))
 			})
+		kingpin.FatalIfError(err, "Could not spy")
 		<-conn.Quit()
+	case "replay":
+		if *replaySpeed < 0 {
+			kingpin.Fatalf("Invalid speed: %g", *replaySpeed)
+		}
+		capture, err := loadCapture(*replayPath)
+		kingpin.FatalIfError(err, "Could not load capture")
+		opts := replayOptions{speed: *replaySpeed, requests: *replayRequests, mock: *replayMock}
+		if opts.mock {
+			registerMocks(conn, capture)
+		}
+		replayCapture(conn, capture, opts)
+		if opts.mock {
+			<-conn.Quit()
+		}
 	case "list-services":
 		// Create service stub
 		stub := client.NewServiceStub(conn, "cellaserv", "")
@@ -173,6 +293,9 @@ func main() {
 			if service.Identification != "" {
 				fmt.Printf("/%s", service.Identification)
 			}
+			if service.LoadBalancing != "" {
+				fmt.Printf(" (%s, %s)", service.LoadBalancing, service.Client)
+			}
 			fmt.Print("\n")
 		}
 	case "list-clients":
@@ -189,5 +312,11 @@ func main() {
 		for _, connection := range connections {
 			fmt.Printf("%s %s\n", connection.Id, connection.Name)
 		}
+	case "shutdown":
+		// Create service stub
+		stub := client.NewServiceStub(conn, "cellaserv", "")
+		// Make request
+		_, err := stub.Request("shutdown", &api.ShutdownRequest{Grace: shutdownGrace.Seconds()})
+		kingpin.FatalIfError(err, "Request failed")
 	}
 }
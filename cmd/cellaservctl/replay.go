@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/client"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/golang/protobuf/proto"
+)
+
+// Name of the cellaserv service, whose recorded requests are not replayed
+const cellaservServiceName = "cellaserv"
+
+type replayOptions struct {
+	// Factor applied to the recorded speed, 0 to replay as fast as possible
+	speed float64
+	// Re-issue the recorded requests
+	requests bool
+	// Answer the requests to the recorded services with the recorded
+	// replies
+	mock bool
+}
+
+// replayEvent is a publish or a request to replay.
+type replayEvent struct {
+	time time.Time
+	pub  *cellaserv.Publish
+	req  *cellaserv.Request
+}
+
+// recordedCall is a request recorded in a capture file, with its reply.
+type recordedCall struct {
+	req *cellaserv.Request
+	rep *cellaserv.Reply
+	// The reply was sent by cellaserv, not by the service
+	fromBroker bool
+	used       bool
+}
+
+type serviceKey struct {
+	name           string
+	identification string
+}
+
+// capture is the content of a capture file.
+type capture struct {
+	events []replayEvent
+	// Recorded services, with the calls of each of their methods
+	services map[serviceKey]map[string][]*recordedCall
+}
+
+// loadCapture reads the capture file. A truncated capture is loaded up to its
+// last complete record.
+func loadCapture(path string) (*capture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r, err := common.NewCaptureReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &capture{services: make(map[serviceKey]map[string][]*recordedCall)}
+	calls := make(map[uint64]*recordedCall)
+	addService := func(key serviceKey) map[string][]*recordedCall {
+		methods, ok := c.services[key]
+		if !ok {
+			methods = make(map[string][]*recordedCall)
+			c.services[key] = methods
+		}
+		return methods
+	}
+
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			fmt.Fprintln(os.Stderr, "Capture file is truncated, ignoring its last record")
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		content := rec.Message.GetContent()
+		switch rec.Message.GetType() {
+		case cellaserv.Message_Register:
+			register := &cellaserv.Register{}
+			if err := proto.Unmarshal(content, register); err != nil {
+				return nil, fmt.Errorf("Could not unmarshal register: %s", err)
+			}
+			if register.Name != cellaservServiceName {
+				addService(serviceKey{register.Name, register.Identification})
+			}
+		case cellaserv.Message_Publish:
+			pub := &cellaserv.Publish{}
+			if err := proto.Unmarshal(content, pub); err != nil {
+				return nil, fmt.Errorf("Could not unmarshal publish: %s", err)
+			}
+			c.events = append(c.events, replayEvent{time: rec.Time, pub: pub})
+		case cellaserv.Message_Request:
+			req := &cellaserv.Request{}
+			if err := proto.Unmarshal(content, req); err != nil {
+				return nil, fmt.Errorf("Could not unmarshal request: %s", err)
+			}
+			if req.ServiceName == cellaservServiceName {
+				continue
+			}
+			c.events = append(c.events, replayEvent{time: rec.Time, req: req})
+			call := &recordedCall{req: req}
+			calls[req.Id] = call
+			methods := addService(serviceKey{req.ServiceName, req.ServiceIdentification})
+			methods[req.Method] = append(methods[req.Method], call)
+		case cellaserv.Message_Reply:
+			rep := &cellaserv.Reply{}
+			if err := proto.Unmarshal(content, rep); err != nil {
+				return nil, fmt.Errorf("Could not unmarshal reply: %s", err)
+			}
+			if call, ok := calls[rep.Id]; ok {
+				call.rep = rep
+				call.fromBroker = rec.Client == ""
+				delete(calls, rep.Id)
+			}
+		}
+	}
+	return c, nil
+}
+
+// replayCapture publishes the recorded events and sends the recorded requests
+// at the recorded pace. Returns when the replies to all the requests are
+// received.
+func replayCapture(conn *client.Client, c *capture, opts replayOptions) {
+	if len(c.events) == 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	start := time.Now()
+	first := c.events[0].time
+	for _, event := range c.events {
+		if opts.speed > 0 {
+			delay := time.Duration(float64(event.time.Sub(first)) / opts.speed)
+			time.Sleep(time.Until(start.Add(delay)))
+		}
+
+		if event.pub != nil {
+			fmt.Printf("%s: %s\n", event.pub.Event, event.pub.Data)
+			conn.PublishRawPriority(event.pub.Event, event.pub.Data, common.GetPriority(event.pub))
+			continue
+		}
+		if !opts.requests {
+			continue
+		}
+		wg.Add(1)
+		go func(req *cellaserv.Request) {
+			defer wg.Done()
+			ctx := client.ContextWithPriority(context.Background(), common.GetPriority(req))
+			if timeout, ok := common.RequestTimeout(req); ok {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			stub := client.NewServiceStub(conn, req.ServiceName, req.ServiceIdentification)
+			data, err := stub.RequestRawContext(ctx, req.Method, req.Data)
+			if err != nil {
+				fmt.Printf("%s: %s\n", requestToString(req), err)
+				return
+			}
+			fmt.Printf("%s: %s\n", requestToString(req), data)
+		}(event.req)
+	}
+	wg.Wait()
+}
+
+// registerMocks registers the recorded services, which answer the requests
+// with the recorded replies.
+func registerMocks(conn *client.Client, c *capture) {
+	var keys []serviceKey
+	for key := range c.services {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].identification < keys[j].identification
+	})
+
+	// Protects the used field of the calls
+	var mtx sync.Mutex
+	for _, key := range keys {
+		service := conn.NewService(key.name, key.identification)
+		for method, calls := range c.services[key] {
+			calls := calls
+			service.HandleRequestFuncContext(method, func(ctx context.Context, req *cellaserv.Request) (interface{}, error) {
+				mtx.Lock()
+				call := matchRecordedCall(calls, req.Data)
+				mtx.Unlock()
+				return mockReply(ctx, call)
+			})
+		}
+		conn.RegisterService(service)
+		fmt.Printf("Mocking %s\n", service)
+	}
+}
+
+// matchRecordedCall returns the first call not used yet with the same data as
+// the request, or else with any data. Calls are used again once they were all
+// used. Returns nil if no call was replied to.
+func matchRecordedCall(calls []*recordedCall, data []byte) *recordedCall {
+	var first, firstSameData, last, lastSameData *recordedCall
+	for _, call := range calls {
+		if call.rep == nil {
+			continue
+		}
+		sameData := string(call.req.Data) == string(data)
+		if !call.used {
+			if sameData && firstSameData == nil {
+				firstSameData = call
+			}
+			if first == nil {
+				first = call
+			}
+		}
+		if sameData {
+			lastSameData = call
+		}
+		last = call
+	}
+	for _, call := range []*recordedCall{firstSameData, first, lastSameData, last} {
+		if call != nil {
+			call.used = true
+			return call
+		}
+	}
+	return nil
+}
+
+// mockReply returns the recorded reply of the call, as returned by a request
+// handler.
+func mockReply(ctx context.Context, call *recordedCall) (interface{}, error) {
+	if call == nil {
+		return nil, errors.New("No recorded reply")
+	}
+	if replyErr := call.rep.GetError(); replyErr != nil && replyErr.GetType() != cellaserv.Reply_Error_NoError {
+		switch {
+		case call.fromBroker && replyErr.GetType() == cellaserv.Reply_Error_Timeout:
+			// Do not reply, so that the request times out again
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case replyErr.GetType() == cellaserv.Reply_Error_NoSuchMethod:
+			return nil, &mockError{kind: client.ErrNoSuchMethod, what: replyErr.GetWhat()}
+		case replyErr.GetType() == cellaserv.Reply_Error_BadArguments:
+			return nil, &mockError{kind: client.ErrBadArguments, what: replyErr.GetWhat()}
+		}
+		what := replyErr.GetWhat()
+		if what == "" {
+			what = replyErr.GetType().String()
+		}
+		return nil, errors.New(what)
+	}
+	data := call.rep.GetData()
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if !json.Valid(data) {
+		return string(data), nil
+	}
+	return json.RawMessage(data), nil
+}
+
+// mockError is a recorded error of the kind of errors sent by services, with
+// the recorded explanation.
+type mockError struct {
+	kind error
+	what string
+}
+
+func (e *mockError) Error() string {
+	return e.what
+}
+
+func (e *mockError) Is(target error) bool {
+	return e.kind == target
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/broker"
+	"github.com/evolutek/cellaserv3/client"
+	"github.com/evolutek/cellaserv3/common"
+	"github.com/evolutek/cellaserv3/testutil"
+	testbroker "github.com/evolutek/cellaserv3/testutil/broker"
+)
+
+// recordSession records a service answering a request, and events published
+// 150ms apart.
+func recordSession(t *testing.T) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	capturePath := filepath.Join(t.TempDir(), "match.cap")
+	b := broker.New(broker.Options{ListenAddress: ":4217", RecordPath: capturePath}, common.NewLogger("broker"))
+	go func() {
+		if err := b.Run(ctx); err != nil {
+			t.Errorf("Could not start broker: %s", err)
+		}
+	}()
+	<-b.Started()
+
+	conn := client.NewClient(client.ClientOpts{CellaservAddr: ":4217"})
+	defer conn.Close()
+	date := conn.NewService("date", "")
+	date.HandleRequestFunc("time", func(req *cellaserv.Request) (interface{}, error) {
+		return json.RawMessage(`"noon"`), nil
+	})
+	conn.RegisterService(date)
+	time.Sleep(50 * time.Millisecond)
+
+	_, err := client.NewServiceStub(conn, "date", "").Request("time", map[string]string{"tz": "UTC"})
+	testutil.Ok(t, err)
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			time.Sleep(150 * time.Millisecond)
+		}
+		conn.Publish("score", i)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = b.StopRecording()
+	testutil.Ok(t, err)
+	return capturePath
+}
+
+func TestReplay(t *testing.T) {
+	capturePath := recordSession(t)
+
+	c, err := loadCapture(capturePath)
+	testutil.Ok(t, err)
+	var scores []replayEvent
+	for _, event := range c.events {
+		if event.pub != nil && event.pub.Event == "score" {
+			scores = append(scores, event)
+		}
+	}
+	testutil.Equals(t, 3, len(scores))
+	recorded := scores[2].time.Sub(scores[0].time)
+
+	testbroker.WithTestBroker(t, ":4218", func(clientOpts client.ClientOpts) {
+		// The recorded service is mocked
+		mock := client.NewClient(clientOpts)
+		defer mock.Close()
+		registerMocks(mock, c)
+
+		received := make(chan time.Time, 10)
+		sub := client.NewClient(clientOpts)
+		defer sub.Close()
+		testutil.Ok(t, sub.Subscribe("score", func(string, []byte) {
+			received <- time.Now()
+		}))
+		time.Sleep(50 * time.Millisecond)
+
+		// Replay twice as fast
+		conn := client.NewClient(clientOpts)
+		defer conn.Close()
+		replayCapture(conn, c, replayOptions{speed: 2, requests: true, mock: true})
+
+		var times []time.Time
+		for len(times) < 3 {
+			select {
+			case at := <-received:
+				times = append(times, at)
+			case <-time.After(time.Second):
+				t.Fatalf("Received %d events, expected 3", len(times))
+			}
+		}
+		replayed := times[2].Sub(times[0])
+		testutil.Assert(t, replayed > recorded/2-50*time.Millisecond && replayed < recorded-50*time.Millisecond,
+			"Replayed in %s, recorded in %s", replayed, recorded)
+
+		// The mock answers with the recorded reply
+		data, err := client.NewServiceStub(conn, "date", "").Request("time", map[string]string{"tz": "UTC"})
+		testutil.Ok(t, err)
+		testutil.Equals(t, `"noon"`, string(data))
+	})
+}
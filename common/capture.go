@@ -0,0 +1,132 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/golang/protobuf/proto"
+)
+
+// A capture file records the messages routed by the broker. It starts with
+// captureMagic, followed by the records:
+//
+//	length    uint32, length of the message
+//	time      int64, nanoseconds since the Unix epoch
+//	idLength  uint16, length of the client id
+//	client    [idLength]byte, id of the client that sent the message, empty
+//	          for the messages sent by the broker
+//	message   [length]byte, the message
+//
+// All integers are big endian. Requests are recorded with the id of the
+// request sent to the service, so that they match the id of their reply.
+const (
+	captureMagic      = "CSCAP\x00\x00\x01"
+	captureHeaderSize = 14
+)
+
+// ErrBadCapture is returned when reading a file that is not a capture file.
+var ErrBadCapture = errors.New("Not a capture file")
+
+// CaptureRecord is a message recorded in a capture file.
+type CaptureRecord struct {
+	Time    time.Time
+	Client  string
+	Message *cellaserv.Message
+}
+
+// CaptureWriter writes capture files.
+type CaptureWriter struct {
+	w *bufio.Writer
+}
+
+// NewCaptureWriter starts a capture file. The records are buffered until
+// Flush is called.
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	cw := &CaptureWriter{w: bufio.NewWriter(w)}
+	if _, err := cw.w.WriteString(captureMagic); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// WriteMessage appends a marshalled message to the capture.
+func (cw *CaptureWriter) WriteMessage(t time.Time, client string, msgBytes []byte) error {
+	if len(client) > 0xffff {
+		client = client[:0xffff]
+	}
+	header := make([]byte, captureHeaderSize)
+	binary.BigEndian.PutUint32(header[0:], uint32(len(msgBytes)))
+	binary.BigEndian.PutUint64(header[4:], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint16(header[12:], uint16(len(client)))
+	if _, err := cw.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := cw.w.WriteString(client); err != nil {
+		return err
+	}
+	_, err := cw.w.Write(msgBytes)
+	return err
+}
+
+// Write appends a record to the capture.
+func (cw *CaptureWriter) Write(rec *CaptureRecord) error {
+	msgBytes, err := proto.Marshal(rec.Message)
+	if err != nil {
+		return fmt.Errorf("Could not marshal message: %s", err)
+	}
+	return cw.WriteMessage(rec.Time, rec.Client, msgBytes)
+}
+
+// Flush writes the buffered records.
+func (cw *CaptureWriter) Flush() error {
+	return cw.w.Flush()
+}
+
+// CaptureReader reads capture files.
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+// NewCaptureReader returns a reader of the capture file, or ErrBadCapture.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	cr := &CaptureReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(cr.r, magic); err != nil || string(magic) != captureMagic {
+		return nil, ErrBadCapture
+	}
+	return cr, nil
+}
+
+// Read returns the next record. Returns io.EOF at the end of the capture, and
+// io.ErrUnexpectedEOF if the last record is incomplete, which happens when
+// cellaserv stopped while writing it.
+func (cr *CaptureReader) Read() (*CaptureRecord, error) {
+	header := make([]byte, captureHeaderSize)
+	if _, err := io.ReadFull(cr.r, header); err != nil {
+		return nil, err
+	}
+	client := make([]byte, binary.BigEndian.Uint16(header[12:]))
+	msgBytes := make([]byte, binary.BigEndian.Uint32(header[0:]))
+	for _, buf := range [][]byte{client, msgBytes} {
+		if _, err := io.ReadFull(cr.r, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	msg := &cellaserv.Message{}
+	if err := proto.Unmarshal(msgBytes, msg); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal recorded message: %s", err)
+	}
+	return &CaptureRecord{
+		Time:    time.Unix(0, int64(binary.BigEndian.Uint64(header[4:]))),
+		Client:  string(client),
+		Message: msg,
+	}, nil
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+)
+
+func TestCapture(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewCaptureWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []*CaptureRecord{
+		{Time: time.Unix(1, 2), Client: "127.0.0.1:1234", Message: &cellaserv.Message{Type: cellaserv.Message_Publish, Content: []byte("event")}},
+		{Time: time.Unix(3, 4), Client: "", Message: &cellaserv.Message{Type: cellaserv.Message_Reply}},
+	}
+	for _, rec := range records {
+		if err := w.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	r, err := NewCaptureReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range records {
+		rec, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rec.Time.Equal(expected.Time) || rec.Client != expected.Client ||
+			rec.Message.Type != expected.Message.Type || !bytes.Equal(rec.Message.Content, expected.Message.Content) {
+			t.Errorf("Read %+v, expected %+v", rec, expected)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got: %v", err)
+	}
+
+	// Incomplete last record
+	r, err = NewCaptureReader(bytes.NewReader(data[:len(data)-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got: %v", err)
+	}
+
+	if _, err := NewCaptureReader(bytes.NewReader([]byte("not a capture"))); err != ErrBadCapture {
+		t.Errorf("Expected ErrBadCapture, got: %v", err)
+	}
+}
@@ -0,0 +1,438 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Filters select events by their JSON payload. The syntax is:
+//
+//	a.b         value of the field b of the object a, true if the field is
+//	            present and is not false, null, 0 or ""
+//	x == y      x equals y, also !=
+//	x < y       x is less than y, numbers and strings only, also <=, >, >=
+//	e && f      both e and f are true
+//	e || f      e or f is true
+//	!e          e is false
+//	(e)         grouping
+//
+// Operands are field paths or literals: numbers, "strings", true, false and
+// null. Comparisons with a missing field are false. For example:
+//
+//	robot == "pal" && speed > 0.1
+//
+// Events whose payload is not valid JSON never match.
+
+// ErrBadFilter is returned when a filter expression is malformed.
+var ErrBadFilter = errors.New("Syntax error in filter")
+
+// A Filter is a compiled filter expression.
+type Filter struct {
+	expr string
+	root filterNode
+}
+
+// String returns the filter expression.
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Match returns whether the event payload matches the filter.
+func (f *Filter) Match(data *FilterData) bool {
+	doc, ok := data.value()
+	if !ok {
+		return false
+	}
+	return f.root.eval(doc)
+}
+
+// FilterData is an event payload matched against filters. The payload is
+// decoded once, the first time it is matched.
+type FilterData struct {
+	data    []byte
+	doc     interface{}
+	decoded bool
+	valid   bool
+}
+
+// NewFilterData returns the payload to match against filters.
+func NewFilterData(data []byte) *FilterData {
+	return &FilterData{data: data}
+}
+
+func (d *FilterData) value() (interface{}, bool) {
+	if !d.decoded {
+		d.decoded = true
+		d.valid = json.Unmarshal(d.data, &d.doc) == nil
+	}
+	return d.doc, d.valid
+}
+
+// MatchFilter returns whether the payload matches the filter expression.
+func MatchFilter(expr string, data []byte) (bool, error) {
+	f, err := ParseFilter(expr)
+	if err != nil {
+		return false, err
+	}
+	return f.Match(NewFilterData(data)), nil
+}
+
+type filterNode interface {
+	eval(doc interface{}) bool
+}
+
+type filterOr struct{ left, right filterNode }
+
+func (n *filterOr) eval(doc interface{}) bool { return n.left.eval(doc) || n.right.eval(doc) }
+
+type filterAnd struct{ left, right filterNode }
+
+func (n *filterAnd) eval(doc interface{}) bool { return n.left.eval(doc) && n.right.eval(doc) }
+
+type filterNot struct{ x filterNode }
+
+func (n *filterNot) eval(doc interface{}) bool { return !n.x.eval(doc) }
+
+// A filterOperand is a field path, or a literal if path is nil.
+type filterOperand struct {
+	path    []string
+	literal interface{}
+}
+
+// resolve returns the value of the operand, if present.
+func (o *filterOperand) resolve(doc interface{}) (interface{}, bool) {
+	if o.path == nil {
+		return o.literal, true
+	}
+	v := doc
+	for _, name := range o.path {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// filterTruthy is an operand used as a condition.
+type filterTruthy struct{ x filterOperand }
+
+func (n *filterTruthy) eval(doc interface{}) bool {
+	v, ok := n.x.resolve(doc)
+	if !ok {
+		return false
+	}
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+type filterCompare struct {
+	op          string
+	left, right filterOperand
+}
+
+func (n *filterCompare) eval(doc interface{}) bool {
+	a, ok := n.left.resolve(doc)
+	if !ok {
+		return false
+	}
+	b, ok := n.right.resolve(doc)
+	if !ok {
+		return false
+	}
+
+	switch n.op {
+	case "==":
+		return equalValues(a, b)
+	case "!=":
+		return !equalValues(a, b)
+	}
+
+	var cmp int
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case a < b:
+			cmp = -1
+		case a > b:
+			cmp = 1
+		}
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(a, b)
+	default:
+		return false
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default: // ">="
+		return cmp >= 0
+	}
+}
+
+// equalValues returns whether the JSON values are equal. Objects and arrays
+// are never equal.
+func equalValues(a, b interface{}) bool {
+	switch a.(type) {
+	case nil, bool, float64, string:
+		return a == b
+	}
+	return false
+}
+
+type filterTokenKind int
+
+const (
+	filterTokenEOF filterTokenKind = iota
+	filterTokenPath
+	filterTokenLiteral
+	filterTokenOp
+)
+
+type filterToken struct {
+	kind    filterTokenKind
+	text    string
+	literal interface{}
+	pos     int
+}
+
+// lexFilter splits the expression in tokens.
+func lexFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	pos := 0
+	for pos < len(expr) {
+		c := expr[pos]
+		start := pos
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+			continue
+		case strings.HasPrefix(expr[pos:], "&&"), strings.HasPrefix(expr[pos:], "||"),
+			strings.HasPrefix(expr[pos:], "=="), strings.HasPrefix(expr[pos:], "!="),
+			strings.HasPrefix(expr[pos:], "<="), strings.HasPrefix(expr[pos:], ">="):
+			pos += 2
+			tokens = append(tokens, filterToken{kind: filterTokenOp, text: expr[start:pos], pos: start})
+		case strings.IndexByte("<>!()", c) >= 0:
+			pos++
+			tokens = append(tokens, filterToken{kind: filterTokenOp, text: expr[start:pos], pos: start})
+		case c == '"':
+			pos++
+			for pos < len(expr) && expr[pos] != '"' {
+				if expr[pos] == '\\' {
+					pos++
+				}
+				pos++
+			}
+			if pos >= len(expr) {
+				return nil, filterError(expr, start, "unterminated string")
+			}
+			pos++
+			s, err := strconv.Unquote(expr[start:pos])
+			if err != nil {
+				return nil, filterError(expr, start, "invalid string")
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenLiteral, text: expr[start:pos], literal: s, pos: start})
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			pos++
+			for pos < len(expr) && strings.IndexByte("0123456789.eE+-", expr[pos]) >= 0 {
+				pos++
+			}
+			n, err := strconv.ParseFloat(expr[start:pos], 64)
+			if err != nil {
+				return nil, filterError(expr, start, "invalid number")
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenLiteral, text: expr[start:pos], literal: n, pos: start})
+		case isFilterIdentChar(c, true):
+			for pos < len(expr) && (isFilterIdentChar(expr[pos], false) || expr[pos] == '.') {
+				pos++
+			}
+			text := expr[start:pos]
+			tok := filterToken{kind: filterTokenLiteral, text: text, pos: start}
+			switch text {
+			case "true":
+				tok.literal = true
+			case "false":
+				tok.literal = false
+			case "null":
+			default:
+				tok.kind = filterTokenPath
+			}
+			tokens = append(tokens, tok)
+		default:
+			return nil, filterError(expr, start, "unexpected character %q", c)
+		}
+	}
+	return append(tokens, filterToken{kind: filterTokenEOF, pos: len(expr)}), nil
+}
+
+func isFilterIdentChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+func filterError(expr string, pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("%w %q at %d: %s", ErrBadFilter, expr, pos, fmt.Sprintf(format, args...))
+}
+
+type filterParser struct {
+	expr   string
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != filterTokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is the operator op.
+func (p *filterParser) accept(op string) bool {
+	tok := p.peek()
+	if tok.kind == filterTokenOp && tok.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return filterError(p.expr, p.peek().pos, format, args...)
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.accept("!") {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{x}, nil
+	}
+	if p.accept("(") {
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.errorf("expected ')'")
+		}
+		return x, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	if tok.kind == filterTokenOp {
+		switch tok.text {
+		case "==", "!=", "<", "<=", ">", ">=":
+			p.next()
+			right, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			return &filterCompare{tok.text, left, right}, nil
+		}
+	}
+	return &filterTruthy{left}, nil
+}
+
+func (p *filterParser) parseOperand() (filterOperand, error) {
+	tok := p.next()
+	switch tok.kind {
+	case filterTokenPath:
+		path := strings.Split(tok.text, ".")
+		for _, name := range path {
+			if name == "" || !isFilterIdentChar(name[0], true) {
+				return filterOperand{}, filterError(p.expr, tok.pos, "invalid field %q", tok.text)
+			}
+		}
+		return filterOperand{path: path}, nil
+	case filterTokenLiteral:
+		return filterOperand{literal: tok.literal}, nil
+	case filterTokenEOF:
+		return filterOperand{}, filterError(p.expr, tok.pos, "unexpected end of filter")
+	}
+	return filterOperand{}, filterError(p.expr, tok.pos, "unexpected %q", tok.text)
+}
+
+// ParseFilter compiles a filter expression. The only possible error is
+// ErrBadFilter.
+func ParseFilter(expr string) (*Filter, error) {
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{expr: expr, tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != filterTokenEOF {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
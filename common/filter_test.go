@@ -0,0 +1,76 @@
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMatchFilter(t *testing.T) {
+	position := `{"robot": "pal", "speed": 0.5, "pos": {"x": 12, "y": -3}, "moving": true, "arm": null}`
+	tests := []struct {
+		filter string
+		data   string
+		match  bool
+	}{
+		{`robot == "pal"`, position, true},
+		{`robot == "pmi"`, position, false},
+		{`robot != "pmi"`, position, true},
+		{`speed > 0.1`, position, true},
+		{`speed >= 0.5 && speed <= 0.5`, position, true},
+		{`speed < 0.1`, position, false},
+		{`robot == "pal" && speed > 0.1`, position, true},
+		{`robot == "pmi" || speed > 0.1`, position, true},
+		{`robot == "pmi" || speed > 1`, position, false},
+		{`pos.x == 12 && pos.y < 0`, position, true},
+		{`0.1 < speed`, position, true},
+		{`moving`, position, true},
+		{`!moving`, position, false},
+		{`arm`, position, false},
+		{`arm == null`, position, true},
+		{`!(robot == "pal" && speed > 1)`, position, true},
+		{`robot > "a"`, position, true},
+		// Missing fields and mismatched types
+		{`missing == 1`, position, false},
+		{`missing != 1`, position, false},
+		{`pos.z > 0`, position, false},
+		{`robot.name == "pal"`, position, false},
+		{`speed > "0"`, position, false},
+		{`speed != "0.5"`, position, true},
+		{`pos == pos`, position, false},
+		// Payloads that are not objects
+		{`speed > 0`, `42`, false},
+		{`true`, `not json`, false},
+		{`true`, `null`, true},
+	}
+	for _, test := range tests {
+		match, err := MatchFilter(test.filter, []byte(test.data))
+		if err != nil {
+			t.Errorf("MatchFilter(%q): %s", test.filter, err)
+			continue
+		}
+		if match != test.match {
+			t.Errorf("MatchFilter(%q, %s) = %t, expected %t", test.filter, test.data, match, test.match)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		"",
+		"speed >",
+		"speed > > 1",
+		"(speed > 1",
+		"speed > 1)",
+		`robot == "pal`,
+		"speed = 1",
+		"speed > 1 &&",
+		"pos..x",
+		"pos.1",
+		"1.2.3 > 0",
+		"speed # 1",
+	} {
+		if _, err := ParseFilter(filter); !errors.Is(err, ErrBadFilter) {
+			t.Errorf("ParseFilter(%q): expected syntax error, got: %v", filter, err)
+		}
+	}
+}
@@ -38,6 +38,8 @@ func SendRawMessage(conn net.Conn, msg []byte) error {
 }
 
 // RecvMessage reads and return a cellaserv message from an open connection.
+// closed is true when the connection cannot be used anymore, err is then set
+// if the connection was not closed cleanly.
 func RecvMessage(conn net.Conn) (closed bool, msgBytes []byte, msg *cellaserv.Message, err error) {
 	// Read message length as uint32
 	var msgLen uint32
@@ -47,21 +49,22 @@ func RecvMessage(conn net.Conn) (closed bool, msgBytes []byte, msg *cellaserv.Me
 			return true, nil, nil, nil
 		}
 		err = fmt.Errorf("Could not read message length: %s", err)
-		return
+		return true, nil, nil, err
 	}
 
 	const maxMessageSize = 8 * 1024 * 1024
 	if msgLen > maxMessageSize {
+		// The rest of the stream cannot be parsed
 		err = fmt.Errorf("Message size too big: %d, max size: %d", msgLen, maxMessageSize)
-		return
+		return true, nil, nil, err
 	}
 
 	// Extract message from connection
 	msgBytes = make([]byte, msgLen)
-	_, err = conn.Read(msgBytes)
+	_, err = io.ReadFull(conn, msgBytes)
 	if err != nil {
 		err = fmt.Errorf("Could not read message: %s", err)
-		return err == io.EOF, nil, nil, nil
+		return true, nil, nil, err
 	}
 
 	// Parse message header
@@ -69,8 +72,23 @@ func RecvMessage(conn net.Conn) (closed bool, msgBytes []byte, msg *cellaserv.Me
 	err = proto.Unmarshal(msgBytes, msg)
 	if err != nil {
 		err = fmt.Errorf("Could not unmarshal message: %s", err)
-		return
+		return false, msgBytes, nil, err
 	}
 
 	return
 }
+
+// MarshalMessage wraps the message content in a cellaserv message and
+// serializes it.
+func MarshalMessage(msgType cellaserv.Message_MessageType, content proto.Message) ([]byte, error) {
+	contentBytes, err := proto.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal message content: %s", err)
+	}
+	msg := &cellaserv.Message{Type: msgType, Content: contentBytes}
+	msgBytes, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal message: %s", err)
+	}
+	return msgBytes, nil
+}
@@ -0,0 +1,549 @@
+package common
+
+import (
+	"fmt"
+	"time"
+
+	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Extension fields of the cellaserv messages.
+//
+// These fields are not part of the cellaserv3-protobuf definitions. They are
+// stored in the unknown fields of the messages, which proto3 parsers skip and
+// preserve, so peers that do not know about them are not affected.
+const (
+	// Request: time budget of the request, in milliseconds
+	requestTimeoutField protowire.Number = 100
+	// Register: load balancing policy of the service group to join
+	registerLoadBalancingField protowire.Number = 100
+	// Request, Reply, Publish: priority of the message
+	priorityField protowire.Number = 101
+	// Publish: the event is retained
+	publishRetainField protowire.Number = 100
+	// Subscribe: remove the subscription instead of adding it
+	subscribeUnsubscribeField protowire.Number = 100
+	// Publish: sequence number of the event in the durable stream
+	publishSequenceField protowire.Number = 102
+	// Publish: time the event was appended to the durable stream, in
+	// nanoseconds since the Unix epoch
+	publishTimestampField protowire.Number = 103
+	// Subscribe: replay the durable stream from this sequence number
+	subscribeFromSequenceField protowire.Number = 101
+	// Subscribe: replay the durable stream from this time, in nanoseconds
+	// since the Unix epoch
+	subscribeFromTimeField protowire.Number = 102
+	// Subscribe: name of the durable subscriber
+	subscribeDurableField protowire.Number = 103
+	// Subscribe: acknowledge the delivery with this id
+	subscribeAckField protowire.Number = 104
+	// Publish: id of the delivery to the durable subscriber
+	publishDeliveryField protowire.Number = 104
+	// Publish: name of the durable subscriber the event is delivered to
+	publishDurableField protowire.Number = 105
+	// Subscribe: name of the queue group to join
+	subscribeQueueField protowire.Number = 105
+	// Subscribe: policy used to pick the member of the queue group
+	subscribeQueuePolicyField protowire.Number = 106
+	// Publish: name of the queue group the event is delivered to
+	publishQueueField protowire.Number = 106
+	// Subscribe: filter expression over the payload of the events
+	subscribeFilterField protowire.Number = 107
+	// Publish: the subscribe to the event pattern failed, the data is the
+	// error
+	publishSubscribeErrorField protowire.Number = 107
+	// Subscribe: minimum interval between two events of the same name
+	// sent to the subscriber, in microseconds
+	subscribeIntervalField protowire.Number = 108
+	// Subscribe: how the events exceeding the rate are handled
+	subscribeRateModeField protowire.Number = 109
+	// Request: trace id and id of the parent span of the request
+	requestTraceField protowire.Number = 102
+	// Request, Reply: id of the client that sent the request, on the copies
+	// sent to the spies
+	spySenderField protowire.Number = 103
+)
+
+// getExtensionVarint returns the value of the varint extension field num of
+// msg, if present.
+func getExtensionVarint(msg proto.Message, num protowire.Number) (uint64, bool) {
+	var value uint64
+	found := false
+	b := proto.MessageReflect(msg).GetUnknown()
+	for len(b) > 0 {
+		fieldNum, fieldType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return 0, false
+		}
+		b = b[n:]
+		if fieldNum == num && fieldType == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return 0, false
+			}
+			value, found = v, true
+		}
+		n = protowire.ConsumeFieldValue(fieldNum, fieldType, b)
+		if n < 0 {
+			return 0, false
+		}
+		b = b[n:]
+	}
+	return value, found
+}
+
+// getExtensionBytes returns the value of the bytes extension field num of msg,
+// if present.
+func getExtensionBytes(msg proto.Message, num protowire.Number) ([]byte, bool) {
+	var value []byte
+	found := false
+	b := proto.MessageReflect(msg).GetUnknown()
+	for len(b) > 0 {
+		fieldNum, fieldType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, false
+		}
+		b = b[n:]
+		if fieldNum == num && fieldType == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, false
+			}
+			value, found = v, true
+		}
+		n = protowire.ConsumeFieldValue(fieldNum, fieldType, b)
+		if n < 0 {
+			return nil, false
+		}
+		b = b[n:]
+	}
+	return value, found
+}
+
+// clearExtension removes all the occurrences of the extension field num of
+// msg.
+func clearExtension(msg proto.Message, num protowire.Number) {
+	m := proto.MessageReflect(msg)
+	b := m.GetUnknown()
+	var kept []byte
+	for len(b) > 0 {
+		fieldNum, fieldType, tagLen := protowire.ConsumeTag(b)
+		if tagLen < 0 {
+			break
+		}
+		valueLen := protowire.ConsumeFieldValue(fieldNum, fieldType, b[tagLen:])
+		if valueLen < 0 {
+			break
+		}
+		if fieldNum != num {
+			kept = append(kept, b[:tagLen+valueLen]...)
+		}
+		b = b[tagLen+valueLen:]
+	}
+	m.SetUnknown(kept)
+}
+
+// setExtensionVarint sets the varint extension field num of msg to value.
+func setExtensionVarint(msg proto.Message, num protowire.Number, value uint64) {
+	clearExtension(msg, num)
+	m := proto.MessageReflect(msg)
+	b := m.GetUnknown()
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	b = protowire.AppendVarint(b, value)
+	m.SetUnknown(b)
+}
+
+// setExtensionBytes sets the bytes extension field num of msg to value.
+func setExtensionBytes(msg proto.Message, num protowire.Number, value []byte) {
+	clearExtension(msg, num)
+	m := proto.MessageReflect(msg)
+	b := m.GetUnknown()
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	b = protowire.AppendBytes(b, value)
+	m.SetUnknown(b)
+}
+
+// SetRequestTimeout attaches a time budget to the request. The broker times
+// out the request when the budget is exhausted.
+func SetRequestTimeout(req *cellaserv.Request, timeout time.Duration) {
+	ms := timeout.Milliseconds()
+	if ms < 1 {
+		// A zero budget means "no budget", use the smallest one instead
+		ms = 1
+	}
+	setExtensionVarint(req, requestTimeoutField, uint64(ms))
+}
+
+// RequestTimeout returns the time budget attached to the request, if any.
+func RequestTimeout(req *cellaserv.Request) (time.Duration, bool) {
+	ms, ok := getExtensionVarint(req, requestTimeoutField)
+	if !ok || ms == 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// SetRequestTrace attaches the trace context to the request. The request is
+// traced as a child of the span of the context.
+func SetRequestTrace(req *cellaserv.Request, trace TraceContext) {
+	value := make([]byte, 0, len(trace.TraceId)+len(trace.SpanId))
+	value = append(value, trace.TraceId[:]...)
+	value = append(value, trace.SpanId[:]...)
+	setExtensionBytes(req, requestTraceField, value)
+}
+
+// RequestTrace returns the trace context attached to the request, if any.
+func RequestTrace(req *cellaserv.Request) (TraceContext, bool) {
+	var trace TraceContext
+	value, ok := getExtensionBytes(req, requestTraceField)
+	if !ok || len(value) != len(trace.TraceId)+len(trace.SpanId) {
+		return trace, false
+	}
+	copy(trace.TraceId[:], value)
+	copy(trace.SpanId[:], value[len(trace.TraceId):])
+	return trace, trace.TraceId.IsValid()
+}
+
+// SetSpySender marks the request or reply as a copy sent to the spies of a
+// service, sent by the client with this id.
+func SetSpySender(msg proto.Message, sender string) {
+	setExtensionBytes(msg, spySenderField, []byte(sender))
+}
+
+// SpySender returns the id of the client that sent the request, if the
+// request or reply is a copy sent to the spies.
+func SpySender(msg proto.Message) (string, bool) {
+	sender, ok := getExtensionBytes(msg, spySenderField)
+	return string(sender), ok
+}
+
+// SetRegisterLoadBalancing makes the service join the group of services
+// registered with the same name and identification, instead of replacing
+// them. Requests are distributed among the members of the group according to
+// the load balancing policy.
+func SetRegisterLoadBalancing(register *cellaserv.Register, policy string) {
+	setExtensionBytes(register, registerLoadBalancingField, []byte(policy))
+}
+
+// RegisterLoadBalancing returns the load balancing policy of the service
+// group the service joins, if any.
+func RegisterLoadBalancing(register *cellaserv.Register) (string, bool) {
+	policy, ok := getExtensionBytes(register, registerLoadBalancingField)
+	if !ok || len(policy) == 0 {
+		return "", false
+	}
+	return string(policy), true
+}
+
+// Priority of a message. cellaserv sends the messages of higher priority to a
+// client before the others.
+type Priority uint64
+
+const (
+	// No priority set, the message has the normal priority unless cellaserv
+	// is configured otherwise
+	PriorityUnset Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+// Priorities, from the highest to the lowest
+var Priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityUnset:
+		return "unset"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return fmt.Sprintf("Priority(%d)", uint64(p))
+}
+
+// ParsePriority returns the priority with this name.
+func ParsePriority(name string) (Priority, error) {
+	for _, p := range Priorities {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return PriorityUnset, fmt.Errorf("Unknown priority: %q", name)
+}
+
+// SetPriority sets the priority of a request, reply or publish message.
+func SetPriority(msg proto.Message, priority Priority) {
+	if priority == PriorityUnset {
+		clearExtension(msg, priorityField)
+		return
+	}
+	setExtensionVarint(msg, priorityField, uint64(priority))
+}
+
+// GetPriority returns the priority of a request, reply or publish message, or
+// PriorityUnset.
+func GetPriority(msg proto.Message) Priority {
+	p, ok := getExtensionVarint(msg, priorityField)
+	if !ok || p > uint64(PriorityHigh) {
+		return PriorityUnset
+	}
+	return Priority(p)
+}
+
+// SetPublishRetain marks the event as retained: cellaserv keeps it and sends
+// it to the clients that subscribe to the event later. A retained event
+// without data clears the retained event.
+func SetPublishRetain(pub *cellaserv.Publish, retain bool) {
+	if !retain {
+		clearExtension(pub, publishRetainField)
+		return
+	}
+	setExtensionVarint(pub, publishRetainField, 1)
+}
+
+// PublishRetain returns whether the event is retained.
+func PublishRetain(pub *cellaserv.Publish) bool {
+	retain, ok := getExtensionVarint(pub, publishRetainField)
+	return ok && retain != 0
+}
+
+// SetSubscribeUnsubscribe turns the subscribe message into an unsubscribe
+// message, which removes the subscription of the client to the pattern.
+func SetSubscribeUnsubscribe(sub *cellaserv.Subscribe) {
+	setExtensionVarint(sub, subscribeUnsubscribeField, 1)
+}
+
+// SubscribeUnsubscribe returns whether the subscribe message is an
+// unsubscribe message.
+func SubscribeUnsubscribe(sub *cellaserv.Subscribe) bool {
+	unsubscribe, ok := getExtensionVarint(sub, subscribeUnsubscribeField)
+	return ok && unsubscribe != 0
+}
+
+// SetPublishSequence sets the position of the event in the durable stream.
+func SetPublishSequence(pub *cellaserv.Publish, seq uint64, t time.Time) {
+	setExtensionVarint(pub, publishSequenceField, seq)
+	setExtensionVarint(pub, publishTimestampField, uint64(t.UnixNano()))
+}
+
+// PublishSequence returns the sequence number of the event in the durable
+// stream and the time it was appended, if the event is part of the stream.
+func PublishSequence(pub *cellaserv.Publish) (uint64, time.Time, bool) {
+	seq, ok := getExtensionVarint(pub, publishSequenceField)
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	nsec, _ := getExtensionVarint(pub, publishTimestampField)
+	return seq, time.Unix(0, int64(nsec)), true
+}
+
+// SetSubscribeFromSequence asks cellaserv to send the events of the durable
+// stream matching the pattern, starting at sequence number seq, before the
+// live events.
+func SetSubscribeFromSequence(sub *cellaserv.Subscribe, seq uint64) {
+	clearExtension(sub, subscribeFromTimeField)
+	setExtensionVarint(sub, subscribeFromSequenceField, seq)
+}
+
+// SubscribeFromSequence returns the sequence number from which the durable
+// stream is replayed, if set.
+func SubscribeFromSequence(sub *cellaserv.Subscribe) (uint64, bool) {
+	return getExtensionVarint(sub, subscribeFromSequenceField)
+}
+
+// SetSubscribeFromTime asks cellaserv to send the events of the durable
+// stream matching the pattern, starting at time t, before the live events.
+func SetSubscribeFromTime(sub *cellaserv.Subscribe, t time.Time) {
+	clearExtension(sub, subscribeFromSequenceField)
+	setExtensionVarint(sub, subscribeFromTimeField, uint64(t.UnixNano()))
+}
+
+// SubscribeFromTime returns the time from which the durable stream is
+// replayed, if set.
+func SubscribeFromTime(sub *cellaserv.Subscribe) (time.Time, bool) {
+	nsec, ok := getExtensionVarint(sub, subscribeFromTimeField)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(nsec)), true
+}
+
+// SetSubscribeDurable makes the subscription durable: cellaserv keeps the
+// events until they are acknowledged by a client subscribed with the same
+// name, and sends them again if they are not acknowledged in time.
+func SetSubscribeDurable(sub *cellaserv.Subscribe, name string) {
+	setExtensionBytes(sub, subscribeDurableField, []byte(name))
+}
+
+// SubscribeDurable returns the name of the durable subscriber, if the
+// subscription is durable.
+func SubscribeDurable(sub *cellaserv.Subscribe) (string, bool) {
+	name, ok := getExtensionBytes(sub, subscribeDurableField)
+	return string(name), ok
+}
+
+// SetSubscribeAck turns the subscribe message into the acknowledgment of a
+// delivery to a durable subscriber.
+func SetSubscribeAck(sub *cellaserv.Subscribe, name string, deliveryId uint64) {
+	SetSubscribeDurable(sub, name)
+	setExtensionVarint(sub, subscribeAckField, deliveryId)
+}
+
+// SubscribeAck returns the id of the acknowledged delivery, if the subscribe
+// message is an acknowledgment.
+func SubscribeAck(sub *cellaserv.Subscribe) (uint64, bool) {
+	return getExtensionVarint(sub, subscribeAckField)
+}
+
+// SetPublishDelivery sets the durable subscriber of the event and the id of
+// the delivery, to acknowledge.
+func SetPublishDelivery(pub *cellaserv.Publish, name string, deliveryId uint64) {
+	setExtensionBytes(pub, publishDurableField, []byte(name))
+	setExtensionVarint(pub, publishDeliveryField, deliveryId)
+}
+
+// PublishDelivery returns the durable subscriber of the event and the id of
+// the delivery, if the event is delivered to a durable subscriber.
+func PublishDelivery(pub *cellaserv.Publish) (string, uint64, bool) {
+	deliveryId, ok := getExtensionVarint(pub, publishDeliveryField)
+	if !ok {
+		return "", 0, false
+	}
+	name, _ := getExtensionBytes(pub, publishDurableField)
+	return string(name), deliveryId, true
+}
+
+// SetSubscribeQueue makes the client join the queue group name: each event
+// matching the pattern is sent to a single member of the group, picked with
+// the policy. The policy of the group is set by its first member, and may be
+// empty.
+func SetSubscribeQueue(sub *cellaserv.Subscribe, name string, policy string) {
+	setExtensionBytes(sub, subscribeQueueField, []byte(name))
+	if policy == "" {
+		clearExtension(sub, subscribeQueuePolicyField)
+	} else {
+		setExtensionBytes(sub, subscribeQueuePolicyField, []byte(policy))
+	}
+}
+
+// SubscribeQueue returns the queue group to join, and its policy, if the
+// subscription is part of a queue group.
+func SubscribeQueue(sub *cellaserv.Subscribe) (string, string, bool) {
+	name, ok := getExtensionBytes(sub, subscribeQueueField)
+	if !ok {
+		return "", "", false
+	}
+	policy, _ := getExtensionBytes(sub, subscribeQueuePolicyField)
+	return string(name), string(policy), true
+}
+
+// SetPublishQueue sets the queue group the event is delivered to.
+func SetPublishQueue(pub *cellaserv.Publish, name string) {
+	setExtensionBytes(pub, publishQueueField, []byte(name))
+}
+
+// PublishQueue returns the queue group the event is delivered to, if any.
+func PublishQueue(pub *cellaserv.Publish) (string, bool) {
+	name, ok := getExtensionBytes(pub, publishQueueField)
+	return string(name), ok
+}
+
+// SetSubscribeFilter sets the filter expression of the subscription: only
+// the events whose payload matches the filter are sent. In an unsubscribe
+// message, an empty filter designates the subscription without a filter.
+func SetSubscribeFilter(sub *cellaserv.Subscribe, filter string) {
+	setExtensionBytes(sub, subscribeFilterField, []byte(filter))
+}
+
+// SubscribeFilter returns the filter expression of the subscription, if set.
+func SubscribeFilter(sub *cellaserv.Subscribe) (string, bool) {
+	filter, ok := getExtensionBytes(sub, subscribeFilterField)
+	return string(filter), ok
+}
+
+// SetPublishSubscribeError turns the publish into the report of a failed
+// subscribe, sent to the subscriber.
+func SetPublishSubscribeError(pub *cellaserv.Publish) {
+	setExtensionVarint(pub, publishSubscribeErrorField, 1)
+}
+
+// PublishSubscribeError returns whether the publish reports a failed
+// subscribe.
+func PublishSubscribeError(pub *cellaserv.Publish) bool {
+	failed, ok := getExtensionVarint(pub, publishSubscribeErrorField)
+	return ok && failed != 0
+}
+
+// SetSubscribeRate limits the rate of the events sent to the subscriber: at
+// most one event of each name per interval. The mode tells how the other
+// events are handled, see the api.RateLimit* constants.
+func SetSubscribeRate(sub *cellaserv.Subscribe, interval time.Duration, mode string) {
+	setExtensionVarint(sub, subscribeIntervalField, uint64(interval/time.Microsecond))
+	if mode == "" {
+		clearExtension(sub, subscribeRateModeField)
+	} else {
+		setExtensionBytes(sub, subscribeRateModeField, []byte(mode))
+	}
+}
+
+// SubscribeRate returns the minimum interval between two events of the same
+// name sent to the subscriber, and the rate limiting mode, if set.
+func SubscribeRate(sub *cellaserv.Subscribe) (time.Duration, string, bool) {
+	us, ok := getExtensionVarint(sub, subscribeIntervalField)
+	if !ok || us == 0 {
+		return 0, "", false
+	}
+	mode, _ := getExtensionBytes(sub, subscribeRateModeField)
+	return time.Duration(us) * time.Microsecond, string(mode), true
+}
+
+// Reply error types that are not part of the cellaserv3-protobuf definitions.
+// Peers that do not know about them see them as unknown errors.
+const (
+	// The client sent a request with the id of one of its requests that
+	// is still waiting for a reply
+	ReplyErrorDuplicateRequestId cellaserv.Reply_Error_Type = 6
+	// The service disconnected before replying to the request
+	ReplyErrorServiceLost cellaserv.Reply_Error_Type = 7
+	// cellaserv is shutting down and does not accept new requests, or the
+	// request did not complete before the end of the grace period
+	ReplyErrorShuttingDown cellaserv.Reply_Error_Type = 8
+	// The outbound queue of the service is full of requests and replies,
+	// the request could not be sent to it
+	ReplyErrorServiceOverloaded cellaserv.Reply_Error_Type = 9
+)
+
+var replyErrorTypeNames = map[cellaserv.Reply_Error_Type]string{
+	ReplyErrorDuplicateRequestId: "DuplicateRequestId",
+	ReplyErrorServiceLost:        "ServiceLost",
+	ReplyErrorShuttingDown:       "ShuttingDown",
+	ReplyErrorServiceOverloaded:  "ServiceOverloaded",
+}
+
+// ReplyErrorTypeName returns the name of the reply error type, including the
+// types that are not part of the cellaserv3-protobuf definitions.
+func ReplyErrorTypeName(errType cellaserv.Reply_Error_Type) string {
+	if name, ok := replyErrorTypeNames[errType]; ok {
+		return name
+	}
+	return errType.String()
+}
+
+// ParseReplyErrorType returns the reply error type with this name.
+func ParseReplyErrorType(name string) (cellaserv.Reply_Error_Type, bool) {
+	if value, ok := cellaserv.Reply_Error_Type_value[name]; ok {
+		return cellaserv.Reply_Error_Type(value), true
+	}
+	for errType, typeName := range replyErrorTypeNames {
+		if typeName == name {
+			return errType, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,436 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Topic patterns match dot-separated event names. The syntax is:
+//
+//	*        as a whole segment, matches exactly one segment
+//	**       as a whole segment, matches zero or more segments
+//	*        inside a segment, matches any sequence of characters of the segment
+//	?        matches any single character, except '.'
+//	[abc]    matches a character of the class, ranges such as [a-z] and
+//	         negated classes such as [^a-z] are supported
+//	\c       matches the character c, for example \* or \[
+//	p!e1!e2  matches the events matching p, except the ones matching the
+//	         exclusion patterns e1 and e2
+//
+// For example, "log.**!log.cellaserv.**" matches all logs but the ones of
+// cellaserv, and "robot.*.position" matches "robot.pal.position" but not
+// "robot.pal.arm.position".
+
+// ErrBadTopicPattern is returned when a topic pattern is malformed.
+var ErrBadTopicPattern = errors.New("Syntax error in topic pattern")
+
+// topicPatternChars are the characters that make an event name a pattern.
+const topicPatternChars = `*?[\!`
+
+type topicTokenKind int
+
+const (
+	tokenLiteral topicTokenKind = iota
+	tokenAnyChar
+	tokenStar
+	tokenClass
+)
+
+type runeRange struct {
+	lo, hi rune
+}
+
+type topicToken struct {
+	kind    topicTokenKind
+	literal rune
+	negated bool
+	ranges  []runeRange
+}
+
+// matches returns whether the single character token matches r.
+func (t *topicToken) matches(r rune) bool {
+	switch t.kind {
+	case tokenLiteral:
+		return r == t.literal
+	case tokenAnyChar:
+		return true
+	case tokenClass:
+		in := false
+		for _, rr := range t.ranges {
+			if rr.lo <= r && r <= rr.hi {
+				in = true
+				break
+			}
+		}
+		return in != t.negated
+	}
+	return false
+}
+
+type topicSegmentKind int
+
+const (
+	// The segment is a plain string
+	segmentLiteral topicSegmentKind = iota
+	// The segment is "*"
+	segmentAny
+	// The segment is "**"
+	segmentAnyMany
+	// The segment contains wildcards or character classes
+	segmentGlob
+)
+
+type topicSegment struct {
+	kind    topicSegmentKind
+	raw     string
+	literal string
+	tokens  []topicToken
+}
+
+// match returns whether the segment matches the segment of an event name.
+func (s *topicSegment) match(name string) bool {
+	switch s.kind {
+	case segmentLiteral:
+		return s.literal == name
+	case segmentAny:
+		return true
+	case segmentGlob:
+		return matchTokens(s.tokens, name)
+	}
+	return false
+}
+
+// matchTokens matches a segment glob. Only the last star is backtracked,
+// which is enough since a star matches any sequence.
+func matchTokens(tokens []topicToken, name string) bool {
+	ti, ni := 0, 0
+	starTi, starNi := -1, 0
+	for ni < len(name) || ti < len(tokens) {
+		if ti < len(tokens) {
+			t := &tokens[ti]
+			if t.kind == tokenStar {
+				starTi, starNi = ti, ni
+				ti++
+				continue
+			}
+			if ni < len(name) {
+				r, size := utf8.DecodeRuneInString(name[ni:])
+				if t.matches(r) {
+					ti++
+					ni += size
+					continue
+				}
+			}
+		}
+		// Mismatch, let the last star match one more character
+		if starTi < 0 || starNi >= len(name) {
+			return false
+		}
+		_, size := utf8.DecodeRuneInString(name[starNi:])
+		starNi += size
+		ti, ni = starTi+1, starNi
+	}
+	return true
+}
+
+// matchSegments matches the segments of a pattern against the segments of an
+// event name.
+func matchSegments(segments []topicSegment, names []string) bool {
+	for i := range segments {
+		if segments[i].kind == segmentAnyMany {
+			rest := segments[i+1:]
+			if len(rest) == 0 {
+				return true
+			}
+			for j := i; j <= len(names); j++ {
+				if matchSegments(rest, names[j:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if i >= len(names) || !segments[i].match(names[i]) {
+			return false
+		}
+	}
+	return len(segments) == len(names)
+}
+
+// A TopicPattern is a parsed topic pattern.
+type TopicPattern struct {
+	pattern  string
+	include  []topicSegment
+	excludes [][]topicSegment
+}
+
+// String returns the pattern as written.
+func (p *TopicPattern) String() string {
+	return p.pattern
+}
+
+// Match returns whether the event name matches the pattern.
+func (p *TopicPattern) Match(event string) bool {
+	names := strings.Split(event, ".")
+	return matchSegments(p.include, names) && !p.excluded(names)
+}
+
+func (p *TopicPattern) excluded(names []string) bool {
+	for _, exclude := range p.excludes {
+		if matchSegments(exclude, names) {
+			return true
+		}
+	}
+	return false
+}
+
+// Excluded returns whether the event name matches an exclusion pattern.
+func (p *TopicPattern) Excluded(event string) bool {
+	if len(p.excludes) == 0 {
+		return false
+	}
+	return p.excluded(strings.Split(event, "."))
+}
+
+// Segments returns the segments of the pattern, without the exclusion
+// patterns. Consecutive "**" are returned as a single segment.
+func (p *TopicPattern) Segments() []TopicSegment {
+	segments := make([]TopicSegment, len(p.include))
+	for i := range p.include {
+		segments[i] = TopicSegment{&p.include[i]}
+	}
+	return segments
+}
+
+// A TopicSegment is a segment of a topic pattern, used to index patterns.
+type TopicSegment struct {
+	s *topicSegment
+}
+
+// String returns the segment as written in the pattern.
+func (s TopicSegment) String() string {
+	return s.s.raw
+}
+
+// Literal returns the event name segment matched by the segment, if it
+// matches a single one.
+func (s TopicSegment) Literal() (string, bool) {
+	return s.s.literal, s.s.kind == segmentLiteral
+}
+
+// IsAny returns whether the segment is "*", matching exactly one segment.
+func (s TopicSegment) IsAny() bool {
+	return s.s.kind == segmentAny
+}
+
+// IsAnyMany returns whether the segment is "**", matching zero or more
+// segments.
+func (s TopicSegment) IsAnyMany() bool {
+	return s.s.kind == segmentAnyMany
+}
+
+// Match returns whether the segment matches a segment of an event name.
+func (s TopicSegment) Match(name string) bool {
+	return s.s.match(name)
+}
+
+// IsTopicPattern returns whether the string contains pattern syntax, i.e. it
+// is not a plain event name.
+func IsTopicPattern(pattern string) bool {
+	return strings.ContainsAny(pattern, topicPatternChars)
+}
+
+// QuoteTopic escapes the pattern syntax of the event name, so that the
+// returned pattern only matches the event name.
+func QuoteTopic(event string) string {
+	var b strings.Builder
+	for _, r := range event {
+		if strings.ContainsRune(topicPatternChars, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// topicParser parses a pattern rune by rune.
+type topicParser struct {
+	pattern string
+	pos     int
+}
+
+func (p *topicParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w %q: %s", ErrBadTopicPattern, p.pattern, fmt.Sprintf(format, args...))
+}
+
+func (p *topicParser) next() (rune, bool) {
+	if p.pos >= len(p.pattern) {
+		return 0, false
+	}
+	r, size := utf8.DecodeRuneInString(p.pattern[p.pos:])
+	p.pos += size
+	return r, true
+}
+
+// parseEscaped returns the character following a backslash.
+func (p *topicParser) parseEscaped() (rune, error) {
+	r, ok := p.next()
+	if !ok {
+		return 0, p.errorf("trailing backslash")
+	}
+	return r, nil
+}
+
+// parseClassChar returns a character of a character class.
+func (p *topicParser) parseClassChar() (rune, error) {
+	r, ok := p.next()
+	if !ok {
+		return 0, p.errorf("unterminated character class")
+	}
+	if r == '\\' {
+		return p.parseEscaped()
+	}
+	return r, nil
+}
+
+// parseClass parses a character class, after its opening bracket.
+func (p *topicParser) parseClass() (topicToken, error) {
+	t := topicToken{kind: tokenClass}
+	if strings.HasPrefix(p.pattern[p.pos:], "^") {
+		t.negated = true
+		p.pos++
+	}
+	for {
+		if strings.HasPrefix(p.pattern[p.pos:], "]") && len(t.ranges) > 0 {
+			p.pos++
+			return t, nil
+		}
+		lo, err := p.parseClassChar()
+		if err != nil {
+			return t, err
+		}
+		hi := lo
+		if strings.HasPrefix(p.pattern[p.pos:], "-") && !strings.HasPrefix(p.pattern[p.pos:], "-]") {
+			p.pos++
+			hi, err = p.parseClassChar()
+			if err != nil {
+				return t, err
+			}
+			if hi < lo {
+				return t, p.errorf("invalid range %c-%c", lo, hi)
+			}
+		}
+		t.ranges = append(t.ranges, runeRange{lo, hi})
+	}
+}
+
+// parseSegment parses a segment, up to the next '.', '!' or the end of the
+// pattern.
+func (p *topicParser) parseSegment() (topicSegment, error) {
+	start := p.pos
+	var tokens []topicToken
+	var literal strings.Builder
+	isLiteral := true
+	doubleStar := false
+	for p.pos < len(p.pattern) {
+		c := p.pattern[p.pos]
+		if c == '.' || c == '!' {
+			break
+		}
+		r, _ := p.next()
+		var t topicToken
+		switch r {
+		case '\\':
+			escaped, err := p.parseEscaped()
+			if err != nil {
+				return topicSegment{}, err
+			}
+			t = topicToken{kind: tokenLiteral, literal: escaped}
+		case '*':
+			t = topicToken{kind: tokenStar}
+		case '?':
+			t = topicToken{kind: tokenAnyChar}
+		case '[':
+			var err error
+			t, err = p.parseClass()
+			if err != nil {
+				return topicSegment{}, err
+			}
+		default:
+			t = topicToken{kind: tokenLiteral, literal: r}
+		}
+		if t.kind == tokenStar && len(tokens) > 0 && tokens[len(tokens)-1].kind == tokenStar {
+			doubleStar = true
+		}
+		if t.kind == tokenLiteral {
+			literal.WriteRune(t.literal)
+		} else {
+			isLiteral = false
+		}
+		tokens = append(tokens, t)
+	}
+
+	switch raw := p.pattern[start:p.pos]; {
+	case raw == "*":
+		return topicSegment{kind: segmentAny, raw: raw}, nil
+	case raw == "**":
+		return topicSegment{kind: segmentAnyMany, raw: raw}, nil
+	case doubleStar:
+		return topicSegment{}, p.errorf("** must be a whole segment")
+	case isLiteral:
+		return topicSegment{kind: segmentLiteral, raw: raw, literal: literal.String()}, nil
+	default:
+		return topicSegment{kind: segmentGlob, raw: raw, tokens: tokens}, nil
+	}
+}
+
+// parseSegments parses a list of dot-separated segments, up to the next '!'
+// or the end of the pattern.
+func (p *topicParser) parseSegments() ([]topicSegment, error) {
+	var segments []topicSegment
+	for {
+		s, err := p.parseSegment()
+		if err != nil {
+			return nil, err
+		}
+		// Consecutive "**" are the same as a single one
+		if s.kind != segmentAnyMany || len(segments) == 0 || segments[len(segments)-1].kind != segmentAnyMany {
+			segments = append(segments, s)
+		}
+		if p.pos >= len(p.pattern) || p.pattern[p.pos] == '!' {
+			return segments, nil
+		}
+		p.pos++ // Skip '.'
+	}
+}
+
+// ParseTopicPattern parses a topic pattern, so that it can be matched against
+// many event names.
+func ParseTopicPattern(pattern string) (*TopicPattern, error) {
+	p := &topicParser{pattern: pattern}
+	include, err := p.parseSegments()
+	if err != nil {
+		return nil, err
+	}
+	tp := &TopicPattern{pattern: pattern, include: include}
+	for p.pos < len(p.pattern) {
+		p.pos++ // Skip '!'
+		exclude, err := p.parseSegments()
+		if err != nil {
+			return nil, err
+		}
+		tp.excludes = append(tp.excludes, exclude)
+	}
+	return tp, nil
+}
+
+// MatchTopic returns whether the event name matches the topic pattern. The
+// only possible error is ErrBadTopicPattern.
+func MatchTopic(pattern, event string) (bool, error) {
+	p, err := ParseTopicPattern(pattern)
+	if err != nil {
+		return false, err
+	}
+	return p.Match(event), nil
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		event   string
+		match   bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "foo.bar", false},
+		{"*", "foo", true},
+		{"*", "foo.bar", false},
+		{"log.*", "log.foo", true},
+		{"log.*", "log.foo.bar", false},
+		{"log.*", "log", false},
+		{"log.**", "log", true},
+		{"log.**", "log.foo.bar", true},
+		{"log.**", "logs.foo", false},
+		{"**.position", "robot.pal.position", true},
+		{"**.position", "position", true},
+		{"robot.*.position", "robot.pal.position", true},
+		{"robot.*.position", "robot.pal.arm.position", false},
+		{"a.**.b.**.c", "a.x.b.y.z.c", true},
+		{"a.**.b.**.c", "a.x.y.c", false},
+		{"test*", "test", true},
+		{"test*", "testfoo", true},
+		{"test*", "test.foo", false},
+		{"*-status", "motor-status", true},
+		{"a*b*c", "axxbyybc", true},
+		{"a*b*c", "axxbyyb", false},
+		{"ro?ot", "robot", true},
+		{"ro?ot", "ro.ot", false},
+		{"motor[0-9]", "motor3", true},
+		{"motor[0-9]", "motorx", false},
+		{"motor[^0-9]", "motorx", true},
+		{"motor[^0-9]", "motor3", false},
+		{"[ab-]", "-", true},
+		{`date\[foo\].killall`, "date[foo].killall", true},
+		{`date\[foo\].killall`, "datef.killall", false},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{"log.**!log.cellaserv.**", "log.robot", true},
+		{"log.**!log.cellaserv.**", "log.cellaserv.new-client", false},
+		{"**!*.debug!*.trace", "motor.info", true},
+		{"**!*.debug!*.trace", "motor.trace", false},
+		{"é*", "été", true},
+	}
+	for _, test := range tests {
+		match, err := MatchTopic(test.pattern, test.event)
+		if err != nil {
+			t.Errorf("MatchTopic(%q, %q): %s", test.pattern, test.event, err)
+			continue
+		}
+		if match != test.match {
+			t.Errorf("MatchTopic(%q, %q) = %t, expected %t", test.pattern, test.event, match, test.match)
+		}
+	}
+}
+
+func TestParseTopicPatternErrors(t *testing.T) {
+	for _, pattern := range []string{
+		`foo\`,
+		"foo[ab",
+		"foo[z-a]",
+		"a**",
+		"log.**b",
+		"log.*!foo[",
+	} {
+		if _, err := ParseTopicPattern(pattern); !errors.Is(err, ErrBadTopicPattern) {
+			t.Errorf("ParseTopicPattern(%q): expected syntax error, got: %v", pattern, err)
+		}
+	}
+	if _, err := ParseTopicPattern(`a\*\*`); err != nil {
+		t.Errorf("Escaped stars should be valid: %s", err)
+	}
+}
+
+func TestIsTopicPattern(t *testing.T) {
+	for pattern, expected := range map[string]bool{
+		"log.cellaserv.new-client": false,
+		"log.*":                    true,
+		"motor?":                   true,
+		"motor[12]":                true,
+		"log!log.debug":            true,
+		`date\[foo\]`:              true,
+	} {
+		if IsTopicPattern(pattern) != expected {
+			t.Errorf("IsTopicPattern(%q) != %t", pattern, expected)
+		}
+	}
+}
+
+func TestQuoteTopic(t *testing.T) {
+	for _, event := range []string{"date.killall", "date[foo].killall", `a*b?c\\d!e`} {
+		pattern := QuoteTopic(event)
+		if matched, err := MatchTopic(pattern, event); err != nil || !matched {
+			t.Errorf("QuoteTopic(%q) = %q does not match the event: %v", event, pattern, err)
+		}
+	}
+	if matched, _ := MatchTopic(QuoteTopic("date[foo].killall"), "datef.killall"); matched {
+		t.Errorf("Quoted pattern matches another event")
+	}
+}
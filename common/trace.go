@@ -0,0 +1,87 @@
+package common
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// TraceId identifies a trace: the spans of a request and of the requests sent
+// while handling it.
+type TraceId [16]byte
+
+// SpanId identifies a span of a trace.
+type SpanId [8]byte
+
+// TraceContext is the trace context propagated with the requests.
+type TraceContext struct {
+	TraceId TraceId
+	// Span of the caller, parent of the spans of the request
+	SpanId SpanId
+}
+
+// Source of the trace and span ids
+var (
+	idRandMtx sync.Mutex
+	idRand    = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func randomId(id []byte) {
+	idRandMtx.Lock()
+	idRand.Read(id)
+	idRandMtx.Unlock()
+}
+
+// NewTraceId returns a random trace id.
+func NewTraceId() TraceId {
+	var id TraceId
+	for !id.IsValid() {
+		randomId(id[:])
+	}
+	return id
+}
+
+// NewSpanId returns a random span id.
+func NewSpanId() SpanId {
+	var id SpanId
+	for !id.IsValid() {
+		randomId(id[:])
+	}
+	return id
+}
+
+// IsValid returns whether the id is not zero.
+func (id TraceId) IsValid() bool {
+	return id != TraceId{}
+}
+
+// String returns the id in lowercase hexadecimal, as in the W3C trace context.
+func (id TraceId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid returns whether the id is not zero.
+func (id SpanId) IsValid() bool {
+	return id != SpanId{}
+}
+
+// String returns the id in lowercase hexadecimal, or "" if the id is zero.
+func (id SpanId) String() string {
+	if !id.IsValid() {
+		return ""
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// ParseTraceId parses a trace id in hexadecimal.
+func ParseTraceId(s string) (TraceId, error) {
+	var id TraceId
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(id) {
+		return id, fmt.Errorf("Invalid trace id: %q", s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
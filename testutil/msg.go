@@ -5,8 +5,10 @@ import (
 	"encoding/binary"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	cellaserv "github.com/evolutek/cellaserv3-protobuf"
+	"github.com/evolutek/cellaserv3/common"
 	"github.com/golang/protobuf/proto"
 )
 
@@ -47,18 +49,98 @@ func MakeMessageRegister(t *testing.T, serviceName string, serviceIdent string)
 	return makeMessage(t, msgType, msgContent)
 }
 
+func MakeMessageRegisterLoadBalanced(t *testing.T, serviceName string, serviceIdent string, policy string) []byte {
+	msgType := cellaserv.Message_Register
+	msgContent := &cellaserv.Register{
+		Name:           serviceName,
+		Identification: serviceIdent,
+	}
+	common.SetRegisterLoadBalancing(msgContent, policy)
+	return makeMessage(t, msgType, msgContent)
+}
+
 func MakeMessagePublish(t *testing.T, topic string) []byte {
 	msgType := cellaserv.Message_Publish
 	msgContent := &cellaserv.Publish{Event: topic}
 	return makeMessage(t, msgType, msgContent)
 }
 
+func MakeMessagePublishData(t *testing.T, topic string, payload []byte) []byte {
+	msgType := cellaserv.Message_Publish
+	msgContent := &cellaserv.Publish{Event: topic, Data: payload}
+	return makeMessage(t, msgType, msgContent)
+}
+
+func MakeMessagePublishRetained(t *testing.T, topic string, payload []byte) []byte {
+	msgType := cellaserv.Message_Publish
+	msgContent := &cellaserv.Publish{Event: topic, Data: payload}
+	common.SetPublishRetain(msgContent, true)
+	return makeMessage(t, msgType, msgContent)
+}
+
 func MakeMessageSubscribe(t *testing.T, topic string) []byte {
 	msgType := cellaserv.Message_Subscribe
 	msgContent := &cellaserv.Subscribe{Event: topic}
 	return makeMessage(t, msgType, msgContent)
 }
 
+func MakeMessageSubscribeFilter(t *testing.T, topic string, filter string) []byte {
+	msgType := cellaserv.Message_Subscribe
+	msgContent := &cellaserv.Subscribe{Event: topic}
+	common.SetSubscribeFilter(msgContent, filter)
+	return makeMessage(t, msgType, msgContent)
+}
+
+func MakeMessageSubscribeRate(t *testing.T, topic string, interval time.Duration, mode string) []byte {
+	msgType := cellaserv.Message_Subscribe
+	msgContent := &cellaserv.Subscribe{Event: topic}
+	common.SetSubscribeRate(msgContent, interval, mode)
+	return makeMessage(t, msgType, msgContent)
+}
+
+func MakeMessageUnsubscribe(t *testing.T, topic string) []byte {
+	msgType := cellaserv.Message_Subscribe
+	msgContent := &cellaserv.Subscribe{Event: topic}
+	common.SetSubscribeUnsubscribe(msgContent)
+	return makeMessage(t, msgType, msgContent)
+}
+
+func MakeMessageSubscribeFromSequence(t *testing.T, topic string, seq uint64) []byte {
+	msgType := cellaserv.Message_Subscribe
+	msgContent := &cellaserv.Subscribe{Event: topic}
+	common.SetSubscribeFromSequence(msgContent, seq)
+	return makeMessage(t, msgType, msgContent)
+}
+
+func MakeMessageSubscribeDurable(t *testing.T, name string, topic string) []byte {
+	msgType := cellaserv.Message_Subscribe
+	msgContent := &cellaserv.Subscribe{Event: topic}
+	common.SetSubscribeDurable(msgContent, name)
+	return makeMessage(t, msgType, msgContent)
+}
+
+func MakeMessageSubscribeQueue(t *testing.T, group string, policy string, topic string) []byte {
+	msgType := cellaserv.Message_Subscribe
+	msgContent := &cellaserv.Subscribe{Event: topic}
+	common.SetSubscribeQueue(msgContent, group, policy)
+	return makeMessage(t, msgType, msgContent)
+}
+
+func MakeMessageUnsubscribeQueue(t *testing.T, group string, topic string) []byte {
+	msgType := cellaserv.Message_Subscribe
+	msgContent := &cellaserv.Subscribe{Event: topic}
+	common.SetSubscribeQueue(msgContent, group, "")
+	common.SetSubscribeUnsubscribe(msgContent)
+	return makeMessage(t, msgType, msgContent)
+}
+
+func MakeMessageAck(t *testing.T, name string, topic string, deliveryId uint64) []byte {
+	msgType := cellaserv.Message_Subscribe
+	msgContent := &cellaserv.Subscribe{Event: topic}
+	common.SetSubscribeAck(msgContent, name, deliveryId)
+	return makeMessage(t, msgType, msgContent)
+}
+
 func MakeMessageRequest(t *testing.T, service string, ident string, method string, payload []byte) []byte {
 	msgType := cellaserv.Message_Request
 	msgId := atomic.AddUint64(&NextMessageRequestId, 1)
@@ -72,6 +154,46 @@ func MakeMessageRequest(t *testing.T, service string, ident string, method strin
 	return makeMessage(t, msgType, msgContent)
 }
 
+func MakeMessageRequestWithTimeout(t *testing.T, service string, ident string, method string, payload []byte, timeout time.Duration) []byte {
+	msgType := cellaserv.Message_Request
+	msgId := atomic.AddUint64(&NextMessageRequestId, 1)
+	msgContent := &cellaserv.Request{
+		ServiceIdentification: ident,
+		ServiceName:           service,
+		Method:                method,
+		Data:                  payload,
+		Id:                    msgId,
+	}
+	common.SetRequestTimeout(msgContent, timeout)
+	return makeMessage(t, msgType, msgContent)
+}
+
+func MakeMessageRequestWithTrace(t *testing.T, service string, ident string, method string, payload []byte, trace common.TraceContext) []byte {
+	msgType := cellaserv.Message_Request
+	msgId := atomic.AddUint64(&NextMessageRequestId, 1)
+	msgContent := &cellaserv.Request{
+		ServiceIdentification: ident,
+		ServiceName:           service,
+		Method:                method,
+		Data:                  payload,
+		Id:                    msgId,
+	}
+	common.SetRequestTrace(msgContent, trace)
+	return makeMessage(t, msgType, msgContent)
+}
+
+func MakeMessageRequestWithId(t *testing.T, service string, ident string, method string, id uint64, payload []byte) []byte {
+	msgType := cellaserv.Message_Request
+	msgContent := &cellaserv.Request{
+		ServiceIdentification: ident,
+		ServiceName:           service,
+		Method:                method,
+		Data:                  payload,
+		Id:                    id,
+	}
+	return makeMessage(t, msgType, msgContent)
+}
+
 func MakeMessageReply(t *testing.T, msgId uint64, payload []byte) []byte {
 	msgType := cellaserv.Message_Reply
 	msgContent := &cellaserv.Reply{